@@ -1,17 +1,43 @@
+# Embeds texts for Sveta (see embed4all/embedder.go).
+# Protocol: one JSON object per line in both directions.
+#   request:  {"id": 1, "texts": ["hello", "world"]}
+#   response: {"id": 1, "embeddings": [[0.1, ...], [0.2, ...]]} or {"id": 1, "error": "..."}
+# Anything the libraries print is redirected to stderr, so it can't break the protocol.
 from gpt4all import GPT4All, Embed4All
+import json
 import sys
+import traceback
+
+protocol_output = sys.stdout
+sys.stdout = sys.stderr
 
 embedder = Embed4All()
 
-while True:
+
+def embed_batch(texts):
+    try:
+        embeddings = embedder.embed(texts)  # newer versions of gpt4all support batches natively
+        if len(embeddings) == len(texts) and all(isinstance(embedding, list) for embedding in embeddings):
+            return embeddings
+    except TypeError:
+        pass
+    return [embedder.embed(text) for text in texts]
+
+
+def respond(response):
+    protocol_output.write(json.dumps(response) + "\n")
+    protocol_output.flush()
+
+
+for line in sys.stdin:
+    line = line.strip()
+    if not line:
+        continue
+    request_id = None
     try:
-        query = input()
-        if query:
-            embedding = embedder.embed(query)
-            print("<begin>")
-            for value in embedding:
-                print(str(value), end="")
-                print(" ", end="")
-            print("<end>", end="")
+        request = json.loads(line)
+        request_id = request["id"]
+        respond({"id": request_id, "embeddings": embed_batch(request["texts"])})
     except Exception as e:
-        print(e)
\ No newline at end of file
+        traceback.print_exc()  # captured by the supervisor
+        respond({"id": request_id, "error": str(e)})
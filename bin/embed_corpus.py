@@ -1,20 +1,33 @@
 from gpt4all import GPT4All, Embed4All
 from text_chunker import TextChunker
 
+BATCH_SIZE = 64
+
 embedder = Embed4All(verbose=False)
 chunker = TextChunker(maxlen=500)
 
+
+def embed_batch(texts):
+    try:
+        embeddings = embedder.embed(texts)  # newer versions of gpt4all support batches natively
+        if len(embeddings) == len(texts) and all(isinstance(embedding, list) for embedding in embeddings):
+            return embeddings
+    except TypeError:
+        pass
+    return [embedder.embed(text) for text in texts]
+
+
 output_file = open("chunks.bin", "w")
 
 with open("corpus.txt") as file:
     allText = file.read()
     allText = allText.replace("\n", " ")
-    for line in chunker.chunk(allText):
-        if line == "":
-            continue
-        output_file.write(line + "\n")
-        embedding = embedder.embed(line)
-        for value in embedding:
-            output_file.write(str(value))
-            output_file.write(" ")
-        output_file.write("\n")
\ No newline at end of file
+    chunks = [chunk for chunk in chunker.chunk(allText) if chunk != ""]
+    for batch_start in range(0, len(chunks), BATCH_SIZE):
+        batch = chunks[batch_start:batch_start + BATCH_SIZE]
+        for line, embedding in zip(batch, embed_batch(batch)):
+            output_file.write(line + "\n")
+            for value in embedding:
+                output_file.write(str(value))
+                output_file.write(" ")
+            output_file.write("\n")
@@ -24,15 +24,11 @@ func mainImpl() error {
 	}
 	userName := config.GetStringOrDefault("userName", "John")
 	roomName := config.GetStringOrDefault("roomName", "JohnRoom")
-	sveta, stoppable := api.NewAPI(config)
-	defer stoppable.Stop()
-	agentDescription := config.GetString(api.ConfigKeyAgentDescription)
-	if agentDescription != "" {
-		err := sveta.ChangeAgentDescription(agentDescription)
-		if err != nil {
-			return err
-		}
+	sveta, stoppable, err := api.NewAPI(config)
+	if err != nil {
+		return err
 	}
+	defer stoppable.Stop()
 	var shouldStop bool
 	rl, err := readline.New("> ")
 	if err != nil {
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/api"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/documents"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/filesystem"
+)
+
+const embeddingBatchSize = 32
+
+// Adds documents (plain text, Markdown and HTML) to the knowledge base, which the AI recalls relevant excerpts from
+// (see the "knowledge" capability). Directories are scanned recursively. A document which was already ingested is
+// replaced, so simply run it again after the document changes.
+// Usage:
+//
+//	ingest docs/ notes.md     ingests the given files and directories
+//	ingest -list              lists the ingested documents
+//	ingest -remove notes.md   removes a document from the knowledge base
+//
+// Don't run it while the bot is running.
+func main() {
+	err := mainImpl()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func mainImpl() error {
+	configPath := flag.String("config", "config.yaml", "path to the config")
+	list := flag.Bool("list", false, "list the ingested documents")
+	remove := flag.String("remove", "", "remove the given document from the knowledge base")
+	flag.Parse()
+	config, err := common.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	knowledgeRepository, err := filesystem.NewKnowledgeRepository(config)
+	if err != nil {
+		return err
+	}
+	if *list {
+		sources, err := knowledgeRepository.ListSources()
+		if err != nil {
+			return err
+		}
+		for _, source := range sources {
+			fmt.Println(source)
+		}
+		return nil
+	}
+	documentsDirPath := config.GetStringOrDefault("knowledgeDocumentsDirPath", "")
+	if *remove != "" {
+		source, err := getSource(*remove, documentsDirPath)
+		if err != nil {
+			return err
+		}
+		return knowledgeRepository.RemoveBySource(source)
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		return nil
+	}
+	paths, err := findDocuments(flag.Args())
+	if err != nil {
+		return err
+	}
+	logger := common.NewFileLogger(config.GetStringOrDefault(api.ConfigKeyLogPath, "sveta.log"))
+	embedder, err := api.NewEmbedder(config, logger)
+	if err != nil {
+		return err
+	}
+	chunker := documents.NewChunker(
+		config.GetIntOrDefault("knowledgeChunkSize", 1000),
+		config.GetIntOrDefault("knowledgeChunkOverlap", 150),
+	)
+	for _, path := range paths {
+		source, err := getSource(path, documentsDirPath)
+		if err != nil {
+			return err
+		}
+		chunkCount, err := ingest(path, source, knowledgeRepository, embedder, chunker)
+		if err != nil {
+			return fmt.Errorf("failed to ingest %s: %w", path, err)
+		}
+		fmt.Printf("%s: %d chunks\n", path, chunkCount)
+	}
+	return nil
+}
+
+func ingest(
+	path string,
+	source string,
+	knowledgeRepository domain.KnowledgeRepository,
+	embedder domain.Embedder,
+	chunker *documents.Chunker,
+) (int, error) {
+	paragraphs, err := documents.Load(path)
+	if err != nil {
+		return 0, err
+	}
+	texts := chunker.Chunk(paragraphs)
+	if len(texts) == 0 {
+		return 0, knowledgeRepository.RemoveBySource(source)
+	}
+	chunks := make([]*domain.KnowledgeChunk, 0, len(texts))
+	for batchStart := 0; batchStart < len(texts); batchStart += embeddingBatchSize {
+		batch := texts[batchStart:min(batchStart+embeddingBatchSize, len(texts))]
+		embeddings, err := embedder.EmbedBatch(batch)
+		if err != nil {
+			return 0, err
+		}
+		for index, text := range batch {
+			if embeddings[index].DimensionCount() == 0 {
+				return 0, fmt.Errorf("failed to embed chunk #%d", batchStart+index)
+			}
+			chunks = append(chunks, &domain.KnowledgeChunk{
+				ID:             knowledgeRepository.NextID(),
+				Source:         source,
+				Index:          batchStart + index,
+				Text:           text,
+				Embedding:      embeddings[index],
+				EmbeddingModel: embedder.ModelName(),
+			})
+		}
+	}
+	return len(chunks), knowledgeRepository.Store(chunks)
+}
+
+// findDocuments directories are scanned recursively; unsupported files in directories are skipped
+func findDocuments(paths []string) ([]string, error) {
+	var result []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			if !documents.IsSupported(path) {
+				return nil, fmt.Errorf("%s: %w", path, documents.ErrUnsupportedFormat)
+			}
+			result = append(result, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() && documents.IsSupported(filePath) {
+				result = append(result, filePath)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// getSource how the document is cited, and the key by which it's replaced when ingested again: the path relative to
+// `documentsDirPath` (see "knowledgeDocumentsDirPath" in the config) or, if it's not set, the absolute path, so that
+// the key doesn't depend on the current directory
+func getSource(path, documentsDirPath string) (string, error) {
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if documentsDirPath == "" {
+		return filepath.ToSlash(absolutePath), nil
+	}
+	absoluteDirPath, err := filepath.Abs(documentsDirPath)
+	if err != nil {
+		return "", err
+	}
+	relativePath, err := filepath.Rel(absoluteDirPath, absolutePath)
+	if err != nil {
+		return "", err
+	}
+	if relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of the documents directory %s", path, documentsDirPath)
+	}
+	return filepath.ToSlash(relativePath), nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/whyrusleeping/hellabot"
@@ -26,15 +27,11 @@ func mainImpl() error {
 	agentName := config.GetStringOrDefault(api.ConfigKeyAgentName, "Sveta")
 	roomName := config.GetStringOrDefault("roomName", "JohnRoom")
 	serverName := config.GetStringOrDefault("serverName", "irc.euirc.net:6667")
-	sveta, stoppable := api.NewAPI(config)
-	defer stoppable.Stop()
-	agentDescription := config.GetString(api.ConfigKeyAgentDescription)
-	if agentDescription != "" {
-		err := sveta.ChangeAgentDescription(agentDescription)
-		if err != nil {
-			return err
-		}
+	sveta, stoppable, err := api.NewAPI(config)
+	if err != nil {
+		return err
 	}
+	defer stoppable.Stop()
 	ircBot, err := hbot.NewBot(serverName, agentName)
 	if err != nil {
 		return err
@@ -68,33 +65,81 @@ func mainImpl() error {
 			if m.Command != "PRIVMSG" {
 				return true
 			}
-			if !strings.HasPrefix(strings.ToLower(m.Content), strings.ToLower(agentName)) {
-				return true
-			}
-			what := strings.TrimSpace(m.Content[len(agentName):])
-			if len(what) == 0 || what[0] == '@' || len(m.To) == 0 || m.To[0] != '#' {
-				return true
-			}
-			if what[0] == ',' {
-				what = what[1:]
+			// A private query is a separate room named after the user (see domain.IsDMRoom(..)), no need to address the bot by name there.
+			isPrivateQuery := m.To == agentName
+			where := roomName
+			var what string
+			if isPrivateQuery {
+				where = m.From
+				what = strings.TrimSpace(m.Content)
+				if len(what) == 0 {
+					return true
+				}
+			} else {
+				if !strings.HasPrefix(strings.ToLower(m.Content), strings.ToLower(agentName)) {
+					return true
+				}
+				what = strings.TrimSpace(m.Content[len(agentName):])
+				if len(what) == 0 || what[0] == '@' || len(m.To) == 0 || m.To[0] != '#' {
+					return true
+				}
+				if what[0] == ',' {
+					what = what[1:]
+				}
 			}
 			if what == "forget everything" {
 				_ = sveta.ClearAllMemory()
 				return true
 			}
 			if what == "summary" {
-				summary, err := sveta.GetSummary(roomName)
+				summary, err := sveta.GetSummary(where)
 				if err != nil || summary == "" {
 					summary = "no summary"
 				}
 				b.Reply(m, m.From+" SUMMARY: "+summary)
 				return true
 			}
+			if what == "create snapshot" {
+				name, err := sveta.CreateSnapshot()
+				if err == nil {
+					b.Reply(m, m.From+" SNAPSHOT: "+name)
+				} else {
+					b.Reply(m, m.From+" failed to create a snapshot")
+				}
+				return true
+			}
 			if what == "list capabilities" {
 				capabilities := strings.Join(sveta.ListCapabilities(), " ")
 				b.Reply(m, m.From+" CAPABILITIES: "+capabilities)
 				return true
 			}
+			if what == "my profile" {
+				entries, err := sveta.ListUserProfile(m.From, where)
+				if err != nil {
+					b.Reply(m, m.From+" failed to list the profile")
+					return true
+				}
+				if len(entries) == 0 {
+					b.Reply(m, m.From+" PROFILE: empty")
+					return true
+				}
+				for index, entry := range entries {
+					b.Reply(m, fmt.Sprintf("%s PROFILE %d: %s", m.From, index+1, entry))
+				}
+				return true
+			}
+			if strings.HasPrefix(what, "forget profile entry ") {
+				index, err := strconv.Atoi(strings.TrimSpace(what[len("forget profile entry "):]))
+				if err == nil {
+					err = sveta.RemoveUserProfileEntry(m.From, where, index-1)
+				}
+				if err == nil {
+					b.Reply(m, m.From+" profile entry removed")
+				} else {
+					b.Reply(m, m.From+" failed to remove the profile entry")
+				}
+				return true
+			}
 			if strings.HasPrefix(what, "context ") {
 				context := what[len("context "):]
 				_ = sveta.ChangeAgentDescription(context)
@@ -125,7 +170,7 @@ func mainImpl() error {
 				}
 				return true
 			}
-			response, err := sveta.Respond(strings.TrimSpace(m.From), what, roomName)
+			response, err := sveta.Respond(strings.TrimSpace(m.From), what, where)
 			if err != nil {
 				response = "I'm borked :("
 			}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/api"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/filesystem"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/inmemory"
+)
+
+// Re-embeds the memory store with the embedding model currently set in the config (see `embedder`), which is required
+// after the embedding model is changed: embeddings of different models can't be compared, so old memories can't be
+// recalled by similarity until they're migrated. Memories which were already embedded with the current model are
+// skipped, so if the migration is interrupted, simply run it again to continue.
+// Usage:
+//
+//	reembed -dry-run   only reports how many memories need to be re-embedded
+//	reembed            re-embeds them
+//
+// Don't run it while the bot is running. It's a good idea to create a snapshot first.
+func main() {
+	err := mainImpl()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func mainImpl() error {
+	configPath := flag.String("config", "config.yaml", "path to the config")
+	dryRun := flag.Bool("dry-run", false, "only report how many memories need to be re-embedded")
+	flag.Parse()
+	config, err := common.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	logger := common.NewFileLogger(config.GetStringOrDefault(api.ConfigKeyLogPath, "sveta.log"))
+	embedder, err := api.NewEmbedder(config, logger)
+	if err != nil {
+		return err
+	}
+	memoryRepository, err := filesystem.NewMemoryRepository(inmemory.NewMemoryRepository(), config, logger)
+	if err != nil {
+		return err
+	}
+	memoryReembedder := domain.NewMemoryReembedder(memoryRepository, embedder, config, logger)
+	outdatedMemories, err := memoryReembedder.FindOutdated()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d memories need to be re-embedded with %s\n", len(outdatedMemories), embedder.ModelName())
+	if *dryRun || len(outdatedMemories) == 0 {
+		return nil
+	}
+	err = memoryReembedder.ReembedOutdated(func(doneCount, totalCount int) {
+		fmt.Printf("\r%d/%d", doneCount, totalCount)
+	})
+	fmt.Println()
+	if err != nil {
+		return fmt.Errorf("interrupted (run again to continue): %w", err)
+	}
+	fmt.Println("Done")
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/filesystem"
+)
+
+// Re-encrypts the store (memories, summaries, user profiles, the knowledge base, the embedding cache and all the
+// snapshots) with a new key (key rotation). The current key is taken from the config as usual
+// (see `memoryEncryptionKeyEnvVar` and `memoryEncryptionKeyFilePath`), the new key is taken from SVETA_NEW_MEMORY_KEY
+// or from the file specified with -new-key-file. If the current key is empty, the plaintext store is encrypted; if
+// the new key is empty, the store is decrypted.
+// Don't run it while the bot is running.
+func main() {
+	err := mainImpl()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func mainImpl() error {
+	configPath := flag.String("config", "config.yaml", "path to the config")
+	newKeyFilePath := flag.String("new-key-file", "", "path to the file with the new key (base64-encoded); overrides SVETA_NEW_MEMORY_KEY")
+	flag.Parse()
+	config, err := common.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	oldKey, err := filesystem.LoadMemoryEncryptionKey(config)
+	if err != nil {
+		return err
+	}
+	encodedNewKey := os.Getenv("SVETA_NEW_MEMORY_KEY")
+	if *newKeyFilePath != "" {
+		data, err := os.ReadFile(*newKeyFilePath)
+		if err != nil {
+			return err
+		}
+		encodedNewKey = string(data)
+	}
+	newKey, err := filesystem.DecodeMemoryEncryptionKey(encodedNewKey)
+	if err != nil {
+		return err
+	}
+	if oldKey == nil && newKey == nil {
+		return fmt.Errorf("neither the current nor the new key is provided")
+	}
+	reencryptedPaths, err := filesystem.ReencryptStore(config, oldKey, newKey)
+	for _, path := range reencryptedPaths {
+		fmt.Println("Re-encrypted " + path)
+	}
+	return err
+}
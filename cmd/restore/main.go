@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/filesystem"
+)
+
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Restores the store (memories, summaries, user profiles, capabilities, the persona, the knowledge base and the embedding
+// cache) from a snapshot, see API.CreateSnapshot().
+// Usage:
+//
+//	restore -list                         lists the available snapshots
+//	restore -at "2024-05-03 18:00"        restores the latest snapshot created before the given time (local time)
+//	restore -snapshot snapshots/xyz.tar.gz restores the given snapshot
+//
+// Don't run it while the bot is running.
+func main() {
+	err := mainImpl()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func mainImpl() error {
+	configPath := flag.String("config", "config.yaml", "path to the config")
+	list := flag.Bool("list", false, "list the available snapshots")
+	at := flag.String("at", "", "restore the latest snapshot created before this time")
+	snapshotPath := flag.String("snapshot", "", "path to the snapshot to restore")
+	flag.Parse()
+	config, err := common.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if *list {
+		snapshots, err := filesystem.ListSnapshots(config)
+		if err != nil {
+			return err
+		}
+		for _, snapshot := range snapshots {
+			fmt.Println(snapshot)
+		}
+		return nil
+	}
+	if *snapshotPath == "" {
+		if *at == "" {
+			flag.Usage()
+			return nil
+		}
+		notNewerThan, err := parseTime(*at)
+		if err != nil {
+			return err
+		}
+		snapshot, err := filesystem.FindSnapshot(config, notNewerThan)
+		if err != nil {
+			return err
+		}
+		*snapshotPath = snapshot.Path
+	}
+	err = filesystem.RestoreSnapshot(config, *snapshotPath)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Restored " + *snapshotPath)
+	return nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown time format: %s", value)
+}
@@ -64,20 +64,31 @@ func (c *Config) GetIntOrDefault(key string, defaultValue int) int {
 	return intValue
 }
 
-// GetFloatOrDefault returns a float-typed parameter. If nothing is found, or if the value cannot be parsed as a float,
-// returns `defaultValue`.
+// GetFloatOrDefault returns a float-typed parameter (integers such as "0" are accepted, too). If nothing is found, or
+// if the value cannot be parsed as a float, returns `defaultValue`.
 func (c *Config) GetFloatOrDefault(key string, defaultValue float64) float64 {
 	value, ok := c.values[key]
 	if !ok {
 		return defaultValue
 	}
-	floatValue, ok := value.(float64)
+	floatValue, ok := toFloat(value)
 	if !ok {
 		return defaultValue
 	}
 	return floatValue
 }
 
+// toFloat YAML parses numbers without a fractional part (such as "0") as integers
+func toFloat(value any) (float64, bool) {
+	switch typedValue := value.(type) {
+	case float64:
+		return typedValue, true
+	case int:
+		return float64(typedValue), true
+	}
+	return 0.0, false
+}
+
 // GetFloat same as GetFloatOrDefault except if nothing is found, returns 0.0
 func (c *Config) GetFloat(key string) float64 {
 	return c.GetFloatOrDefault(key, 0.0)
@@ -92,3 +103,65 @@ func (c *Config) GetDurationOrDefault(key string, defaultValue time.Duration) ti
 	}
 	return time.Duration(intValue) * time.Millisecond
 }
+
+// GetFloatMap returns a map of float-typed parameters (for example, per-room overrides); integers are accepted, too.
+// Values which cannot be parsed as floats are skipped. If nothing is found, returns an empty map.
+func (c *Config) GetFloatMap(key string) map[string]float64 {
+	result := make(map[string]float64)
+	value, ok := c.values[key]
+	if !ok {
+		return result
+	}
+	mapValue, ok := value.(map[string]any)
+	if !ok {
+		return result
+	}
+	for mapKey, mapValue := range mapValue {
+		floatValue, ok := toFloat(mapValue)
+		if !ok {
+			continue
+		}
+		result[mapKey] = floatValue
+	}
+	return result
+}
+
+// GetIntMap returns a map of integer-typed parameters. Values which cannot be parsed as integers are skipped.
+// If nothing is found, returns an empty map.
+func (c *Config) GetIntMap(key string) map[string]int {
+	result := make(map[string]int)
+	value, ok := c.values[key]
+	if !ok {
+		return result
+	}
+	mapValue, ok := value.(map[string]any)
+	if !ok {
+		return result
+	}
+	for mapKey, mapValue := range mapValue {
+		intValue, ok := mapValue.(int)
+		if !ok {
+			continue
+		}
+		result[mapKey] = intValue
+	}
+	return result
+}
+
+// Unmarshal decodes a structured parameter (for example, a list of objects) into `target` which must be a pointer, as
+// in yaml.Unmarshal(..). Returns false if nothing is found, in which case `target` is left intact.
+func (c *Config) Unmarshal(key string, target any) (bool, error) {
+	value, ok := c.values[key]
+	if !ok {
+		return false, nil
+	}
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	err = yaml.Unmarshal(data, target)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFloatsAcceptIntegers(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "temperature: 0\npenalty: 1.1\nname: John\nweights:\n  JohnRoom: 0\n  MaryRoom: 1\n  SvetaRoom: 0.3\n  BadRoom: high\n"
+	err := os.WriteFile(configPath, []byte(yaml), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key           string
+		expectedValue float64
+	}{
+		{key: "temperature", expectedValue: 0.0},
+		{key: "penalty", expectedValue: 1.1},
+		{key: "name", expectedValue: -1.0},
+		{key: "unknown", expectedValue: -1.0},
+	}
+	for _, test := range tests {
+		value := config.GetFloatOrDefault(test.key, -1.0)
+		if value != test.expectedValue {
+			t.Errorf("expected %f for \"%s\", got %f", test.expectedValue, test.key, value)
+		}
+	}
+	weights := config.GetFloatMap("weights")
+	expectedWeights := map[string]float64{"JohnRoom": 0.0, "MaryRoom": 1.0, "SvetaRoom": 0.3}
+	if len(weights) != len(expectedWeights) {
+		t.Errorf("expected %v, got %v", expectedWeights, weights)
+	}
+	for room, expectedWeight := range expectedWeights {
+		if weight, ok := weights[room]; !ok || weight != expectedWeight {
+			t.Errorf("expected %f for \"%s\", got %v", expectedWeight, room, weights)
+		}
+	}
+}
@@ -1,21 +1,27 @@
 package common
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 type Job func() error
 
 type JobQueue struct {
-	jobsChannel chan Job
-	stopChannel chan struct{}
-	waitGroup   sync.WaitGroup
-	logger      Logger
+	jobsChannel     chan Job
+	stopChannel     chan struct{}
+	scheduleChannel chan struct{} // closed on stop to stop all scheduled jobs
+	stopOnce        sync.Once
+	waitGroup       sync.WaitGroup
+	logger          Logger
 }
 
 func NewJobQueue(logger Logger) *JobQueue {
 	worker := &JobQueue{
-		jobsChannel: make(chan Job, 128),
-		stopChannel: make(chan struct{}),
-		logger:      logger,
+		jobsChannel:     make(chan Job, 128),
+		stopChannel:     make(chan struct{}),
+		scheduleChannel: make(chan struct{}),
+		logger:          logger,
 	}
 	worker.waitGroup.Add(1)
 	go worker.run()
@@ -26,9 +32,35 @@ func (j *JobQueue) Enqueue(job Job) {
 	j.jobsChannel <- job
 }
 
+// Schedule enqueues the job periodically, until the queue is stopped. The first run happens after `interval`.
+func (j *JobQueue) Schedule(interval time.Duration, job Job) {
+	j.waitGroup.Add(1)
+	go func() {
+		defer j.waitGroup.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case j.jobsChannel <- job:
+				case <-j.scheduleChannel:
+					return
+				}
+			case <-j.scheduleChannel:
+				return
+			}
+		}
+	}()
+}
+
+// Stop can be called more than once (only the first call has effect)
 func (j *JobQueue) Stop() {
-	j.stopChannel <- struct{}{}
-	j.waitGroup.Wait()
+	j.stopOnce.Do(func() {
+		close(j.scheduleChannel)
+		j.stopChannel <- struct{}{}
+		j.waitGroup.Wait()
+	})
 }
 
 func (j *JobQueue) run() {
@@ -3,3 +3,12 @@ package common
 type Stopper interface {
 	Stop()
 }
+
+// Stoppers stops all the stoppers in order
+type Stoppers []Stopper
+
+func (s Stoppers) Stop() {
+	for _, stopper := range s {
+		stopper.Stop()
+	}
+}
@@ -1,32 +1,37 @@
 package api
 
 import (
+	"fmt"
+	"time"
+
 	"kgeyst.com/sveta/pkg/common"
 	"kgeyst.com/sveta/pkg/sveta/domain"
 	"kgeyst.com/sveta/pkg/sveta/domain/passes/bio"
 	"kgeyst.com/sveta/pkg/sveta/domain/passes/code"
 	"kgeyst.com/sveta/pkg/sveta/domain/passes/facts"
+	"kgeyst.com/sveta/pkg/sveta/domain/passes/importance"
 	"kgeyst.com/sveta/pkg/sveta/domain/passes/inspire"
+	"kgeyst.com/sveta/pkg/sveta/domain/passes/knowledge"
 	"kgeyst.com/sveta/pkg/sveta/domain/passes/news"
+	"kgeyst.com/sveta/pkg/sveta/domain/passes/profile"
 	"kgeyst.com/sveta/pkg/sveta/domain/passes/remember"
 	"kgeyst.com/sveta/pkg/sveta/domain/passes/response"
 	"kgeyst.com/sveta/pkg/sveta/domain/passes/rewrite"
 	"kgeyst.com/sveta/pkg/sveta/domain/passes/summary"
+	"kgeyst.com/sveta/pkg/sveta/domain/passes/temporal"
 	"kgeyst.com/sveta/pkg/sveta/domain/passes/vision"
 	domainweb "kgeyst.com/sveta/pkg/sveta/domain/passes/web"
 	domainwiki "kgeyst.com/sveta/pkg/sveta/domain/passes/wiki"
 	"kgeyst.com/sveta/pkg/sveta/domain/passes/workingmemory"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/cassette"
 	"kgeyst.com/sveta/pkg/sveta/infrastructure/docker"
 	"kgeyst.com/sveta/pkg/sveta/infrastructure/embed4all"
 	"kgeyst.com/sveta/pkg/sveta/infrastructure/filesystem"
 	"kgeyst.com/sveta/pkg/sveta/infrastructure/inmemory"
 	"kgeyst.com/sveta/pkg/sveta/infrastructure/juju"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/llamacpp"
 	"kgeyst.com/sveta/pkg/sveta/infrastructure/llavacpp"
-	"kgeyst.com/sveta/pkg/sveta/infrastructure/llms/deepseekcoder"
-	"kgeyst.com/sveta/pkg/sveta/infrastructure/llms/llama2"
-	"kgeyst.com/sveta/pkg/sveta/infrastructure/llms/llama3"
-	"kgeyst.com/sveta/pkg/sveta/infrastructure/llms/logging"
-	"kgeyst.com/sveta/pkg/sveta/infrastructure/llms/solar"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/llms/registry"
 	"kgeyst.com/sveta/pkg/sveta/infrastructure/rss"
 	infraweb "kgeyst.com/sveta/pkg/sveta/infrastructure/web"
 	infrawiki "kgeyst.com/sveta/pkg/sveta/infrastructure/wiki"
@@ -61,30 +66,92 @@ type API interface {
 	ChangeAgentDescription(description string) error
 	ChangeAgentName(name string) error
 	GetSummary(where string) (string, error)
+	// ListUserProfile lists what the AI knows about the user (only the entries visible in the given room).
+	// See also RemoveUserProfileEntry(..)
+	ListUserProfile(who, where string) ([]string, error)
+	// RemoveUserProfileEntry removes an entry from the user's profile. The index is zero-based and refers to the list
+	// returned by ListUserProfile(..) for the same room.
+	RemoveUserProfileEntry(who, where string, index int) error
 	ListCapabilities() []string
 	EnableCapability(name string, value bool) error
+	// CreateSnapshot backs up memories, summaries, user profiles, capabilities, the persona, the knowledge base and the
+	// embedding cache into a single archive. Returns the name of the snapshot. Snapshots can be restored with cmd/restore.
+	CreateSnapshot() (string, error)
 }
 
-func NewAPI(config *common.Config) (API, common.Stopper) {
+// NewAPI fails if the memory store can't be loaded (for example, if the memory encryption key is wrong)
+func NewAPI(config *common.Config) (API, common.Stopper, error) {
 	logger := common.NewFileLogger(config.GetStringOrDefault(ConfigKeyLogPath, "sveta.log"))
 	languageModelJobQueue := common.NewJobQueue(logger)
 	tempFileProvider := filesystem.NewTempFilePathProvider(config)
-	embedder := embed4all.NewEmbedder(logger)
+	// see `cassetteMode` in the config (nil if disabled)
+	modelCassette, err := cassette.NewCassette(config, logger)
+	if err != nil {
+		languageModelJobQueue.Stop()
+		return nil, nil, err
+	}
+	var embedder domain.Embedder
+	if modelCassette != nil && modelCassette.IsReplaying() {
+		embedder = cassette.NewEmbedderDecorator(nil, modelCassette) // the embedding model may be unavailable
+	} else {
+		embedder, err = NewEmbedder(config, logger)
+		if err != nil {
+			languageModelJobQueue.Stop()
+			return nil, nil, err
+		}
+		if modelCassette != nil {
+			embedder = cassette.NewEmbedderDecorator(embedder, modelCassette)
+		}
+	}
 	aiContext := domain.NewAIContextFromConfig(config)
 	namedMutexAcquirer := juju.NewNamedMutexAcquirer()
-	roleplayLLama2Model := logging.NewLanguageModelDecorator(llama2.NewRoleplayLanguageModel(aiContext, namedMutexAcquirer, config, logger), logger)
-	genericSolarModel := logging.NewLanguageModelDecorator(solar.NewGenericLanguageModel(aiContext, namedMutexAcquirer, config, logger), logger)
-	llama3Model := llama3.NewLanguageModel(namedMutexAcquirer, config, logger)
-	deepSeekCoderModel := deepseekcoder.NewLanguageModel(namedMutexAcquirer, config, logger)
-	defaultLanguageModelSelector := domain.NewLanguageModelSelector([]domain.LanguageModel{llama3Model, genericSolarModel, roleplayLLama2Model})
-	roleplayLanguageModelSelector := domain.NewLanguageModelSelector([]domain.LanguageModel{roleplayLLama2Model, genericSolarModel})
-	rerankLanguageModelSelector := domain.NewLanguageModelSelector([]domain.LanguageModel{genericSolarModel})
-	codeLanguageModelSelector := domain.NewLanguageModelSelector([]domain.LanguageModel{deepSeekCoderModel})
-	rewriteLanguageModelSelector := domain.NewLanguageModelSelector([]domain.LanguageModel{genericSolarModel})
+	languageModelRegistry, err := registry.NewRegistry(aiContext, namedMutexAcquirer, config, logger)
+	if err != nil {
+		languageModelJobQueue.Stop()
+		return nil, nil, err
+	}
+	if modelCassette != nil {
+		languageModelRegistry.DecorateLanguageModels(func(languageModel domain.LanguageModel) domain.LanguageModel {
+			return cassette.NewLanguageModelDecorator(languageModel, modelCassette)
+		})
+	}
+	// llama.cpp servers (see `llmBackend` in the config) must be terminated on shutdown, after the jobs which may use them
+	stoppers := common.Stoppers{languageModelJobQueue, languageModelRegistry}
+	if modelCassette != nil {
+		stoppers = append(stoppers, modelCassette) // after the jobs which may record
+	}
+	defaultLanguageModelSelector := languageModelRegistry.Selector(registry.RoleDefault)
+	roleplayLanguageModelSelector := languageModelRegistry.Selector(registry.RoleRoleplay)
+	rerankLanguageModelSelector := languageModelRegistry.Selector(registry.RoleRerank)
+	codeLanguageModelSelector := languageModelRegistry.Selector(registry.RoleCode)
+	rewriteLanguageModelSelector := languageModelRegistry.Selector(registry.RoleRewrite)
 	inMemoryMemoryRepository := inmemory.NewMemoryRepository()
-	memoryRepository := filesystem.NewMemoryRepository(inMemoryMemoryRepository, config, logger)
+	memoryRepository, err := filesystem.NewMemoryRepository(inMemoryMemoryRepository, config, logger)
+	if err != nil {
+		languageModelJobQueue.Stop()
+		return nil, nil, err
+	}
 	memoryFactory := inmemory.NewMemoryFactory(memoryRepository, embedder)
-	summaryRepository := inmemory.NewSummaryRepository()
+	memoryReembedder := domain.NewMemoryReembedder(memoryRepository, embedder, config, logger)
+	outdatedMemories, err := memoryReembedder.FindOutdated()
+	if err == nil && len(outdatedMemories) > 0 {
+		logger.Log(fmt.Sprintf("WARNING: %d memories weren't embedded with the current embedding model (%s), run cmd/reembed to migrate them\n", len(outdatedMemories), embedder.ModelName()))
+	}
+	summaryRepository, err := filesystem.NewSummaryRepository(inmemory.NewSummaryRepository(), config)
+	if err != nil {
+		languageModelJobQueue.Stop()
+		return nil, nil, err
+	}
+	userProfileRepository, err := filesystem.NewUserProfileRepository(config)
+	if err != nil {
+		languageModelJobQueue.Stop()
+		return nil, nil, err
+	}
+	knowledgeRepository, err := filesystem.NewKnowledgeRepository(config)
+	if err != nil {
+		languageModelJobQueue.Stop()
+		return nil, nil, err
+	}
 	defaultResponseService := domain.NewResponseService(
 		aiContext,
 		defaultLanguageModelSelector,
@@ -134,6 +201,7 @@ func NewAPI(config *common.Config) (API, common.Stopper) {
 		filesystem.NewBioFactProvider(config),
 		memoryRepository,
 		memoryFactory,
+		config,
 		logger,
 	)
 	webPass := domainweb.NewPass(
@@ -142,7 +210,10 @@ func NewAPI(config *common.Config) (API, common.Stopper) {
 		config,
 		logger,
 	)
-	visionModel := llavacpp.NewVisionModel()
+	var visionModel vision.Model = llavacpp.NewVisionModel()
+	if modelCassette != nil {
+		visionModel = cassette.NewVisionModelDecorator(visionModel, modelCassette)
+	}
 	visionPass := vision.NewPass(
 		urlFinder,
 		visionModel,
@@ -159,6 +230,22 @@ func NewAPI(config *common.Config) (API, common.Stopper) {
 		config,
 		logger,
 	)
+	profilePass := profile.NewPass(
+		userProfileRepository,
+		config,
+		logger,
+	)
+	knowledgePass := knowledge.NewPass(
+		knowledgeRepository,
+		embedder,
+		config,
+		logger,
+	)
+	temporalPass := temporal.NewPass(
+		memoryRepository,
+		config,
+		logger,
+	)
 	codeRunner := docker.NewCodeRunner(namedMutexAcquirer)
 	codePass := code.NewPass(
 		aiContext,
@@ -181,6 +268,12 @@ func NewAPI(config *common.Config) (API, common.Stopper) {
 		logger,
 	)
 	rememberPass := remember.NewPass(memoryRepository)
+	importancePass := importance.NewPass(
+		memoryRepository,
+		defaultResponseService,
+		languageModelJobQueue,
+		logger,
+	)
 	summaryPass := summary.NewPass(
 		aiContext,
 		summaryRepository,
@@ -193,33 +286,91 @@ func NewAPI(config *common.Config) (API, common.Stopper) {
 		aiContext,
 		memoryRepository,
 		memoryFactory,
+		userProfileRepository,
 		defaultResponseService,
 		languageModelJobQueue,
+		config,
 		logger,
 	)
-	return &api{
-		aiService: domain.NewAIService(
+	memorySweepInterval := config.GetDurationOrDefault("memorySweepInterval", 10*time.Minute)
+	if memorySweepInterval > 0 {
+		languageModelJobQueue.Schedule(memorySweepInterval, func() error {
+			return memoryRepository.RemoveExpired(time.Now())
+		})
+	}
+	consolidationInterval := config.GetDurationOrDefault(domain.ConfigKeyConsolidationInterval, time.Hour)
+	if consolidationInterval > 0 {
+		memoryConsolidator := domain.NewMemoryConsolidator(
 			memoryRepository,
 			memoryFactory,
-			summaryRepository,
-			aiContext,
-			[]domain.Pass{
-				inspirePass,
-				workingMemoryPass,
-				newsPass,
-				bioPass,
-				rewritePass,
-				webPass,
-				visionPass,
-				wikiPass,
-				codePass,
-				responsePass,
-				rememberPass,
-				summaryPass,
-				factsPass,
-			},
-		),
-	}, languageModelJobQueue
+			defaultResponseService,
+			config,
+			logger,
+		)
+		languageModelJobQueue.Schedule(consolidationInterval, memoryConsolidator.Consolidate)
+	}
+	reembedInterval := config.GetDurationOrDefault(domain.ConfigKeyReembedInterval, 5*time.Minute)
+	if reembedInterval > 0 {
+		languageModelJobQueue.Schedule(reembedInterval, memoryReembedder.Reembed)
+	}
+	aiService, err := domain.NewAIService(
+		memoryRepository,
+		memoryFactory,
+		summaryRepository,
+		userProfileRepository,
+		filesystem.NewAIStateRepository(config),
+		filesystem.NewSnapshotter(config, logger),
+		aiContext,
+		[]domain.Pass{
+			inspirePass,
+			workingMemoryPass,
+			newsPass,
+			bioPass,
+			rewritePass,
+			webPass,
+			visionPass,
+			wikiPass,
+			temporalPass,
+			profilePass,
+			knowledgePass,
+			codePass,
+			responsePass,
+			rememberPass,
+			importancePass,
+			summaryPass,
+			factsPass,
+		},
+	)
+	if err != nil {
+		languageModelJobQueue.Stop()
+		return nil, nil, err
+	}
+	snapshotInterval := config.GetDurationOrDefault("snapshotInterval", 24*time.Hour)
+	if snapshotInterval > 0 {
+		languageModelJobQueue.Schedule(snapshotInterval, func() error {
+			_, err := aiService.CreateSnapshot()
+			return err
+		})
+	}
+	return &api{
+		aiService: aiService,
+	}, stoppers, nil
+}
+
+// NewEmbedder see `embedder` in the config: "embed4all" (the default, requires Python 3) or "llamacpp".
+// Embeddings are cached on disk unless `embeddingCacheMaxSize` is 0.
+func NewEmbedder(config *common.Config, logger common.Logger) (domain.Embedder, error) {
+	var embedder domain.Embedder
+	switch config.GetStringOrDefault("embedder", "embed4all") {
+	case "llamacpp":
+		embedder = llamacpp.NewEmbedder(config, logger)
+	default:
+		embedder = embed4all.NewEmbedder(config, logger)
+	}
+	if config.GetIntOrDefault("embeddingCacheMaxSize", 10000) <= 0 {
+		return embedder, nil
+	}
+	return filesystem.NewCachingEmbedder(embedder, config, logger)
 }
 
 func (a *api) Respond(who string, what string, where string) (string, error) {
@@ -246,6 +397,22 @@ func (a *api) GetSummary(where string) (string, error) {
 	return a.aiService.GetSummary(where)
 }
 
+func (a *api) ListUserProfile(who, where string) ([]string, error) {
+	entries, err := a.aiService.ListUserProfile(who, where)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, fmt.Sprintf("%s (%s)", entry.What, entry.Visibility))
+	}
+	return result, nil
+}
+
+func (a *api) RemoveUserProfileEntry(who, where string, index int) error {
+	return a.aiService.RemoveUserProfileEntry(who, where, index)
+}
+
 func (a *api) ListCapabilities() []string {
 	return a.aiService.ListCapabilities()
 }
@@ -253,3 +420,7 @@ func (a *api) ListCapabilities() []string {
 func (a *api) EnableCapability(name string, value bool) error {
 	return a.aiService.EnableCapability(name, value)
 }
+
+func (a *api) CreateSnapshot() (string, error) {
+	return a.aiService.CreateSnapshot()
+}
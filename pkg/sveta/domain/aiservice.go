@@ -6,39 +6,72 @@ import (
 	"sync"
 )
 
-var errUnknownCapability = errors.New("unknown capability")
+var (
+	errUnknownCapability   = errors.New("unknown capability")
+	errUnknownProfileEntry = errors.New("unknown profile entry")
+)
 
 // AIService is the main orchestrator of the whole AI: it receives a list of passes and runs them one after another.
 // Additionally, it has various functions for debugging/control: remove all memory, remember actions, change context etc.\
 type AIService struct {
-	mutex               sync.Mutex
-	memoryRepository    MemoryRepository
-	memoryFactory       MemoryFactory
-	summaryRepository   SummaryRepository
-	aiContext           *AIContext
-	passes              []Pass
-	capabilities        map[string]*Capability
-	enabledCapabilities map[string]bool
+	mutex                 sync.Mutex
+	memoryRepository      MemoryRepository
+	memoryFactory         MemoryFactory
+	summaryRepository     SummaryRepository
+	userProfileRepository UserProfileRepository
+	aiStateRepository     AIStateRepository
+	snapshotter           Snapshotter
+	aiContext             *AIContext
+	passes                []Pass
+	capabilities          map[string]*Capability
+	enabledCapabilities   map[string]bool
+	// savedCapabilities capabilities enabled/disabled in a previous run (see AIStateRepository)
+	savedCapabilities map[string]bool
+	// persona overrides set at runtime (empty if the values from the config are used)
+	agentNameOverride        string
+	agentDescriptionOverride string
 }
 
 func NewAIService(
 	memoryRepository MemoryRepository,
 	memoryFactory MemoryFactory,
 	summaryRepository SummaryRepository,
+	userProfileRepository UserProfileRepository,
+	aiStateRepository AIStateRepository,
+	snapshotter Snapshotter,
 	aiContext *AIContext,
 	passes []Pass,
-) *AIService {
+) (*AIService, error) {
 	capabilities := make(map[string]*Capability)
 	enabledCapabilities := make(map[string]bool)
-	return &AIService{
-		memoryRepository:    memoryRepository,
-		memoryFactory:       memoryFactory,
-		summaryRepository:   summaryRepository,
-		aiContext:           aiContext,
-		passes:              passes,
-		capabilities:        capabilities,
-		enabledCapabilities: enabledCapabilities,
+	aiState, err := aiStateRepository.Load()
+	if err != nil {
+		return nil, err
+	}
+	if aiState == nil {
+		aiState = &AIState{}
+	}
+	if aiState.AgentName != "" {
+		aiContext.AgentName = aiState.AgentName
 	}
+	if aiState.AgentDescription != "" {
+		aiContext.AgentDescription = aiState.AgentDescription
+	}
+	return &AIService{
+		memoryRepository:         memoryRepository,
+		memoryFactory:            memoryFactory,
+		summaryRepository:        summaryRepository,
+		userProfileRepository:    userProfileRepository,
+		aiStateRepository:        aiStateRepository,
+		snapshotter:              snapshotter,
+		aiContext:                aiContext,
+		passes:                   passes,
+		capabilities:             capabilities,
+		enabledCapabilities:      enabledCapabilities,
+		savedCapabilities:        aiState.EnabledCapabilities,
+		agentNameOverride:        aiState.AgentName,
+		agentDescriptionOverride: aiState.AgentDescription,
+	}, nil
 }
 
 // Respond see API.Respond
@@ -76,7 +109,11 @@ func (a *AIService) ClearAllMemory() error {
 	if err != nil {
 		return err
 	}
-	return a.summaryRepository.RemoveAll()
+	err = a.summaryRepository.RemoveAll()
+	if err != nil {
+		return err
+	}
+	return a.userProfileRepository.RemoveAll()
 }
 
 // ChangeAgentDescription see API.ChangeAgentDescription
@@ -84,14 +121,16 @@ func (a *AIService) ChangeAgentDescription(description string) error {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 	a.aiContext.AgentDescription = description
-	return nil
+	a.agentDescriptionOverride = description
+	return a.saveState()
 }
 
 func (a *AIService) ChangeAgentName(name string) error {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 	a.aiContext.AgentName = name
-	return nil
+	a.agentNameOverride = name
+	return a.saveState()
 }
 
 func (a *AIService) GetSummary(where string) (string, error) {
@@ -107,6 +146,36 @@ func (a *AIService) GetSummary(where string) (string, error) {
 	return *summary, nil
 }
 
+// ListUserProfile see API.ListUserProfile
+func (a *AIService) ListUserProfile(who, where string) ([]*UserProfileEntry, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.listUserProfile(who, where)
+}
+
+// RemoveUserProfileEntry see API.RemoveUserProfileEntry
+func (a *AIService) RemoveUserProfileEntry(who, where string, index int) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	entries, err := a.listUserProfile(who, where)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(entries) {
+		return errUnknownProfileEntry
+	}
+	return a.userProfileRepository.Remove(who, entries[index].ID)
+}
+
+// listUserProfile only the entries visible in the room are listed, so that private entries don't leak into public rooms
+func (a *AIService) listUserProfile(who, where string) ([]*UserProfileEntry, error) {
+	entries, err := a.userProfileRepository.FindByWho(who)
+	if err != nil {
+		return nil, err
+	}
+	return FilterVisibleProfileEntries(entries, where), nil
+}
+
 func (a *AIService) ListCapabilities() []string {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
@@ -130,7 +199,27 @@ func (a *AIService) EnableCapability(name string, value bool) error {
 		return errUnknownCapability
 	}
 	a.enabledCapabilities[name] = value
-	return nil
+	return a.saveState()
+}
+
+// CreateSnapshot see API.CreateSnapshot
+func (a *AIService) CreateSnapshot() (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.snapshotter.CreateSnapshot()
+}
+
+func (a *AIService) saveState() error {
+	a.lazyLoadCapabilities()
+	enabledCapabilities := make(map[string]bool, len(a.enabledCapabilities))
+	for name, value := range a.enabledCapabilities {
+		enabledCapabilities[name] = value
+	}
+	return a.aiStateRepository.Save(&AIState{
+		AgentName:           a.agentNameOverride,
+		AgentDescription:    a.agentDescriptionOverride,
+		EnabledCapabilities: enabledCapabilities,
+	})
 }
 
 func (a *AIService) lazyLoadCapabilities() {
@@ -143,6 +232,11 @@ func (a *AIService) lazyLoadCapabilities() {
 			a.capabilities[c.Name] = c
 		}
 	}
+	for name, value := range a.savedCapabilities {
+		if _, ok := a.capabilities[name]; ok { // the capability may no longer exist
+			a.enabledCapabilities[name] = value
+		}
+	}
 }
 
 func (a *AIService) listEnabledCapabilities() []*Capability {
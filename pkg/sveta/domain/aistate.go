@@ -0,0 +1,17 @@
+package domain
+
+// AIState the state of the AI which can be changed at runtime (see AIService) and which must survive restarts
+type AIState struct {
+	// AgentName empty if not overridden
+	AgentName string
+	// AgentDescription empty if not overridden
+	AgentDescription string
+	// EnabledCapabilities capability name => whether it's enabled (capabilities not found here are enabled by default)
+	EnabledCapabilities map[string]bool
+}
+
+type AIStateRepository interface {
+	// Load returns nil if no state was saved yet
+	Load() (*AIState, error)
+	Save(state *AIState) error
+}
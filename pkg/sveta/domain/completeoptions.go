@@ -1,12 +1,52 @@
 package domain
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
 var DefaultCompleteOptions = CompleteOptions{}
 
 type CompleteOptions struct {
 	// JSONMode makes sure the output will be a syntactically valid JSON (grammar-restricted completion)
 	JSONMode bool
-	// Temperature specifies
-	Temperature float64
+	// JSONGrammar the GBNF grammar the JSON output must match (see GenerateJSONGrammar(..)), if JSONMode is on. If it's
+	// empty, any JSON object is allowed.
+	JSONGrammar string
+	// Temperature how creative the output is; only if HasTemperature is set (0 is a valid temperature), otherwise the
+	// model's default temperature is used
+	Temperature    float64
+	HasTemperature bool
+	// PromptCacheKey the evaluated prompt can be cached and reused for the next prompt with the same key, if the
+	// language model supports it (see NewPromptCacheKey(..))
+	PromptCacheKey PromptCacheKey
+}
+
+// PromptCacheKey consecutive prompts in the same room usually share a long prefix (the system prompt, the persona, the
+// history), which doesn't have to be evaluated again. The fingerprint changes if anything in the prefix which isn't
+// supposed to change between turns does (the persona, the summary), so that the stale cache of the room is discarded.
+type PromptCacheKey struct {
+	// Room where the prompt is from (possibly qualified, e.g. with the response mode)
+	Room        string
+	Fingerprint string
+}
+
+// NewPromptCacheKey the fingerprint is a hash of `prefixParts`
+func NewPromptCacheKey(room string, prefixParts ...string) PromptCacheKey {
+	hash := sha256.New()
+	for _, part := range prefixParts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return PromptCacheKey{
+		Room:        room,
+		Fingerprint: hex.EncodeToString(hash.Sum(nil))[:16],
+	}
+}
+
+// IsZero caching is disabled for prompts which don't belong to a room
+func (k PromptCacheKey) IsZero() bool {
+	return k.Room == ""
 }
 
 func (c CompleteOptions) WithJSONMode(value bool) CompleteOptions {
@@ -14,13 +54,24 @@ func (c CompleteOptions) WithJSONMode(value bool) CompleteOptions {
 	return c
 }
 
+func (c CompleteOptions) WithJSONGrammar(value string) CompleteOptions {
+	c.JSONGrammar = value
+	return c
+}
+
 func (c CompleteOptions) WithTemperature(value float64) CompleteOptions {
 	c.Temperature = value
+	c.HasTemperature = true
+	return c
+}
+
+func (c CompleteOptions) WithPromptCacheKey(value PromptCacheKey) CompleteOptions {
+	c.PromptCacheKey = value
 	return c
 }
 
 func (c CompleteOptions) TemperatureOrDefault(defaultValue float64) float64 {
-	if c.Temperature == 0.0 {
+	if !c.HasTemperature {
 		return defaultValue
 	}
 	return c.Temperature
@@ -27,13 +27,59 @@ const (
 	// ConfigKeyEpisodicMemorySimilarityThreshold what embedding similarity is considered so low we don't want to
 	// include it in the context at all (even if it's the top result)
 	ConfigKeyEpisodicMemorySimilarityThreshold = "episodicMemorySimilarityThreshold"
+	// ConfigKeyEpisodicMemorySimilarityWeight how much semantic similarity contributes to the recall score of a memory
+	ConfigKeyEpisodicMemorySimilarityWeight = "episodicMemorySimilarityWeight"
+	// ConfigKeyEpisodicMemoryRecencyWeight how much recency contributes to the recall score of a memory
+	ConfigKeyEpisodicMemoryRecencyWeight = "episodicMemoryRecencyWeight"
+	// ConfigKeyEpisodicMemoryImportanceWeight how much importance contributes to the recall score of a memory
+	ConfigKeyEpisodicMemoryImportanceWeight = "episodicMemoryImportanceWeight"
+	// ConfigKeyEpisodicMemoryAccessWeight how much the number of times a memory was recalled before contributes to the
+	// recall score of a memory
+	ConfigKeyEpisodicMemoryAccessWeight = "episodicMemoryAccessWeight"
+	// ConfigKeyEpisodicMemoryRecencyHalfLife after how much time the recency of a memory decays by half, in milliseconds
+	ConfigKeyEpisodicMemoryRecencyHalfLife = "episodicMemoryRecencyHalfLife"
+	// ConfigKeyEpisodicMemoryLexicalWeight how much lexical (BM25) search contributes to episodic memory recall, from 0.0
+	// (only embeddings are used) to 1.0 (only lexical search is used)
+	ConfigKeyEpisodicMemoryLexicalWeight = "episodicMemoryLexicalWeight"
+	// ConfigKeyEpisodicMemoryLexicalWeights per-room overrides of ConfigKeyEpisodicMemoryLexicalWeight (room => weight)
+	ConfigKeyEpisodicMemoryLexicalWeights = "episodicMemoryLexicalWeights"
+	// ConfigKeyEpisodicMemoryTypeQuotas the maximum number of recalled memories of each type (memory type name => count),
+	// see MemoryType.String()
+	ConfigKeyEpisodicMemoryTypeQuotas = "episodicMemoryTypeQuotas"
+	// ConfigKeyConsolidationInterval how often old dialog memories are consolidated into digests, in milliseconds
+	// (0 disables consolidation), see MemoryConsolidator
+	ConfigKeyConsolidationInterval = "consolidationInterval"
+	// ConfigKeyConsolidationMinAge only dialog memories older than this are consolidated, in milliseconds
+	ConfigKeyConsolidationMinAge = "consolidationMinAge"
+	// ConfigKeyConsolidationMaxTimeGap the maximum time between two consecutive dialog lines of the same cluster, in milliseconds
+	ConfigKeyConsolidationMaxTimeGap = "consolidationMaxTimeGap"
+	// ConfigKeyConsolidationSimilarityThreshold how similar (by embeddings) a dialog line must be to the cluster to join it
+	ConfigKeyConsolidationSimilarityThreshold = "consolidationSimilarityThreshold"
+	// ConfigKeyConsolidationMinClusterSize clusters with fewer dialog lines are left as is
+	ConfigKeyConsolidationMinClusterSize = "consolidationMinClusterSize"
+	// ConfigKeyConsolidationMaxClusterSize the maximum number of dialog lines summarized in one digest
+	ConfigKeyConsolidationMaxClusterSize = "consolidationMaxClusterSize"
+	// ConfigKeyReembedInterval how often memories which were stored without embeddings (while the embedder was
+	// unavailable) are re-embedded, in milliseconds (0 disables re-embedding), see MemoryReembedder
+	ConfigKeyReembedInterval = "reembedInterval"
+	// ConfigKeyReembedBatchSize how many memories are re-embedded at once
+	ConfigKeyReembedBatchSize = "reembedBatchSize"
 	// ConfigKeyRerankerMaxMemorySize specifies the maximum size of a recalled memory when passed to  the reranker (to reduce the amount of data sent to it)
 	ConfigKeyRerankerMaxMemorySize = "rerankerMaxMemorySize"
 	// ConfigKeyResponseRetryCount how many times we should try retrieve an answer from an LLM in case it fails for some reason,
 	// before we finally return an error.
 	ConfigKeyResponseRetryCount = "responseRetryCount"
-	// ConfigKeyResponseTextTemperature specifies the default temperature for text-based completions
+	// ConfigKeyResponseTextTemperature specifies the default temperature for text-based completions (the model's
+	// default temperature is used if it's not set)
 	ConfigKeyResponseTextTemperature = "responseTextTemperature"
 	// ConfigKeyResponseJSONTemperature specifies the default temperature for completions in JSON mode
 	ConfigKeyResponseJSONTemperature = "responseJSONTemperature"
+	// ConfigKeyResponseTokenReserve how many tokens of the model's context are left for the response; the rest of the
+	// prompt is truncated by priority to fit (see formatPromptWithinBudget(..))
+	ConfigKeyResponseTokenReserve = "responseTokenReserve"
+	// ConfigKeyLanguageModelFailureThreshold after how many failures in a row (errors, timeouts, empty responses) a
+	// language model is temporarily skipped in favor of other models (0 disables skipping)
+	ConfigKeyLanguageModelFailureThreshold = "languageModelFailureThreshold"
+	// ConfigKeyLanguageModelFailureCooldown for how long a failing language model is skipped, in milliseconds
+	ConfigKeyLanguageModelFailureCooldown = "languageModelFailureCooldown"
 )
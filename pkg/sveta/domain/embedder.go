@@ -5,4 +5,12 @@ type Embedder interface {
 	// Embed calculates an embedding (a coordinate in a virtual semantic space) of a sentence (not only individual words).
 	// The produced embeddings can be compared with Embedding.GetSimilarityTo(..)
 	Embed(sentence string) (Embedding, error)
+	// EmbedBatch same as Embed(..), but for many sentences at once, which is considerably faster than embedding them one
+	// by one. The result has the same order and length as the input.
+	EmbedBatch(sentences []string) ([]Embedding, error)
+	// ModelName the name of the embedding model. Embeddings produced by different models can't be compared, so every
+	// memory records which model produced its embedding (see Memory.EmbeddingModel).
+	ModelName() string
+	// DimensionCount the number of dimensions of the produced embeddings
+	DimensionCount() int
 }
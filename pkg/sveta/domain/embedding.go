@@ -1,22 +1,41 @@
 package domain
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"strconv"
 	"strings"
 )
 
+// ErrMixedEmbeddingDimensions embeddings of different dimensions (i.e. produced by different models) can't be compared
+var ErrMixedEmbeddingDimensions = errors.New("embeddings of different dimensions can't be compared")
+
 // Embedding a coordinate in a virtual embedding space. Embeddings can be compared to find which sentences are close
 // to each other in meaning.
+// Embeddings are normalized to unit length once, when created, so that cosine similarity is a plain dot product.
+// They're stored as float32 (or int8, see Quantize()) to halve the memory used by large stores.
 type Embedding struct {
-	values []float64
+	values    []float32 // unit length; nil if quantized
+	quantized []int8    // see Quantize()
+	scale     float32   // quantized[i]*scale approximates the original values[i]
 }
 
 // NewEmbedding creates a new embedding from the provided vector components (can be an arbitrary number, depends on the
 // exact embedding model used).
 func NewEmbedding(values []float64) Embedding {
-	return Embedding{values: values}
+	var squaredNorm float64
+	for _, value := range values {
+		squaredNorm += value * value
+	}
+	normalizedValues := make([]float32, len(values))
+	if squaredNorm > 0 {
+		norm := math.Sqrt(squaredNorm)
+		for i, value := range values {
+			normalizedValues[i] = float32(value / norm)
+		}
+	}
+	return Embedding{values: normalizedValues}
 }
 
 // NewEmbeddingFromFormattedValues creates an embedding from a text form.
@@ -35,35 +54,95 @@ func NewEmbeddingFromFormattedValues(text string) (Embedding, error) {
 	return NewEmbedding(values), nil
 }
 
+// NewEmbeddingFromExactFormattedValues parses the output of ToExactFormattedValues(): the components are already
+// normalized, so the embedding is restored exactly.
+func NewEmbeddingFromExactFormattedValues(text string) (Embedding, error) {
+	split := strings.Fields(text)
+	values := make([]float32, len(split))
+	for i, formattedValue := range split {
+		value, err := strconv.ParseFloat(formattedValue, 32)
+		if err != nil {
+			return Embedding{}, err
+		}
+		values[i] = float32(value)
+	}
+	return Embedding{values: values}, nil
+}
+
+// ToExactFormattedValues same as ToFormattedValues(), but each component is formatted without the loss of precision
+// (see NewEmbeddingFromExactFormattedValues(..))
+func (a Embedding) ToExactFormattedValues() string {
+	var builder strings.Builder
+	dimensionCount := a.DimensionCount()
+	for i := 0; i < dimensionCount; i++ {
+		builder.WriteString(strconv.FormatFloat(float64(a.valueAt(i)), 'g', -1, 32))
+		if i < dimensionCount-1 {
+			builder.WriteRune(' ')
+		}
+	}
+	return builder.String()
+}
+
 func (a Embedding) ToFormattedValues() string {
 	var builder strings.Builder
-	for i := 0; i < len(a.values); i++ {
-		builder.WriteString(fmt.Sprintf("%.3f", a.values[i]))
-		if i < len(a.values)-1 {
+	dimensionCount := a.DimensionCount()
+	for i := 0; i < dimensionCount; i++ {
+		builder.WriteString(fmt.Sprintf("%.3f", a.valueAt(i)))
+		if i < dimensionCount-1 {
 			builder.WriteRune(' ')
 		}
 	}
 	return builder.String()
 }
 
+// Quantize returns a copy of the embedding which takes 4 times less memory (one byte per component), at the cost of a
+// slight loss of precision (the error in similarity is usually below 0.01). Quantized and non-quantized embeddings
+// can be compared with each other.
+func (a Embedding) Quantize() Embedding {
+	if a.quantized != nil {
+		return a
+	}
+	var maxAbsValue float32
+	for _, value := range a.values {
+		if value < 0 {
+			value = -value
+		}
+		if value > maxAbsValue {
+			maxAbsValue = value
+		}
+	}
+	quantized := make([]int8, len(a.values))
+	if maxAbsValue == 0 {
+		return Embedding{quantized: quantized}
+	}
+	scale := maxAbsValue / math.MaxInt8
+	for i, value := range a.values {
+		quantized[i] = int8(math.Round(float64(value / scale)))
+	}
+	return Embedding{quantized: quantized, scale: scale}
+}
+
+func (a Embedding) IsQuantized() bool {
+	return a.quantized != nil
+}
+
 // GetSimilarityTo finds how similar two embeddings are to each other semantically using cosine similarity.
 // If the result value is 1.0 -- the embeddings are identical. If it's 0.0 -- the embeddings are completely different.
+// Embeddings of different dimensions can't be compared, 0.0 is returned (see GetCommonDimensionCount(..))
 func (a Embedding) GetSimilarityTo(b Embedding) float64 {
-	aValues := a.values
-	bValues := b.values
-	if len(aValues) != len(bValues) {
+	if a.DimensionCount() != b.DimensionCount() {
 		return 0.0
 	}
-	var sum, s1, s2 float64
-	for i := 0; i < len(aValues); i++ {
-		sum += aValues[i] * bValues[i]
-		s1 += math.Pow(aValues[i], 2)
-		s2 += math.Pow(bValues[i], 2)
-	}
-	if s1 == 0 || s2 == 0 {
-		return 0.0
+	switch {
+	case a.quantized != nil && b.quantized != nil:
+		return float64(dotInt8(a.quantized, b.quantized)) * float64(a.scale) * float64(b.scale)
+	case a.quantized != nil:
+		return float64(dotInt8Float32(a.quantized, b.values) * a.scale)
+	case b.quantized != nil:
+		return float64(dotInt8Float32(b.quantized, a.values) * b.scale)
+	default:
+		return float64(dotFloat32(a.values, b.values))
 	}
-	return sum / (math.Sqrt(s1) * math.Sqrt(s2))
 }
 
 func (a Embedding) GetBestSimilarityTo(bs []Embedding) float64 {
@@ -78,5 +157,73 @@ func (a Embedding) GetBestSimilarityTo(bs []Embedding) float64 {
 }
 
 func (a Embedding) DimensionCount() int {
+	if a.quantized != nil {
+		return len(a.quantized)
+	}
 	return len(a.values)
 }
+
+func (a Embedding) valueAt(index int) float32 {
+	if a.quantized != nil {
+		return float32(a.quantized[index]) * a.scale
+	}
+	return a.values[index]
+}
+
+// dotFloat32 the loop is unrolled, as it's the hottest spot of recall (the slices must be of the same length)
+func dotFloat32(a, b []float32) float32 {
+	b = b[:len(a)]
+	var sum0, sum1, sum2, sum3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		sum0 += a[i] * b[i]
+		sum1 += a[i+1] * b[i+1]
+		sum2 += a[i+2] * b[i+2]
+		sum3 += a[i+3] * b[i+3]
+	}
+	for ; i < len(a); i++ {
+		sum0 += a[i] * b[i]
+	}
+	return sum0 + sum1 + sum2 + sum3
+}
+
+func dotInt8(a, b []int8) int32 {
+	b = b[:len(a)]
+	var sum0, sum1, sum2, sum3 int32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		sum0 += int32(a[i]) * int32(b[i])
+		sum1 += int32(a[i+1]) * int32(b[i+1])
+		sum2 += int32(a[i+2]) * int32(b[i+2])
+		sum3 += int32(a[i+3]) * int32(b[i+3])
+	}
+	for ; i < len(a); i++ {
+		sum0 += int32(a[i]) * int32(b[i])
+	}
+	return sum0 + sum1 + sum2 + sum3
+}
+
+func dotInt8Float32(a []int8, b []float32) float32 {
+	b = b[:len(a)]
+	var sum float32
+	for i, value := range a {
+		sum += float32(value) * b[i]
+	}
+	return sum
+}
+
+// GetCommonDimensionCount returns the dimension count shared by all the non-empty embeddings (0 if there are none), or
+// ErrMixedEmbeddingDimensions.
+func GetCommonDimensionCount(embeddings []Embedding) (int, error) {
+	dimensionCount := 0
+	for _, embedding := range embeddings {
+		if embedding.DimensionCount() == 0 {
+			continue
+		}
+		if dimensionCount != 0 && embedding.DimensionCount() != dimensionCount {
+			return 0, ErrMixedEmbeddingDimensions
+		}
+		dimensionCount = embedding.DimensionCount()
+	}
+	return dimensionCount, nil
+}
@@ -0,0 +1,196 @@
+package domain
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+const (
+	testDimensionCount = 384 // as in all-MiniLM-L6-v2
+	testMemoryCount    = 2000
+	testQueryCount     = 50
+	testTopCount       = 10
+)
+
+// cosineSimilarity the original implementation (float64, norms computed on every comparison), which the normalized
+// float32 and int8 embeddings must agree with
+func cosineSimilarity(a, b []float64) float64 {
+	var dotProduct, squaredNormA, squaredNormB float64
+	for i := range a {
+		dotProduct += a[i] * b[i]
+		squaredNormA += math.Pow(a[i], 2)
+		squaredNormB += math.Pow(b[i], 2)
+	}
+	if squaredNormA == 0 || squaredNormB == 0 {
+		return 0.0
+	}
+	return dotProduct / (math.Sqrt(squaredNormA) * math.Sqrt(squaredNormB))
+}
+
+func randomVector(random *rand.Rand) []float64 {
+	vector := make([]float64, testDimensionCount)
+	for i := range vector {
+		vector[i] = random.NormFloat64()
+	}
+	return vector
+}
+
+// nearbyVector a query which is close to `vector` in meaning
+func nearbyVector(random *rand.Rand, vector []float64, noise float64) []float64 {
+	result := make([]float64, len(vector))
+	for i := range vector {
+		result[i] = vector[i] + random.NormFloat64()*noise
+	}
+	return result
+}
+
+// rank returns the indices of the top `count` most similar vectors
+func rank(similarities []float64, count int) []int {
+	indices := make([]int, len(similarities))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(i, j int) bool {
+		return similarities[indices[i]] > similarities[indices[j]]
+	})
+	return indices[:count]
+}
+
+func countCommon(a, b []int) int {
+	set := make(map[int]struct{}, len(a))
+	for _, value := range a {
+		set[value] = struct{}{}
+	}
+	count := 0
+	for _, value := range b {
+		if _, ok := set[value]; ok {
+			count++
+		}
+	}
+	return count
+}
+
+func TestEmbeddingSimilarityMatchesCosineSimilarity(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		a := randomVector(random)
+		b := nearbyVector(random, a, random.Float64()*2)
+		expected := cosineSimilarity(a, b)
+		embeddingA, embeddingB := NewEmbedding(a), NewEmbedding(b)
+		actual := embeddingA.GetSimilarityTo(embeddingB)
+		if math.Abs(actual-expected) > 1e-5 {
+			t.Fatalf("float32: expected %f, got %f", expected, actual)
+		}
+		quantized := embeddingA.Quantize().GetSimilarityTo(embeddingB)
+		if math.Abs(quantized-expected) > 0.01 {
+			t.Fatalf("int8 vs float32: expected %f, got %f", expected, quantized)
+		}
+		quantized = embeddingA.Quantize().GetSimilarityTo(embeddingB.Quantize())
+		if math.Abs(quantized-expected) > 0.01 {
+			t.Fatalf("int8 vs int8: expected %f, got %f", expected, quantized)
+		}
+	}
+}
+
+func TestEmbeddingSimilarityOfZeroVector(t *testing.T) {
+	zero := NewEmbedding(make([]float64, testDimensionCount))
+	other := NewEmbedding(randomVector(rand.New(rand.NewSource(1))))
+	if similarity := zero.GetSimilarityTo(other); similarity != 0.0 {
+		t.Fatalf("expected 0.0, got %f", similarity)
+	}
+	if similarity := zero.Quantize().GetSimilarityTo(other); similarity != 0.0 {
+		t.Fatalf("expected 0.0, got %f", similarity)
+	}
+}
+
+// TestQuantizedRecallRanking recall must return (almost) the same memories whether embeddings are quantized or not
+func TestQuantizedRecallRanking(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	vectors := make([][]float64, testMemoryCount)
+	embeddings := make([]Embedding, testMemoryCount)
+	quantizedEmbeddings := make([]Embedding, testMemoryCount)
+	for i := range vectors {
+		vectors[i] = randomVector(random)
+		embeddings[i] = NewEmbedding(vectors[i])
+		quantizedEmbeddings[i] = embeddings[i].Quantize()
+	}
+	commonCount := 0
+	for q := 0; q < testQueryCount; q++ {
+		target := random.Intn(testMemoryCount)
+		queryVector := nearbyVector(random, vectors[target], 1.5)
+		query := NewEmbedding(queryVector)
+		expectedSimilarities := make([]float64, testMemoryCount)
+		quantizedSimilarities := make([]float64, testMemoryCount)
+		for i := range vectors {
+			expectedSimilarities[i] = cosineSimilarity(queryVector, vectors[i])
+			quantizedSimilarities[i] = quantizedEmbeddings[i].GetSimilarityTo(query)
+		}
+		expectedRanking := rank(expectedSimilarities, testTopCount)
+		quantizedRanking := rank(quantizedSimilarities, testTopCount)
+		if expectedRanking[0] != target || quantizedRanking[0] != target {
+			t.Fatalf("query %d: expected memory %d first, got %d (cosine) and %d (int8)", q, target, expectedRanking[0], quantizedRanking[0])
+		}
+		commonCount += countCommon(expectedRanking, quantizedRanking)
+	}
+	// The tail of the top is made of unrelated memories with nearly equal similarities, so a few of them may swap.
+	overlap := float64(commonCount) / float64(testQueryCount*testTopCount)
+	if overlap < 0.8 {
+		t.Fatalf("expected the top %d to overlap by at least 80%%, got %.0f%%", testTopCount, overlap*100)
+	}
+}
+
+func newBenchmarkEmbeddings() (Embedding, []Embedding) {
+	random := rand.New(rand.NewSource(1))
+	embeddings := make([]Embedding, testMemoryCount)
+	for i := range embeddings {
+		embeddings[i] = NewEmbedding(randomVector(random))
+	}
+	return NewEmbedding(randomVector(random)), embeddings
+}
+
+func benchmarkRecall(b *testing.B, query Embedding, embeddings []Embedding) {
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, embedding := range embeddings {
+			_ = embedding.GetSimilarityTo(query)
+		}
+	}
+}
+
+func BenchmarkCosineSimilarity(b *testing.B) {
+	random := rand.New(rand.NewSource(1))
+	vectors := make([][]float64, testMemoryCount)
+	for i := range vectors {
+		vectors[i] = randomVector(random)
+	}
+	query := randomVector(random)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, vector := range vectors {
+			_ = cosineSimilarity(vector, query)
+		}
+	}
+}
+
+func BenchmarkFloat32Similarity(b *testing.B) {
+	query, embeddings := newBenchmarkEmbeddings()
+	benchmarkRecall(b, query, embeddings)
+}
+
+func BenchmarkInt8Similarity(b *testing.B) {
+	query, embeddings := newBenchmarkEmbeddings()
+	for i := range embeddings {
+		embeddings[i] = embeddings[i].Quantize()
+	}
+	benchmarkRecall(b, query, embeddings)
+}
+
+func BenchmarkInt8QuantizedQuerySimilarity(b *testing.B) {
+	query, embeddings := newBenchmarkEmbeddings()
+	for i := range embeddings {
+		embeddings[i] = embeddings[i].Quantize()
+	}
+	benchmarkRecall(b, query.Quantize(), embeddings)
+}
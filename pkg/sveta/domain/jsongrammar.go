@@ -0,0 +1,249 @@
+package domain
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// jsonGrammarEnumTag restricts a string or integer field to the listed comma-separated values, for example:
+//
+//	ReturnedValue string `json:"returnedValue" enum:"yes,no"`
+const jsonGrammarEnumTag = "enum"
+
+// jsonGrammarCommonRules the rules which the generated rules refer to (same as in json.gbnf)
+const jsonGrammarCommonRules = `value ::= object | array | string | number | ("true" | "false" | "null") ws
+object ::= "{" ws ( string ":" ws value ("," ws string ":" ws value)* )? "}" ws
+array ::= "[" ws ( value ("," ws value)* )? "]" ws
+string ::= "\"" ( [^"\\] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F]) )* "\"" ws
+number ::= ("-"? ([0-9] | [1-9] [0-9]*)) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? ws
+integer ::= "-"? ([0-9] | [1-9] [0-9]*) ws
+unsigned ::= ([0-9] | [1-9] [0-9]*) ws
+boolean ::= ("true" | "false") ws
+ws ::= ([ \t\n] ws)?
+`
+
+var (
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	ruleNameRegexp    = regexp.MustCompile("[^a-zA-Z0-9]+")
+)
+
+type jsonGrammarGenerator struct {
+	rules     []string
+	ruleNames map[reflect.Type]string
+	usedNames map[string]struct{}
+}
+
+// GenerateJSONGrammar generates a GBNF grammar (for llama.cpp) which only allows JSON matching the Go type of `value`:
+// struct fields become required keys in the declaration order (named after their `json` tags), and the values must
+// have the fields' types. String and integer fields can be restricted to a set of values with the `enum` tag.
+// Interfaces, json.Marshaler's and map values of unsupported types allow any JSON value.
+func GenerateJSONGrammar(value any) (string, error) {
+	typ := reflect.TypeOf(value)
+	if typ == nil {
+		return "", fmt.Errorf("can't generate a JSON grammar for nil")
+	}
+	for typ.Kind() == reflect.Pointer { // the object to unmarshal into is usually passed by pointer
+		typ = typ.Elem()
+	}
+	g := &jsonGrammarGenerator{
+		ruleNames: make(map[reflect.Type]string),
+		usedNames: make(map[string]struct{}),
+	}
+	for _, name := range []string{"root", "value", "object", "array", "string", "number", "integer", "unsigned", "boolean", "ws"} {
+		g.usedNames[name] = struct{}{}
+	}
+	root, err := g.generate(typ, "")
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	buf.WriteString("root ::= ")
+	buf.WriteString(root)
+	buf.WriteString("\n")
+	for _, rule := range g.rules {
+		buf.WriteString(rule)
+		buf.WriteString("\n")
+	}
+	buf.WriteString(jsonGrammarCommonRules)
+	return buf.String(), nil
+}
+
+// generate returns the expression which matches the type (either a reference to a rule or an inline expression)
+func (g *jsonGrammarGenerator) generate(typ reflect.Type, enum string) (string, error) {
+	if typ.Kind() == reflect.Pointer {
+		elem, err := g.generate(typ.Elem(), enum) // an enum restricts the value pointed to
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s | \"null\" ws)", elem), nil
+	}
+	if enum != "" {
+		return g.generateEnum(typ, enum)
+	}
+	if typ.Kind() != reflect.Interface {
+		if typ.Implements(jsonMarshalerType) {
+			return "value", nil
+		}
+		if typ.Implements(textMarshalerType) {
+			return "string", nil
+		}
+	}
+	switch typ.Kind() {
+	case reflect.Interface:
+		return "value", nil
+	case reflect.String:
+		return "string", nil
+	case reflect.Bool:
+		return "boolean", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "integer", nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "unsigned", nil
+	case reflect.Float32, reflect.Float64:
+		return "number", nil
+	case reflect.Slice, reflect.Array:
+		if typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8 { // []byte is marshaled as base64
+			return "string", nil
+		}
+		elem, err := g.generate(typ.Elem(), "")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(\"[\" ws ( %s (\",\" ws %s)* )? \"]\" ws)", elem, elem), nil
+	case reflect.Map:
+		if typ.Key().Kind() != reflect.String {
+			return "", fmt.Errorf("can't generate a JSON grammar for map keys of type %s", typ.Key())
+		}
+		elem, err := g.generate(typ.Elem(), "")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(\"{\" ws ( string \":\" ws %s (\",\" ws string \":\" ws %s)* )? \"}\" ws)", elem, elem), nil
+	case reflect.Struct:
+		return g.generateStruct(typ)
+	}
+	return "", fmt.Errorf("can't generate a JSON grammar for type %s", typ)
+}
+
+// generateStruct declares a rule per struct type, so that recursive types are supported
+func (g *jsonGrammarGenerator) generateStruct(typ reflect.Type) (string, error) {
+	if name, ok := g.ruleNames[typ]; ok {
+		return name, nil
+	}
+	name := g.newRuleName(typ.Name())
+	g.ruleNames[typ] = name
+	var fields []string
+	err := g.collectFields(typ, &fields)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	buf.WriteString(name)
+	buf.WriteString(" ::= \"{\" ws")
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteString(" \",\" ws")
+		}
+		buf.WriteString(" ")
+		buf.WriteString(field)
+	}
+	buf.WriteString(" \"}\" ws")
+	g.rules = append(g.rules, buf.String())
+	return name, nil
+}
+
+// collectFields follows encoding/json: unexported fields and fields tagged with "-" are skipped, and the fields of
+// embedded structs without a name in the tag are promoted.
+func (g *jsonGrammarGenerator) collectFields(typ reflect.Type, fields *[]string) error {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		fieldType := field.Type
+		if field.Anonymous && name == "" {
+			if fieldType.Kind() == reflect.Pointer {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() == reflect.Struct {
+				err := g.collectFields(fieldType, fields)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		value, err := g.generate(field.Type, field.Tag.Get(jsonGrammarEnumTag))
+		if err != nil {
+			return fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return err
+		}
+		*fields = append(*fields, fmt.Sprintf("%s ws \":\" ws %s", quoteGBNFLiteral(string(key)), value))
+	}
+	return nil
+}
+
+func (g *jsonGrammarGenerator) generateEnum(typ reflect.Type, enum string) (string, error) {
+	var alternatives []string
+	for _, value := range strings.Split(enum, ",") {
+		value = strings.TrimSpace(value)
+		switch typ.Kind() {
+		case reflect.String:
+			encodedValue, err := json.Marshal(value)
+			if err != nil {
+				return "", err
+			}
+			alternatives = append(alternatives, quoteGBNFLiteral(string(encodedValue)))
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			var number int64
+			err := json.Unmarshal([]byte(value), &number)
+			if err != nil {
+				return "", fmt.Errorf("malformed enum value \"%s\": %w", value, err)
+			}
+			alternatives = append(alternatives, quoteGBNFLiteral(value))
+		default:
+			return "", fmt.Errorf("enums are only supported for strings and integers, not %s", typ)
+		}
+	}
+	return fmt.Sprintf("(%s) ws", strings.Join(alternatives, " | ")), nil
+}
+
+func (g *jsonGrammarGenerator) newRuleName(typeName string) string {
+	base := strings.ToLower(ruleNameRegexp.ReplaceAllString(typeName, "-"))
+	base = strings.Trim(base, "-")
+	if base == "" {
+		base = "object"
+	}
+	name := base
+	for i := 2; ; i++ {
+		if _, ok := g.usedNames[name]; !ok {
+			break
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	g.usedNames[name] = struct{}{}
+	return name
+}
+
+// quoteGBNFLiteral turns a string into a GBNF literal, e.g. `"yes"` => `"\"yes\""`
+func quoteGBNFLiteral(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + replacer.Replace(s) + `"`
+}
@@ -0,0 +1,155 @@
+package domain
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type testGrammarAnswer struct {
+	Answer string  `json:"answer"`
+	Score  float64 `json:"score"`
+	Count  uint    `json:"count"`
+	IsSure bool
+}
+
+type testGrammarEnums struct {
+	Mood   string  `json:"mood" enum:"happy, sad"`
+	Level  int     `json:"level" enum:"1,2,3"`
+	Choice *string `json:"choice" enum:"yes,no"`
+}
+
+type testGrammarPointers struct {
+	Optional *int      `json:"optional"`
+	When     time.Time `json:"when"`
+	Any      any       `json:"any"`
+	Data     []byte    `json:"data"`
+}
+
+type testGrammarBase struct {
+	ID string `json:"id"`
+}
+
+type testGrammarEmbedded struct {
+	testGrammarBase
+	Name       string `json:"name"`
+	unexported string
+	Ignored    string `json:"-"`
+}
+
+type testGrammarNode struct {
+	Value    int                `json:"value"`
+	Children []*testGrammarNode `json:"children"`
+}
+
+type testGrammarMaps struct {
+	Scores map[string]float64 `json:"scores"`
+	Tags   []string           `json:"tags"`
+}
+
+func TestGenerateJSONGrammar(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         any
+		expectedRules string // without jsonGrammarCommonRules
+	}{
+		{
+			name:  "struct",
+			value: &testGrammarAnswer{},
+			expectedRules: `root ::= testgrammaranswer
+testgrammaranswer ::= "{" ws "\"answer\"" ws ":" ws string "," ws "\"score\"" ws ":" ws number "," ws "\"count\"" ws ":" ws unsigned "," ws "\"IsSure\"" ws ":" ws boolean "}" ws
+`,
+		},
+		{
+			name:  "enum",
+			value: &testGrammarEnums{},
+			expectedRules: `root ::= testgrammarenums
+testgrammarenums ::= "{" ws "\"mood\"" ws ":" ws ("\"happy\"" | "\"sad\"") ws "," ws "\"level\"" ws ":" ws ("1" | "2" | "3") ws "," ws "\"choice\"" ws ":" ws (("\"yes\"" | "\"no\"") ws | "null" ws) "}" ws
+`,
+		},
+		{
+			name:  "pointer, marshaler, interface and bytes",
+			value: testGrammarPointers{},
+			expectedRules: `root ::= testgrammarpointers
+testgrammarpointers ::= "{" ws "\"optional\"" ws ":" ws (integer | "null" ws) "," ws "\"when\"" ws ":" ws value "," ws "\"any\"" ws ":" ws value "," ws "\"data\"" ws ":" ws string "}" ws
+`,
+		},
+		{
+			name:  "embedded",
+			value: &testGrammarEmbedded{},
+			expectedRules: `root ::= testgrammarembedded
+testgrammarembedded ::= "{" ws "\"id\"" ws ":" ws string "," ws "\"name\"" ws ":" ws string "}" ws
+`,
+		},
+		{
+			name:  "recursive",
+			value: &testGrammarNode{},
+			expectedRules: `root ::= testgrammarnode
+testgrammarnode ::= "{" ws "\"value\"" ws ":" ws integer "," ws "\"children\"" ws ":" ws ("[" ws ( (testgrammarnode | "null" ws) ("," ws (testgrammarnode | "null" ws))* )? "]" ws) "}" ws
+`,
+		},
+		{
+			name:  "map",
+			value: &testGrammarMaps{},
+			expectedRules: `root ::= testgrammarmaps
+testgrammarmaps ::= "{" ws "\"scores\"" ws ":" ws ("{" ws ( string ":" ws number ("," ws string ":" ws number)* )? "}" ws) "," ws "\"tags\"" ws ":" ws ("[" ws ( string ("," ws string)* )? "]" ws) "}" ws
+`,
+		},
+		{
+			name:  "anonymous struct",
+			value: &struct{ Value string }{},
+			expectedRules: `root ::= object-2
+object-2 ::= "{" ws "\"Value\"" ws ":" ws string "}" ws
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			grammar, err := GenerateJSONGrammar(test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(grammar, jsonGrammarCommonRules) {
+				t.Fatalf("expected the common rules at the end, got:\n%s", grammar)
+			}
+			rules := strings.TrimSuffix(grammar, jsonGrammarCommonRules)
+			if rules != test.expectedRules {
+				t.Errorf("expected:\n%s\ngot:\n%s", test.expectedRules, rules)
+			}
+		})
+	}
+}
+
+func TestGenerateJSONGrammarErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       any
+		expectedErr string
+	}{
+		{name: "nil", value: nil, expectedErr: "can't generate a JSON grammar for nil"},
+		{name: "map keys", value: map[int]string{}, expectedErr: "can't generate a JSON grammar for map keys of type int"},
+		{name: "unsupported type", value: make(chan int), expectedErr: "can't generate a JSON grammar for type chan int"},
+		{
+			name: "enum of floats",
+			value: &struct {
+				Value float64 `enum:"1"`
+			}{},
+			expectedErr: "field Value: enums are only supported for strings and integers, not float64",
+		},
+		{
+			name: "malformed integer enum",
+			value: &struct {
+				Value int `enum:"one"`
+			}{},
+			expectedErr: "field Value: malformed enum value \"one\"",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := GenerateJSONGrammar(test.value)
+			if err == nil || !strings.HasPrefix(err.Error(), test.expectedErr) {
+				t.Errorf("expected an error starting with %q, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package domain
+
+// KnowledgeChunk a piece of a document from the knowledge base (see cmd/ingest)
+type KnowledgeChunk struct {
+	ID string
+	// Source the path of the document the chunk comes from (used for citations)
+	Source string
+	// Index the position of the chunk in the document
+	Index          int
+	Text           string
+	Embedding      Embedding
+	EmbeddingModel string
+}
+
+type KnowledgeFilter struct {
+	Embeddings []Embedding
+	// EmbeddingModel chunks embedded with another model are ignored (see EmbeddingFilter.EmbeddingModel)
+	EmbeddingModel      string
+	TopCount            int
+	SimilarityThreshold float64
+}
+
+// KnowledgeRepository the knowledge base is kept separately from the memory, as it's not part of what the AI
+// experienced: it's loaded in bulk, it's shared by all rooms, and it's replaced as a whole when a document changes.
+type KnowledgeRepository interface {
+	NextID() string
+	// Store replaces all the chunks of the same source(s)
+	Store(chunks []*KnowledgeChunk) error
+	RemoveBySource(source string) error
+	// FindByEmbeddings finds the most similar chunks, the most similar first
+	FindByEmbeddings(filter KnowledgeFilter) ([]*KnowledgeChunk, error)
+	ListSources() ([]string, error)
+}
@@ -1,5 +1,10 @@
 package domain
 
+import "errors"
+
+// ErrLanguageModelTimeout the model didn't finish in time; what has been generated so far is returned along with it
+var ErrLanguageModelTimeout = errors.New("the language model didn't finish in time")
+
 // LanguageModel a generic interface for a large language model (LLM).
 type LanguageModel interface {
 	// Name the name of the model. Useful for debugging.
@@ -7,11 +12,16 @@ type LanguageModel interface {
 	// ResponseModes response modes supported by the model. Some models are not good at JSON or roleplay, so we want LanguageModelSelector
 	// to take that into consideration.
 	ResponseModes() []ResponseMode
-	// Complete completes the given prompt by using the underlying LLM (large language model).
+	// Complete completes the given prompt by using the underlying LLM (large language model). If the model doesn't finish
+	// in time, the partial completion is returned with an error which wraps ErrLanguageModelTimeout.
 	Complete(prompt string, options CompleteOptions) (string, error)
 	// PromptFormatter the prompt formatter associated with this language model. Different language models assume
 	// different formatting rules and can be quite sensitive to slight variations.
 	PromptFormatter() PromptFormatter
 	// ResponseCleaner cleans the response by fixing known issues specific to the current model
 	ResponseCleaner() ResponseCleaner
+	// ContextSize how many tokens the model can process at once (the prompt and the response). 0 if unknown.
+	ContextSize() int
+	// Tokenizer counts tokens the way the model does, to fit prompts into ContextSize()
+	Tokenizer() Tokenizer
 }
@@ -0,0 +1,68 @@
+package domain
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"kgeyst.com/sveta/pkg/common"
+)
+
+type languageModelHealthState struct {
+	consecutiveFailureCount int
+	unhealthyUntil          time.Time
+}
+
+// LanguageModelHealthTracker tracks failures of language models (errors, timeouts, empty responses) so that models
+// which keep failing are temporarily skipped by selectors (see LanguageModelSelector). It's thread-safe and is
+// supposed to be shared by all selectors, as a model is the same regardless of who uses it.
+type LanguageModelHealthTracker struct {
+	mutex            sync.Mutex
+	states           map[string]*languageModelHealthState
+	failureThreshold int
+	cooldown         time.Duration
+	logger           common.Logger
+}
+
+func NewLanguageModelHealthTracker(config *common.Config, logger common.Logger) *LanguageModelHealthTracker {
+	return &LanguageModelHealthTracker{
+		states:           make(map[string]*languageModelHealthState),
+		failureThreshold: config.GetIntOrDefault(ConfigKeyLanguageModelFailureThreshold, 3),
+		cooldown:         config.GetDurationOrDefault(ConfigKeyLanguageModelFailureCooldown, time.Minute),
+		logger:           logger,
+	}
+}
+
+// IsHealthy returns false if the model has failed too many times in a row and the cooldown hasn't passed yet
+func (h *LanguageModelHealthTracker) IsHealthy(languageModel LanguageModel) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	state, ok := h.states[languageModel.Name()]
+	if !ok {
+		return true
+	}
+	return !time.Now().Before(state.unhealthyUntil)
+}
+
+func (h *LanguageModelHealthTracker) ReportSuccess(languageModel LanguageModel) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.states, languageModel.Name())
+}
+
+// ReportFailure once the model fails ConfigKeyLanguageModelFailureThreshold times in a row, it's skipped for
+// ConfigKeyLanguageModelFailureCooldown. If it fails again after the cooldown, it's skipped again.
+func (h *LanguageModelHealthTracker) ReportFailure(languageModel LanguageModel) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	state, ok := h.states[languageModel.Name()]
+	if !ok {
+		state = &languageModelHealthState{}
+		h.states[languageModel.Name()] = state
+	}
+	state.consecutiveFailureCount++
+	if h.failureThreshold > 0 && state.consecutiveFailureCount >= h.failureThreshold {
+		state.unhealthyUntil = time.Now().Add(h.cooldown)
+		h.logger.Log(fmt.Sprintf("language model \"%s\" failed %d times in a row, skipping it for %s\n", languageModel.Name(), state.consecutiveFailureCount, h.cooldown))
+	}
+}
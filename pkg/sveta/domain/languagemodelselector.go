@@ -1,33 +1,192 @@
 package domain
 
-// LanguageModelSelector makes sure the right language model is chosen for a given scenario.
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrNoLanguageModel = errors.New("no language model supports the response mode")
+
+// LanguageModelSelectionStrategy how a selector chooses among the models which support the response mode
+type LanguageModelSelectionStrategy int
+
+const (
+	// LanguageModelSelectionStrategyRoundRobin the models take turns
+	LanguageModelSelectionStrategyRoundRobin = LanguageModelSelectionStrategy(iota)
+	// LanguageModelSelectionStrategyWeighted the models take turns in proportion to their weights
+	// (see LanguageModelSelectorOptions.Weights)
+	LanguageModelSelectionStrategyWeighted
+	// LanguageModelSelectionStrategyPriority the first healthy model in the list is always chosen; the rest are fallbacks
+	LanguageModelSelectionStrategyPriority
+)
+
+var languageModelSelectionStrategyNames = map[LanguageModelSelectionStrategy]string{
+	LanguageModelSelectionStrategyRoundRobin: "roundRobin",
+	LanguageModelSelectionStrategyWeighted:   "weighted",
+	LanguageModelSelectionStrategyPriority:   "priority",
+}
+
+func (s LanguageModelSelectionStrategy) String() string {
+	name, ok := languageModelSelectionStrategyNames[s]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+// ParseLanguageModelSelectionStrategy returns false if the name is unknown (see LanguageModelSelectionStrategy.String())
+func ParseLanguageModelSelectionStrategy(name string) (LanguageModelSelectionStrategy, bool) {
+	for strategy, strategyName := range languageModelSelectionStrategyNames {
+		if strategyName == name {
+			return strategy, true
+		}
+	}
+	return LanguageModelSelectionStrategyRoundRobin, false
+}
+
+var DefaultLanguageModelSelectorOptions = LanguageModelSelectorOptions{}
+
+type LanguageModelSelectorOptions struct {
+	Strategy LanguageModelSelectionStrategy
+	// Weights the weights of the language models, in the same order (for LanguageModelSelectionStrategyWeighted).
+	// Missing or non-positive weights are considered 1.
+	Weights []int
+	// HealthTracker if nil, the selector doesn't skip failing models
+	HealthTracker *LanguageModelHealthTracker
+}
+
+func (o LanguageModelSelectorOptions) WithStrategy(value LanguageModelSelectionStrategy) LanguageModelSelectorOptions {
+	o.Strategy = value
+	return o
+}
+
+func (o LanguageModelSelectorOptions) WithWeights(value []int) LanguageModelSelectorOptions {
+	o.Weights = value
+	return o
+}
+
+func (o LanguageModelSelectorOptions) WithHealthTracker(value *LanguageModelHealthTracker) LanguageModelSelectorOptions {
+	o.HealthTracker = value
+	return o
+}
+
+type weightedLanguageModel struct {
+	languageModel LanguageModel
+	weight        int
+	// currentWeight for the smooth weighted round-robin (same as in nginx)
+	currentWeight int
+}
+
+// LanguageModelSelector makes sure the right language model is chosen for a given scenario. It's thread-safe.
 type LanguageModelSelector struct {
-	responseModesToLanguageModels       map[ResponseMode][]LanguageModel
+	mutex                         sync.Mutex
+	strategy                      LanguageModelSelectionStrategy
+	healthTracker                 *LanguageModelHealthTracker
+	responseModesToLanguageModels map[ResponseMode][]*weightedLanguageModel
+	// responseModesToLanguageModelIndices for the round-robin
 	responseModesToLanguageModelIndices map[ResponseMode]int
 }
 
-func NewLanguageModelSelector(languageModels []LanguageModel) *LanguageModelSelector {
-	modesToLanguageModels := make(map[ResponseMode][]LanguageModel)
-	modesToLanguageModelIndices := make(map[ResponseMode]int)
-	for _, languageModel := range languageModels {
-		for _, responseModes := range languageModel.ResponseModes() {
-			modesToLanguageModels[responseModes] = append(modesToLanguageModels[responseModes], languageModel)
+func NewLanguageModelSelector(languageModels []LanguageModel, options LanguageModelSelectorOptions) *LanguageModelSelector {
+	modesToLanguageModels := make(map[ResponseMode][]*weightedLanguageModel)
+	for i, languageModel := range languageModels {
+		weight := 1
+		if i < len(options.Weights) && options.Weights[i] > 0 {
+			weight = options.Weights[i]
+		}
+		for _, responseMode := range languageModel.ResponseModes() {
+			modesToLanguageModels[responseMode] = append(modesToLanguageModels[responseMode], &weightedLanguageModel{
+				languageModel: languageModel,
+				weight:        weight,
+			})
 		}
-	}
-	for _, responseMode := range ResponseModes {
-		modesToLanguageModelIndices[responseMode] = 0
 	}
 	return &LanguageModelSelector{
+		strategy:                            options.Strategy,
+		healthTracker:                       options.HealthTracker,
 		responseModesToLanguageModels:       modesToLanguageModels,
-		responseModesToLanguageModelIndices: modesToLanguageModelIndices,
+		responseModesToLanguageModelIndices: make(map[ResponseMode]int),
+	}
+}
+
+// SelectWithFallbacks returns all the language models which support the response mode: the one chosen by the strategy
+// goes first, then the other healthy models (in the declared order) to fail over to, then the unhealthy ones as the
+// last resort. Returns ErrNoLanguageModel if no model supports the response mode.
+func (l *LanguageModelSelector) SelectWithFallbacks(responseMode ResponseMode) ([]LanguageModel, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	candidates := l.responseModesToLanguageModels[responseMode]
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w \"%s\"", ErrNoLanguageModel, responseMode)
+	}
+	var healthy, unhealthy []*weightedLanguageModel
+	for _, candidate := range candidates {
+		if l.healthTracker == nil || l.healthTracker.IsHealthy(candidate.languageModel) {
+			healthy = append(healthy, candidate)
+		} else {
+			unhealthy = append(unhealthy, candidate)
+		}
+	}
+	result := make([]LanguageModel, 0, len(candidates))
+	if len(healthy) > 0 {
+		chosen := l.choose(responseMode, candidates, healthy)
+		result = append(result, chosen.languageModel)
+		for _, candidate := range healthy {
+			if candidate != chosen {
+				result = append(result, candidate.languageModel)
+			}
+		}
+	}
+	for _, candidate := range unhealthy {
+		result = append(result, candidate.languageModel)
+	}
+	return result, nil
+}
+
+// ReportSuccess see LanguageModelHealthTracker
+func (l *LanguageModelSelector) ReportSuccess(languageModel LanguageModel) {
+	if l.healthTracker != nil {
+		l.healthTracker.ReportSuccess(languageModel)
 	}
 }
 
-// Select given a list of memories and the response mode, finds the language model most suitable for the task.
-// TODO not thread-safe
-func (l *LanguageModelSelector) Select(responseMode ResponseMode) LanguageModel {
-	languageModelIndex := l.responseModesToLanguageModelIndices[responseMode]
-	languageModel := l.responseModesToLanguageModels[responseMode][languageModelIndex]
-	l.responseModesToLanguageModelIndices[responseMode] = (languageModelIndex + 1) % (len(l.responseModesToLanguageModels[responseMode]))
-	return languageModel
+// ReportFailure see LanguageModelHealthTracker
+func (l *LanguageModelSelector) ReportFailure(languageModel LanguageModel) {
+	if l.healthTracker != nil {
+		l.healthTracker.ReportFailure(languageModel)
+	}
+}
+
+// choose picks one of the healthy models (which can't be empty) according to the strategy
+func (l *LanguageModelSelector) choose(responseMode ResponseMode, candidates, healthy []*weightedLanguageModel) *weightedLanguageModel {
+	switch l.strategy {
+	case LanguageModelSelectionStrategyPriority:
+		return healthy[0]
+	case LanguageModelSelectionStrategyWeighted:
+		totalWeight := 0
+		var chosen *weightedLanguageModel
+		for _, candidate := range healthy {
+			candidate.currentWeight += candidate.weight
+			totalWeight += candidate.weight
+			if chosen == nil || candidate.currentWeight > chosen.currentWeight {
+				chosen = candidate
+			}
+		}
+		chosen.currentWeight -= totalWeight
+		return chosen
+	}
+	// Round-robin over all the models so that the order stays stable when a model becomes unhealthy for a while;
+	// unhealthy models are just passed over.
+	index := l.responseModesToLanguageModelIndices[responseMode]
+	for i := 0; i < len(candidates); i++ {
+		candidate := candidates[(index+i)%len(candidates)]
+		for _, healthyCandidate := range healthy {
+			if healthyCandidate == candidate {
+				l.responseModesToLanguageModelIndices[responseMode] = (index + i + 1) % len(candidates)
+				return candidate
+			}
+		}
+	}
+	return healthy[0]
 }
@@ -10,17 +10,84 @@ type MemoryType int
 const (
 	// MemoryTypeDialog an utterance in the chat
 	MemoryTypeDialog = MemoryType(iota)
+	// MemoryTypeFact a fact extracted from the chat history
+	MemoryTypeFact
+	// MemoryTypeNews a news item
+	MemoryTypeNews
+	// MemoryTypeBio a fact from the AI agent's biography
+	MemoryTypeBio
+	// MemoryTypeSearchResult a search result (for example, a summary of a Wikipedia article)
+	MemoryTypeSearchResult
+	// MemoryTypeSummary a summary of a part of the chat history
+	MemoryTypeSummary
+	// MemoryTypeDocument an excerpt from a document of the knowledge base (see KnowledgeRepository)
+	MemoryTypeDocument
 )
 
+var memoryTypeNames = map[MemoryType]string{
+	MemoryTypeDialog:       "dialog",
+	MemoryTypeFact:         "fact",
+	MemoryTypeNews:         "news",
+	MemoryTypeBio:          "bio",
+	MemoryTypeSearchResult: "searchResult",
+	MemoryTypeSummary:      "summary",
+	MemoryTypeDocument:     "document",
+}
+
+// KnowledgeMemoryTypes memory types which are not part of the dialog itself but rather enrich the context of the dialog
+var KnowledgeMemoryTypes = []MemoryType{
+	MemoryTypeFact,
+	MemoryTypeNews,
+	MemoryTypeBio,
+	MemoryTypeSearchResult,
+	MemoryTypeSummary,
+	MemoryTypeDocument,
+}
+
+func (m MemoryType) String() string {
+	name, ok := memoryTypeNames[m]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+// ParseMemoryType returns false if the name is unknown (see MemoryType.String())
+func ParseMemoryType(name string) (MemoryType, bool) {
+	for memoryType, memoryTypeName := range memoryTypeNames {
+		if memoryTypeName == name {
+			return memoryType, true
+		}
+	}
+	return MemoryTypeDialog, false
+}
+
 type Memory struct {
-	ID          string
-	Type        MemoryType
-	Who         string
-	When        time.Time
-	What        string
-	Where       string
-	Embedding   *Embedding // nullable
-	IsTransient bool
+	ID        string
+	Type      MemoryType
+	Who       string
+	When      time.Time
+	What      string
+	Where     string
+	Embedding *Embedding // nullable
+	// EmbeddingModel the name of the model which produced the embedding (see Embedder.ModelName())
+	EmbeddingModel string
+	IsTransient    bool
+	// Importance how poignant the memory is, from 0.0 (mundane) to 1.0 (extremely important). It's assigned
+	// asynchronously after the memory is stored, so it's 0.0 for memories which haven't been rated yet.
+	Importance float64
+	// AccessCount how many times the memory was recalled from the episodic memory
+	AccessCount int
+	// SourceIDs the memories this memory was derived from (for example, the dialog lines a digest summarizes)
+	SourceIDs []string
+	// IsArchived archived memories are kept in the store but are never recalled (for example, after they were
+	// consolidated into a digest, see MemoryConsolidator)
+	IsArchived bool
+	// ExpiresAt expired memories are no longer recalled and are eventually evicted (see MemoryRepository.RemoveExpired(..));
+	// zero if the memory never expires
+	ExpiresAt time.Time
+	// Source where the memory came from ("news", "wiki" etc.), empty for the chat history
+	Source string
 }
 
 type MemoryFilter struct {
@@ -30,16 +97,36 @@ type MemoryFilter struct {
 	What         string
 	LatestCount  int
 	NotOlderThan *time.Time
+	NotNewerThan *time.Time
+	// WithoutEmbedding only memories which have no embedding (for example, because the embedder was unavailable)
+	WithoutEmbedding bool
+	// IncludeArchived archived memories are normally never found (see Memory.IsArchived)
+	IncludeArchived bool
 }
 
 type EmbeddingFilter struct {
 	Types               []MemoryType
 	Where               string
+	NotOlderThan        *time.Time
+	NotNewerThan        *time.Time
 	Embeddings          []Embedding
 	TopCount            int
 	SurroundingCount    int
 	ExcludedIDs         []string
 	SimilarityThreshold float64
+	// Scorer ranks the found memories; if nil, the memories are ranked purely by similarity
+	Scorer *MemoryScorer
+	// Query the text of the query for lexical search which complements the embedding-based search
+	Query string
+	// LexicalWeight how much the lexical ranking contributes to the final ranking, from 0.0 (lexical search disabled)
+	// to 1.0 (only the lexical ranking matters)
+	LexicalWeight float64
+	// EmbeddingModel the model which produced Embeddings. Memories embedded with another model (or of another dimension)
+	// are excluded from the embedding-based ranking, as their embeddings can't be compared (see cmd/reembed).
+	EmbeddingModel string
+	// MatchedIDs if not nil, receives the IDs of the memories which matched the query, as opposed to the surrounding
+	// memories which are returned only as context (see SurroundingCount)
+	MatchedIDs map[string]bool
 }
 
 func NewMemory(id string, typ MemoryType, who string, when time.Time, what string, where string, embedding *Embedding) *Memory {
@@ -54,6 +141,35 @@ func NewMemory(id string, typ MemoryType, who string, when time.Time, what strin
 	}
 }
 
+// Clone memories found in the repository are shared, so they must never be changed in place: a changed copy is stored
+// instead (see MemoryRepository.Modify(..))
+func (m *Memory) Clone() *Memory {
+	clone := *m
+	if m.SourceIDs != nil {
+		clone.SourceIDs = append([]string(nil), m.SourceIDs...)
+	}
+	return &clone
+}
+
+// MakeTransient transient memories are never persisted; they're evicted after `ttl` (if it's positive) and can be
+// reloaded from their source afterwards.
+func (m *Memory) MakeTransient(source string, ttl time.Duration) {
+	m.IsTransient = true
+	m.Source = source
+	if ttl > 0 {
+		m.ExpiresAt = m.When.Add(ttl)
+	}
+}
+
+func (m *Memory) IsExpired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// isDecaying only memories of the chat history fade with time; knowledge (bio facts, news etc.) is timeless
+func (m *Memory) isDecaying() bool {
+	return m.Type == MemoryTypeDialog || m.Type == MemoryTypeSummary
+}
+
 func FilterMemoriesByTypes(memories []*Memory, types []MemoryType) []*Memory {
 	result := make([]*Memory, 0, len(memories))
 	for _, memory := range memories {
@@ -121,3 +237,19 @@ func UniqueMemories(memories []*Memory) []*Memory {
 func LastMemory(memories []*Memory) *Memory {
 	return memories[len(memories)-1]
 }
+
+// LimitMemoriesByTypeQuotas keeps at most N first memories of each type, as specified by `quotas` (type => N).
+// Memories of types which are not found in `quotas` are kept as is.
+func LimitMemoriesByTypeQuotas(memories []*Memory, quotas map[MemoryType]int) []*Memory {
+	counts := make(map[MemoryType]int)
+	result := make([]*Memory, 0, len(memories))
+	for _, memory := range memories {
+		quota, ok := quotas[memory.Type]
+		if ok && counts[memory.Type] >= quota {
+			continue
+		}
+		counts[memory.Type]++
+		result = append(result, memory)
+	}
+	return result
+}
@@ -0,0 +1,227 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"kgeyst.com/sveta/pkg/common"
+)
+
+var errEmptyDigest = errors.New("the digest is empty")
+
+// MemoryConsolidator periodically condenses old dialog memories into episodic digests ("On May 3rd John and Sveta
+// discussed his trip to Riga..."), so that recall surfaces what a conversation was about instead of raw fragments of
+// small talk. Dialog lines are clustered per room by time proximity and embedding similarity; each cluster is
+// replaced with a digest (of type MemoryTypeSummary) which links to its source memories, and the originals are
+// archived so that they're no longer recalled.
+type MemoryConsolidator struct {
+	memoryRepository    MemoryRepository
+	memoryFactory       MemoryFactory
+	responseService     *ResponseService
+	logger              common.Logger
+	minAge              time.Duration
+	maxTimeGap          time.Duration
+	similarityThreshold float64
+	minClusterSize      int
+	maxClusterSize      int
+}
+
+func NewMemoryConsolidator(
+	memoryRepository MemoryRepository,
+	memoryFactory MemoryFactory,
+	responseService *ResponseService,
+	config *common.Config,
+	logger common.Logger,
+) *MemoryConsolidator {
+	return &MemoryConsolidator{
+		memoryRepository:    memoryRepository,
+		memoryFactory:       memoryFactory,
+		responseService:     responseService,
+		logger:              logger,
+		minAge:              config.GetDurationOrDefault(ConfigKeyConsolidationMinAge, 7*24*time.Hour),
+		maxTimeGap:          config.GetDurationOrDefault(ConfigKeyConsolidationMaxTimeGap, 30*time.Minute),
+		similarityThreshold: config.GetFloatOrDefault(ConfigKeyConsolidationSimilarityThreshold, 0.5),
+		minClusterSize:      config.GetIntOrDefault(ConfigKeyConsolidationMinClusterSize, 4),
+		maxClusterSize:      config.GetIntOrDefault(ConfigKeyConsolidationMaxClusterSize, 20),
+	}
+}
+
+// Consolidate is meant to be run in the background (see common.JobQueue.Schedule(..))
+func (c *MemoryConsolidator) Consolidate() error {
+	notNewerThan := time.Now().Add(-c.minAge)
+	memories, err := c.memoryRepository.Find(MemoryFilter{
+		Types:        []MemoryType{MemoryTypeDialog},
+		LatestCount:  -1,
+		NotNewerThan: &notNewerThan,
+	})
+	if err != nil {
+		return err
+	}
+	memories, err = c.archiveConsolidatedMemories(memories)
+	if err != nil {
+		return err
+	}
+	clusterCount := 0
+	failedClusterCount := 0
+	for _, roomMemories := range c.groupByRoom(memories) {
+		for _, cluster := range c.cluster(roomMemories) {
+			if len(cluster) < c.minClusterSize {
+				continue // too little to summarize; such memories are left as is
+			}
+			// A failed cluster is retried on the next run, it mustn't stop the other clusters from being consolidated.
+			err = c.consolidateCluster(cluster)
+			if err != nil {
+				c.logger.Log(fmt.Sprintf("failed to consolidate a cluster of memories in room \"%s\": %s\n", cluster[0].Where, err))
+				failedClusterCount++
+				continue
+			}
+			clusterCount++
+		}
+	}
+	if clusterCount > 0 || failedClusterCount > 0 {
+		c.logger.Log(fmt.Sprintf("Consolidated %d clusters of memories (%d failed)\n", clusterCount, failedClusterCount))
+	}
+	return nil
+}
+
+// archiveConsolidatedMemories a previous run may have failed after storing a digest but before archiving all of its
+// source memories; such memories are archived now rather than summarized into a duplicate digest. Returns the memories
+// which are yet to be consolidated.
+func (c *MemoryConsolidator) archiveConsolidatedMemories(memories []*Memory) ([]*Memory, error) {
+	digests, err := c.memoryRepository.Find(MemoryFilter{
+		Types:       []MemoryType{MemoryTypeSummary},
+		LatestCount: -1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	consolidatedIDs := make(map[string]bool)
+	for _, digest := range digests {
+		for _, sourceID := range digest.SourceIDs {
+			consolidatedIDs[sourceID] = true
+		}
+	}
+	var result []*Memory
+	var consolidatedMemories []*Memory
+	for _, memory := range memories {
+		if consolidatedIDs[memory.ID] {
+			consolidatedMemories = append(consolidatedMemories, memory)
+		} else {
+			result = append(result, memory)
+		}
+	}
+	err = c.archive(consolidatedMemories)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *MemoryConsolidator) groupByRoom(memories []*Memory) [][]*Memory {
+	var result [][]*Memory
+	roomIndices := make(map[string]int)
+	for _, memory := range memories {
+		index, ok := roomIndices[memory.Where]
+		if !ok {
+			index = len(result)
+			roomIndices[memory.Where] = index
+			result = append(result, nil)
+		}
+		result[index] = append(result[index], memory)
+	}
+	return result
+}
+
+// cluster memories must be sorted by time. A memory joins the current cluster if it's close enough in time to the
+// previous memory and is similar enough to any memory in the cluster, otherwise a new cluster is started.
+func (c *MemoryConsolidator) cluster(memories []*Memory) [][]*Memory {
+	var clusters [][]*Memory
+	var cluster []*Memory
+	var clusterEmbeddings []Embedding
+	for _, memory := range memories {
+		if len(cluster) > 0 {
+			previousMemory := LastMemory(cluster)
+			isCloseInTime := memory.When.Sub(previousMemory.When) <= c.maxTimeGap
+			// Short lines ("ok", "lol") often have no meaningful embedding, so they're joined by time proximity alone.
+			isSimilar := memory.Embedding == nil || len(clusterEmbeddings) == 0 ||
+				memory.Embedding.GetBestSimilarityTo(clusterEmbeddings) >= c.similarityThreshold
+			if !isCloseInTime || !isSimilar || len(cluster) >= c.maxClusterSize {
+				clusters = append(clusters, cluster)
+				cluster = nil
+				clusterEmbeddings = nil
+			}
+		}
+		cluster = append(cluster, memory)
+		if memory.Embedding != nil {
+			clusterEmbeddings = append(clusterEmbeddings, *memory.Embedding)
+		}
+	}
+	if len(cluster) > 0 {
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+func (c *MemoryConsolidator) consolidateCluster(cluster []*Memory) error {
+	var output struct {
+		Digest string `json:"digest"`
+	}
+	firstMemory := cluster[0]
+	err := c.getConsolidatorResponseService().RespondToQueryWithJSON(
+		fmt.Sprintf(
+			"%s\nWrite a short digest of the chat history above in the past tense, in 1-3 sentences. Mention who took part and what was discussed. Start with \"On %s\".",
+			c.formatMemories(cluster),
+			firstMemory.When.Format("January 2"),
+		),
+		&output,
+	)
+	if err != nil {
+		return err
+	}
+	if output.Digest == "" {
+		return errEmptyDigest
+	}
+	digestMemory := c.memoryFactory.NewMemory(MemoryTypeSummary, "", output.Digest, firstMemory.Where)
+	digestMemory.When = firstMemory.When // so that the digest is recalled by time and decays like the original dialog
+	digestMemory.SourceIDs = GetMemoryIDs(cluster)
+	err = c.memoryRepository.Store(digestMemory)
+	if err != nil {
+		return err
+	}
+	// If archiving fails partway through, the rest is archived on the next run (see archiveConsolidatedMemories(..)).
+	return c.archive(cluster)
+}
+
+func (c *MemoryConsolidator) archive(memories []*Memory) error {
+	// The memories can be recalled concurrently, so they're not changed in place.
+	for _, memory := range memories {
+		_, err := c.memoryRepository.Modify(memory.ID, func(memory *Memory) {
+			memory.IsArchived = true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *MemoryConsolidator) formatMemories(memories []*Memory) string {
+	var buf strings.Builder
+	buf.WriteString("Chat history: ```\n")
+	for _, memory := range memories {
+		buf.WriteString(fmt.Sprintf("%s: %s\n\n", memory.Who, memory.What))
+	}
+	buf.WriteString("```\n\n")
+	return buf.String()
+}
+
+func (c *MemoryConsolidator) getConsolidatorResponseService() *ResponseService {
+	consolidatorAIContext := NewAIContext(
+		"DigestLLM",
+		"You're DigestLLM, an intelligent assistant that condenses chat history into short digests of what was discussed.",
+		"",
+	)
+	return c.responseService.WithAIContext(consolidatorAIContext)
+}
@@ -2,4 +2,6 @@ package domain
 
 type MemoryFactory interface {
 	NewMemory(typ MemoryType, who string, what string, where string) *Memory
+	// NewMemories same as NewMemory(..), but for many memories at once, which embeds them in a single batch
+	NewMemories(typ MemoryType, who string, whats []string, where string) []*Memory
 }
@@ -0,0 +1,129 @@
+package domain
+
+import (
+	"fmt"
+
+	"kgeyst.com/sveta/pkg/common"
+)
+
+// MemoryReembedder embeds memories which were stored without embeddings because the embedder was unavailable at the
+// time (crashed, hung etc.) Without embeddings, such memories can only be recalled by lexical search.
+type MemoryReembedder struct {
+	memoryRepository MemoryRepository
+	embedder         Embedder
+	logger           common.Logger
+	batchSize        int
+}
+
+func NewMemoryReembedder(
+	memoryRepository MemoryRepository,
+	embedder Embedder,
+	config *common.Config,
+	logger common.Logger,
+) *MemoryReembedder {
+	return &MemoryReembedder{
+		memoryRepository: memoryRepository,
+		embedder:         embedder,
+		logger:           logger,
+		batchSize:        max(config.GetIntOrDefault(ConfigKeyReembedBatchSize, 32), 1),
+	}
+}
+
+// Reembed is meant to be run in the background (see common.JobQueue.Schedule(..)) Stops at the first error (most
+// likely, the embedder is still unavailable), the rest of the memories are re-embedded on the next run.
+func (r *MemoryReembedder) Reembed() error {
+	memories, err := r.memoryRepository.Find(MemoryFilter{
+		LatestCount:      -1,
+		WithoutEmbedding: true,
+	})
+	if err != nil {
+		return err
+	}
+	reembeddedCount, err := r.reembed(memories, nil)
+	if reembeddedCount > 0 {
+		r.logger.Log(fmt.Sprintf("Re-embedded %d memories\n", reembeddedCount))
+	}
+	return err
+}
+
+// FindOutdated finds memories (including archived ones) which weren't embedded with the current embedding model, for
+// example, after the model was changed in the config.
+func (r *MemoryReembedder) FindOutdated() ([]*Memory, error) {
+	memories, err := r.memoryRepository.Find(MemoryFilter{
+		LatestCount:     -1,
+		IncludeArchived: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	modelName := r.embedder.ModelName()
+	dimensionCount := r.embedder.DimensionCount()
+	var result []*Memory
+	for _, memory := range memories {
+		if memory.IsTransient || memory.What == "" { // transient memories aren't persisted and will expire anyway
+			continue
+		}
+		isOutdated := memory.Embedding == nil ||
+			memory.EmbeddingModel != modelName ||
+			(dimensionCount > 0 && memory.Embedding.DimensionCount() != dimensionCount)
+		if isOutdated {
+			result = append(result, memory)
+		}
+	}
+	return result, nil
+}
+
+// ReembedOutdated re-embeds all the memories returned by FindOutdated(). Every batch is persisted as soon as it's
+// embedded, so if it's interrupted, it can be simply run again to continue where it stopped. `onProgress` (optional)
+// is called after each batch.
+func (r *MemoryReembedder) ReembedOutdated(onProgress func(doneCount, totalCount int)) error {
+	memories, err := r.FindOutdated()
+	if err != nil {
+		return err
+	}
+	_, err = r.reembed(memories, onProgress)
+	return err
+}
+
+// reembed returns the number of memories which were re-embedded successfully
+func (r *MemoryReembedder) reembed(memories []*Memory, onProgress func(doneCount, totalCount int)) (int, error) {
+	var pendingMemories []*Memory
+	for _, memory := range memories {
+		if memory.What != "" {
+			pendingMemories = append(pendingMemories, memory)
+		}
+	}
+	reembeddedCount := 0
+	for batchStart := 0; batchStart < len(pendingMemories); batchStart += r.batchSize {
+		batch := pendingMemories[batchStart:min(batchStart+r.batchSize, len(pendingMemories))]
+		whats := make([]string, len(batch))
+		for index, memory := range batch {
+			whats[index] = memory.What
+		}
+		embeddings, err := r.embedder.EmbedBatch(whats)
+		if err != nil {
+			return reembeddedCount, err
+		}
+		modelName := r.embedder.ModelName()
+		for index, memory := range batch {
+			if embeddings[index].DimensionCount() == 0 {
+				continue
+			}
+			// The memory is recalled concurrently while the bot is running, so an updated copy replaces it instead
+			// (the latest version, so that concurrent changes of the importance etc. aren't lost).
+			embedding := embeddings[index]
+			_, err = r.memoryRepository.Modify(memory.ID, func(memory *Memory) {
+				memory.Embedding = &embedding
+				memory.EmbeddingModel = modelName
+			})
+			if err != nil {
+				return reembeddedCount, err
+			}
+			reembeddedCount++
+		}
+		if onProgress != nil {
+			onProgress(batchStart+len(batch), len(pendingMemories))
+		}
+	}
+	return reembeddedCount, nil
+}
@@ -1,9 +1,22 @@
 package domain
 
+import "time"
+
 type MemoryRepository interface {
 	NextID() string // should be time-sortable
 	Store(memory *Memory) error
+	// Update replaces the memory with the same ID (for example, after it was re-embedded). The memory must be a copy
+	// (see Memory.Clone()), as the memories found in the repository are shared.
+	Update(memory *Memory) error
+	// Modify applies `modify` to a copy of the memory with the given ID and replaces the memory with the copy, atomically
+	// (for example, to rate the importance of a memory while it can be recalled concurrently). Returns the modified
+	// memory, or nil if there's no such memory.
+	Modify(id string, modify func(memory *Memory)) (*Memory, error)
+	// RecordAccess increments Memory.AccessCount of the memories with the given IDs, in one write to the store
+	RecordAccess(ids []string) error
 	Find(filter MemoryFilter) ([]*Memory, error)
 	FindByEmbeddings(filter EmbeddingFilter) ([]*Memory, error)
 	RemoveAll() error
+	// RemoveExpired evicts memories which expired by `now` (see Memory.ExpiresAt)
+	RemoveExpired(now time.Time) error
 }
@@ -0,0 +1,58 @@
+package domain
+
+import (
+	"math"
+	"time"
+
+	"kgeyst.com/sveta/pkg/common"
+)
+
+// MemoryScorer ranks recalled memories by combining semantic similarity, recency, importance and how often the memory
+// was recalled before, similar to memory streams in "Generative Agents" (Park et al., 2023). Without it, a two-year-old
+// trivial remark can outrank yesterday's important statement only because it happens to be slightly more similar to the query.
+type MemoryScorer struct {
+	SimilarityWeight float64
+	RecencyWeight    float64
+	ImportanceWeight float64
+	AccessWeight     float64
+	// RecencyHalfLife after how much time the recency of a memory decays by half
+	RecencyHalfLife time.Duration
+}
+
+// NewMemoryScorerFromConfig by default, the scorer ranks memories purely by similarity (see ConfigKeyEpisodicMemorySimilarityWeight etc.)
+func NewMemoryScorerFromConfig(config *common.Config) *MemoryScorer {
+	return &MemoryScorer{
+		SimilarityWeight: config.GetFloatOrDefault(ConfigKeyEpisodicMemorySimilarityWeight, 1.0),
+		RecencyWeight:    config.GetFloat(ConfigKeyEpisodicMemoryRecencyWeight),
+		ImportanceWeight: config.GetFloat(ConfigKeyEpisodicMemoryImportanceWeight),
+		AccessWeight:     config.GetFloat(ConfigKeyEpisodicMemoryAccessWeight),
+		RecencyHalfLife:  config.GetDurationOrDefault(ConfigKeyEpisodicMemoryRecencyHalfLife, 7*24*time.Hour),
+	}
+}
+
+// Score the higher the score, the more likely the memory is recalled. `similarity` is the similarity of the memory
+// to the query, as calculated with Embedding.GetSimilarityTo(..)
+func (s *MemoryScorer) Score(memory *Memory, similarity float64, now time.Time) float64 {
+	return s.SimilarityWeight*similarity +
+		s.RecencyWeight*s.getRecency(memory, now) +
+		s.ImportanceWeight*memory.Importance +
+		s.AccessWeight*s.getAccessFrequency(memory)
+}
+
+// getAccessFrequency from 0.0 (never recalled) approaching 1.0 (recalled many times), so that frequently recalled
+// memories couldn't outweigh similarity no matter what
+func (s *MemoryScorer) getAccessFrequency(memory *Memory) float64 {
+	return 1.0 - 1.0/float64(1+memory.AccessCount)
+}
+
+// getRecency exponential decay: 1.0 for a memory which was just formed, 0.5 for a memory which is RecencyHalfLife old, etc.
+func (s *MemoryScorer) getRecency(memory *Memory, now time.Time) float64 {
+	if !memory.isDecaying() || memory.When.IsZero() || s.RecencyHalfLife <= 0 {
+		return 1.0
+	}
+	age := now.Sub(memory.When)
+	if age < 0 {
+		age = 0
+	}
+	return math.Pow(0.5, float64(age)/float64(s.RecencyHalfLife))
+}
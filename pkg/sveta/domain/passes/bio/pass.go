@@ -16,7 +16,8 @@ type pass struct {
 	memoryRepository domain.MemoryRepository
 	memoryFactory    domain.MemoryFactory
 	logger           common.Logger
-	loaded           map[string]bool // where => isLoaded
+	loadedUntil      map[string]time.Time // where => when the loaded bio facts expire
+	memoryTTL        time.Duration
 }
 
 func NewPass(
@@ -24,6 +25,7 @@ func NewPass(
 	bioProvider Provider,
 	memoryRepository domain.MemoryRepository,
 	memoryFactory domain.MemoryFactory,
+	config *common.Config,
 	logger common.Logger,
 ) domain.Pass {
 	return &pass{
@@ -32,7 +34,8 @@ func NewPass(
 		memoryRepository: memoryRepository,
 		memoryFactory:    memoryFactory,
 		logger:           logger,
-		loaded:           make(map[string]bool),
+		loadedUntil:      make(map[string]time.Time),
+		memoryTTL:        config.GetDurationOrDefault("bioMemoryTTL", 24*time.Hour),
 	}
 }
 
@@ -53,9 +56,9 @@ func (p *pass) Apply(context *domain.PassContext, nextPassFunc domain.NextPassFu
 	if inputMemory == nil {
 		return nextPassFunc(context)
 	}
-	if !p.loaded[inputMemory.Where] {
+	if !time.Now().Before(p.loadedUntil[inputMemory.Where]) { // reloaded periodically to pick up changes in the biography
 		p.loadBioFacts(inputMemory.Where)
-		p.loaded[inputMemory.Where] = true
+		p.loadedUntil[inputMemory.Where] = time.Now().Add(p.memoryTTL)
 	}
 	return nextPassFunc(context)
 }
@@ -66,11 +69,9 @@ func (p *pass) loadBioFacts(where string) {
 		p.logger.Log("failed to load bio facts")
 		return
 	}
-	for index, bioFact := range bioFacts {
-		p.logger.Log(fmt.Sprintf("Loading bio fact #%d...\n", index))
-		memory := p.memoryFactory.NewMemory(domain.MemoryTypeDialog, p.aiContext.AgentName, bioFact, where)
-		memory.When = time.Time{}
-		memory.IsTransient = true
+	p.logger.Log(fmt.Sprintf("Loading %d bio facts...\n", len(bioFacts)))
+	for _, memory := range p.memoryFactory.NewMemories(domain.MemoryTypeBio, p.aiContext.AgentName, bioFacts, where) {
+		memory.MakeTransient(bioCapabillity, p.memoryTTL)
 		err = p.memoryRepository.Store(memory)
 		if err != nil {
 			p.logger.Log("failed to store bio facts as memory")
@@ -121,7 +121,7 @@ func (p *pass) generateCode(input string) (string, error) {
 func (p *pass) satifies(input, result string) (bool, error) {
 	var output struct {
 		Reasoning     string `json:"reasoning"`
-		ReturnedValue string `json:"returnedValue"`
+		ReturnedValue string `json:"returnedValue" enum:"yes,no"`
 	}
 	err := p.getEvaluatorResponseService().RespondToQueryWithJSON(
 		fmt.Sprintf("Question or task: \"%s\".\nAnswer: \"%s\".\n\nDoes the answer appear to satisfy the question/task? Provide the reasoning and return only yes or no. Answer yes even if the answer is not entirely accurate.\n", input, result),
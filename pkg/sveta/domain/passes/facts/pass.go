@@ -16,26 +16,39 @@ type pass struct {
 	aiContext             *domain.AIContext
 	memoryRepository      domain.MemoryRepository
 	memoryFactory         domain.MemoryFactory
+	userProfileRepository domain.UserProfileRepository
 	responseService       *domain.ResponseService
 	languageModelJobQueue *common.JobQueue
 	logger                common.Logger
+	defaultVisibility     domain.ProfileVisibility
 }
 
+// NewPass creates a pass which extracts facts from the dialog. Facts about the user are stored in the user's profile
+// instead of the room (see the profile pass), so that they could be recalled in other rooms if allowed (see
+// `userProfileDefaultVisibility` in the config).
 func NewPass(
 	aiContext *domain.AIContext,
 	memoryRepository domain.MemoryRepository,
 	memoryFactory domain.MemoryFactory,
+	userProfileRepository domain.UserProfileRepository,
 	responseService *domain.ResponseService,
 	languageModelJobQueue *common.JobQueue,
+	config *common.Config,
 	logger common.Logger,
 ) domain.Pass {
+	defaultVisibility, ok := domain.ParseProfileVisibility(config.GetStringOrDefault("userProfileDefaultVisibility", "room"))
+	if !ok {
+		logger.Log("unknown user profile visibility, falling back to \"room\"")
+	}
 	return &pass{
 		aiContext:             aiContext,
 		memoryRepository:      memoryRepository,
 		memoryFactory:         memoryFactory,
+		userProfileRepository: userProfileRepository,
 		responseService:       responseService,
 		languageModelJobQueue: languageModelJobQueue,
 		logger:                logger,
+		defaultVisibility:     defaultVisibility,
 	}
 }
 
@@ -61,25 +74,41 @@ func (p *pass) Apply(context *domain.PassContext, nextPassFunc domain.NextPassFu
 	formattedMemories := p.formatMemories(domain.MergeMemories(workingMemories, []*domain.Memory{inputMemory, outputMemory}...))
 	p.languageModelJobQueue.Enqueue(func() error {
 		var output struct {
-			Fact1 string `json:"fact1"`
-			Fact2 string `json:"fact2"`
+			Fact1            string `json:"fact1"`
+			Fact1IsAboutUser bool   `json:"fact1IsAboutUser"`
+			Fact2            string `json:"fact2"`
+			Fact2IsAboutUser bool   `json:"fact2IsAboutUser"`
 		}
 		err := p.getSummarizerResponseService().RespondToQueryWithJSON(
-			fmt.Sprintf("%s\nExtract facts from the chat history above into 2 short summaries at most (if possible). Example: \"User likes cat.\".", formattedMemories),
+			fmt.Sprintf(
+				"%s\nExtract facts from the chat history above into 2 short summaries at most (if possible). Example: \"User likes cat.\". For each fact, specify if it's a fact about %s personally.",
+				formattedMemories,
+				inputMemory.Who,
+			),
 			&output,
 		)
 		if err != nil {
 			return err
 		}
+		// A fact about the user is stored only in the profile, so that removing the profile entry forgets the fact.
 		var facts []string
 		if output.Fact1 != "" {
-			facts = append(facts, output.Fact1)
+			if output.Fact1IsAboutUser {
+				p.storeProfileEntry(inputMemory, output.Fact1)
+			} else {
+				facts = append(facts, output.Fact1)
+			}
 		}
 		if output.Fact2 != "" {
-			facts = append(facts, output.Fact2)
+			if output.Fact2IsAboutUser {
+				p.storeProfileEntry(inputMemory, output.Fact2)
+			} else {
+				facts = append(facts, output.Fact2)
+			}
 		}
 		for _, fact := range facts {
 			existingMemory, err := p.memoryRepository.Find(domain.MemoryFilter{
+				Types: []domain.MemoryType{domain.MemoryTypeFact},
 				What:  fact,
 				Where: inputMemory.Where,
 			})
@@ -90,8 +119,7 @@ func (p *pass) Apply(context *domain.PassContext, nextPassFunc domain.NextPassFu
 			if existingMemory != nil {
 				continue
 			}
-			factMemory := p.memoryFactory.NewMemory(domain.MemoryTypeDialog, p.aiContext.AgentName, fact, inputMemory.Where)
-			factMemory.When = time.Time{}
+			factMemory := p.memoryFactory.NewMemory(domain.MemoryTypeFact, p.aiContext.AgentName, fact, inputMemory.Where)
 			err = p.memoryRepository.Store(factMemory)
 			if err != nil {
 				p.logger.Log("failed to extract facts: " + err.Error())
@@ -103,6 +131,34 @@ func (p *pass) Apply(context *domain.PassContext, nextPassFunc domain.NextPassFu
 	return nextPassFunc(context)
 }
 
+func (p *pass) storeProfileEntry(inputMemory *domain.Memory, fact string) {
+	entries, err := p.userProfileRepository.FindByWho(inputMemory.Who)
+	if err != nil {
+		p.logger.Log("failed to update the user profile: " + err.Error())
+		return
+	}
+	for _, entry := range entries {
+		if entry.What == fact {
+			return
+		}
+	}
+	visibility := p.defaultVisibility
+	if domain.IsDMRoom(inputMemory.Who, inputMemory.Where) {
+		visibility = domain.ProfileVisibilityDM // what is said in private stays private
+	}
+	err = p.userProfileRepository.Store(&domain.UserProfileEntry{
+		ID:         p.userProfileRepository.NextID(),
+		Who:        inputMemory.Who,
+		What:       fact,
+		Where:      inputMemory.Where,
+		When:       time.Now(),
+		Visibility: visibility,
+	})
+	if err != nil {
+		p.logger.Log("failed to update the user profile: " + err.Error())
+	}
+}
+
 func (p *pass) getSummarizerResponseService() *domain.ResponseService {
 	rankerAIContext := domain.NewAIContext(
 		"FactLLM",
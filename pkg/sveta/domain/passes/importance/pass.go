@@ -0,0 +1,105 @@
+package importance
+
+import (
+	"fmt"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+const importanceCapability = "importance"
+
+const maxRating = 10
+
+type pass struct {
+	memoryRepository      domain.MemoryRepository
+	responseService       *domain.ResponseService
+	languageModelJobQueue *common.JobQueue
+	logger                common.Logger
+}
+
+// NewPass creates a pass which rates the importance of the newly formed memories in the background, so that important
+// memories could be recalled more readily than mundane ones (see domain.MemoryScorer).
+func NewPass(
+	memoryRepository domain.MemoryRepository,
+	responseService *domain.ResponseService,
+	languageModelJobQueue *common.JobQueue,
+	logger common.Logger,
+) domain.Pass {
+	return &pass{
+		memoryRepository:      memoryRepository,
+		responseService:       responseService,
+		languageModelJobQueue: languageModelJobQueue,
+		logger:                logger,
+	}
+}
+
+func (p *pass) Capabilities() []*domain.Capability {
+	return []*domain.Capability{
+		{
+			Name:        importanceCapability,
+			Description: "rates the importance of memories to recall important memories more readily",
+		},
+	}
+}
+
+func (p *pass) Apply(context *domain.PassContext, nextPassFunc domain.NextPassFunc) error {
+	if !context.IsCapabilityEnabled(importanceCapability) {
+		return nextPassFunc(context)
+	}
+	inputMemory := context.Memory(domain.DataKeyInput)
+	outputMemory := context.Memory(domain.DataKeyOutput)
+	if inputMemory == nil || outputMemory == nil {
+		return nextPassFunc(context)
+	}
+	p.languageModelJobQueue.Enqueue(func() error {
+		var output struct {
+			Rating1 int `json:"rating1" enum:"1,2,3,4,5,6,7,8,9,10"` // 1..maxRating
+			Rating2 int `json:"rating2" enum:"1,2,3,4,5,6,7,8,9,10"`
+		}
+		err := p.getImportanceResponseService().RespondToQueryWithJSON(
+			fmt.Sprintf(
+				"On the scale of 1 to %d, where 1 is purely mundane (e.g., greetings, small talk) and %d is extremely poignant (e.g., a break up, a new job, a strong preference), rate the likely poignancy of each of the following chat lines.\n1. %s: \"%s\"\n2. %s: \"%s\"",
+				maxRating,
+				maxRating,
+				inputMemory.Who,
+				inputMemory.What,
+				outputMemory.Who,
+				outputMemory.What,
+			),
+			&output,
+		)
+		if err != nil {
+			return err
+		}
+		err = p.updateImportance(inputMemory, output.Rating1)
+		if err != nil {
+			return err
+		}
+		return p.updateImportance(outputMemory, output.Rating2)
+	})
+	return nextPassFunc(context)
+}
+
+func (p *pass) updateImportance(memory *domain.Memory, rating int) error {
+	if rating < 1 {
+		rating = 1
+	}
+	if rating > maxRating {
+		rating = maxRating
+	}
+	// The memory can be recalled concurrently, so it's not changed in place.
+	_, err := p.memoryRepository.Modify(memory.ID, func(memory *domain.Memory) {
+		memory.Importance = float64(rating) / maxRating
+	})
+	return err
+}
+
+func (p *pass) getImportanceResponseService() *domain.ResponseService {
+	importanceAIContext := domain.NewAIContext(
+		"ImportanceLLM",
+		"You're ImportanceLLM, an intelligent assistant that rates how important chat lines are to remember in the long run.",
+		"",
+	)
+	return p.responseService.WithAIContext(importanceAIContext)
+}
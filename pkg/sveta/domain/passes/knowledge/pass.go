@@ -0,0 +1,93 @@
+package knowledge
+
+import (
+	"fmt"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+	"kgeyst.com/sveta/pkg/sveta/domain/passes/rewrite"
+)
+
+const DataKeyKnowledgeMemories = "knowledgeMemories"
+
+const knowledgeCapability = "knowledge"
+
+type pass struct {
+	knowledgeRepository domain.KnowledgeRepository
+	embedder            domain.Embedder
+	logger              common.Logger
+	topCount            int
+	similarityThreshold float64
+}
+
+// NewPass creates a pass which recalls excerpts from the documents of the knowledge base (see cmd/ingest) which are
+// relevant to the user's query. Each excerpt mentions the document it comes from, so that the AI could cite it.
+func NewPass(
+	knowledgeRepository domain.KnowledgeRepository,
+	embedder domain.Embedder,
+	config *common.Config,
+	logger common.Logger,
+) domain.Pass {
+	return &pass{
+		knowledgeRepository: knowledgeRepository,
+		embedder:            embedder,
+		logger:              logger,
+		topCount:            config.GetIntOrDefault("knowledgeTopCount", 3),
+		similarityThreshold: config.GetFloatOrDefault("knowledgeSimilarityThreshold", 0.5),
+	}
+}
+
+func (p *pass) Capabilities() []*domain.Capability {
+	return []*domain.Capability{
+		{
+			Name:        knowledgeCapability,
+			Description: "recalls relevant excerpts from the documents of the knowledge base",
+		},
+	}
+}
+
+func (p *pass) Apply(context *domain.PassContext, nextPassFunc domain.NextPassFunc) error {
+	if !context.IsCapabilityEnabled(knowledgeCapability) {
+		return nextPassFunc(context)
+	}
+	inputMemory := context.Memory(domain.DataKeyInput)
+	if inputMemory == nil {
+		return nextPassFunc(context)
+	}
+	var embeddings []domain.Embedding
+	for _, memory := range []*domain.Memory{inputMemory, context.Memory(rewrite.DataKeyRewrittenInput)} {
+		if memory != nil && memory.Embedding != nil {
+			embeddings = append(embeddings, *memory.Embedding)
+		}
+	}
+	if len(embeddings) == 0 {
+		return nextPassFunc(context)
+	}
+	chunks, err := p.knowledgeRepository.FindByEmbeddings(domain.KnowledgeFilter{
+		Embeddings:          embeddings,
+		EmbeddingModel:      p.embedder.ModelName(),
+		TopCount:            p.topCount,
+		SimilarityThreshold: p.similarityThreshold,
+	})
+	if err != nil {
+		p.logger.Log("failed to recall knowledge: " + err.Error())
+		return nextPassFunc(context)
+	}
+	if len(chunks) == 0 {
+		return nextPassFunc(context)
+	}
+	memories := make([]*domain.Memory, 0, len(chunks))
+	for _, chunk := range chunks {
+		// Without the embedding, as knowledge memories are not searched for.
+		memory := domain.NewMemory(chunk.ID, domain.MemoryTypeDocument, "", inputMemory.When, formatChunk(chunk), inputMemory.Where, nil)
+		memory.IsTransient = true
+		memory.Source = knowledgeCapability
+		memories = append(memories, memory)
+	}
+	return nextPassFunc(context.WithMemories(DataKeyKnowledgeMemories, memories))
+}
+
+// formatChunk the source comes first, so that the model could cite it
+func formatChunk(chunk *domain.KnowledgeChunk) string {
+	return fmt.Sprintf("[%s] %s", chunk.Source, chunk.Text)
+}
@@ -17,8 +17,9 @@ type pass struct {
 	memoryFactory     domain.MemoryFactory
 	summaryRepository domain.SummaryRepository
 	logger            common.Logger
-	loaded            map[string]bool // where => isLoaded
+	loadedUntil       map[string]time.Time // where => when the loaded news expire
 	maxNewsCount      int
+	memoryTTL         time.Duration
 }
 
 func NewPass(
@@ -35,8 +36,9 @@ func NewPass(
 		memoryFactory:     memoryFactory,
 		summaryRepository: summaryRepository,
 		logger:            logger,
-		loaded:            make(map[string]bool),
+		loadedUntil:       make(map[string]time.Time),
 		maxNewsCount:      config.GetIntOrDefault("newsMaxCount", 100),
+		memoryTTL:         config.GetDurationOrDefault("newsMemoryTTL", 12*time.Hour),
 	}
 }
 
@@ -57,7 +59,7 @@ func (p *pass) Apply(context *domain.PassContext, nextPassFunc domain.NextPassFu
 	if inputMemory == nil {
 		return nextPassFunc(context)
 	}
-	if p.loaded[inputMemory.Where] {
+	if time.Now().Before(p.loadedUntil[inputMemory.Where]) {
 		return nextPassFunc(context)
 	}
 	summary, err := p.summaryRepository.FindByWhere(inputMemory.Where)
@@ -71,8 +73,9 @@ func (p *pass) Apply(context *domain.PassContext, nextPassFunc domain.NextPassFu
 	if len(workingMemories) < 1 || summary == nil {
 		return nextPassFunc(context)
 	}
+	// The previous news expire at the same time, so they're replaced with the fresh news.
 	p.loadNews(inputMemory.Where)
-	p.loaded[inputMemory.Where] = true
+	p.loadedUntil[inputMemory.Where] = time.Now().Add(p.memoryTTL)
 	return nextPassFunc(context)
 }
 
@@ -82,12 +85,13 @@ func (p *pass) loadNews(where string) {
 		p.logger.Log("failed to load news")
 		return
 	}
+	lines := make([]string, len(newsItems))
 	for index, newsItem := range newsItems {
-		p.logger.Log(fmt.Sprintf("Loading news #%d...\n", index))
-		line := fmt.Sprintf("Published Date: %s. Title: \"%s\". Description: \"%s\"", newsItem.PublishedDate, newsItem.Title, newsItem.Description)
-		memory := p.memoryFactory.NewMemory(domain.MemoryTypeDialog, "News", line, where)
-		memory.When = time.Time{}
-		memory.IsTransient = true
+		lines[index] = fmt.Sprintf("Published Date: %s. Title: \"%s\". Description: \"%s\"", newsItem.PublishedDate, newsItem.Title, newsItem.Description)
+	}
+	p.logger.Log(fmt.Sprintf("Loading %d news...\n", len(lines)))
+	for _, memory := range p.memoryFactory.NewMemories(domain.MemoryTypeNews, "", lines, where) {
+		memory.MakeTransient(newsCapabillity, p.memoryTTL)
 		err = p.memoryRepository.Store(memory)
 		if err != nil {
 			p.logger.Log("failed to store news as memory")
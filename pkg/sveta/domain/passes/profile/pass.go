@@ -0,0 +1,69 @@
+package profile
+
+import (
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+const DataKeyProfileMemories = "profileMemories"
+
+const profileCapability = "profile"
+
+type pass struct {
+	userProfileRepository domain.UserProfileRepository
+	logger                common.Logger
+	maxEntryCount         int
+}
+
+// NewPass creates a pass which recalls what the AI knows about the speaking user from all rooms (see
+// domain.UserProfileRepository), respecting the visibility of each profile entry.
+func NewPass(
+	userProfileRepository domain.UserProfileRepository,
+	config *common.Config,
+	logger common.Logger,
+) domain.Pass {
+	return &pass{
+		userProfileRepository: userProfileRepository,
+		logger:                logger,
+		maxEntryCount:         config.GetIntOrDefault("userProfileMaxEntryCount", 10),
+	}
+}
+
+func (p *pass) Capabilities() []*domain.Capability {
+	return []*domain.Capability{
+		{
+			Name:        profileCapability,
+			Description: "recalls what is known about the user across rooms",
+		},
+	}
+}
+
+func (p *pass) Apply(context *domain.PassContext, nextPassFunc domain.NextPassFunc) error {
+	if !context.IsCapabilityEnabled(profileCapability) {
+		return nextPassFunc(context)
+	}
+	inputMemory := context.Memory(domain.DataKeyInput)
+	if inputMemory == nil || inputMemory.Who == "" {
+		return nextPassFunc(context)
+	}
+	entries, err := p.userProfileRepository.FindByWho(inputMemory.Who)
+	if err != nil {
+		p.logger.Log("failed to recall the user profile: " + err.Error())
+		return nextPassFunc(context)
+	}
+	entries = domain.FilterVisibleProfileEntries(entries, inputMemory.Where)
+	if len(entries) > p.maxEntryCount {
+		entries = entries[len(entries)-p.maxEntryCount:] // the latest entries are the most relevant
+	}
+	if len(entries) == 0 {
+		return nextPassFunc(context)
+	}
+	memories := make([]*domain.Memory, 0, len(entries))
+	for _, entry := range entries {
+		// Without the embedding, as profile memories are not searched for.
+		memory := domain.NewMemory(entry.ID, domain.MemoryTypeFact, entry.Who, entry.When, entry.What, inputMemory.Where, nil)
+		memory.IsTransient = true
+		memories = append(memories, memory)
+	}
+	return nextPassFunc(context.WithMemories(DataKeyProfileMemories, memories))
+}
@@ -6,7 +6,10 @@ import (
 
 	"kgeyst.com/sveta/pkg/common"
 	"kgeyst.com/sveta/pkg/sveta/domain"
+	"kgeyst.com/sveta/pkg/sveta/domain/passes/knowledge"
+	"kgeyst.com/sveta/pkg/sveta/domain/passes/profile"
 	"kgeyst.com/sveta/pkg/sveta/domain/passes/rewrite"
+	"kgeyst.com/sveta/pkg/sveta/domain/passes/temporal"
 	"kgeyst.com/sveta/pkg/sveta/domain/passes/workingmemory"
 )
 
@@ -25,9 +28,12 @@ type pass struct {
 	embedder                          domain.Embedder
 	logger                            common.Logger
 	episodicMemoryFirstStageTopCount  int
-	episodicMemorySecondStageTopCount int
 	episodicMemorySurroundingCount    int
 	episodicMemorySimilarityThreshold float64
+	episodicMemoryScorer              *domain.MemoryScorer
+	episodicMemoryLexicalWeight       float64
+	episodicMemoryLexicalWeights      map[string]float64 // where => weight
+	episodicMemoryTypeQuotas          map[domain.MemoryType]int
 	rerankerMaxMemorySize             int
 }
 
@@ -50,9 +56,12 @@ func NewPass(
 		embedder:                          embedder,
 		logger:                            logger,
 		episodicMemoryFirstStageTopCount:  config.GetIntOrDefault(domain.ConfigKeyEpisodicMemoryFirstStageTopCount, 10),
-		episodicMemorySecondStageTopCount: config.GetIntOrDefault(domain.ConfigKeyEpisodicMemorySecondStageTopCount, 3),
 		episodicMemorySurroundingCount:    config.GetIntOrDefault(domain.ConfigKeyEpisodicMemorySurroundingCount, 1),
 		episodicMemorySimilarityThreshold: config.GetFloatOrDefault(domain.ConfigKeyEpisodicMemorySimilarityThreshold, 0.1),
+		episodicMemoryScorer:              domain.NewMemoryScorerFromConfig(config),
+		episodicMemoryLexicalWeight:       config.GetFloat(domain.ConfigKeyEpisodicMemoryLexicalWeight),
+		episodicMemoryLexicalWeights:      config.GetFloatMap(domain.ConfigKeyEpisodicMemoryLexicalWeights),
+		episodicMemoryTypeQuotas:          getTypeQuotas(config, logger),
 		rerankerMaxMemorySize:             config.GetIntOrDefault(domain.ConfigKeyRerankerMaxMemorySize, 500),
 	}
 }
@@ -98,6 +107,9 @@ func (p *pass) Apply(context *domain.PassContext, nextPassFunc domain.NextPassFu
 		return err
 	}
 	memories := domain.MergeMemories(episodicMemories, workingMemories...)
+	memories = domain.MergeMemories(memories, context.Memories(temporal.DataKeyTemporalMemories)...)
+	memories = domain.MergeMemories(memories, context.Memories(profile.DataKeyProfileMemories)...)
+	memories = domain.MergeMemories(memories, context.Memories(knowledge.DataKeyKnowledgeMemories)...)
 	memories = domain.MergeMemories(memories, inputMemory)
 	response, err := p.defaultResponseService.RespondToMemoriesWithText(memories, domain.ResponseModeNormal)
 	if err != nil {
@@ -123,17 +135,34 @@ func (p *pass) recallFromEpisodicMemory(context *domain.PassContext, workingMemo
 	if rewrittenInputMemory.Embedding != nil {
 		embeddingsToSearch = append(embeddingsToSearch, *rewrittenInputMemory.Embedding)
 	}
-	episodicMemories, err := p.memoryRepository.FindByEmbeddings(domain.EmbeddingFilter{
+	embeddingFilter := domain.EmbeddingFilter{
+		Types:               []domain.MemoryType{domain.MemoryTypeDialog, domain.MemoryTypeSummary},
 		Where:               rewrittenInputMemory.Where,
 		Embeddings:          embeddingsToSearch,
 		TopCount:            p.episodicMemoryFirstStageTopCount,
 		SurroundingCount:    p.episodicMemorySurroundingCount,
 		ExcludedIDs:         domain.GetMemoryIDs(workingMemories), // don't recall what's already in the input
 		SimilarityThreshold: p.episodicMemorySimilarityThreshold,
-	})
+		Scorer:              p.episodicMemoryScorer,
+		Query:               p.getLexicalQuery(inputMemory, rewrittenInputMemory),
+		LexicalWeight:       p.getLexicalWeight(rewrittenInputMemory.Where),
+		EmbeddingModel:      p.embedder.ModelName(),
+		MatchedIDs:          make(map[string]bool),
+	}
+	episodicMemories, err := p.memoryRepository.FindByEmbeddings(embeddingFilter)
+	if err != nil {
+		return nil, err
+	}
+	// Knowledge is searched separately, so that numerous news items or search results couldn't crowd out the dialog
+	// (and vice versa).
+	embeddingFilter.Types = domain.KnowledgeMemoryTypes
+	embeddingFilter.TopCount = p.getKnowledgeFirstStageTopCount()
+	embeddingFilter.SurroundingCount = 0 // surrounding knowledge is usually unrelated
+	knowledgeMemories, err := p.memoryRepository.FindByEmbeddings(embeddingFilter)
 	if err != nil {
 		return nil, err
 	}
+	episodicMemories = append(episodicMemories, knowledgeMemories...)
 	if len(episodicMemories) == 0 {
 		return nil, nil
 	}
@@ -142,9 +171,51 @@ func (p *pass) recallFromEpisodicMemory(context *domain.PassContext, workingMemo
 		return nil, nil
 	}
 	p.logRecalledMemories(episodicMemories)
+	p.recordAccess(episodicMemories, embeddingFilter.MatchedIDs)
 	return episodicMemories, nil
 }
 
+// recordAccess see domain.Memory.AccessCount; the surrounding memories don't count, as they're recalled only as
+// context
+func (p *pass) recordAccess(memories []*domain.Memory, matchedIDs map[string]bool) {
+	var ids []string
+	for _, memory := range memories {
+		if matchedIDs[memory.ID] {
+			ids = append(ids, memory.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	err := p.memoryRepository.RecordAccess(ids)
+	if err != nil {
+		p.logger.Log("failed to record access to memories: " + err.Error())
+	}
+}
+
+func (p *pass) getKnowledgeFirstStageTopCount() int {
+	var result int
+	for _, memoryType := range domain.KnowledgeMemoryTypes {
+		result += p.episodicMemoryTypeQuotas[memoryType]
+	}
+	return result * 2 // to leave room for the reranker
+}
+
+func (p *pass) getLexicalQuery(inputMemory, rewrittenInputMemory *domain.Memory) string {
+	if inputMemory.What == rewrittenInputMemory.What {
+		return inputMemory.What
+	}
+	return inputMemory.What + " " + rewrittenInputMemory.What
+}
+
+func (p *pass) getLexicalWeight(where string) float64 {
+	lexicalWeight, ok := p.episodicMemoryLexicalWeights[where]
+	if ok {
+		return lexicalWeight
+	}
+	return p.episodicMemoryLexicalWeight
+}
+
 func (p *pass) getEmbedding(what string) *domain.Embedding {
 	embedding, err := p.embedder.Embed(what)
 	if err != nil {
@@ -155,9 +226,13 @@ func (p *pass) getEmbedding(what string) *domain.Embedding {
 }
 
 func (p *pass) logRecalledMemories(memories []*domain.Memory) {
-	memories = domain.FilterMemoriesByTypes(memories, []domain.MemoryType{domain.MemoryTypeDialog})
 	var builder strings.Builder
 	for _, memory := range memories {
+		if memory.Type != domain.MemoryTypeDialog {
+			builder.WriteString("[")
+			builder.WriteString(memory.Type.String())
+			builder.WriteString("] ")
+		}
 		builder.WriteString(memory.Who)
 		builder.WriteString(": ")
 		builder.WriteString(memory.What)
@@ -165,3 +240,25 @@ func (p *pass) logRecalledMemories(memories []*domain.Memory) {
 	}
 	p.logger.Log(fmt.Sprintf("\n======\nRecalled context:\n%s\n========\n", builder.String()))
 }
+
+// getTypeQuotas how many memories of each type can be recalled at most (second stage). Dialog memories are limited
+// by ConfigKeyEpisodicMemorySecondStageTopCount unless overridden.
+func getTypeQuotas(config *common.Config, logger common.Logger) map[domain.MemoryType]int {
+	quotas := map[domain.MemoryType]int{
+		domain.MemoryTypeDialog:       config.GetIntOrDefault(domain.ConfigKeyEpisodicMemorySecondStageTopCount, 3),
+		domain.MemoryTypeFact:         2,
+		domain.MemoryTypeNews:         2,
+		domain.MemoryTypeBio:          2,
+		domain.MemoryTypeSearchResult: 2,
+		domain.MemoryTypeSummary:      1,
+	}
+	for name, quota := range config.GetIntMap(domain.ConfigKeyEpisodicMemoryTypeQuotas) {
+		memoryType, ok := domain.ParseMemoryType(name)
+		if !ok {
+			logger.Log("unknown memory type in episodic memory type quotas: " + name)
+			continue
+		}
+		quotas[memoryType] = quota
+	}
+	return quotas
+}
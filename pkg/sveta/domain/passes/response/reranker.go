@@ -36,10 +36,7 @@ func (p *pass) rankMemoriesAndGetTopN(context *domain.PassContext, memories []*d
 	if len(result) == 0 {
 		result = memories
 	}
-	if len(result) > p.episodicMemorySecondStageTopCount {
-		result = result[0:p.episodicMemorySecondStageTopCount]
-	}
-	return result
+	return domain.LimitMemoriesByTypeQuotas(result, p.episodicMemoryTypeQuotas)
 }
 
 func (p *pass) getRankerResponseService() *domain.ResponseService {
@@ -54,7 +51,11 @@ func (p *pass) formatMemoriesForRanker(memories []*domain.Memory) string {
 		if len(what) > p.rerankerMaxMemorySize {
 			what = what[0:p.rerankerMaxMemorySize] + "..." // trimming it to fit huge memories in the context, at least partially
 		}
-		buf.WriteString(fmt.Sprintf("[%d] %s: %s\n", index+1, memory.Who, what))
+		who := memory.Who
+		if memory.Type != domain.MemoryTypeDialog {
+			who = memory.Type.String()
+		}
+		buf.WriteString(fmt.Sprintf("[%d] %s: %s\n", index+1, who, what))
 	}
 	return buf.String()
 }
@@ -0,0 +1,124 @@
+package temporal
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+const DataKeyTemporalMemories = "temporalMemories"
+
+const temporalCapability = "temporal"
+
+var memoryTypes = []domain.MemoryType{domain.MemoryTypeDialog, domain.MemoryTypeSummary} // digests of consolidated dialogs, too
+
+type pass struct {
+	memoryRepository domain.MemoryRepository
+	logger           common.Logger
+	location         *time.Location
+	maxMemoryCount   int
+}
+
+// NewPass creates a pass which recalls memories by an explicit time window for questions like "what did we talk
+// about last Tuesday?" (semantic recall doesn't help here). The temporal expression is resolved against the user's clock
+// (see `userTimeZone` in the config). If there are more than `temporalMaxMemoryCount` memories in the window, the ones
+// most similar to the question are recalled.
+func NewPass(
+	memoryRepository domain.MemoryRepository,
+	config *common.Config,
+	logger common.Logger,
+) domain.Pass {
+	location, err := time.LoadLocation(config.GetStringOrDefault("userTimeZone", "Local"))
+	if err != nil {
+		logger.Log("failed to load the user's time zone: " + err.Error())
+		location = time.Local
+	}
+	return &pass{
+		memoryRepository: memoryRepository,
+		logger:           logger,
+		location:         location,
+		maxMemoryCount:   config.GetIntOrDefault("temporalMaxMemoryCount", 10),
+	}
+}
+
+func (p *pass) Capabilities() []*domain.Capability {
+	return []*domain.Capability{
+		{
+			Name:        temporalCapability,
+			Description: "recalls what was discussed at a specific time (\"last Tuesday\", \"yesterday\" etc.)",
+		},
+	}
+}
+
+func (p *pass) Apply(context *domain.PassContext, nextPassFunc domain.NextPassFunc) error {
+	if !context.IsCapabilityEnabled(temporalCapability) {
+		return nextPassFunc(context)
+	}
+	inputMemory := context.Memory(domain.DataKeyInput)
+	if inputMemory == nil {
+		return nextPassFunc(context)
+	}
+	window, ok := resolveTimeRange(inputMemory.What, time.Now().In(p.location))
+	if !ok {
+		return nextPassFunc(context)
+	}
+	memories, err := p.memoryRepository.Find(domain.MemoryFilter{
+		Types:        memoryTypes,
+		Where:        inputMemory.Where,
+		LatestCount:  -1,
+		NotOlderThan: &window.From,
+		NotNewerThan: &window.To,
+	})
+	if err != nil {
+		p.logger.Log("failed to recall memories by time: " + err.Error())
+		return nextPassFunc(context)
+	}
+	memories = p.excludeMemory(memories, inputMemory)
+	p.logger.Log(fmt.Sprintf("Temporal recall: %d memories between %s and %s\n", len(memories), window.From.Format(time.RFC1123), window.To.Format(time.RFC1123)))
+	if len(memories) == 0 {
+		return nextPassFunc(context)
+	}
+	if len(memories) > p.maxMemoryCount {
+		memories = p.findMostSimilarMemories(memories, window, inputMemory)
+	}
+	return nextPassFunc(context.WithMemories(DataKeyTemporalMemories, memories))
+}
+
+// findMostSimilarMemories picks the memories of the window most similar to the input (in chronological order), or the
+// latest ones if the input has no embedding (the embedder is down)
+func (p *pass) findMostSimilarMemories(memories []*domain.Memory, window timeRange, inputMemory *domain.Memory) []*domain.Memory {
+	if inputMemory.Embedding != nil {
+		similarMemories, err := p.memoryRepository.FindByEmbeddings(domain.EmbeddingFilter{
+			Types:          memoryTypes,
+			Where:          inputMemory.Where,
+			NotOlderThan:   &window.From,
+			NotNewerThan:   &window.To,
+			Embeddings:     []domain.Embedding{*inputMemory.Embedding},
+			TopCount:       p.maxMemoryCount,
+			ExcludedIDs:    []string{inputMemory.ID},
+			EmbeddingModel: inputMemory.EmbeddingModel,
+		})
+		if err != nil {
+			p.logger.Log("failed to find the most similar memories recalled by time: " + err.Error())
+		} else if len(similarMemories) > 0 {
+			sort.SliceStable(similarMemories, func(i, j int) bool {
+				return similarMemories[i].When.Before(similarMemories[j].When)
+			})
+			return similarMemories
+		}
+	}
+	return memories[len(memories)-p.maxMemoryCount:]
+}
+
+func (p *pass) excludeMemory(memories []*domain.Memory, excludedMemory *domain.Memory) []*domain.Memory {
+	result := make([]*domain.Memory, 0, len(memories))
+	for _, memory := range memories {
+		if memory.ID != excludedMemory.ID {
+			result = append(result, memory)
+		}
+	}
+	return result
+}
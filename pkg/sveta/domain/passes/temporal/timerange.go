@@ -0,0 +1,162 @@
+package temporal
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NOTE: only supports English
+
+var wordsToNumbers = map[string]int{
+	"a":     1,
+	"an":    1,
+	"one":   1,
+	"two":   2,
+	"three": 3,
+	"four":  4,
+	"five":  5,
+	"six":   6,
+	"seven": 7,
+	"eight": 8,
+	"nine":  9,
+	"ten":   10,
+}
+
+var (
+	agoRegex          = regexp.MustCompile(`\b(\d+|a|an|one|two|three|four|five|six|seven|eight|nine|ten) (hour|day|week|month)s? ago\b`)
+	weekdayRegex      = regexp.MustCompile(`\b(last|on|this past) (monday|tuesday|wednesday|thursday|friday|saturday|sunday)\b`)
+	monthDayRegex     = regexp.MustCompile(`\b(january|february|march|april|may|june|july|august|september|october|november|december) (\d{1,2})(st|nd|rd|th)?\b`)
+	dayMonthRegex     = regexp.MustCompile(`\b(\d{1,2})(st|nd|rd|th)? (of )?(january|february|march|april|may|june|july|august|september|october|november|december)\b`)
+	nonAlphanumericRe = regexp.MustCompile(`[^a-z0-9 ]+`)
+	// recallIntentRegex a temporal expression alone ("I'm tired today") isn't a question about past conversations
+	recallIntentRegex = regexp.MustCompile(`\b(talk|talked|talking|discuss|discussed|discussing|say|said|tell|told|mention|mentioned|remember|recall|ask|asked|chat|chatted|speak|spoke|conversation|conversations|happened|did we)\b`)
+)
+
+// timeRange a bounded time window (inclusive)
+type timeRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// resolveTimeRange detects a question about past conversations with a temporal expression ("yesterday", "last
+// Tuesday", "3 days ago", "May 3rd" etc.) in the text and resolves it against `now` (which must be in the user's time
+// zone). Returns false if it's not such a question.
+func resolveTimeRange(text string, now time.Time) (timeRange, bool) {
+	text = strings.ToLower(text)
+	text = nonAlphanumericRe.ReplaceAllString(text, " ")
+	text = strings.Join(strings.Fields(text), " ")
+	if !recallIntentRegex.MatchString(text) {
+		return timeRange{}, false
+	}
+	today := startOfDay(now)
+	switch {
+	case containsPhrase(text, "day before yesterday"):
+		return dayRange(today.AddDate(0, 0, -2)), true
+	case containsPhrase(text, "yesterday"):
+		return dayRange(today.AddDate(0, 0, -1)), true
+	case containsPhrase(text, "last night"):
+		return timeRange{From: today.AddDate(0, 0, -1).Add(18 * time.Hour), To: today.Add(6 * time.Hour)}, true
+	case containsPhrase(text, "this morning"):
+		return timeRange{From: today, To: today.Add(12 * time.Hour)}, true
+	case containsPhrase(text, "today"):
+		return timeRange{From: today, To: now}, true
+	case containsPhrase(text, "last week"):
+		thisWeek := startOfWeek(today)
+		return timeRange{From: thisWeek.AddDate(0, 0, -7), To: thisWeek.Add(-time.Nanosecond)}, true
+	case containsPhrase(text, "this week"):
+		return timeRange{From: startOfWeek(today), To: now}, true
+	case containsPhrase(text, "last month"):
+		thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		return timeRange{From: thisMonth.AddDate(0, -1, 0), To: thisMonth.Add(-time.Nanosecond)}, true
+	case containsPhrase(text, "this month"):
+		return timeRange{From: time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()), To: now}, true
+	}
+	if match := agoRegex.FindStringSubmatch(text); match != nil {
+		return resolveAgo(match[1], match[2], now)
+	}
+	if match := weekdayRegex.FindStringSubmatch(text); match != nil {
+		return resolveWeekday(match[2], today), true
+	}
+	if match := monthDayRegex.FindStringSubmatch(text); match != nil {
+		return resolveMonthDay(match[1], match[2], now)
+	}
+	if match := dayMonthRegex.FindStringSubmatch(text); match != nil {
+		return resolveMonthDay(match[4], match[1], now)
+	}
+	return timeRange{}, false
+}
+
+func resolveAgo(countStr, unit string, now time.Time) (timeRange, bool) {
+	count, ok := wordsToNumbers[countStr]
+	if !ok {
+		var err error
+		count, err = strconv.Atoi(countStr)
+		if err != nil {
+			return timeRange{}, false
+		}
+	}
+	switch unit {
+	case "hour":
+		center := now.Add(-time.Duration(count) * time.Hour)
+		return timeRange{From: center.Add(-time.Hour), To: center.Add(time.Hour)}, true
+	case "day":
+		return dayRange(startOfDay(now).AddDate(0, 0, -count)), true
+	case "week":
+		weekStart := startOfWeek(startOfDay(now)).AddDate(0, 0, -7*count)
+		return timeRange{From: weekStart, To: weekStart.AddDate(0, 0, 7).Add(-time.Nanosecond)}, true
+	case "month":
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, -count, 0)
+		return timeRange{From: monthStart, To: monthStart.AddDate(0, 1, 0).Add(-time.Nanosecond)}, true
+	}
+	return timeRange{}, false
+}
+
+// resolveWeekday finds the latest such weekday before today
+func resolveWeekday(weekdayName string, today time.Time) timeRange {
+	day := today.AddDate(0, 0, -1)
+	for i := 0; i < 7; i++ {
+		if strings.ToLower(day.Weekday().String()) == weekdayName {
+			break
+		}
+		day = day.AddDate(0, 0, -1)
+	}
+	return dayRange(day)
+}
+
+// resolveMonthDay if the date is in the future, it's assumed the user means the last year
+func resolveMonthDay(monthName, dayStr string, now time.Time) (timeRange, bool) {
+	dayOfMonth, err := strconv.Atoi(dayStr)
+	if err != nil || dayOfMonth < 1 || dayOfMonth > 31 {
+		return timeRange{}, false
+	}
+	month, err := time.Parse("January", strings.ToUpper(monthName[:1])+monthName[1:])
+	if err != nil {
+		return timeRange{}, false
+	}
+	day := time.Date(now.Year(), month.Month(), dayOfMonth, 0, 0, 0, 0, now.Location())
+	if day.After(now) {
+		day = day.AddDate(-1, 0, 0)
+	}
+	return dayRange(day), true
+}
+
+// containsPhrase matches whole words only ("today" doesn't match "todays"), the text must be normalized
+func containsPhrase(text, phrase string) bool {
+	return strings.Contains(" "+text+" ", " "+phrase+" ")
+}
+
+func dayRange(day time.Time) timeRange {
+	return timeRange{From: day, To: day.AddDate(0, 0, 1).Add(-time.Nanosecond)}
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// startOfWeek weeks start on Monday
+func startOfWeek(day time.Time) time.Time {
+	offset := (int(day.Weekday()) + 6) % 7
+	return day.AddDate(0, 0, -offset)
+}
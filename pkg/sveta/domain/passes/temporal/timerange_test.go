@@ -0,0 +1,39 @@
+package temporal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolveTimeRange(t *testing.T) {
+	now := time.Date(2024, time.May, 8, 15, 30, 0, 0, time.UTC) // a Wednesday
+	today := time.Date(2024, time.May, 8, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		text         string
+		expectedFrom time.Time
+		expectedTo   time.Time
+		expectedOK   bool
+	}{
+		{text: "What did we talk about yesterday?", expectedFrom: today.AddDate(0, 0, -1), expectedTo: today.Add(-time.Nanosecond), expectedOK: true},
+		{text: "What did I tell you today?", expectedFrom: today, expectedTo: now, expectedOK: true},
+		{text: "Remember what we discussed last Tuesday?", expectedFrom: today.AddDate(0, 0, -1), expectedTo: today.Add(-time.Nanosecond), expectedOK: true},
+		{text: "What did we chat about 3 days ago?", expectedFrom: today.AddDate(0, 0, -3), expectedTo: today.AddDate(0, 0, -2).Add(-time.Nanosecond), expectedOK: true},
+		{text: "What did John say this week?", expectedFrom: today.AddDate(0, 0, -2), expectedTo: now, expectedOK: true},
+		// No question about past conversations.
+		{text: "I'm so tired today", expectedOK: false},
+		{text: "Let's go hiking this week", expectedOK: false},
+		// Not whole words.
+		{text: "Tell me about todays_news and this weekend", expectedOK: false},
+		{text: "What did we talk about?", expectedOK: false},
+	}
+	for _, test := range tests {
+		window, ok := resolveTimeRange(test.text, now)
+		if ok != test.expectedOK {
+			t.Errorf("%q: expected %t, got %t", test.text, test.expectedOK, ok)
+			continue
+		}
+		if ok && (!window.From.Equal(test.expectedFrom) || !window.To.Equal(test.expectedTo)) {
+			t.Errorf("%q: expected %s - %s, got %s - %s", test.text, test.expectedFrom, test.expectedTo, window.From, window.To)
+		}
+	}
+}
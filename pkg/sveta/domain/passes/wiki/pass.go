@@ -27,6 +27,7 @@ type pass struct {
 	maxArticleSentenceCount        int
 	wordSizeThreshold              int
 	wordFrequencyPositionThreshold int
+	memoryTTL                      time.Duration
 }
 
 func NewPass(
@@ -49,6 +50,7 @@ func NewPass(
 		maxArticleSentenceCount:        config.GetIntOrDefault("wikiMaxArticleSentenceCount", 3),
 		wordSizeThreshold:              config.GetIntOrDefault("wikiWordSizeThreshold", 2),
 		wordFrequencyPositionThreshold: config.GetIntOrDefault("wikiWordFrequencyPositionThreshold", 4000),
+		memoryTTL:                      config.GetDurationOrDefault("wikiMemoryTTL", 7*24*time.Hour),
 	}
 }
 
@@ -135,9 +137,8 @@ func (p *pass) shouldApply(what string) bool {
 }
 
 func (p *pass) storeMemory(what, where string) error {
-	memory := p.memoryFactory.NewMemory(domain.MemoryTypeDialog, "SearchResult", what, where)
-	memory.When = time.Time{}
-	memory.IsTransient = true
+	memory := p.memoryFactory.NewMemory(domain.MemoryTypeSearchResult, "", what, where)
+	memory.MakeTransient(wikiCapability, p.memoryTTL)
 	return p.memoryRepository.Store(memory)
 }
 
@@ -148,7 +149,7 @@ func (p *pass) getWikiResponseService() *domain.ResponseService {
 
 func (p *pass) memoryExists(what, where string) bool {
 	memories, err := p.memoryRepository.Find(domain.MemoryFilter{
-		Types:       []domain.MemoryType{domain.MemoryTypeDialog},
+		Types:       []domain.MemoryType{domain.MemoryTypeSearchResult},
 		Where:       where,
 		What:        what,
 		LatestCount: 1,
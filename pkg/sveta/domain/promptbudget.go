@@ -0,0 +1,175 @@
+package domain
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// promptBudgetDropOrder when the prompt doesn't fit the context, knowledge memories are dropped first, from the
+// lowest priority to the highest. Then go dialog memories, the oldest first (those are usually recalled from the
+// episodic memory rather than from the working memory), then the summary. As the last resort, the last dialog line
+// (the input, which may contain a whole web page) is truncated in the middle. The system prompt is never dropped.
+var promptBudgetDropOrder = []MemoryType{
+	MemoryTypeNews,
+	MemoryTypeSearchResult,
+	MemoryTypeDocument,
+	MemoryTypeSummary,
+	MemoryTypeFact,
+	MemoryTypeBio,
+}
+
+// truncationMarker replaces the middle of a truncated memory
+const truncationMarker = " [...] "
+
+// maxTruncationAttempts the truncated length is estimated from the token count of the memory, so it may take a few
+// attempts to make it fit
+const maxTruncationAttempts = 3
+
+// formatPromptWithinBudget formats the prompt so that it fits the context of the language model, leaving room for
+// the response (see ConfigKeyResponseTokenReserve). The memories themselves are left intact.
+// Counting tokens can be expensive (see Tokenizer), so the whole prompt is counted again only to verify an estimate:
+// the token count of each dropped part is counted once and subtracted.
+func (r *ResponseService) formatPromptWithinBudget(languageModel LanguageModel, options FormatOptions) string {
+	promptFormatter := languageModel.PromptFormatter()
+	prompt := promptFormatter.FormatPrompt(options)
+	if languageModel.ContextSize() <= 0 {
+		return prompt
+	}
+	tokenizer := languageModel.Tokenizer()
+	budget := languageModel.ContextSize() - r.responseTokenReserve
+	originalTokenCount := tokenizer.CountTokens(prompt)
+	if originalTokenCount <= budget {
+		return prompt
+	}
+	options.Memories = slices.Clone(options.Memories)
+	tokenCount := originalTokenCount
+	var dropped []string
+	// fits the estimated token count is verified, as the formatting adds tokens around each part
+	fits := func() bool {
+		if tokenCount > budget {
+			return false
+		}
+		prompt = promptFormatter.FormatPrompt(options)
+		tokenCount = tokenizer.CountTokens(prompt)
+		return tokenCount <= budget
+	}
+	logDropped := func(result string) {
+		r.logger.Log(fmt.Sprintf(
+			"Prompt budget (%s): the prompt takes %d tokens out of %d; %s:\n%s\n",
+			languageModel.Name(),
+			originalTokenCount,
+			budget,
+			result,
+			strings.Join(dropped, "\n"),
+		))
+	}
+	for _, memory := range getMemoriesInBudgetDropOrder(options.Memories) {
+		dropped = append(dropped, "- dropped "+describeMemoryForBudget(memory))
+		options.Memories = slices.DeleteFunc(options.Memories, func(m *Memory) bool {
+			return m == memory
+		})
+		tokenCount -= tokenizer.CountTokens(memory.Who + ": " + memory.What)
+		if fits() {
+			logDropped("fixed")
+			return prompt
+		}
+	}
+	if options.Summary != "" {
+		dropped = append(dropped, "- dropped the summary")
+		tokenCount -= tokenizer.CountTokens(options.Summary)
+		options.Summary = ""
+		if fits() {
+			logDropped("fixed")
+			return prompt
+		}
+	}
+	// The estimate errs on the side of more tokens (the formatting around the dropped parts isn't subtracted), so it's
+	// verified before truncating.
+	tokenCount = min(tokenCount, budget)
+	if fits() {
+		logDropped("fixed")
+		return prompt
+	}
+	dialogIndices := getDialogMemoryIndices(options.Memories)
+	if len(dialogIndices) == 0 {
+		logDropped("still doesn't fit")
+		return prompt
+	}
+	index := dialogIndices[len(dialogIndices)-1]
+	lastMemory := options.Memories[index]
+	truncatedMemory := *lastMemory
+	options.Memories[index] = &truncatedMemory
+	runes := []rune(lastMemory.What)
+	memoryTokenCount := tokenizer.CountTokens(lastMemory.What)
+	keptRuneCount := len(runes)
+	for attempt := 0; attempt < maxTruncationAttempts && memoryTokenCount > 0; attempt++ {
+		// The runes to remove are estimated from the average size of a token of the memory.
+		excessTokenCount := tokenCount - budget
+		if attempt == 0 {
+			excessTokenCount += tokenizer.CountTokens(truncationMarker)
+		}
+		keptRuneCount -= (excessTokenCount*len(runes) + memoryTokenCount - 1) / memoryTokenCount
+		if keptRuneCount <= 0 {
+			break
+		}
+		truncatedMemory.What = truncateMiddle(runes, keptRuneCount)
+		tokenCount = budget // forces the verification
+		if fits() {
+			dropped = append(dropped, fmt.Sprintf("- truncated %s to %d characters", describeMemoryForBudget(lastMemory), keptRuneCount))
+			logDropped("fixed")
+			return prompt
+		}
+	}
+	// Even the system prompt doesn't fit (or the estimates failed): the input is more useful intact, the model will
+	// deal with it.
+	options.Memories[index] = lastMemory
+	prompt = promptFormatter.FormatPrompt(options)
+	logDropped("still doesn't fit")
+	return prompt
+}
+
+// getMemoriesInBudgetDropOrder see promptBudgetDropOrder; the last dialog memory is never dropped
+func getMemoriesInBudgetDropOrder(memories []*Memory) []*Memory {
+	var result []*Memory
+	for _, memoryType := range promptBudgetDropOrder {
+		result = append(result, FilterMemoriesByTypes(memories, []MemoryType{memoryType})...)
+	}
+	dialogIndices := getDialogMemoryIndices(memories)
+	for _, index := range dialogIndices[:max(len(dialogIndices)-1, 0)] {
+		result = append(result, memories[index])
+	}
+	return result
+}
+
+func getDialogMemoryIndices(memories []*Memory) []int {
+	var result []int
+	for index, memory := range memories {
+		if memory.Type == MemoryTypeDialog {
+			result = append(result, index)
+		}
+	}
+	return result
+}
+
+// truncateMiddle keeps `count` runes in total, from the beginning and the end
+func truncateMiddle(runes []rune, count int) string {
+	if count >= len(runes) {
+		return string(runes)
+	}
+	headCount := count / 2
+	tailCount := count - headCount
+	return string(runes[:headCount]) + truncationMarker + string(runes[len(runes)-tailCount:])
+}
+
+func describeMemoryForBudget(memory *Memory) string {
+	const maxLength = 80
+	what := []rune(strings.ReplaceAll(memory.What, "\n", " "))
+	if len(what) > maxLength {
+		what = append(what[:maxLength], []rune("...")...)
+	}
+	if memory.Who == "" {
+		return fmt.Sprintf("[%s] %s", memory.Type, string(what))
+	}
+	return fmt.Sprintf("[%s] %s: %s", memory.Type, memory.Who, string(what))
+}
@@ -0,0 +1,153 @@
+package domain
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Log(message string) {
+	l.t.Log(message)
+}
+
+// countingTokenizer counts the calls, as counting tokens can be expensive (see Tokenizer)
+type countingTokenizer struct {
+	wrapped   Tokenizer
+	callCount int
+}
+
+func (t *countingTokenizer) CountTokens(text string) int {
+	t.callCount++
+	return t.wrapped.CountTokens(text)
+}
+
+type testPromptFormatter struct{}
+
+func (f testPromptFormatter) FormatPrompt(options FormatOptions) string {
+	var buf strings.Builder
+	buf.WriteString("You're Sveta.\n")
+	if options.Summary != "" {
+		buf.WriteString("Summary: " + options.Summary + "\n")
+	}
+	for _, memory := range options.Memories {
+		buf.WriteString(memory.Who + ": " + memory.What + "\n")
+	}
+	return buf.String()
+}
+
+type testBudgetLanguageModel struct {
+	contextSize int
+	tokenizer   Tokenizer
+}
+
+func (l *testBudgetLanguageModel) Name() string {
+	return "test"
+}
+
+func (l *testBudgetLanguageModel) ResponseModes() []ResponseMode {
+	return []ResponseMode{ResponseModeNormal}
+}
+
+func (l *testBudgetLanguageModel) Complete(prompt string, options CompleteOptions) (string, error) {
+	return prompt, nil
+}
+
+func (l *testBudgetLanguageModel) PromptFormatter() PromptFormatter {
+	return testPromptFormatter{}
+}
+
+func (l *testBudgetLanguageModel) ResponseCleaner() ResponseCleaner {
+	return nil
+}
+
+func (l *testBudgetLanguageModel) ContextSize() int {
+	return l.contextSize
+}
+
+func (l *testBudgetLanguageModel) Tokenizer() Tokenizer {
+	return l.tokenizer
+}
+
+// newTestBudgetMemory the label marks the memory in the prompt, and the padding makes it take about `size` characters
+func newTestBudgetMemory(memoryType MemoryType, who, label string, size int) *Memory {
+	return NewMemory(label, memoryType, who, time.Time{}, label+" "+strings.Repeat("a", size), "room", nil)
+}
+
+func TestFormatPromptWithinBudget(t *testing.T) {
+	memories := []*Memory{
+		newTestBudgetMemory(MemoryTypeDialog, "John", "dialog1", 150),
+		newTestBudgetMemory(MemoryTypeFact, "", "fact", 150),
+		newTestBudgetMemory(MemoryTypeDialog, "Sveta", "dialog2", 150),
+		newTestBudgetMemory(MemoryTypeNews, "", "news", 150),
+		newTestBudgetMemory(MemoryTypeDocument, "", "document", 150),
+		newTestBudgetMemory(MemoryTypeDialog, "John", "input", 1500),
+	}
+	summary := "summary " + strings.Repeat("b", 150)
+	tests := []struct {
+		name string
+		// expectedDropped the budget is set to fit the prompt without these parts
+		expectedDropped []string
+		isTruncated     bool
+		isTooSmall      bool
+	}{
+		{name: "fits"},
+		{name: "news first", expectedDropped: []string{"news"}},
+		{name: "knowledge before dialog", expectedDropped: []string{"news", "document", "fact"}},
+		{name: "oldest dialog", expectedDropped: []string{"news", "document", "fact", "dialog1"}},
+		{name: "summary after dialog", expectedDropped: []string{"news", "document", "fact", "dialog1", "dialog2", "summary"}},
+		{name: "input truncated", expectedDropped: []string{"news", "document", "fact", "dialog1", "dialog2", "summary"}, isTruncated: true},
+		{name: "system prompt too long", expectedDropped: []string{"news", "document", "fact", "dialog1", "dialog2", "summary"}, isTooSmall: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := FormatOptions{Summary: summary, Memories: slices.Clone(memories)}
+			expectedOptions := options
+			expectedOptions.Memories = slices.DeleteFunc(slices.Clone(memories), func(memory *Memory) bool {
+				return slices.Contains(test.expectedDropped, memory.ID)
+			})
+			if slices.Contains(test.expectedDropped, "summary") {
+				expectedOptions.Summary = ""
+			}
+			approximateTokenizer := NewApproximateTokenizer()
+			contextSize := approximateTokenizer.CountTokens(testPromptFormatter{}.FormatPrompt(expectedOptions)) + 2 // estimates may be off a bit
+			if test.isTruncated {
+				contextSize -= 200
+			}
+			if test.isTooSmall {
+				contextSize = 3
+			}
+			tokenizer := &countingTokenizer{wrapped: approximateTokenizer}
+			languageModel := &testBudgetLanguageModel{contextSize: contextSize, tokenizer: tokenizer}
+			responseService := &ResponseService{logger: testLogger{t: t}}
+			prompt := responseService.formatPromptWithinBudget(languageModel, options)
+			for _, label := range []string{"dialog1", "fact", "dialog2", "news", "document", "summary", "input"} {
+				if strings.Contains(prompt, label) == slices.Contains(test.expectedDropped, label) {
+					t.Errorf("expected \"%s\" to be dropped: %t, got:\n%s", label, slices.Contains(test.expectedDropped, label), prompt)
+				}
+			}
+			tokenCount := approximateTokenizer.CountTokens(prompt)
+			if test.isTooSmall {
+				if strings.Contains(prompt, truncationMarker) {
+					t.Errorf("expected the input to be left intact, got:\n%s", prompt)
+				}
+			} else if tokenCount > contextSize {
+				t.Errorf("expected at most %d tokens, got %d", contextSize, tokenCount)
+			}
+			if test.isTruncated && (!strings.Contains(prompt, truncationMarker) || tokenCount < contextSize-20) {
+				t.Errorf("expected the input to be truncated to about %d tokens, got %d:\n%s", contextSize, tokenCount, prompt)
+			}
+			if !test.isTruncated && !test.isTooSmall && strings.Contains(prompt, truncationMarker) {
+				t.Errorf("expected no truncation, got:\n%s", prompt)
+			}
+			// The whole prompt, each dropped part once, a few verifications and truncation attempts.
+			if maxCallCount := len(memories) + 2*maxTruncationAttempts + 4; tokenizer.callCount > maxCallCount {
+				t.Errorf("expected at most %d calls of the tokenizer, got %d", maxCallCount, tokenizer.callCount)
+			}
+		})
+	}
+}
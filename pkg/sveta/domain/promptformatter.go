@@ -1,6 +1,22 @@
 package domain
 
-import "time"
+import (
+	"strings"
+	"time"
+)
+
+// knowledgeSectionTitles how each type of knowledge memories is titled in the prompt, in the order of appearance.
+var knowledgeSectionTitles = []struct {
+	Type  MemoryType
+	Title string
+}{
+	{Type: MemoryTypeBio, Title: "Facts from your biography"},
+	{Type: MemoryTypeFact, Title: "Facts you learned from the conversation"},
+	{Type: MemoryTypeSummary, Title: "Earlier conversations"},
+	{Type: MemoryTypeSearchResult, Title: "Search results"},
+	{Type: MemoryTypeDocument, Title: "Excerpts from your documents (mention the document in brackets when you use it)"},
+	{Type: MemoryTypeNews, Title: "Latest news"},
+}
 
 type FormatOptions struct {
 	AgentName                string
@@ -8,10 +24,39 @@ type FormatOptions struct {
 	AgentDescriptionReminder string
 	Summary                  string
 	AnnouncedTime            *time.Time
-	Memories                 []*Memory
-	JSONOutputSchema         string
+	// Memories can be of any type: dialog memories are formatted as dialog lines, and the rest is formatted as
+	// knowledge (see FormatKnowledgeMemories(..))
+	Memories         []*Memory
+	JSONOutputSchema string
 }
 
 type PromptFormatter interface {
 	FormatPrompt(options FormatOptions) string
 }
+
+// DialogMemories returns only the memories which should be formatted as dialog lines.
+func (f FormatOptions) DialogMemories() []*Memory {
+	return FilterMemoriesByTypes(f.Memories, []MemoryType{MemoryTypeDialog})
+}
+
+// FormatKnowledgeMemories formats non-dialog memories (facts, news, search results etc.) as lists grouped by type,
+// so that they could be included in the system prompt instead of being presented as dialog lines.
+// Returns an empty string if there's no knowledge among the memories.
+func FormatKnowledgeMemories(memories []*Memory) string {
+	var buf strings.Builder
+	for _, section := range knowledgeSectionTitles {
+		sectionMemories := FilterMemoriesByTypes(memories, []MemoryType{section.Type})
+		if len(sectionMemories) == 0 {
+			continue
+		}
+		buf.WriteString(section.Title)
+		buf.WriteString(":\n")
+		for _, memory := range sectionMemories {
+			buf.WriteString("- ")
+			buf.WriteString(memory.What)
+			buf.WriteString("\n")
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
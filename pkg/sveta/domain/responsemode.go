@@ -18,4 +18,30 @@ var ResponseModes = []ResponseMode{
 	ResponseModeJSON,
 	ResponseModeNormal,
 	ResponseModeRerank,
+	ResponseModeCode,
+}
+
+var responseModeNames = map[ResponseMode]string{
+	ResponseModeNormal: "normal",
+	ResponseModeJSON:   "json",
+	ResponseModeRerank: "rerank",
+	ResponseModeCode:   "code",
+}
+
+func (r ResponseMode) String() string {
+	name, ok := responseModeNames[r]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+// ParseResponseMode returns false if the name is unknown (see ResponseMode.String())
+func ParseResponseMode(name string) (ResponseMode, bool) {
+	for responseMode, responseModeName := range responseModeNames {
+		if responseModeName == name {
+			return responseMode, true
+		}
+	}
+	return ResponseModeNormal, false
 }
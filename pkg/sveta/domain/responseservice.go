@@ -3,6 +3,7 @@ package domain
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
@@ -22,6 +23,7 @@ type ResponseService struct {
 	retryCount            int
 	textTemperature       float64
 	jsonTemperature       float64
+	responseTokenReserve  int
 }
 
 func NewResponseService(
@@ -41,8 +43,9 @@ func NewResponseService(
 		summaryRepository:     summaryRepository,
 		logger:                logger,
 		retryCount:            config.GetIntOrDefault(ConfigKeyResponseRetryCount, 3),
-		textTemperature:       config.GetFloat(ConfigKeyResponseTextTemperature),
-		jsonTemperature:       config.GetFloat(ConfigKeyResponseJSONTemperature),
+		textTemperature:       config.GetFloatOrDefault(ConfigKeyResponseTextTemperature, -1),
+		jsonTemperature:       config.GetFloatOrDefault(ConfigKeyResponseJSONTemperature, -1),
+		responseTokenReserve:  config.GetIntOrDefault(ConfigKeyResponseTokenReserve, 512),
 	}
 }
 
@@ -69,52 +72,70 @@ func (r *ResponseService) RespondToMemoriesWithText(memories []*Memory, response
 	if len(memories) == 0 {
 		return "", nil
 	}
-	dialogAndActionMemories := FilterMemoriesByTypes(memories, []MemoryType{MemoryTypeDialog})
-	languageModel := r.languageModelSelector.Select(responseMode)
+	languageModels, err := r.languageModelSelector.SelectWithFallbacks(responseMode)
+	if err != nil {
+		return "", err
+	}
 	announcedTime := time.Now()
 	summary := r.getSummary(memories)
-	dialogPrompt := languageModel.PromptFormatter().FormatPrompt(FormatOptions{
+	formatOptions := FormatOptions{
 		AgentName:                r.aiContext.AgentName,
 		AgentDescription:         r.aiContext.AgentDescription,
 		AgentDescriptionReminder: r.aiContext.AgentDescriptionReminder,
 		Summary:                  summary,
 		AnnouncedTime:            &announcedTime,
-		Memories:                 dialogAndActionMemories,
-	})
+		Memories:                 memories,
+	}
 	completeOptions := DefaultCompleteOptions
 	if responseMode == ResponseModeNormal {
-		completeOptions = completeOptions.WithTemperature(r.textTemperature)
+		completeOptions = withTemperature(completeOptions, r.textTemperature)
 	} else {
-		completeOptions = completeOptions.WithTemperature(r.jsonTemperature) // the reranker must have a lower temperature, similar to JSON
+		completeOptions = withTemperature(completeOptions, r.jsonTemperature) // the reranker must have a lower temperature, similar to JSON
 	}
+	completeOptions = completeOptions.WithPromptCacheKey(NewPromptCacheKey(
+		LastMemory(memories).Where+":"+responseMode.String(), // prompts of different modes have different prefixes
+		r.aiContext.AgentName,
+		r.aiContext.AgentDescription,
+		r.aiContext.AgentDescriptionReminder,
+		summary,
+	))
 	return r.complete(
-		dialogPrompt,
+		formatOptions,
 		completeOptions,
-		memories,
-		languageModel,
+		languageModels,
 	)
 }
 
 // RespondToQueryWithJSON responds to the given query in the JSON format and automatically fills `obj`'s property.
+// The output is restricted with a grammar generated from `obj`'s type (see GenerateJSONGrammar(..)), so the keys
+// and the types of the values are guaranteed to match, if the language model supports grammars.
 func (r *ResponseService) RespondToQueryWithJSON(query string, jsonObject any) error {
 	jsonOutputSchema, err := json.Marshal(jsonObject)
 	if err != nil {
 		return err
 	}
+	completeOptions := withTemperature(DefaultCompleteOptions.WithJSONMode(true), r.jsonTemperature)
+	jsonGrammar, err := GenerateJSONGrammar(jsonObject)
+	if err != nil {
+		r.logger.Log(fmt.Sprintf("failed to generate a JSON grammar, falling back to any JSON: %s", err))
+	} else {
+		completeOptions = completeOptions.WithJSONGrammar(jsonGrammar)
+	}
+	languageModels, err := r.languageModelSelector.SelectWithFallbacks(ResponseModeJSON)
+	if err != nil {
+		return err
+	}
 	queryMemories := []*Memory{r.memoryFactory.NewMemory(MemoryTypeDialog, "User", query, "")}
-	languageModel := r.languageModelSelector.Select(ResponseModeJSON)
-	dialogPrompt := languageModel.PromptFormatter().FormatPrompt(FormatOptions{
-		AgentName:                r.aiContext.AgentName,
-		AgentDescription:         r.aiContext.AgentDescription,
-		AgentDescriptionReminder: r.aiContext.AgentDescriptionReminder,
-		Memories:                 queryMemories,
-		JSONOutputSchema:         string(jsonOutputSchema),
-	})
 	response, err := r.complete(
-		dialogPrompt,
-		DefaultCompleteOptions.WithJSONMode(true).WithTemperature(r.jsonTemperature),
-		queryMemories,
-		languageModel,
+		FormatOptions{
+			AgentName:                r.aiContext.AgentName,
+			AgentDescription:         r.aiContext.AgentDescription,
+			AgentDescriptionReminder: r.aiContext.AgentDescriptionReminder,
+			Memories:                 queryMemories,
+			JSONOutputSchema:         string(jsonOutputSchema),
+		},
+		completeOptions,
+		languageModels,
 	)
 	if err != nil {
 		return err
@@ -123,14 +144,40 @@ func (r *ResponseService) RespondToQueryWithJSON(query string, jsonObject any) e
 }
 
 // For both RespondToMemoriesWithText(..) and RespondToQueryWithJSON(..)
-func (r *ResponseService) complete(prompt string, completeOptions CompleteOptions, memories []*Memory, languageModel LanguageModel) (string, error) {
-	if len(memories) == 0 {
+// Makes up to `retryCount` attempts (but at least one per language model): if a model returns an empty response, the
+// next one is tried, cycling back to the first one (see LanguageModelSelector.SelectWithFallbacks(..)); a model which
+// returns an error isn't tried again. A partial response of a model which timed out is used, but counts as a failure.
+// The failures are reported to the selector so that it could skip the models which keep failing.
+func (r *ResponseService) complete(formatOptions FormatOptions, completeOptions CompleteOptions, languageModels []LanguageModel) (string, error) {
+	memories := formatOptions.Memories
+	dialogMemories := FilterMemoriesByTypes(memories, []MemoryType{MemoryTypeDialog})
+	if len(dialogMemories) == 0 {
 		return "", ErrFailedToResponse
 	}
-	for i := 0; i < r.retryCount; i++ {
+	// the prompt depends on the model's format and context size
+	prompts := make(map[string]string)
+	erroredLanguageModels := make(map[string]struct{})
+	var lastErr error
+	attemptCount := max(r.retryCount, len(languageModels))
+	for i, attempt := 0, 0; attempt < attemptCount && len(erroredLanguageModels) < len(languageModels); i++ {
+		languageModel := languageModels[i%len(languageModels)]
+		if _, ok := erroredLanguageModels[languageModel.Name()]; ok {
+			continue
+		}
+		attempt++
+		prompt, ok := prompts[languageModel.Name()]
+		if !ok {
+			prompt = r.formatPromptWithinBudget(languageModel, formatOptions)
+			prompts[languageModel.Name()] = prompt
+		}
 		response, err := languageModel.Complete(prompt, completeOptions)
-		if err != nil {
-			return "", err
+		isTimedOut := errors.Is(err, ErrLanguageModelTimeout)
+		if err != nil && !isTimedOut {
+			r.logger.Log(fmt.Sprintf("language model \"%s\" failed: %s\n", languageModel.Name(), err))
+			r.languageModelSelector.ReportFailure(languageModel)
+			erroredLanguageModels[languageModel.Name()] = struct{}{}
+			lastErr = err
+			continue
 		}
 		cleanResponse := languageModel.ResponseCleaner().CleanResponse(CleanOptions{
 			Prompt:    prompt,
@@ -139,16 +186,34 @@ func (r *ResponseService) complete(prompt string, completeOptions CompleteOption
 			Memories:  memories,
 		})
 		// Sometimes, a model can just repeat the user's name.
-		if strings.ToLower(cleanResponse) == strings.ToLower(LastMemory(memories).Who) {
+		if strings.ToLower(cleanResponse) == strings.ToLower(LastMemory(dialogMemories).Who) || cleanResponse == "" {
+			r.logger.Log(fmt.Sprintf("language model \"%s\" returned an empty response\n", languageModel.Name()))
+			r.languageModelSelector.ReportFailure(languageModel)
 			continue
 		}
-		if cleanResponse != "" {
-			return cleanResponse, nil
+		if isTimedOut {
+			// The partial response is still better than nothing, but a model which keeps timing out must be skipped.
+			r.logger.Log(fmt.Sprintf("language model \"%s\" returned a partial response: %s\n", languageModel.Name(), err))
+			r.languageModelSelector.ReportFailure(languageModel)
+		} else {
+			r.languageModelSelector.ReportSuccess(languageModel)
 		}
+		return cleanResponse, nil
+	}
+	if lastErr != nil {
+		return "", lastErr
 	}
 	return "", ErrFailedToResponse
 }
 
+// withTemperature a negative temperature means it's not configured, so the model's default temperature is used
+func withTemperature(options CompleteOptions, temperature float64) CompleteOptions {
+	if temperature < 0 {
+		return options
+	}
+	return options.WithTemperature(temperature)
+}
+
 func (r *ResponseService) getSummary(memories []*Memory) string {
 	where := LastMemory(memories).Where
 	summary, err := r.summaryRepository.FindByWhere(where)
@@ -0,0 +1,7 @@
+package domain
+
+// Snapshotter creates backups of the whole state of the AI (memories, summaries, capabilities, persona etc.)
+type Snapshotter interface {
+	// CreateSnapshot returns the name of the created snapshot
+	CreateSnapshot() (string, error)
+}
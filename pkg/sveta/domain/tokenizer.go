@@ -0,0 +1,31 @@
+package domain
+
+import "unicode/utf8"
+
+// Tokenizer counts how many tokens a text takes in a language model's context.
+type Tokenizer interface {
+	CountTokens(text string) int
+}
+
+type approximateTokenizer struct{}
+
+// NewApproximateTokenizer estimates the token count without the model's vocabulary (for models whose tokenizer isn't
+// available), erring on the side of more tokens:
+// 3 ASCII characters per token (it's about 4 for English with most tokenizers), and 1 token per non-ASCII character
+// (Cyrillic, CJK etc. are split into much smaller tokens than Latin).
+func NewApproximateTokenizer() Tokenizer {
+	return &approximateTokenizer{}
+}
+
+func (t *approximateTokenizer) CountTokens(text string) int {
+	asciiCount := 0
+	nonASCIICount := 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			asciiCount++
+		} else {
+			nonASCIICount++
+		}
+	}
+	return (asciiCount+2)/3 + nonASCIICount
+}
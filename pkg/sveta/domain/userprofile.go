@@ -0,0 +1,78 @@
+package domain
+
+import "time"
+
+// ProfileVisibility specifies in which rooms an entry of a user's profile can be recalled
+type ProfileVisibility int
+
+const (
+	// ProfileVisibilityPublic the entry is recalled in every room
+	ProfileVisibilityPublic = ProfileVisibility(iota)
+	// ProfileVisibilityRoom the entry is recalled only in the room it was learned in
+	ProfileVisibilityRoom
+	// ProfileVisibilityDM the entry is recalled only in private conversations with the user (see IsDMRoom(..))
+	ProfileVisibilityDM
+)
+
+var profileVisibilityNames = map[ProfileVisibility]string{
+	ProfileVisibilityPublic: "public",
+	ProfileVisibilityRoom:   "room",
+	ProfileVisibilityDM:     "dm",
+}
+
+func (v ProfileVisibility) String() string {
+	name, ok := profileVisibilityNames[v]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+// ParseProfileVisibility returns false if the name is unknown (see ProfileVisibility.String())
+func ParseProfileVisibility(name string) (ProfileVisibility, bool) {
+	for visibility, visibilityName := range profileVisibilityNames {
+		if visibilityName == name {
+			return visibility, true
+		}
+	}
+	return ProfileVisibilityRoom, false
+}
+
+// UserProfileEntry a fact about a user, shared across rooms (unlike fact memories which belong to a single room)
+type UserProfileEntry struct {
+	ID         string
+	Who        string
+	What       string
+	Where      string // the room the entry was learned in
+	When       time.Time
+	Visibility ProfileVisibility
+}
+
+// IsDMRoom private conversations with a user are stored in a room named after the user
+func IsDMRoom(who, where string) bool {
+	return who != "" && who == where
+}
+
+// IsVisibleIn whether the entry can be recalled in the given room
+func (e *UserProfileEntry) IsVisibleIn(where string) bool {
+	switch e.Visibility {
+	case ProfileVisibilityPublic:
+		return true
+	case ProfileVisibilityRoom:
+		return e.Where == where
+	case ProfileVisibilityDM:
+		return IsDMRoom(e.Who, where)
+	}
+	return false
+}
+
+// FilterVisibleProfileEntries keeps only the entries which can be recalled in the given room
+func FilterVisibleProfileEntries(entries []*UserProfileEntry, where string) []*UserProfileEntry {
+	result := make([]*UserProfileEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsVisibleIn(where) {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
@@ -0,0 +1,11 @@
+package domain
+
+type UserProfileRepository interface {
+	NextID() string
+	Store(entry *UserProfileEntry) error
+	// FindByWho returns the entries sorted by time (older first)
+	FindByWho(who string) ([]*UserProfileEntry, error)
+	// Remove removes the entry only if it belongs to the given user
+	Remove(who, id string) error
+	RemoveAll() error
+}
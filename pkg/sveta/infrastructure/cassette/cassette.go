@@ -0,0 +1,254 @@
+package cassette
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+
+	"kgeyst.com/sveta/pkg/common"
+)
+
+const (
+	// ConfigKeyCassetteMode "record" saves every completion, embedding and image description to the cassette file;
+	// "replay" serves them back from the file instead of running the models (for deterministic offline runs). Empty
+	// by default (disabled).
+	ConfigKeyCassetteMode = "cassetteMode"
+	// ConfigKeyCassettePath the path to the cassette file (JSON Lines, one interaction per line)
+	ConfigKeyCassettePath = "cassettePath"
+)
+
+const (
+	ModeRecord = "record"
+	ModeReplay = "replay"
+)
+
+// ErrUnmatchedInteraction the cassette has no recorded interaction for the request (the prompt has changed, etc.)
+var ErrUnmatchedInteraction = errors.New("no matching interaction in the cassette")
+
+const (
+	interactionKindCompletion = "completion"
+	interactionKindEmbedding  = "embedding"
+	interactionKindVision     = "vision"
+	// interactionKindEmbedder the model name and the dimension count of the embedder (not a request)
+	interactionKindEmbedder = "embedder"
+)
+
+// volatilePatterns the parts of prompts which depend on the current time; they're masked when matching, so that a
+// conversation recorded yesterday can be replayed today
+var volatilePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(Mon|Tue|Wed|Thu|Fri|Sat|Sun), \d{2} [A-Z][a-z]{2} \d{4} \d{2}:\d{2}(:\d{2})?`), // the announced time
+	regexp.MustCompile(`\(said [^()]*\)`), // "(said 5 minutes ago)"
+}
+
+// interaction a recorded request to a model and its outcome
+type interaction struct {
+	Kind  string `json:"kind"`
+	Model string `json:"model,omitempty"`
+	// Input the prompt or the sentence to embed
+	Input string `json:"input"`
+	// Options the complete options (for completions) or the hash of the image (for vision)
+	Options string `json:"options,omitempty"`
+	// Output the response or the formatted embedding (see domain.Embedding.ToExactFormattedValues())
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// IsTimedOut the completion is partial (see domain.ErrLanguageModelTimeout)
+	IsTimedOut bool `json:"timedOut,omitempty"`
+	// DimensionCount only for interactionKindEmbedder
+	DimensionCount int `json:"dimensionCount,omitempty"`
+}
+
+// Cassette a file of recorded interactions with the models, shared by the recording and replaying decorators
+// (see NewLanguageModelDecorator(..), NewEmbedderDecorator(..) and NewVisionModelDecorator(..)). It's thread-safe.
+type Cassette struct {
+	mutex    sync.Mutex
+	mode     string
+	filePath string
+	logger   common.Logger
+	file     *os.File // the record mode only, nil after Stop()
+	// embedder the model name and the dimension count of the embedder (interactionKindEmbedder), so that the embedder
+	// can be replayed without the embedding model
+	embedder interaction
+	// replayIndices how many times each interaction key has been replayed: identical requests are served the recorded
+	// responses in the order of recording, and the last one is repeated after that
+	replayIndices map[string]int
+	replayQueues  map[string][]*interaction
+}
+
+// NewCassette returns nil if the cassette is disabled (see ConfigKeyCassetteMode). In the replay mode, the cassette
+// file must exist; in the record mode, it's overwritten, and Stop() must be called on shutdown.
+func NewCassette(config *common.Config, logger common.Logger) (*Cassette, error) {
+	mode := config.GetString(ConfigKeyCassetteMode)
+	if mode == "" {
+		return nil, nil
+	}
+	if mode != ModeRecord && mode != ModeReplay {
+		return nil, fmt.Errorf("unknown cassette mode \"%s\"", mode)
+	}
+	c := &Cassette{
+		mode:          mode,
+		filePath:      config.GetStringOrDefault(ConfigKeyCassettePath, "cassette.jsonl"),
+		logger:        logger,
+		replayIndices: make(map[string]int),
+		replayQueues:  make(map[string][]*interaction),
+	}
+	if mode == ModeRecord {
+		file, err := os.OpenFile(c.filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		c.file = file
+		return c, nil
+	}
+	err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cassette) load() error {
+	file, err := os.Open(c.filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	interactionCount := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024) // prompts can be long
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var i interaction
+		err = json.Unmarshal(scanner.Bytes(), &i)
+		if err != nil {
+			return fmt.Errorf("malformed cassette \"%s\" at line %d: %w", c.filePath, lineNumber, err)
+		}
+		if i.Kind == interactionKindEmbedder {
+			c.embedder = i
+			continue
+		}
+		key := i.key()
+		c.replayQueues[key] = append(c.replayQueues[key], &i)
+		interactionCount++
+	}
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("malformed cassette \"%s\": %w", c.filePath, err)
+	}
+	c.logger.Log(fmt.Sprintf("cassette: replaying %d interactions from \"%s\"\n", interactionCount, c.filePath))
+	return nil
+}
+
+func (c *Cassette) IsReplaying() bool {
+	return c.mode == ModeReplay
+}
+
+// Stop closes the cassette file; nothing is recorded after that
+func (c *Cassette) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.file == nil {
+		return
+	}
+	err := c.file.Close()
+	if err != nil {
+		c.logger.Log(fmt.Sprintf("cassette: failed to close \"%s\": %s\n", c.filePath, err))
+	}
+	c.file = nil
+}
+
+// record appends the interaction to the file right away, so that nothing is lost if the process is killed
+func (c *Cassette) record(i *interaction) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.appendLine(i)
+}
+
+func (c *Cassette) recordEmbedder(modelName string, dimensionCount int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.embedder.Model == modelName && c.embedder.DimensionCount == dimensionCount {
+		return
+	}
+	c.embedder = interaction{
+		Kind:           interactionKindEmbedder,
+		Model:          modelName,
+		DimensionCount: dimensionCount,
+	}
+	c.appendLine(&c.embedder)
+}
+
+// appendLine must be called under the mutex
+func (c *Cassette) appendLine(i *interaction) {
+	if c.file == nil {
+		c.logger.Log(fmt.Sprintf("cassette: \"%s\" is closed, the %s isn't recorded\n", c.filePath, i.Kind))
+		return
+	}
+	line, err := json.Marshal(i)
+	if err != nil {
+		c.logger.Log(fmt.Sprintf("cassette: %s\n", err))
+		return
+	}
+	_, err = c.file.Write(append(line, '\n'))
+	if err != nil {
+		c.logger.Log(fmt.Sprintf("cassette: failed to save \"%s\": %s\n", c.filePath, err))
+	}
+}
+
+// replay finds the recorded outcome of the request (Kind, Model, Input and Options must be set)
+func (c *Cassette) replay(request *interaction) (*interaction, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := request.key()
+	queue := c.replayQueues[key]
+	if len(queue) == 0 {
+		c.logger.Log(fmt.Sprintf("cassette: unmatched %s (model \"%s\"):\n%s\n", request.Kind, request.Model, request.Input))
+		return nil, fmt.Errorf("%w: %s for \"%s\"", ErrUnmatchedInteraction, request.Kind, request.Model)
+	}
+	index := c.replayIndices[key]
+	if index < len(queue)-1 {
+		c.replayIndices[key] = index + 1
+	}
+	return queue[index], nil
+}
+
+func (c *Cassette) embedderModelName() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.embedder.Model
+}
+
+func (c *Cassette) embedderDimensionCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.embedder.DimensionCount
+}
+
+func (i *interaction) key() string {
+	input := i.Input
+	for _, pattern := range volatilePatterns {
+		input = pattern.ReplaceAllString(input, "<time>")
+	}
+	return i.Kind + "\x00" + i.Model + "\x00" + i.Options + "\x00" + input
+}
+
+// outcome converts the recorded error back
+func (i *interaction) outcome() (string, error) {
+	if i.Error != "" {
+		return "", errors.New(i.Error)
+	}
+	return i.Output, nil
+}
+
+func errorToString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,186 @@
+package cassette
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Log(message string) {
+	l.t.Log(message)
+}
+
+// testLanguageModel numbers its completions, so that repeated prompts get different responses
+type testLanguageModel struct {
+	completionCount int
+}
+
+func (l *testLanguageModel) Name() string {
+	return "test"
+}
+
+func (l *testLanguageModel) ResponseModes() []domain.ResponseMode {
+	return []domain.ResponseMode{domain.ResponseModeNormal}
+}
+
+func (l *testLanguageModel) Complete(prompt string, options domain.CompleteOptions) (string, error) {
+	if strings.Contains(prompt, "fail") {
+		return "", errors.New("the model failed")
+	}
+	l.completionCount++
+	return fmt.Sprintf("%s\nresponse %d", prompt, l.completionCount), nil
+}
+
+func (l *testLanguageModel) PromptFormatter() domain.PromptFormatter {
+	return nil
+}
+
+func (l *testLanguageModel) ResponseCleaner() domain.ResponseCleaner {
+	return nil
+}
+
+func (l *testLanguageModel) ContextSize() int {
+	return 0
+}
+
+func (l *testLanguageModel) Tokenizer() domain.Tokenizer {
+	return domain.NewApproximateTokenizer()
+}
+
+type testEmbedder struct{}
+
+func (e testEmbedder) Embed(sentence string) (domain.Embedding, error) {
+	// Not round, so that a loss of precision would change the replayed embeddings.
+	return domain.NewEmbedding([]float64{float64(len(sentence)) / 7.0, 0.123456789, -1.0 / 3.0}), nil
+}
+
+func (e testEmbedder) EmbedBatch(sentences []string) ([]domain.Embedding, error) {
+	result := make([]domain.Embedding, 0, len(sentences))
+	for _, sentence := range sentences {
+		embedding, _ := e.Embed(sentence)
+		result = append(result, embedding)
+	}
+	return result, nil
+}
+
+func (e testEmbedder) ModelName() string {
+	return "test-embedder"
+}
+
+func (e testEmbedder) DimensionCount() int {
+	return 3
+}
+
+func newTestCassette(t *testing.T, mode, cassettePath string) *Cassette {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configPath, []byte("cassetteMode: "+mode+"\ncassettePath: "+cassettePath+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := common.LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cassette, err := NewCassette(config, testLogger{t: t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cassette
+}
+
+func TestReplayRecordedInteractions(t *testing.T) {
+	cassettePath := filepath.Join(t.TempDir(), "cassette.jsonl")
+	recordingCassette := newTestCassette(t, ModeRecord, cassettePath)
+	recordingModel := NewLanguageModelDecorator(&testLanguageModel{}, recordingCassette)
+	recordingEmbedder := NewEmbedderDecorator(testEmbedder{}, recordingCassette)
+	prompts := []string{
+		"Current time: Mon, 06 May 2024 10:00\nJohn: hi",
+		"Current time: Mon, 06 May 2024 10:00\nJohn: hi", // a repeated prompt
+		"John: fail",
+	}
+	var expectedResponses []string
+	var expectedErrors []error
+	for _, prompt := range prompts {
+		response, err := recordingModel.Complete(prompt, domain.CompleteOptions{})
+		expectedResponses = append(expectedResponses, response)
+		expectedErrors = append(expectedErrors, err)
+	}
+	expectedEmbeddings, err := recordingEmbedder.EmbedBatch([]string{"hi", "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordingCassette.Stop()
+
+	replayingCassette := newTestCassette(t, ModeReplay, cassettePath)
+	replayingModel := NewLanguageModelDecorator(&testLanguageModel{completionCount: 100}, replayingCassette)
+	replayingEmbedder := NewEmbedderDecorator(nil, replayingCassette)
+	for index, prompt := range prompts {
+		prompt = strings.ReplaceAll(prompt, "Mon, 06 May 2024 10:00", "Tue, 07 May 2024 18:30") // replayed a day later
+		response, err := replayingModel.Complete(prompt, domain.CompleteOptions{})
+		if response != expectedResponses[index] { // the recorded response is served as is
+			t.Errorf("expected the response %q, got %q", expectedResponses[index], response)
+		}
+		if fmt.Sprint(err) != fmt.Sprint(expectedErrors[index]) {
+			t.Errorf("expected the error %v, got %v", expectedErrors[index], err)
+		}
+	}
+	_, err = replayingModel.Complete("John: unknown", domain.CompleteOptions{})
+	if !errors.Is(err, ErrUnmatchedInteraction) {
+		t.Errorf("expected ErrUnmatchedInteraction, got %v", err)
+	}
+	if replayingEmbedder.ModelName() != "test-embedder" || replayingEmbedder.DimensionCount() != 3 {
+		t.Errorf("expected the embedder to be replayed, got %s (%d)", replayingEmbedder.ModelName(), replayingEmbedder.DimensionCount())
+	}
+	for index, sentence := range []string{"hi", "hello"} {
+		embedding, err := replayingEmbedder.Embed(sentence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if embedding.ToExactFormattedValues() != expectedEmbeddings[index].ToExactFormattedValues() {
+			t.Errorf("expected the embedding %s, got %s", expectedEmbeddings[index].ToExactFormattedValues(), embedding.ToExactFormattedValues())
+		}
+		if similarity := embedding.GetSimilarityTo(expectedEmbeddings[index]); similarity != expectedEmbeddings[index].GetSimilarityTo(expectedEmbeddings[index]) {
+			t.Errorf("expected the same similarity as the recorded embedding, got %f", similarity)
+		}
+	}
+}
+
+// tokenizingLanguageModel has a tokenizer which differs from the estimate
+type tokenizingLanguageModel struct {
+	testLanguageModel
+}
+
+type wordTokenizer struct{}
+
+func (t wordTokenizer) CountTokens(text string) int {
+	return len(strings.Fields(text))
+}
+
+func (l *tokenizingLanguageModel) Tokenizer() domain.Tokenizer {
+	return wordTokenizer{}
+}
+
+func TestTokensAreEstimatedInBothModes(t *testing.T) {
+	cassettePath := filepath.Join(t.TempDir(), "cassette.jsonl")
+	text := "John: Привет, Sveta! How are you?"
+	expectedTokenCount := domain.NewApproximateTokenizer().CountTokens(text)
+	for _, mode := range []string{ModeRecord, ModeReplay} {
+		modelCassette := newTestCassette(t, mode, cassettePath)
+		languageModel := NewLanguageModelDecorator(&tokenizingLanguageModel{}, modelCassette)
+		tokenCount := languageModel.Tokenizer().CountTokens(text)
+		modelCassette.Stop()
+		if tokenCount != expectedTokenCount {
+			t.Errorf("%s: expected the estimated %d tokens, got %d", mode, expectedTokenCount, tokenCount)
+		}
+	}
+}
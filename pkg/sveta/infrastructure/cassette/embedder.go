@@ -0,0 +1,96 @@
+package cassette
+
+import (
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+type embedderDecorator struct {
+	wrappedEmbedder domain.Embedder // nil when replaying
+	cassette        *Cassette
+}
+
+// NewEmbedderDecorator records the embeddings produced by the wrapped embedder to the cassette. When replaying,
+// `wrappedEmbedder` can be nil, as the embeddings, the model name and the dimension count are all served from the
+// cassette.
+func NewEmbedderDecorator(wrappedEmbedder domain.Embedder, cassette *Cassette) domain.Embedder {
+	return &embedderDecorator{
+		wrappedEmbedder: wrappedEmbedder,
+		cassette:        cassette,
+	}
+}
+
+func (e *embedderDecorator) Embed(sentence string) (domain.Embedding, error) {
+	if e.cassette.IsReplaying() {
+		return e.replay(sentence)
+	}
+	embedding, err := e.wrappedEmbedder.Embed(sentence)
+	e.record(sentence, embedding, err)
+	return embedding, err
+}
+
+// EmbedBatch the embeddings are recorded one by one, so that they could be replayed regardless of how they're batched
+func (e *embedderDecorator) EmbedBatch(sentences []string) ([]domain.Embedding, error) {
+	if e.cassette.IsReplaying() {
+		embeddings := make([]domain.Embedding, 0, len(sentences))
+		for _, sentence := range sentences {
+			embedding, err := e.replay(sentence)
+			if err != nil {
+				return nil, err
+			}
+			embeddings = append(embeddings, embedding)
+		}
+		return embeddings, nil
+	}
+	embeddings, err := e.wrappedEmbedder.EmbedBatch(sentences)
+	if err != nil {
+		return nil, err
+	}
+	for i, sentence := range sentences {
+		e.record(sentence, embeddings[i], nil)
+	}
+	return embeddings, nil
+}
+
+func (e *embedderDecorator) ModelName() string {
+	if e.cassette.IsReplaying() {
+		return e.cassette.embedderModelName()
+	}
+	return e.wrappedEmbedder.ModelName()
+}
+
+func (e *embedderDecorator) DimensionCount() int {
+	if e.cassette.IsReplaying() {
+		return e.cassette.embedderDimensionCount()
+	}
+	return e.wrappedEmbedder.DimensionCount()
+}
+
+func (e *embedderDecorator) record(sentence string, embedding domain.Embedding, err error) {
+	request := &interaction{
+		Kind:  interactionKindEmbedding,
+		Model: e.wrappedEmbedder.ModelName(),
+		Input: sentence,
+		Error: errorToString(err),
+	}
+	if err == nil {
+		request.Output = embedding.ToExactFormattedValues()
+		e.cassette.recordEmbedder(request.Model, embedding.DimensionCount())
+	}
+	e.cassette.record(request)
+}
+
+func (e *embedderDecorator) replay(sentence string) (domain.Embedding, error) {
+	recorded, err := e.cassette.replay(&interaction{
+		Kind:  interactionKindEmbedding,
+		Model: e.cassette.embedderModelName(),
+		Input: sentence,
+	})
+	if err != nil {
+		return domain.Embedding{}, err
+	}
+	output, err := recorded.outcome()
+	if err != nil {
+		return domain.Embedding{}, err
+	}
+	return domain.NewEmbeddingFromExactFormattedValues(output)
+}
@@ -0,0 +1,87 @@
+package cassette
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+type languageModelDecorator struct {
+	wrappedLanguageModel domain.LanguageModel
+	cassette             *Cassette
+	tokenizer            domain.Tokenizer
+}
+
+// NewLanguageModelDecorator records the completions of the wrapped model to the cassette, or serves them from the
+// cassette (the wrapped model is then only used for its prompt formatter, response cleaner etc.)
+func NewLanguageModelDecorator(wrappedLanguageModel domain.LanguageModel, cassette *Cassette) domain.LanguageModel {
+	return &languageModelDecorator{
+		wrappedLanguageModel: wrappedLanguageModel,
+		cassette:             cassette,
+		tokenizer:            domain.NewApproximateTokenizer(),
+	}
+}
+
+func (l *languageModelDecorator) Name() string {
+	return l.wrappedLanguageModel.Name()
+}
+
+func (l *languageModelDecorator) ResponseModes() []domain.ResponseMode {
+	return l.wrappedLanguageModel.ResponseModes()
+}
+
+func (l *languageModelDecorator) Complete(prompt string, options domain.CompleteOptions) (string, error) {
+	request := &interaction{
+		Kind:    interactionKindCompletion,
+		Model:   l.Name(),
+		Input:   prompt,
+		Options: formatCompleteOptions(options),
+	}
+	if l.cassette.IsReplaying() {
+		recorded, err := l.cassette.replay(request)
+		if err != nil {
+			return "", err
+		}
+		if recorded.IsTimedOut {
+			return recorded.Output, fmt.Errorf("%w (replayed)", domain.ErrLanguageModelTimeout)
+		}
+		return recorded.outcome()
+	}
+	response, err := l.wrappedLanguageModel.Complete(prompt, options)
+	request.Output = response
+	request.Error = errorToString(err)
+	request.IsTimedOut = errors.Is(err, domain.ErrLanguageModelTimeout)
+	l.cassette.record(request)
+	return response, err
+}
+
+func (l *languageModelDecorator) PromptFormatter() domain.PromptFormatter {
+	return l.wrappedLanguageModel.PromptFormatter()
+}
+
+func (l *languageModelDecorator) ResponseCleaner() domain.ResponseCleaner {
+	return l.wrappedLanguageModel.ResponseCleaner()
+}
+
+func (l *languageModelDecorator) ContextSize() int {
+	return l.wrappedLanguageModel.ContextSize()
+}
+
+// Tokenizer the model's own tokenizer may be unavailable when replaying (see llamacpp's tokenizer), and its fallback
+// would fit prompts into the context differently, so that they wouldn't match the recorded ones: the same estimate
+// is used in both modes instead
+func (l *languageModelDecorator) Tokenizer() domain.Tokenizer {
+	return l.tokenizer
+}
+
+// formatCompleteOptions the options are part of the key, as the same prompt can be completed differently (for
+// example, with a different grammar)
+func formatCompleteOptions(options domain.CompleteOptions) string {
+	bytes, err := json.Marshal(options)
+	if err != nil {
+		return ""
+	}
+	return string(bytes)
+}
@@ -0,0 +1,61 @@
+package cassette
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+
+	"kgeyst.com/sveta/pkg/sveta/domain/passes/vision"
+)
+
+// visionModelName vision models have no names, but the interactions are keyed by the model for consistency
+const visionModelName = "vision"
+
+type visionModelDecorator struct {
+	wrappedVisionModel vision.Model // nil when replaying
+	cassette           *Cassette
+}
+
+// NewVisionModelDecorator records the image descriptions of the wrapped model to the cassette, or serves them from
+// the cassette (then `wrappedVisionModel` can be nil). Images are matched by their contents, as they're downloaded to
+// temporary files with random names.
+func NewVisionModelDecorator(wrappedVisionModel vision.Model, cassette *Cassette) vision.Model {
+	return &visionModelDecorator{
+		wrappedVisionModel: wrappedVisionModel,
+		cassette:           cassette,
+	}
+}
+
+func (v *visionModelDecorator) Infer(filePath, prompt string) (string, error) {
+	imageHash, err := hashFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	request := &interaction{
+		Kind:    interactionKindVision,
+		Model:   visionModelName,
+		Input:   prompt,
+		Options: imageHash,
+	}
+	if v.cassette.IsReplaying() {
+		recorded, err := v.cassette.replay(request)
+		if err != nil {
+			return "", err
+		}
+		return recorded.outcome()
+	}
+	response, err := v.wrappedVisionModel.Infer(filePath, prompt)
+	request.Output = response
+	request.Error = errorToString(err)
+	v.cassette.record(request)
+	return response, err
+}
+
+func hashFile(filePath string) (string, error) {
+	bytes, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(bytes)
+	return hex.EncodeToString(hash[:]), nil
+}
@@ -0,0 +1,135 @@
+package documents
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type Chunker struct {
+	maxSize int
+	overlap int
+}
+
+// NewChunker splits documents into chunks of at most `maxSize` characters, preferably at paragraph and sentence
+// boundaries. Consecutive chunks share up to `overlap` characters (whole sentences), so that a statement split between
+// two chunks can still be found.
+func NewChunker(maxSize, overlap int) *Chunker {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	if overlap >= maxSize {
+		overlap = maxSize / 2
+	}
+	return &Chunker{
+		maxSize: maxSize,
+		overlap: max(overlap, 0),
+	}
+}
+
+func (c *Chunker) Chunk(paragraphs []string) []string {
+	var result []string
+	var chunk []string // sentences
+	chunkSize := 0
+	flush := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		result = append(result, strings.Join(chunk, " "))
+		// The trailing sentences are repeated in the next chunk.
+		overlapStart := len(chunk)
+		overlapSize := 0
+		for overlapStart > 0 {
+			sentenceSize := utf8.RuneCountInString(chunk[overlapStart-1]) + 1
+			if overlapSize+sentenceSize > c.overlap {
+				break
+			}
+			overlapSize += sentenceSize
+			overlapStart--
+		}
+		chunk = append([]string(nil), chunk[overlapStart:]...)
+		chunkSize = overlapSize
+	}
+	for _, paragraph := range paragraphs {
+		if chunkSize-c.overlap >= c.maxSize/2 { // prefer to start a new chunk with a new paragraph
+			flush()
+		}
+		for _, sentence := range c.splitIntoSentences(paragraph) {
+			sentenceSize := utf8.RuneCountInString(sentence) + 1
+			if chunkSize+sentenceSize > c.maxSize+1 {
+				flush()
+				for chunkSize > 0 && chunkSize+sentenceSize > c.maxSize+1 { // the overlap doesn't fit
+					chunkSize -= utf8.RuneCountInString(chunk[0]) + 1
+					chunk = chunk[1:]
+				}
+			}
+			chunk = append(chunk, sentence)
+			chunkSize += sentenceSize
+		}
+	}
+	if chunkSize > 0 && (len(result) == 0 || !c.isOnlyOverlap(chunk, result[len(result)-1])) {
+		result = append(result, strings.Join(chunk, " "))
+	}
+	return result
+}
+
+// isOnlyOverlap whether the remaining chunk only repeats the end of the previous chunk
+func (c *Chunker) isOnlyOverlap(chunk []string, previousChunk string) bool {
+	return strings.HasSuffix(previousChunk, strings.Join(chunk, " "))
+}
+
+// splitIntoSentences sentences longer than the maximum chunk size are split by words (or by characters, if a word
+// is too long, too)
+func (c *Chunker) splitIntoSentences(paragraph string) []string {
+	var result []string
+	for _, sentence := range splitIntoSentences(paragraph) {
+		if utf8.RuneCountInString(sentence) <= c.maxSize {
+			result = append(result, sentence)
+			continue
+		}
+		var piece []string
+		pieceSize := 0
+		flushPiece := func() {
+			if len(piece) > 0 {
+				result = append(result, strings.Join(piece, " "))
+				piece = nil
+				pieceSize = 0
+			}
+		}
+		for _, word := range strings.Fields(sentence) {
+			for utf8.RuneCountInString(word) > c.maxSize {
+				flushPiece()
+				runes := []rune(word)
+				result = append(result, string(runes[:c.maxSize]))
+				word = string(runes[c.maxSize:])
+			}
+			wordSize := utf8.RuneCountInString(word) + 1
+			if pieceSize+wordSize > c.maxSize+1 {
+				flushPiece()
+			}
+			piece = append(piece, word)
+			pieceSize += wordSize
+		}
+		flushPiece()
+	}
+	return result
+}
+
+// splitIntoSentences a sentence ends with '.', '!' or '?' followed by whitespace and an uppercase letter or a digit
+// (a simple heuristic which doesn't split "e.g. this")
+func splitIntoSentences(text string) []string {
+	runes := []rune(normalizeWhitespace(text))
+	var result []string
+	start := 0
+	for i := 0; i < len(runes)-2; i++ {
+		if (runes[i] == '.' || runes[i] == '!' || runes[i] == '?') && runes[i+1] == ' ' &&
+			(unicode.IsUpper(runes[i+2]) || unicode.IsDigit(runes[i+2]) || runes[i+2] == '"') {
+			result = append(result, string(runes[start:i+1]))
+			start = i + 2
+		}
+	}
+	if start < len(runes) {
+		result = append(result, string(runes[start:]))
+	}
+	return result
+}
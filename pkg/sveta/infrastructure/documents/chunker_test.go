@@ -0,0 +1,124 @@
+package documents
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestChunk(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxSize        int
+		overlap        int
+		paragraphs     []string
+		expectedChunks []string
+	}{
+		{
+			name:       "empty",
+			maxSize:    100,
+			overlap:    20,
+			paragraphs: nil,
+		},
+		{
+			name:           "short paragraphs are joined",
+			maxSize:        40,
+			overlap:        0,
+			paragraphs:     []string{"Short.", "Also short."},
+			expectedChunks: []string{"Short. Also short."},
+		},
+		{
+			name:           "a new chunk starts with a new paragraph",
+			maxSize:        40,
+			overlap:        0,
+			paragraphs:     []string{"A first paragraph here.", "Second paragraph."},
+			expectedChunks: []string{"A first paragraph here.", "Second paragraph."},
+		},
+		{
+			name:           "sentences overlap",
+			maxSize:        30,
+			overlap:        12,
+			paragraphs:     []string{"First sentence. Second one. Third one here."},
+			expectedChunks: []string{"First sentence. Second one.", "Second one. Third one here."},
+		},
+		{
+			name:           "a sentence too long for the overlap isn't repeated",
+			maxSize:        30,
+			overlap:        10,
+			paragraphs:     []string{"First sentence. Second one. Third one here."},
+			expectedChunks: []string{"First sentence. Second one.", "Third one here."},
+		},
+		{
+			name:           "the remaining overlap isn't a chunk",
+			maxSize:        20,
+			overlap:        5,
+			paragraphs:     []string{"Three go. One. Two.", " "},
+			expectedChunks: []string{"Three go. One. Two."},
+		},
+		{
+			name:           "long sentences are split by words",
+			maxSize:        10,
+			overlap:        0,
+			paragraphs:     []string{"aaaa bbbb cccc dddd"},
+			expectedChunks: []string{"aaaa bbbb", "cccc dddd"},
+		},
+		{
+			name:           "long words are split by characters",
+			maxSize:        4,
+			overlap:        0,
+			paragraphs:     []string{"abcdefghij"},
+			expectedChunks: []string{"abcd", "efgh", "ij"},
+		},
+		{
+			name:           "characters, not bytes",
+			maxSize:        4,
+			overlap:        0,
+			paragraphs:     []string{"абвгдеж"},
+			expectedChunks: []string{"абвг", "деж"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunks := NewChunker(test.maxSize, test.overlap).Chunk(test.paragraphs)
+			if !slices.Equal(chunks, test.expectedChunks) {
+				t.Errorf("expected %q, got %q", test.expectedChunks, chunks)
+			}
+		})
+	}
+}
+
+func TestSplitIntoSentences(t *testing.T) {
+	tests := []struct {
+		name              string
+		text              string
+		expectedSentences []string
+	}{
+		{
+			name:              "one sentence",
+			text:              "Just one",
+			expectedSentences: []string{"Just one"},
+		},
+		{
+			name:              "punctuation",
+			text:              "It works. Does it? Yes! \"Quoted,\" he said. 42 is the answer.",
+			expectedSentences: []string{"It works.", "Does it?", "Yes!", "\"Quoted,\" he said.", "42 is the answer."},
+		},
+		{
+			name:              "abbreviations",
+			text:              "Use a tool, e.g. this one. Then stop.",
+			expectedSentences: []string{"Use a tool, e.g. this one.", "Then stop."},
+		},
+		{
+			name:              "whitespace",
+			text:              "First.\n\n  Second.",
+			expectedSentences: []string{"First.", "Second."},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sentences := splitIntoSentences(test.text)
+			if !slices.Equal(sentences, test.expectedSentences) {
+				t.Errorf("expected %q, got %q", test.expectedSentences, sentences)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package documents
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported document format")
+
+var (
+	markdownHeadingRegex    = regexp.MustCompile(`^#{1,6}\s+`)
+	markdownListItemRegex   = regexp.MustCompile(`^(\s*[-*+]\s+|\s*\d+[.)]\s+)`)
+	markdownQuoteRegex      = regexp.MustCompile(`^\s*>\s?`)
+	markdownImageRegex      = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLinkRegex       = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	markdownEmphasisRegex   = regexp.MustCompile("(\\*\\*|__|\\*|_|~~|`)")
+	markdownHTMLTagRegex    = regexp.MustCompile(`<[^>]+>`)
+	markdownHorizontalRegex = regexp.MustCompile(`^\s*([-*_]\s*){3,}$`)
+)
+
+// htmlBlockSelector elements which contain the text of an HTML page
+const htmlBlockSelector = "h1, h2, h3, h4, h5, h6, p, li, pre, blockquote, td, th, dt, dd"
+
+// IsSupported whether the file can be loaded with Load(..): plain text, Markdown and HTML are supported
+func IsSupported(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".txt", ".md", ".markdown", ".html", ".htm":
+		return true
+	default:
+		return false
+	}
+}
+
+// Load extracts the text of the document as a list of paragraphs (the markup is removed)
+func Load(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".txt":
+		return splitIntoParagraphs(string(data), nil), nil
+	case ".md", ".markdown":
+		return splitIntoParagraphs(string(data), cleanMarkdownLine), nil
+	case ".html", ".htm":
+		return loadHTML(string(data))
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// splitIntoParagraphs paragraphs are separated with empty lines. Headings and list items are separate paragraphs,
+// too. `cleanLine` (optional) removes the markup of a line, and returns false if the line starts a new paragraph.
+func splitIntoParagraphs(text string, cleanLine func(line string) (string, bool)) []string {
+	var result []string
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			result = append(result, normalizeWhitespace(strings.Join(paragraph, " ")))
+			paragraph = nil
+		}
+	}
+	isCodeBlock := false
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if cleanLine != nil && strings.HasPrefix(strings.TrimSpace(line), "```") {
+			flush()
+			isCodeBlock = !isCodeBlock
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		if cleanLine != nil && !isCodeBlock {
+			var isContinuation bool
+			line, isContinuation = cleanLine(line)
+			if !isContinuation {
+				flush()
+			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+		}
+		paragraph = append(paragraph, line)
+	}
+	flush()
+	return result
+}
+
+func cleanMarkdownLine(line string) (string, bool) {
+	if markdownHorizontalRegex.MatchString(line) {
+		return "", false
+	}
+	isContinuation := true
+	if markdownHeadingRegex.MatchString(line) {
+		line = markdownHeadingRegex.ReplaceAllString(line, "")
+		line = strings.TrimRight(line, "# ")
+		if !strings.HasSuffix(line, ".") {
+			line += "." // so that the heading doesn't merge with the following sentence
+		}
+		isContinuation = false
+	}
+	if markdownListItemRegex.MatchString(line) {
+		line = markdownListItemRegex.ReplaceAllString(line, "")
+		isContinuation = false
+	}
+	line = markdownQuoteRegex.ReplaceAllString(line, "")
+	line = markdownImageRegex.ReplaceAllString(line, "$1")
+	line = markdownLinkRegex.ReplaceAllString(line, "$1")
+	line = markdownEmphasisRegex.ReplaceAllString(line, "")
+	line = markdownHTMLTagRegex.ReplaceAllString(line, "")
+	return line, isContinuation
+}
+
+func loadHTML(html string) ([]string, error) {
+	document, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		return nil, err
+	}
+	document.Find("script, style, noscript, nav, header, footer").Remove()
+	var result []string
+	title := normalizeWhitespace(document.Find("title").First().Text())
+	if title != "" {
+		result = append(result, title+".")
+	}
+	document.Find(htmlBlockSelector).Each(func(_ int, selection *goquery.Selection) {
+		if selection.ParentsFiltered(htmlBlockSelector).Length() > 0 {
+			return // the text of nested blocks (for example, a paragraph in a list item) is already included
+		}
+		text := normalizeWhitespace(selection.Text())
+		if text != "" {
+			result = append(result, text)
+		}
+	})
+	if len(result) <= 1 { // no structure, for example, the text is directly in <body>
+		text := normalizeWhitespace(document.Find("body").Text())
+		if text != "" {
+			result = append(result, text)
+		}
+	}
+	return result, nil
+}
+
+func normalizeWhitespace(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
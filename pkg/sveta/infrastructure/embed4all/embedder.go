@@ -1,6 +1,9 @@
 package embed4all
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
@@ -12,92 +15,315 @@ import (
 	"kgeyst.com/sveta/pkg/sveta/domain"
 )
 
-const beginTag = "<begin>"
-const endTag = "<end>"
+const (
+	// ConfigKeyEmbed4allTimeout how long to wait for a batch of embeddings before the subprocess is considered hung
+	ConfigKeyEmbed4allTimeout = "embed4allTimeout"
+	// ConfigKeyEmbed4allStartTimeout how long to wait for the subprocess to start and load the model
+	ConfigKeyEmbed4allStartTimeout = "embed4allStartTimeout"
+	// ConfigKeyEmbed4allMaxRestartDelay the maximum delay between restarts of a failing subprocess (the delay doubles
+	// after each consecutive failure, starting from 1 second)
+	ConfigKeyEmbed4allMaxRestartDelay = "embed4allMaxRestartDelay"
+)
+
 const embeddingDimensionCount = 384
 
+// modelName the default model of Embed4All
+const modelName = "all-MiniLM-L6-v2"
+
+// maxResponseLineSize a response line contains all the embeddings of a batch
+const maxResponseLineSize = 64 * 1024 * 1024
+
+// stderrTailSize how many last lines of stderr are included in errors
+const stderrTailSize = 10
+
+// healthCheckProbe what to embed to check that the subprocess works after it's started
+const healthCheckProbe = "hello"
+
+const minRestartDelay = time.Second
+
+var ErrEmbedderUnavailable = errors.New("the embedder is unavailable")
+
 type Embedder struct {
-	mutex     sync.Mutex
+	mutex              sync.Mutex
+	logger             common.Logger
+	timeout            time.Duration
+	startTimeout       time.Duration
+	maxRestartDelay    time.Duration
+	subprocess         *subprocess // nil if not started
+	lastRequestID      int
+	failureCount       int // consecutive failures, for the restart backoff
+	nextStartAllowedAt time.Time
+}
+
+// subprocess a running instance of embed.py
+type subprocess struct {
 	cmd       *exec.Cmd
-	stdin     io.Writer
-	stdout    io.Reader
-	outBuffer []byte
-	logger    common.Logger
+	stdin     io.WriteCloser
+	responses chan embedResponse
+	stopped   chan struct{} // closed when the process is abandoned by the supervisor
+	exited    chan struct{} // closed when the process exits
+	exitErr   error         // valid after `exited` is closed
+	stderr    *lineRingBuffer
+}
+
+// embedRequest see the protocol in embed.py
+type embedRequest struct {
+	ID    int      `json:"id"`
+	Texts []string `json:"texts"`
+}
+
+type embedResponse struct {
+	ID         int         `json:"id"`
+	Embeddings [][]float64 `json:"embeddings"`
+	Error      string      `json:"error"`
 }
 
 // NewEmbedder depends on Python 3 and the Embed4all library.
 // Also, it automatically downloads the sentence_transformers model which is not good for container-native images.
+// The subprocess (embed.py) is supervised: it's health-checked after start, killed if it hangs (see
+// ConfigKeyEmbed4allTimeout), and restarted with a backoff if it crashes. While it's down, ErrEmbedderUnavailable is
+// returned without waiting (memories created in the meantime are re-embedded later, see domain.MemoryReembedder).
 // TODO use something more robust and controllable, without a dependency on Python 3
-func NewEmbedder(logger common.Logger) *Embedder {
+func NewEmbedder(config *common.Config, logger common.Logger) *Embedder {
 	return &Embedder{
-		outBuffer: make([]byte, 24000), // an estimate
-		logger:    logger,
+		logger:          logger,
+		timeout:         config.GetDurationOrDefault(ConfigKeyEmbed4allTimeout, 30*time.Second),
+		startTimeout:    config.GetDurationOrDefault(ConfigKeyEmbed4allStartTimeout, 2*time.Minute),
+		maxRestartDelay: config.GetDurationOrDefault(ConfigKeyEmbed4allMaxRestartDelay, time.Minute),
 	}
 }
 
 func (v *Embedder) Embed(sentence string) (domain.Embedding, error) {
-	sentence = strings.ReplaceAll(sentence, "\n", " ") // otherwise it can break line-by-line reading logic in embed.py
-	v.logger.Log(fmt.Sprintf("Embedding: \"%s\"...\n", sentence))
-	if sentence == "" {
-		return domain.Embedding{}, nil
+	embeddings, err := v.EmbedBatch([]string{sentence})
+	if err != nil {
+		return domain.Embedding{}, err
+	}
+	return embeddings[0], nil
+}
+
+// EmbedBatch empty sentences get empty embeddings
+func (v *Embedder) EmbedBatch(sentences []string) ([]domain.Embedding, error) {
+	result := make([]domain.Embedding, len(sentences))
+	var texts []string
+	var textIndices []int // index in `texts` => index in `sentences`
+	for index, sentence := range sentences {
+		sentence = strings.ReplaceAll(sentence, "\n", " ")
+		if sentence == "" {
+			continue
+		}
+		v.logger.Log(fmt.Sprintf("Embedding: \"%s\"...\n", sentence))
+		texts = append(texts, sentence)
+		textIndices = append(textIndices, index)
+	}
+	if len(texts) == 0 {
+		return result, nil
 	}
 	v.mutex.Lock()
 	defer v.mutex.Unlock()
 	err := v.startSubprocessIfRequired()
 	if err != nil {
-		v.logger.Log("failed to embed: " + err.Error())
-		return domain.Embedding{}, nil
+		return nil, err
 	}
-	_, err = v.stdin.Write([]byte(fmt.Sprintf("%s\n\n", sentence)))
+	embeddings, err := v.embed(texts, v.timeout)
 	if err != nil {
-		v.logger.Log("failed to embed (writing to embed4all): " + err.Error())
-		return domain.Embedding{}, nil
+		return nil, err
 	}
-	var result string
-	for {
-		n, err := v.stdout.Read(v.outBuffer)
-		if err != nil {
-			v.logger.Log("failed to embed (reading from embed4all): " + err.Error())
-			return domain.Embedding{}, nil
-		}
-		if n == 0 {
-			time.Sleep(time.Millisecond)
-			continue
-		}
-		line := string(v.outBuffer[:n])
-		result += line
-		if strings.Contains(line, "<end>") {
-			break
-		}
+	for index, values := range embeddings {
+		result[textIndices[index]] = domain.NewEmbedding(values)
+	}
+	return result, nil
+}
+
+func (v *Embedder) ModelName() string {
+	return modelName
+}
+
+func (v *Embedder) DimensionCount() int {
+	return embeddingDimensionCount
+}
+
+// embed the subprocess must be running
+func (v *Embedder) embed(texts []string, timeout time.Duration) ([][]float64, error) {
+	p := v.subprocess
+	v.lastRequestID++
+	requestID := v.lastRequestID
+	requestBytes, err := json.Marshal(embedRequest{ID: requestID, Texts: texts})
+	if err != nil {
+		return nil, err
 	}
-	beginIndex := strings.Index(result, beginTag)
-	endIndex := strings.Index(result, endTag)
-	if beginIndex == -1 || endIndex == -1 || beginIndex >= endIndex {
-		v.logger.Log("failed to embed (missing begin/end)")
-		return domain.Embedding{}, nil
+	_, err = p.stdin.Write(append(requestBytes, '\n'))
+	if err != nil {
+		v.failSubprocess(fmt.Sprintf("writing to embed4all failed: %s", err))
+		return nil, fmt.Errorf("%w: writing to embed4all: %s", ErrEmbedderUnavailable, err)
 	}
-	result = result[beginIndex+len(beginTag) : endIndex]
-	embedding, err := domain.NewEmbeddingFromFormattedValues(result)
-	if embedding.DimensionCount() != embeddingDimensionCount {
-		v.logger.Log("wrong dimension count")
-		return domain.Embedding{}, nil
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case response := <-p.responses:
+			if response.ID != requestID {
+				continue // a response to an earlier request which was abandoned
+			}
+			if response.Error != "" { // the subprocess is still fine, it's the input which failed
+				return nil, fmt.Errorf("embed4all failed: %s", response.Error)
+			}
+			if len(response.Embeddings) != len(texts) {
+				return nil, errors.New("embed4all returned a wrong number of embeddings")
+			}
+			for _, embedding := range response.Embeddings {
+				if len(embedding) != embeddingDimensionCount {
+					return nil, errors.New("embed4all returned an embedding of a wrong dimension")
+				}
+			}
+			v.failureCount = 0
+			return response.Embeddings, nil
+		case <-p.exited:
+			message := fmt.Sprintf("embed4all exited unexpectedly (%v): %s", p.exitErr, p.stderr.String())
+			v.failSubprocess(message)
+			return nil, fmt.Errorf("%w: %s", ErrEmbedderUnavailable, message)
+		case <-timer.C:
+			message := fmt.Sprintf("embed4all didn't respond in %s: %s", timeout, p.stderr.String())
+			v.failSubprocess(message)
+			return nil, fmt.Errorf("%w: %s", ErrEmbedderUnavailable, message)
+		}
 	}
-	return embedding, err
 }
 
 func (v *Embedder) startSubprocessIfRequired() error {
-	if v.cmd != nil {
+	if v.subprocess != nil {
 		return nil
 	}
-	cmd := exec.Command("python3", "embed.py")
-	stdin, _ := cmd.StdinPipe()
-	stdout, _ := cmd.StdoutPipe()
-	err := cmd.Start()
+	now := time.Now()
+	if now.Before(v.nextStartAllowedAt) {
+		return fmt.Errorf("%w: restarting in %s", ErrEmbedderUnavailable, v.nextStartAllowedAt.Sub(now).Round(time.Second))
+	}
+	p, err := v.startSubprocess()
+	if err != nil {
+		v.registerFailure("failed to start embed4all: " + err.Error())
+		return fmt.Errorf("%w: %s", ErrEmbedderUnavailable, err)
+	}
+	v.subprocess = p
+	// The health check: the subprocess may start fine but fail to load the model.
+	_, err = v.embed([]string{healthCheckProbe}, v.startTimeout)
 	if err != nil {
+		if v.subprocess != nil { // the input failed, not the subprocess, yet it can't embed anything
+			v.failSubprocess("embed4all failed the health check: " + err.Error())
+		}
 		return err
 	}
-	v.cmd = cmd
-	v.stdin = stdin
-	v.stdout = stdout
+	v.logger.Log("Started embed4all\n")
 	return nil
 }
+
+func (v *Embedder) startSubprocess() (*subprocess, error) {
+	cmd := exec.Command("python3", "embed.py")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	p := &subprocess{
+		cmd:       cmd,
+		stdin:     stdin,
+		responses: make(chan embedResponse, 1),
+		stopped:   make(chan struct{}),
+		exited:    make(chan struct{}),
+		stderr:    newLineRingBuffer(stderrTailSize),
+	}
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxResponseLineSize)
+		for scanner.Scan() {
+			var response embedResponse
+			err := json.Unmarshal(scanner.Bytes(), &response)
+			if err != nil {
+				continue // not a part of the protocol (stray output of the libraries)
+			}
+			select {
+			case p.responses <- response:
+			case <-p.stopped:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer readers.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			p.stderr.Add(line)
+			v.logger.Log("embed4all: " + line + "\n")
+		}
+	}()
+	go func() {
+		readers.Wait() // Wait() must not be called before all reads from the pipes are done
+		p.exitErr = cmd.Wait()
+		close(p.exited)
+	}()
+	return p, nil
+}
+
+// failSubprocess kills the subprocess (if it's still alive) so that it's restarted on one of the next calls
+func (v *Embedder) failSubprocess(reason string) {
+	p := v.subprocess
+	v.subprocess = nil
+	if p != nil {
+		close(p.stopped)
+		_ = p.stdin.Close()
+		_ = p.cmd.Process.Kill()
+	}
+	v.registerFailure(reason)
+}
+
+func (v *Embedder) registerFailure(reason string) {
+	v.failureCount++
+	delay := minRestartDelay << min(v.failureCount-1, 16)
+	if delay > v.maxRestartDelay {
+		delay = v.maxRestartDelay
+	}
+	v.nextStartAllowedAt = time.Now().Add(delay)
+	v.logger.Log(fmt.Sprintf("%s (restarting in %s)\n", reason, delay))
+}
+
+// lineRingBuffer keeps the last lines of output
+type lineRingBuffer struct {
+	mutex sync.Mutex
+	lines []string
+	size  int
+}
+
+func newLineRingBuffer(size int) *lineRingBuffer {
+	return &lineRingBuffer{size: size}
+}
+
+func (b *lineRingBuffer) Add(line string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.lines = append(b.lines, line)
+	if len(b.lines) > b.size {
+		b.lines = b.lines[len(b.lines)-b.size:]
+	}
+}
+
+func (b *lineRingBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.lines) == 0 {
+		return "no output in stderr"
+	}
+	return strings.Join(b.lines, "\n")
+}
@@ -0,0 +1,64 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+type aiStateRepository struct {
+	mutex    sync.Mutex
+	filePath string
+}
+
+type jsonAIState struct {
+	AgentName           string          `json:"agentName,omitempty"`
+	AgentDescription    string          `json:"agentDescription,omitempty"`
+	EnabledCapabilities map[string]bool `json:"enabledCapabilities,omitempty"`
+}
+
+// NewAIStateRepository stores the state of the AI in the state file (see `stateFilePath` in the config)
+func NewAIStateRepository(config *common.Config) domain.AIStateRepository {
+	return &aiStateRepository{
+		filePath: config.GetStringOrDefault("stateFilePath", "state.json"),
+	}
+}
+
+func (r *aiStateRepository) Load() (*domain.AIState, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	data, err := os.ReadFile(r.filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state jsonAIState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.AIState{
+		AgentName:           state.AgentName,
+		AgentDescription:    state.AgentDescription,
+		EnabledCapabilities: state.EnabledCapabilities,
+	}, nil
+}
+
+func (r *aiStateRepository) Save(state *domain.AIState) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	data, err := json.MarshalIndent(jsonAIState{
+		AgentName:           state.AgentName,
+		AgentDescription:    state.AgentDescription,
+		EnabledCapabilities: state.EnabledCapabilities,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(r.filePath, data)
+}
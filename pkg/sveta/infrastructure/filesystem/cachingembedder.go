@@ -0,0 +1,316 @@
+package filesystem
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+// embeddingCacheStatsLogInterval how often (in lookups) to log the statistics of the cache
+const embeddingCacheStatsLogInterval = 100
+
+// EmbeddingCacheStats the statistics of the embedding cache since the start
+type EmbeddingCacheStats struct {
+	Hits   int
+	Misses int
+	Size   int
+}
+
+type CachingEmbedder struct {
+	mutex     sync.Mutex
+	wrapped   domain.Embedder
+	logger    common.Logger
+	cipher    *memoryCipher
+	filePath  string
+	file      *os.File
+	maxSize   int
+	entries   map[string]*list.Element // key => element of `lru`
+	lru       *list.List               // of *embeddingCacheEntry, most recently used first
+	lineCount int                      // the number of entries in the file (including evicted and duplicate ones)
+	stats     EmbeddingCacheStats
+	modelName string
+}
+
+type embeddingCacheEntry struct {
+	Key       string
+	Embedding domain.Embedding
+}
+
+type jsonEmbeddingCacheHeader struct {
+	Model string `json:"model"`
+}
+
+type jsonEmbeddingCacheEntry struct {
+	Key       string `json:"key"`
+	Embedding string `json:"embedding"`
+}
+
+// NewCachingEmbedder caches embeddings on disk (see `embeddingCacheFilePath`), as the same strings are often embedded
+// repeatedly (rewritten inputs, reloaded news etc.) The cache is keyed by the hash of the normalized text and the name
+// of the embedding model, and is discarded as a whole if the embedding model changes. At most `embeddingCacheMaxSize`
+// most recently used embeddings are kept. The cache file is encrypted with the same key as the memory store.
+func NewCachingEmbedder(wrapped domain.Embedder, config *common.Config, logger common.Logger) (*CachingEmbedder, error) {
+	encryptionKey, err := LoadMemoryEncryptionKey(config)
+	if err != nil {
+		return nil, err
+	}
+	cacheCipher, err := newMemoryCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	c := &CachingEmbedder{
+		wrapped:   wrapped,
+		logger:    logger,
+		cipher:    cacheCipher,
+		filePath:  config.GetStringOrDefault("embeddingCacheFilePath", "embeddings.cache"),
+		maxSize:   config.GetIntOrDefault("embeddingCacheMaxSize", 10000),
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+		modelName: wrapped.ModelName(),
+	}
+	err = c.load()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CachingEmbedder) Embed(sentence string) (domain.Embedding, error) {
+	embeddings, err := c.EmbedBatch([]string{sentence})
+	if err != nil {
+		return domain.Embedding{}, err
+	}
+	return embeddings[0], nil
+}
+
+// EmbedBatch only the sentences which aren't in the cache are passed to the wrapped embedder (as a single batch)
+func (c *CachingEmbedder) EmbedBatch(sentences []string) ([]domain.Embedding, error) {
+	result := make([]domain.Embedding, len(sentences))
+	var missedSentences []string
+	var missedKeys []string
+	missedIndices := make(map[string][]int) // key => indices in `sentences` (the same sentence can occur many times)
+	c.mutex.Lock()
+	for index, sentence := range sentences {
+		normalizedSentence := normalizeSentence(sentence)
+		if normalizedSentence == "" {
+			continue
+		}
+		key := common.Hash(c.modelName + "\n" + normalizedSentence)
+		if element, ok := c.entries[key]; ok {
+			c.lru.MoveToFront(element)
+			result[index] = element.Value.(*embeddingCacheEntry).Embedding
+			c.stats.Hits++
+			c.logStatsIfRequired()
+			continue
+		}
+		c.stats.Misses++
+		c.logStatsIfRequired()
+		if _, ok := missedIndices[key]; !ok {
+			missedSentences = append(missedSentences, normalizedSentence)
+			missedKeys = append(missedKeys, key)
+		}
+		missedIndices[key] = append(missedIndices[key], index)
+	}
+	c.mutex.Unlock()
+	if len(missedSentences) == 0 {
+		return result, nil
+	}
+	embeddings, err := c.wrapped.EmbedBatch(missedSentences)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for missIndex, embedding := range embeddings {
+		key := missedKeys[missIndex]
+		for _, index := range missedIndices[key] {
+			result[index] = embedding
+		}
+		if embedding.DimensionCount() == 0 { // failed embeddings must not be cached
+			continue
+		}
+		c.add(key, embedding)
+		err = c.appendEntry(key, embedding)
+		if err != nil {
+			c.logger.Log("failed to write to the embedding cache: " + err.Error())
+		}
+	}
+	return result, nil
+}
+
+func (c *CachingEmbedder) ModelName() string {
+	return c.wrapped.ModelName()
+}
+
+func (c *CachingEmbedder) DimensionCount() int {
+	return c.wrapped.DimensionCount()
+}
+
+func (c *CachingEmbedder) Stats() EmbeddingCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Size = c.lru.Len()
+	return stats
+}
+
+func (c *CachingEmbedder) add(key string, embedding domain.Embedding) {
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*embeddingCacheEntry).Embedding = embedding
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&embeddingCacheEntry{Key: key, Embedding: embedding})
+	for c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*embeddingCacheEntry).Key)
+	}
+}
+
+func (c *CachingEmbedder) logStatsIfRequired() {
+	lookupCount := c.stats.Hits + c.stats.Misses
+	if lookupCount%embeddingCacheStatsLogInterval != 0 {
+		return
+	}
+	c.logger.Log(fmt.Sprintf(
+		"Embedding cache: %d hits, %d misses (%.0f%% hit rate), %d entries\n",
+		c.stats.Hits,
+		c.stats.Misses,
+		float64(c.stats.Hits)*100/float64(lookupCount),
+		c.lru.Len(),
+	))
+}
+
+// load the first line of the file is the header which specifies the embedding model; if the model changed, the cache
+// is discarded.
+func (c *CachingEmbedder) load() error {
+	lines, err := common.ReadAllLines(c.filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	isValid := false
+	for index, line := range lines {
+		if line == "" {
+			continue
+		}
+		plaintextLine, _, err := c.cipher.decrypt(line)
+		if err != nil {
+			return err
+		}
+		if index == 0 {
+			var header jsonEmbeddingCacheHeader
+			err = json.Unmarshal([]byte(plaintextLine), &header)
+			isValid = err == nil && header.Model == c.modelName
+			if !isValid {
+				c.logger.Log("the embedding model changed, discarding the embedding cache\n")
+				break
+			}
+			continue
+		}
+		var entry jsonEmbeddingCacheEntry
+		err = json.Unmarshal([]byte(plaintextLine), &entry)
+		if err != nil {
+			continue
+		}
+		embedding, err := domain.NewEmbeddingFromFormattedValues(entry.Embedding)
+		if err != nil {
+			continue
+		}
+		c.add(entry.Key, embedding)
+	}
+	if !isValid || len(lines)-1 > c.maxSize*2 {
+		return c.compact()
+	}
+	c.lineCount = len(lines) - 1
+	return c.openFile()
+}
+
+func (c *CachingEmbedder) appendEntry(key string, embedding domain.Embedding) error {
+	if c.lineCount >= c.maxSize*2 { // most of the file consists of evicted entries
+		return c.compact()
+	}
+	if c.file == nil {
+		return nil
+	}
+	line, err := c.formatEntry(key, embedding)
+	if err != nil {
+		return err
+	}
+	err = c.writeLine(line)
+	if err != nil {
+		return err
+	}
+	c.lineCount++
+	return nil
+}
+
+// writeLine under the shared store lock, so that a snapshot never captures a half-written line (see storeMutex)
+func (c *CachingEmbedder) writeLine(line string) error {
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	_, err := c.file.WriteString(line + "\n")
+	return err
+}
+
+// compact rewrites the file so that it contains only the current entries
+func (c *CachingEmbedder) compact() error {
+	if c.file != nil {
+		_ = c.file.Close()
+		c.file = nil
+	}
+	headerBytes, err := json.Marshal(jsonEmbeddingCacheHeader{Model: c.modelName})
+	if err != nil {
+		return err
+	}
+	header, err := c.cipher.encrypt(string(headerBytes))
+	if err != nil {
+		return err
+	}
+	lines := []string{header}
+	for element := c.lru.Back(); element != nil; element = element.Prev() { // the most recently used entries last, so that they win on load
+		entry := element.Value.(*embeddingCacheEntry)
+		line, err := c.formatEntry(entry.Key, entry.Embedding)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	err = writeLinesAtomically(c.filePath, lines)
+	if err != nil {
+		return err
+	}
+	c.lineCount = len(lines) - 1
+	return c.openFile()
+}
+
+func (c *CachingEmbedder) openFile() error {
+	file, err := os.OpenFile(c.filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	c.file = file
+	return nil
+}
+
+func (c *CachingEmbedder) formatEntry(key string, embedding domain.Embedding) (string, error) {
+	entryBytes, err := json.Marshal(jsonEmbeddingCacheEntry{
+		Key:       key,
+		Embedding: embedding.ToFormattedValues(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return c.cipher.encrypt(string(entryBytes))
+}
+
+// normalizeSentence so that trivial differences in whitespace don't produce cache misses
+func normalizeSentence(sentence string) string {
+	return strings.Join(strings.Fields(sentence), " ")
+}
@@ -0,0 +1,201 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+type knowledgeRepository struct {
+	mutex    sync.Mutex
+	filePath string
+	cipher   *memoryCipher
+	chunks   []*domain.KnowledgeChunk
+}
+
+type jsonKnowledgeChunk struct {
+	ID             string `json:"id"`
+	Source         string `json:"source"`
+	Index          int    `json:"index"`
+	Text           string `json:"text"`
+	Embedding      string `json:"embedding"`
+	EmbeddingModel string `json:"embeddingModel"`
+}
+
+type scoredKnowledgeChunk struct {
+	Chunk      *domain.KnowledgeChunk
+	Similarity float64
+}
+
+// NewKnowledgeRepository stores the knowledge base in a separate file (see `knowledgeFilePath` in the config), one
+// chunk per line, and keeps it in memory for search. The knowledge base changes rarely (see cmd/ingest), so the whole
+// file is rewritten on every change. The file is encrypted with the same key as the memory store (see
+// LoadMemoryEncryptionKey(..)).
+func NewKnowledgeRepository(config *common.Config) (domain.KnowledgeRepository, error) {
+	encryptionKey, err := LoadMemoryEncryptionKey(config)
+	if err != nil {
+		return nil, err
+	}
+	knowledgeCipher, err := newMemoryCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	r := &knowledgeRepository{
+		filePath: config.GetStringOrDefault("knowledgeFilePath", "knowledge.txt"),
+		cipher:   knowledgeCipher,
+	}
+	err = r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *knowledgeRepository) NextID() string {
+	return uuid.NewString()
+}
+
+func (r *knowledgeRepository) Store(chunks []*domain.KnowledgeChunk) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sources := make(map[string]struct{})
+	for _, chunk := range chunks {
+		sources[chunk.Source] = struct{}{}
+	}
+	r.removeBySources(sources)
+	r.chunks = append(r.chunks, chunks...)
+	return r.save()
+}
+
+func (r *knowledgeRepository) RemoveBySource(source string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.removeBySources(map[string]struct{}{source: {}})
+	return r.save()
+}
+
+func (r *knowledgeRepository) FindByEmbeddings(filter domain.KnowledgeFilter) ([]*domain.KnowledgeChunk, error) {
+	queryDimensionCount, err := domain.GetCommonDimensionCount(filter.Embeddings)
+	if err != nil {
+		return nil, err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var scoredChunks []scoredKnowledgeChunk
+	for _, chunk := range r.chunks {
+		if chunk.Embedding.DimensionCount() != queryDimensionCount {
+			continue
+		}
+		if filter.EmbeddingModel != "" && chunk.EmbeddingModel != "" && chunk.EmbeddingModel != filter.EmbeddingModel {
+			continue
+		}
+		similarity := chunk.Embedding.GetBestSimilarityTo(filter.Embeddings)
+		if similarity < filter.SimilarityThreshold {
+			continue
+		}
+		scoredChunks = append(scoredChunks, scoredKnowledgeChunk{Chunk: chunk, Similarity: similarity})
+	}
+	sort.SliceStable(scoredChunks, func(i, j int) bool {
+		return scoredChunks[i].Similarity > scoredChunks[j].Similarity
+	})
+	if len(scoredChunks) > filter.TopCount {
+		scoredChunks = scoredChunks[:filter.TopCount]
+	}
+	result := make([]*domain.KnowledgeChunk, 0, len(scoredChunks))
+	for _, scoredChunk := range scoredChunks {
+		result = append(result, scoredChunk.Chunk)
+	}
+	return result, nil
+}
+
+func (r *knowledgeRepository) ListSources() ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var result []string
+	sources := make(map[string]struct{})
+	for _, chunk := range r.chunks {
+		if _, ok := sources[chunk.Source]; ok {
+			continue
+		}
+		sources[chunk.Source] = struct{}{}
+		result = append(result, chunk.Source)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (r *knowledgeRepository) removeBySources(sources map[string]struct{}) {
+	chunks := make([]*domain.KnowledgeChunk, 0, len(r.chunks))
+	for _, chunk := range r.chunks {
+		if _, ok := sources[chunk.Source]; !ok {
+			chunks = append(chunks, chunk)
+		}
+	}
+	r.chunks = chunks
+}
+
+func (r *knowledgeRepository) load() error {
+	if _, err := os.Stat(r.filePath); os.IsNotExist(err) {
+		return nil
+	}
+	lines, err := common.ReadAllLines(r.filePath)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		plaintextLine, _, err := r.cipher.decrypt(line)
+		if err != nil {
+			return err
+		}
+		var jsonChunk jsonKnowledgeChunk
+		err = json.Unmarshal([]byte(plaintextLine), &jsonChunk)
+		if err != nil {
+			continue
+		}
+		embedding, err := domain.NewEmbeddingFromFormattedValues(jsonChunk.Embedding)
+		if err != nil {
+			continue
+		}
+		r.chunks = append(r.chunks, &domain.KnowledgeChunk{
+			ID:             jsonChunk.ID,
+			Source:         jsonChunk.Source,
+			Index:          jsonChunk.Index,
+			Text:           jsonChunk.Text,
+			Embedding:      embedding,
+			EmbeddingModel: jsonChunk.EmbeddingModel,
+		})
+	}
+	return nil
+}
+
+func (r *knowledgeRepository) save() error {
+	lines := make([]string, 0, len(r.chunks))
+	for _, chunk := range r.chunks {
+		jsonChunkBytes, err := json.Marshal(jsonKnowledgeChunk{
+			ID:             chunk.ID,
+			Source:         removeNewLines(chunk.Source),
+			Index:          chunk.Index,
+			Text:           removeNewLines(chunk.Text),
+			Embedding:      chunk.Embedding.ToFormattedValues(),
+			EmbeddingModel: chunk.EmbeddingModel,
+		})
+		if err != nil {
+			return err
+		}
+		line, err := r.cipher.encrypt(string(jsonChunkBytes))
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	return writeLinesAtomically(r.filePath, lines)
+}
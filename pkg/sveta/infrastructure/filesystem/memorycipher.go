@@ -0,0 +1,210 @@
+package filesystem
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"kgeyst.com/sveta/pkg/common"
+)
+
+const (
+	// ConfigKeyMemoryEncryptionKeyEnvVar the name of the environment variable which contains the encryption key
+	// of the memory store (base64-encoded, 32 bytes for AES-256)
+	ConfigKeyMemoryEncryptionKeyEnvVar = "memoryEncryptionKeyEnvVar"
+	// ConfigKeyMemoryEncryptionKeyFilePath the path to the file which contains the encryption key of the memory store
+	// (base64-encoded), used if the environment variable is not set
+	ConfigKeyMemoryEncryptionKeyFilePath = "memoryEncryptionKeyFilePath"
+)
+
+const defaultMemoryEncryptionKeyEnvVar = "SVETA_MEMORY_KEY"
+
+// encryptedLinePrefix marks encrypted lines in the memory file (the version allows to change the scheme later on)
+const encryptedLinePrefix = "enc:v1:"
+
+var (
+	ErrWrongMemoryEncryptionKey   = errors.New("failed to decrypt the memory store: wrong encryption key or corrupted data")
+	ErrMissingMemoryEncryptionKey = errors.New("the memory store is encrypted but no encryption key is provided")
+)
+
+// memoryCipher encrypts lines of the memory file with AES-GCM. A nil cipher leaves lines in plaintext.
+type memoryCipher struct {
+	aead cipher.AEAD
+}
+
+// LoadMemoryEncryptionKey returns nil if encryption at rest is not configured.
+func LoadMemoryEncryptionKey(config *common.Config) ([]byte, error) {
+	encodedKey := os.Getenv(config.GetStringOrDefault(ConfigKeyMemoryEncryptionKeyEnvVar, defaultMemoryEncryptionKeyEnvVar))
+	keyFilePath := config.GetString(ConfigKeyMemoryEncryptionKeyFilePath)
+	if encodedKey == "" && keyFilePath != "" {
+		data, err := os.ReadFile(keyFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the memory encryption key: %w", err)
+		}
+		encodedKey = string(data)
+	}
+	return DecodeMemoryEncryptionKey(encodedKey)
+}
+
+// DecodeMemoryEncryptionKey decodes a base64-encoded key. Returns nil for an empty string.
+func DecodeMemoryEncryptionKey(encodedKey string) ([]byte, error) {
+	encodedKey = strings.TrimSpace(encodedKey)
+	if encodedKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the memory encryption key (must be base64-encoded): %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("the memory encryption key must be 32 bytes long (AES-256), got %d bytes", len(key))
+	}
+	return key, nil
+}
+
+// newMemoryCipher returns nil (no encryption) if the key is nil.
+func newMemoryCipher(key []byte) (*memoryCipher, error) {
+	if key == nil {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryCipher{aead: aead}, nil
+}
+
+func (c *memoryCipher) encrypt(line string) (string, error) {
+	if c == nil {
+		return line, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(line), nil)
+	return encryptedLinePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt plaintext lines are returned as is (for migration); also returns true if the line was in plaintext
+func (c *memoryCipher) decrypt(line string) (string, bool, error) {
+	if !strings.HasPrefix(line, encryptedLinePrefix) {
+		return line, true, nil
+	}
+	if c == nil {
+		return "", false, ErrMissingMemoryEncryptionKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(line[len(encryptedLinePrefix):])
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", false, ErrWrongMemoryEncryptionKey
+	}
+	nonceSize := c.aead.NonceSize()
+	plaintext, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", false, ErrWrongMemoryEncryptionKey
+	}
+	return string(plaintext), false, nil
+}
+
+// ReencryptStore re-encrypts every encrypted file of the store, including the ones inside snapshots, with a new key
+// (key rotation), and returns the paths of the re-encrypted files. Either key can be nil: a nil old key means the store
+// is currently in plaintext, a nil new key decrypts the store. Lines which are already encrypted with the new key are
+// kept as is, so if the rotation is interrupted, it can be simply run again. Must not be called while the store is in
+// use by another process.
+func ReencryptStore(config *common.Config, oldKey, newKey []byte) ([]string, error) {
+	oldCipher, err := newMemoryCipher(oldKey)
+	if err != nil {
+		return nil, err
+	}
+	newCipher, err := newMemoryCipher(newKey)
+	if err != nil {
+		return nil, err
+	}
+	files := getStoreFiles(config)
+	var result []string
+	for _, file := range files {
+		if !file.IsEncrypted {
+			continue
+		}
+		data, err := os.ReadFile(file.Path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		reencryptedData, err := reencryptLines(data, oldCipher, newCipher)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", file.Path, err)
+		}
+		err = writeFileAtomically(file.Path, reencryptedData)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, file.Path)
+	}
+	snapshots, err := ListSnapshots(config)
+	if err != nil {
+		return result, err
+	}
+	for _, snapshot := range snapshots {
+		fileContents, err := readSnapshot(snapshot.Path)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", snapshot.Path, err)
+		}
+		for _, file := range files {
+			data, ok := fileContents[file.Name]
+			if !ok || !file.IsEncrypted {
+				continue
+			}
+			fileContents[file.Name], err = reencryptLines(data, oldCipher, newCipher)
+			if err != nil {
+				return result, fmt.Errorf("%s (%s): %w", snapshot.Path, file.Name, err)
+			}
+		}
+		err = writeSnapshot(snapshot.Path, files, fileContents, snapshot.CreatedAt)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, snapshot.Path)
+	}
+	return result, nil
+}
+
+func reencryptLines(data []byte, oldCipher, newCipher *memoryCipher) ([]byte, error) {
+	var buf strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		plaintext, _, err := oldCipher.decrypt(line)
+		if errors.Is(err, ErrWrongMemoryEncryptionKey) || errors.Is(err, ErrMissingMemoryEncryptionKey) {
+			_, _, newErr := newCipher.decrypt(line)
+			if newErr == nil { // already re-encrypted by an interrupted rotation
+				buf.WriteString(line)
+				buf.WriteString("\n")
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		reencryptedLine, err := newCipher.encrypt(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(reencryptedLine)
+		buf.WriteString("\n")
+	}
+	return []byte(buf.String()), nil
+}
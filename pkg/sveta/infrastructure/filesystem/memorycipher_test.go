@@ -0,0 +1,106 @@
+package filesystem
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encryptTestFile(t *testing.T, path string, key []byte, lines ...string) {
+	cipher, err := newMemoryCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encryptedLines []string
+	for _, line := range lines {
+		encryptedLine, err := cipher.encrypt(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encryptedLines = append(encryptedLines, encryptedLine)
+	}
+	err = writeLinesAtomically(path, encryptedLines)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReencryptStore every encrypted file of the store, including the snapshots, must be readable with the new key
+func TestReencryptStore(t *testing.T) {
+	dirPath := t.TempDir()
+	keyFilePath := filepath.Join(dirPath, "key")
+	yaml := "snapshotDirPath: " + filepath.Join(dirPath, "snapshots") + "\nmemoryEncryptionKeyEnvVar: SVETA_TEST_UNSET_KEY\nmemoryEncryptionKeyFilePath: " + keyFilePath + "\n"
+	for _, name := range []string{"memoryFilePath", "summaryFilePath", "userProfileFilePath", "stateFilePath", "knowledgeFilePath", "embeddingCacheFilePath"} {
+		yaml += name + ": " + filepath.Join(dirPath, name) + "\n"
+	}
+	config := newTestConfig(t, yaml)
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	files := getStoreFiles(config)
+	for _, file := range files {
+		if file.IsEncrypted {
+			encryptTestFile(t, file.Path, oldKey, "first "+file.Name, "second "+file.Name)
+		} else {
+			err := os.WriteFile(file.Path, []byte("{}"), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err := os.WriteFile(keyFilePath, []byte(base64.StdEncoding.EncodeToString(oldKey)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotName, err := NewSnapshotter(config, testLogger{t: t}).CreateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The memory file is rotated already, as if a previous run was interrupted.
+	encryptTestFile(t, files[0].Path, newKey, "first memory.txt", "second memory.txt")
+	reencryptedPaths, err := ReencryptStore(config, oldKey, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reencryptedPaths) != 6 { // 5 encrypted files and the snapshot
+		t.Fatalf("expected 6 re-encrypted files, got %v", reencryptedPaths)
+	}
+	err = os.WriteFile(keyFilePath, []byte(base64.StdEncoding.EncodeToString(newKey)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RestoreSnapshot(config, filepath.Join(dirPath, "snapshots", snapshotName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCipher, err := newMemoryCipher(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if !file.IsEncrypted {
+			continue
+		}
+		data, err := os.ReadFile(file.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := reencryptLines(data, newCipher, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", file.Name, err)
+		}
+		expected := "first " + file.Name + "\nsecond " + file.Name + "\n"
+		if string(plaintext) != expected {
+			t.Fatalf("%s: expected %q, got %q", file.Name, expected, string(plaintext))
+		}
+	}
+}
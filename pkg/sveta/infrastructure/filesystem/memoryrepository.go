@@ -12,14 +12,26 @@ import (
 	"kgeyst.com/sveta/pkg/sveta/domain"
 )
 
+// memoryFileVersion is incremented every time the format of the memory file changes (see migrateMemory(..))
+const memoryFileVersion = 2
+
+// legacyEmbeddingModel before version 2, all embeddings were produced by Embed4All's default model
+const legacyEmbeddingModel = "all-MiniLM-L6-v2"
+
+// zeroTimeUnixNano what time.Time{}.UnixNano() evaluates to (which is how zero timestamps ended up in the memory file)
+var zeroTimeUnixNano = time.Time{}.UnixNano()
+
 type memoryRepository struct {
-	wrapped domain.MemoryRepository
-	file    *os.File
-	logger  common.Logger
-	mutex   sync.Mutex
+	wrapped             domain.MemoryRepository
+	file                *os.File
+	cipher              *memoryCipher // nil if encryption at rest is disabled
+	logger              common.Logger
+	mutex               sync.Mutex
+	quantizesEmbeddings bool
 }
 
 type jsonMemory struct {
+	Version   int    `json:"version,omitempty"`
 	ID        string `json:"id"`
 	Type      int    `json:"type"`
 	Who       string `json:"who"`
@@ -27,22 +39,49 @@ type jsonMemory struct {
 	What      string `json:"what"`
 	Where     string `json:"where"`
 	Embedding string `json:"embedding"`
+	// EmbeddingUnchanged the embedding is omitted, as it's the same as in the previous entry with the same ID (see Modify(..))
+	EmbeddingUnchanged bool     `json:"embeddingUnchanged,omitempty"`
+	EmbeddingModel     string   `json:"embeddingModel,omitempty"`
+	Importance         float64  `json:"importance,omitempty"`
+	AccessCount        int      `json:"accessCount,omitempty"`
+	SourceIDs          []string `json:"sourceIds,omitempty"`
+	IsArchived         bool     `json:"isArchived,omitempty"`
+	ExpiresAt          int64    `json:"expiresAt,omitempty"`
+	Source             string   `json:"source,omitempty"`
 }
 
+// NewMemoryRepository persists memories to the memory file (see `memoryFilePath` in the config), optionally encrypted
+// with AES-GCM (see LoadMemoryEncryptionKey(..)). Fails if the memory file is encrypted and the key is wrong or missing.
 func NewMemoryRepository(
 	wrapped domain.MemoryRepository,
 	config *common.Config,
 	logger common.Logger,
-) domain.MemoryRepository {
+) (domain.MemoryRepository, error) {
 	memoryFilePath := config.GetString("memoryFilePath")
+	encryptionKey, err := LoadMemoryEncryptionKey(config)
+	if err != nil {
+		return nil, err
+	}
+	memoryCipher, err := newMemoryCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
 	file, _ := os.OpenFile(memoryFilePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 	r := &memoryRepository{
-		wrapped: wrapped,
-		file:    file,
-		logger:  logger,
+		wrapped:             wrapped,
+		file:                file,
+		cipher:              memoryCipher,
+		logger:              logger,
+		quantizesEmbeddings: isEmbeddingQuantizationEnabled(config),
 	}
-	r.rememberMemories(memoryFilePath)
-	return r
+	err = r.rememberMemories(memoryFilePath)
+	if err != nil {
+		if file != nil {
+			_ = file.Close()
+		}
+		return nil, err
+	}
+	return r, nil
 }
 
 func (m *memoryRepository) NextID() string {
@@ -50,33 +89,124 @@ func (m *memoryRepository) NextID() string {
 }
 
 func (m *memoryRepository) Store(memory *domain.Memory) error {
-	err := m.wrapped.Store(memory)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	err := m.wrapped.Store(m.toIndexedMemory(memory))
 	if err != nil {
 		return err
 	}
-	if m.file == nil || memory.IsTransient {
-		return nil
-	}
-	jsonMemory := jsonMemory{
-		ID:        memory.ID,
-		Type:      int(memory.Type),
-		Who:       removeNewLines(memory.Who),
-		When:      memory.When.UnixNano(),
-		What:      removeNewLines(memory.What),
-		Where:     removeNewLines(memory.Where),
-		Embedding: memory.Embedding.ToFormattedValues(),
-	}
-	jsonMemoryBytes, err := json.Marshal(jsonMemory)
+	return m.appendMemory(memory, true)
+}
+
+// Update the memory file is append-only: the updated memory is simply appended to the end of the file, and when the
+// file is loaded, later entries override earlier entries with the same ID (the file is compacted on load if there are
+// too many of them, see rememberMemories(..))
+func (m *memoryRepository) Update(memory *domain.Memory) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	err := m.wrapped.Update(m.toIndexedMemory(memory))
 	if err != nil {
 		return err
 	}
+	return m.appendMemory(memory, true)
+}
+
+// Modify see Update(..); the embedding is written only if it was changed, as it takes most of the line.
+func (m *memoryRepository) Modify(id string, modify func(memory *domain.Memory)) (*domain.Memory, error) {
+	m.mutex.Lock() // so that concurrent modifications of the same memory are written in the same order they're applied
+	defer m.mutex.Unlock()
+	isEmbeddingChanged := false
+	var modifiedMemory *domain.Memory // with the full-precision embedding, if it was changed
+	memory, err := m.wrapped.Modify(id, func(memory *domain.Memory) {
+		embedding := memory.Embedding
+		modify(memory)
+		isEmbeddingChanged = memory.Embedding != embedding
+		modifiedMemory = memory.Clone()
+		if isEmbeddingChanged {
+			memory.Embedding = m.toIndexedEmbedding(memory.Embedding)
+		}
+	})
+	if err != nil || memory == nil {
+		return memory, err
+	}
+	return modifiedMemory, m.appendMemory(modifiedMemory, isEmbeddingChanged)
+}
+
+// RecordAccess the modified memories are appended to the file at once, without the embeddings (see Modify(..))
+func (m *memoryRepository) RecordAccess(ids []string) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	_, err = m.file.WriteString(string(jsonMemoryBytes))
-	if err != nil {
-		return err
+	modifiedMemories := make([]*domain.Memory, 0, len(ids))
+	for _, id := range ids {
+		memory, err := m.wrapped.Modify(id, func(memory *domain.Memory) {
+			memory.AccessCount++
+		})
+		if err != nil {
+			return err
+		}
+		if memory != nil {
+			modifiedMemories = append(modifiedMemories, memory)
+		}
+	}
+	return m.appendMemories(modifiedMemories, false)
+}
+
+// isEmbeddingQuantizationEnabled see `embeddingQuantization` in the config: "none" (the default) or "int8" (embeddings
+// are kept in memory quantized, see domain.Embedding.Quantize(), which is useful for large stores; the memory file keeps
+// the full precision)
+func isEmbeddingQuantizationEnabled(config *common.Config) bool {
+	return config.GetStringOrDefault("embeddingQuantization", "none") == "int8"
+}
+
+// toIndexedMemory returns the memory as it's kept by the wrapped repository: a copy with the quantized embedding if
+// quantization is enabled, so that the caller's memory (which is written to the file) keeps the full precision
+func (m *memoryRepository) toIndexedMemory(memory *domain.Memory) *domain.Memory {
+	embedding := m.toIndexedEmbedding(memory.Embedding)
+	if embedding == memory.Embedding {
+		return memory
+	}
+	indexedMemory := memory.Clone()
+	indexedMemory.Embedding = embedding
+	return indexedMemory
+}
+
+func (m *memoryRepository) toIndexedEmbedding(embedding *domain.Embedding) *domain.Embedding {
+	if !m.quantizesEmbeddings || embedding == nil || embedding.IsQuantized() {
+		return embedding
+	}
+	quantizedEmbedding := embedding.Quantize()
+	return &quantizedEmbedding
+}
+
+// appendMemory must be called under `mutex`. Quantized embeddings are never written, as they lose precision: such a
+// memory was found in the repository, so the file already has its full-precision embedding.
+func (m *memoryRepository) appendMemory(memory *domain.Memory, withEmbedding bool) error {
+	return m.appendMemories([]*domain.Memory{memory}, withEmbedding)
+}
+
+// appendMemories see appendMemory(..); the file is synced once for all the memories
+func (m *memoryRepository) appendMemories(memories []*domain.Memory, withEmbedding bool) error {
+	if m.file == nil {
+		return nil
+	}
+	var lines strings.Builder
+	for _, memory := range memories {
+		if memory.IsTransient {
+			continue
+		}
+		line, err := m.formatMemoryLine(memory, withEmbedding && (memory.Embedding == nil || !memory.Embedding.IsQuantized()))
+		if err != nil {
+			return err
+		}
+		lines.WriteString(line)
+		lines.WriteString("\n")
+	}
+	if lines.Len() == 0 {
+		return nil
 	}
-	_, err = m.file.WriteString("\n")
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	_, err := m.file.WriteString(lines.String())
 	if err != nil {
 		return err
 	}
@@ -95,34 +225,213 @@ func (m *memoryRepository) RemoveAll() error {
 	return m.wrapped.RemoveAll()
 }
 
-func (m *memoryRepository) rememberMemories(memoryFilePath string) {
+func (m *memoryRepository) RemoveExpired(now time.Time) error {
+	return m.wrapped.RemoveExpired(now)
+}
+
+func (m *memoryRepository) rememberMemories(memoryFilePath string) error {
 	lines, err := common.ReadAllLines(memoryFilePath)
 	if err != nil {
-		return
+		return nil
 	}
+	var memoryIDs []string
+	memories := make(map[string]*domain.Memory)
+	migrated := false
+	lineCount := 0
 	for _, line := range lines {
-		var jsonMemory jsonMemory
-		err := json.Unmarshal([]byte(line), &jsonMemory)
+		if line == "" {
+			continue
+		}
+		lineCount++
+		plaintextLine, isPlaintext, err := m.cipher.decrypt(line)
+		if err != nil {
+			return err // unlike unparsable lines, a wrong key must not be ignored, or the memory would be silently lost
+		}
+		// Plaintext lines are encrypted when the file is rewritten.
+		migrated = migrated || (isPlaintext && m.cipher != nil)
+		memory, embeddingUnchanged, lineMigrated, err := parseMemoryLine(plaintextLine)
 		if err != nil {
 			m.logger.Log(fmt.Sprintf("failed to parse memory in the memory file: %s", line))
 			continue
 		}
-		embedding, err := domain.NewEmbeddingFromFormattedValues(jsonMemory.Embedding)
+		migrated = migrated || lineMigrated
+		previousMemory, ok := memories[memory.ID]
+		if !ok {
+			memoryIDs = append(memoryIDs, memory.ID)
+		} else if embeddingUnchanged {
+			memory.Embedding = previousMemory.Embedding
+		}
+		memories[memory.ID] = memory // later entries are updates of earlier entries (see Update(..))
+	}
+	orderedMemories := make([]*domain.Memory, 0, len(memoryIDs))
+	for _, memoryID := range memoryIDs {
+		orderedMemories = append(orderedMemories, memories[memoryID])
+		_ = m.wrapped.Store(m.toIndexedMemory(memories[memoryID]))
+	}
+	m.warnIfEmbeddingModelsAreMixed(orderedMemories)
+	// Most of the file consists of outdated entries (importance ratings, access counts etc. are appended as updates).
+	isCompactionRequired := lineCount > len(orderedMemories)*2
+	if migrated || isCompactionRequired {
+		err = m.rewriteMemoryFile(memoryFilePath, orderedMemories)
 		if err != nil {
-			m.logger.Log(fmt.Sprintf("failed to parse memory in the memory file: %s", line))
+			m.logger.Log("failed to migrate the memory file: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// warnIfEmbeddingModelsAreMixed memories embedded with a model other than the current one are invisible to
+// embedding-based recall until they're re-embedded (see cmd/reembed)
+func (m *memoryRepository) warnIfEmbeddingModelsAreMixed(memories []*domain.Memory) {
+	var models []string
+	memoryCounts := make(map[string]int) // model => number of memories
+	for _, memory := range memories {
+		if memory.Embedding == nil {
 			continue
 		}
-		memory := domain.NewMemory(
-			jsonMemory.ID,
-			domain.MemoryType(jsonMemory.Type),
-			jsonMemory.Who,
-			time.Unix(0, jsonMemory.When),
-			jsonMemory.What,
-			jsonMemory.Where,
-			&embedding,
-		)
-		_ = m.wrapped.Store(memory)
+		model := fmt.Sprintf("%s (%d dimensions)", memory.EmbeddingModel, memory.Embedding.DimensionCount())
+		if _, ok := memoryCounts[model]; !ok {
+			models = append(models, model)
+		}
+		memoryCounts[model]++
+	}
+	if len(models) < 2 {
+		return
+	}
+	descriptions := make([]string, 0, len(models))
+	for _, model := range models {
+		descriptions = append(descriptions, fmt.Sprintf("%s: %d", model, memoryCounts[model]))
+	}
+	m.logger.Log(fmt.Sprintf(
+		"WARNING: the memory store contains embeddings of different models (%s); memories embedded with a model other than the current one can't be recalled by similarity, run cmd/reembed to migrate them\n",
+		strings.Join(descriptions, "; "),
+	))
+}
+
+// rewriteMemoryFile atomically replaces the whole memory file with the given memories (also compacts the file, as
+// updates are no longer stored as separate entries).
+func (m *memoryRepository) rewriteMemoryFile(memoryFilePath string, memories []*domain.Memory) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	lines := make([]string, 0, len(memories))
+	for _, memory := range memories {
+		if memory.IsTransient {
+			continue
+		}
+		line, err := m.formatMemoryLine(memory, true)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	err := writeLinesAtomically(memoryFilePath, lines)
+	if err != nil {
+		return err
+	}
+	if m.file != nil {
+		_ = m.file.Close()
+	}
+	m.file, err = os.OpenFile(memoryFilePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	return err
+}
+
+func (m *memoryRepository) formatMemoryLine(memory *domain.Memory, withEmbedding bool) (string, error) {
+	line, err := formatMemoryLine(memory, withEmbedding)
+	if err != nil {
+		return "", err
+	}
+	return m.cipher.encrypt(line)
+}
+
+// formatMemoryLine without the embedding, the line is an update of an earlier entry which has the embedding
+func formatMemoryLine(memory *domain.Memory, withEmbedding bool) (string, error) {
+	var formattedEmbedding string
+	if memory.Embedding != nil && withEmbedding {
+		formattedEmbedding = memory.Embedding.ToFormattedValues()
+	}
+	jsonMemory := jsonMemory{
+		Version:            memoryFileVersion,
+		ID:                 memory.ID,
+		Type:               int(memory.Type),
+		Who:                removeNewLines(memory.Who),
+		When:               memory.When.UnixNano(),
+		What:               removeNewLines(memory.What),
+		Where:              removeNewLines(memory.Where),
+		Embedding:          formattedEmbedding,
+		EmbeddingUnchanged: memory.Embedding != nil && !withEmbedding,
+		EmbeddingModel:     memory.EmbeddingModel,
+		Importance:         memory.Importance,
+		AccessCount:        memory.AccessCount,
+		SourceIDs:          memory.SourceIDs,
+		IsArchived:         memory.IsArchived,
+		Source:             memory.Source,
+	}
+	if !memory.ExpiresAt.IsZero() {
+		jsonMemory.ExpiresAt = memory.ExpiresAt.UnixNano()
+	}
+	jsonMemoryBytes, err := json.Marshal(jsonMemory)
+	if err != nil {
+		return "", err
+	}
+	return string(jsonMemoryBytes), nil
+}
+
+// parseMemoryLine also returns whether the embedding must be taken from the previous entry with the same ID (see
+// jsonMemory.EmbeddingUnchanged), and whether the memory had to be migrated from an older version of the format
+func parseMemoryLine(line string) (*domain.Memory, bool, bool, error) {
+	var jsonMemory jsonMemory
+	err := json.Unmarshal([]byte(line), &jsonMemory)
+	if err != nil {
+		return nil, false, false, err
+	}
+	var embedding *domain.Embedding
+	if jsonMemory.Embedding != "" {
+		parsedEmbedding, err := domain.NewEmbeddingFromFormattedValues(jsonMemory.Embedding)
+		if err != nil {
+			return nil, false, false, err
+		}
+		embedding = &parsedEmbedding
+	}
+	migrated := migrateMemory(&jsonMemory)
+	when := time.Unix(0, jsonMemory.When)
+	if jsonMemory.When == zeroTimeUnixNano {
+		when = time.Time{}
+	}
+	memory := domain.NewMemory(
+		jsonMemory.ID,
+		domain.MemoryType(jsonMemory.Type),
+		jsonMemory.Who,
+		when,
+		jsonMemory.What,
+		jsonMemory.Where,
+		embedding,
+	)
+	memory.EmbeddingModel = jsonMemory.EmbeddingModel
+	memory.Importance = jsonMemory.Importance
+	memory.AccessCount = jsonMemory.AccessCount
+	memory.SourceIDs = jsonMemory.SourceIDs
+	memory.IsArchived = jsonMemory.IsArchived
+	memory.Source = jsonMemory.Source
+	if jsonMemory.ExpiresAt != 0 {
+		memory.ExpiresAt = time.Unix(0, jsonMemory.ExpiresAt)
+	}
+	return memory, jsonMemory.EmbeddingUnchanged, migrated, nil
+}
+
+// migrateMemory before version 1, there was only one memory type (dialog), and extracted facts were stored as dialog
+// lines with a zero timestamp. Before version 2, the embedding model wasn't recorded.
+func migrateMemory(jsonMemory *jsonMemory) bool {
+	if jsonMemory.Version >= memoryFileVersion {
+		return false
+	}
+	if jsonMemory.Version < 1 && domain.MemoryType(jsonMemory.Type) == domain.MemoryTypeDialog && jsonMemory.When == zeroTimeUnixNano {
+		jsonMemory.Type = int(domain.MemoryTypeFact)
+	}
+	if jsonMemory.Version < 2 && jsonMemory.Embedding != "" && jsonMemory.EmbeddingModel == "" {
+		jsonMemory.EmbeddingModel = legacyEmbeddingModel
 	}
+	jsonMemory.Version = memoryFileVersion
+	return true
 }
 
 func removeNewLines(str string) string {
@@ -0,0 +1,156 @@
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/inmemory"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Log(message string) {
+	l.t.Log(message)
+}
+
+func newTestConfig(t *testing.T, yaml string) *common.Config {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configPath, []byte(yaml), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := common.LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func newTestMemoryRepository(t *testing.T, config *common.Config) domain.MemoryRepository {
+	repository, err := NewMemoryRepository(inmemory.NewMemoryRepository(), config, testLogger{t: t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repository
+}
+
+func findAllMemories(t *testing.T, repository domain.MemoryRepository) []*domain.Memory {
+	memories, err := repository.Find(domain.MemoryFilter{LatestCount: -1, IncludeArchived: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return memories
+}
+
+// TestQuantizedMemoryRepositoryKeepsFullPrecision quantized embeddings are kept in memory only: updates of memories
+// found in the repository must not write their lossy embeddings to the file
+func TestQuantizedMemoryRepositoryKeepsFullPrecision(t *testing.T) {
+	memoryFilePath := filepath.Join(t.TempDir(), "memory.txt")
+	config := newTestConfig(t, "memoryFilePath: "+memoryFilePath+"\nembeddingQuantization: int8\n")
+	repository := newTestMemoryRepository(t, config)
+	embedding := domain.NewEmbedding([]float64{0.1, 0.25, 0.5, 0.75, 1.0, -0.3})
+	expectedEmbedding := embedding.ToFormattedValues()
+	memory := domain.NewMemory("1", domain.MemoryTypeDialog, "John", time.Now(), "Hello", "room", &embedding)
+	err := repository.Store(memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory.Embedding.IsQuantized() {
+		t.Fatal("the stored memory must not be changed")
+	}
+	foundMemory := findAllMemories(t, repository)[0]
+	if !foundMemory.Embedding.IsQuantized() {
+		t.Fatal("the embedding must be quantized in memory")
+	}
+	_, err = repository.Modify("1", func(memory *domain.Memory) {
+		memory.Importance = 0.5
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatedMemory := findAllMemories(t, repository)[0].Clone()
+	updatedMemory.AccessCount = 3
+	err = repository.Update(updatedMemory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadedMemory := findAllMemories(t, newTestMemoryRepository(t, newTestConfig(t, "memoryFilePath: "+memoryFilePath+"\n")))[0]
+	if reloadedMemory.Embedding == nil || reloadedMemory.Embedding.ToFormattedValues() != expectedEmbedding {
+		t.Fatalf("expected the embedding %s", expectedEmbedding)
+	}
+	if reloadedMemory.Importance != 0.5 || reloadedMemory.AccessCount != 3 {
+		t.Fatalf("expected the updates to be kept, got importance %f and access count %d", reloadedMemory.Importance, reloadedMemory.AccessCount)
+	}
+}
+
+func TestQuantizedMemoryRepositoryPersistsReembeddedMemories(t *testing.T) {
+	memoryFilePath := filepath.Join(t.TempDir(), "memory.txt")
+	config := newTestConfig(t, "memoryFilePath: "+memoryFilePath+"\nembeddingQuantization: int8\n")
+	repository := newTestMemoryRepository(t, config)
+	err := repository.Store(domain.NewMemory("1", domain.MemoryTypeDialog, "John", time.Now(), "Hello", "room", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedding := domain.NewEmbedding([]float64{0.3, -0.2, 0.9})
+	_, err = repository.Modify("1", func(memory *domain.Memory) {
+		memory.Embedding = &embedding
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !findAllMemories(t, repository)[0].Embedding.IsQuantized() {
+		t.Fatal("the new embedding must be quantized in memory")
+	}
+	reloadedMemory := findAllMemories(t, newTestMemoryRepository(t, newTestConfig(t, "memoryFilePath: "+memoryFilePath+"\n")))[0]
+	if reloadedMemory.Embedding == nil || reloadedMemory.Embedding.ToFormattedValues() != embedding.ToFormattedValues() {
+		t.Fatalf("expected the embedding %s", embedding.ToFormattedValues())
+	}
+}
+
+func TestRecordAccessCountsOnlyMatchedMemories(t *testing.T) {
+	memoryFilePath := filepath.Join(t.TempDir(), "memory.txt")
+	repository := newTestMemoryRepository(t, newTestConfig(t, "memoryFilePath: "+memoryFilePath+"\n"))
+	now := time.Now()
+	for index, vector := range [][]float64{{0.0, 1.0}, {1.0, 0.0}, {0.0, 1.0}} {
+		embedding := domain.NewEmbedding(vector)
+		id := repository.NextID()
+		err := repository.Store(domain.NewMemory(id, domain.MemoryTypeDialog, "John", now.Add(time.Duration(index)*time.Second), id, "room", &embedding))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	filter := domain.EmbeddingFilter{
+		Where:            "room",
+		Embeddings:       []domain.Embedding{domain.NewEmbedding([]float64{1.0, 0.0})},
+		TopCount:         1,
+		SurroundingCount: 1,
+		MatchedIDs:       make(map[string]bool),
+	}
+	memories, err := repository.FindByEmbeddings(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(memories) != 3 || len(filter.MatchedIDs) != 1 || !filter.MatchedIDs[memories[1].ID] {
+		t.Fatalf("expected the matched memory surrounded by 2 memories, got %d memories and %v", len(memories), filter.MatchedIDs)
+	}
+	err = repository.RecordAccess([]string{memories[1].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadedMemories := findAllMemories(t, newTestMemoryRepository(t, newTestConfig(t, "memoryFilePath: "+memoryFilePath+"\n")))
+	for index, memory := range reloadedMemories {
+		expectedAccessCount := 0
+		if index == 1 {
+			expectedAccessCount = 1
+		}
+		if memory.AccessCount != expectedAccessCount {
+			t.Errorf("expected the access count %d of memory %d, got %d", expectedAccessCount, index, memory.AccessCount)
+		}
+	}
+}
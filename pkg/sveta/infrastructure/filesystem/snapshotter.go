@@ -0,0 +1,264 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+const (
+	snapshotFilePrefix    = "snapshot-"
+	snapshotFileExtension = ".tar.gz"
+	snapshotTimeLayout    = "20060102T150405.000Z"
+)
+
+var ErrSnapshotNotFound = errors.New("no snapshot found")
+
+// SnapshotInfo describes a snapshot archive
+type SnapshotInfo struct {
+	Path      string
+	CreatedAt time.Time
+}
+
+type snapshotter struct {
+	files           []storeFile
+	dirPath         string
+	retentionCount  int
+	retentionMaxAge time.Duration
+	logger          common.Logger
+}
+
+// NewSnapshotter creates snapshots of the store (memories, summaries, user profiles, capabilities and persona, the
+// knowledge base and the embedding cache) as .tar.gz archives in `snapshotDirPath`. Encrypted files stay encrypted in
+// the archive. After each snapshot, old snapshots are removed according to `snapshotRetentionCount` and
+// `snapshotRetentionMaxAge` (the latest snapshot is always kept).
+func NewSnapshotter(config *common.Config, logger common.Logger) domain.Snapshotter {
+	return &snapshotter{
+		files:           getStoreFiles(config),
+		dirPath:         getSnapshotDirPath(config),
+		retentionCount:  config.GetIntOrDefault("snapshotRetentionCount", 7),
+		retentionMaxAge: config.GetDurationOrDefault("snapshotRetentionMaxAge", 0),
+		logger:          logger,
+	}
+}
+
+func (s *snapshotter) CreateSnapshot() (string, error) {
+	err := os.MkdirAll(s.dirPath, 0700)
+	if err != nil {
+		return "", err
+	}
+	fileContents, err := s.readFiles()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	snapshotPath := filepath.Join(s.dirPath, snapshotFilePrefix+now.UTC().Format(snapshotTimeLayout)+snapshotFileExtension)
+	err = writeSnapshot(snapshotPath, s.files, fileContents, now)
+	if err != nil {
+		return "", err
+	}
+	s.logger.Log("Created snapshot " + snapshotPath + "\n")
+	s.applyRetentionPolicy(now)
+	return filepath.Base(snapshotPath), nil
+}
+
+// readFiles reads all the files at once under the exclusive lock, so that the snapshot is consistent
+func (s *snapshotter) readFiles() (map[string][]byte, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	result := make(map[string][]byte)
+	for _, file := range s.files {
+		data, err := os.ReadFile(file.Path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[file.Name] = data
+	}
+	return result, nil
+}
+
+func (s *snapshotter) applyRetentionPolicy(now time.Time) {
+	snapshots, err := listSnapshots(s.dirPath)
+	if err != nil {
+		s.logger.Log("failed to apply the snapshot retention policy: " + err.Error())
+		return
+	}
+	// Newer first.
+	for i, j := 0, len(snapshots)-1; i < j; i, j = i+1, j-1 {
+		snapshots[i], snapshots[j] = snapshots[j], snapshots[i]
+	}
+	for index, snapshot := range snapshots {
+		if index == 0 {
+			continue
+		}
+		isTooMany := s.retentionCount > 0 && index >= s.retentionCount
+		isTooOld := s.retentionMaxAge > 0 && now.Sub(snapshot.CreatedAt) > s.retentionMaxAge
+		if !isTooMany && !isTooOld {
+			continue
+		}
+		err = os.Remove(snapshot.Path)
+		if err != nil {
+			s.logger.Log("failed to remove an old snapshot: " + err.Error())
+		}
+	}
+}
+
+// ListSnapshots returns the snapshots sorted by time (older first)
+func ListSnapshots(config *common.Config) ([]SnapshotInfo, error) {
+	return listSnapshots(getSnapshotDirPath(config))
+}
+
+// FindSnapshot finds the latest snapshot which is not newer than the given time
+func FindSnapshot(config *common.Config, notNewerThan time.Time) (*SnapshotInfo, error) {
+	snapshots, err := ListSnapshots(config)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !snapshots[i].CreatedAt.After(notNewerThan) {
+			return &snapshots[i], nil
+		}
+	}
+	return nil, ErrSnapshotNotFound
+}
+
+// RestoreSnapshot replaces the files of the store with the ones from the snapshot. Files which didn't exist when the
+// snapshot was created are removed. Must not be called while the store is in use by another process.
+func RestoreSnapshot(config *common.Config, snapshotPath string) error {
+	fileContents, err := readSnapshot(snapshotPath)
+	if err != nil {
+		return err
+	}
+	for _, file := range getStoreFiles(config) {
+		data, ok := fileContents[file.Name]
+		if !ok {
+			err = os.Remove(file.Path)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		err = writeFileAtomically(file.Path, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSnapshot the files are archived in the order of `files`
+func writeSnapshot(snapshotPath string, files []storeFile, fileContents map[string][]byte, modTime time.Time) error {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, file := range files {
+		data, ok := fileContents[file.Name]
+		if !ok {
+			continue
+		}
+		err := tarWriter.WriteHeader(&tar.Header{
+			Name:    file.Name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: modTime,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tarWriter.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	err := tarWriter.Close()
+	if err != nil {
+		return err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(snapshotPath, buf.Bytes())
+}
+
+func readSnapshot(snapshotPath string) (map[string][]byte, error) {
+	file, err := os.Open(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	tarReader := tar.NewReader(gzipReader)
+	result := make(map[string][]byte)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, err
+		}
+		result[header.Name] = data
+	}
+	return result, nil
+}
+
+func listSnapshots(dirPath string) ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(dirPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []SnapshotInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, snapshotFilePrefix) || !strings.HasSuffix(name, snapshotFileExtension) {
+			continue
+		}
+		createdAt, err := time.Parse(snapshotTimeLayout, name[len(snapshotFilePrefix):len(name)-len(snapshotFileExtension)])
+		if err != nil {
+			continue
+		}
+		result = append(result, SnapshotInfo{
+			Path:      filepath.Join(dirPath, name),
+			CreatedAt: createdAt,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result, nil
+}
+
+func getSnapshotDirPath(config *common.Config) string {
+	return config.GetStringOrDefault("snapshotDirPath", "snapshots")
+}
+
+func (s SnapshotInfo) String() string {
+	return fmt.Sprintf("%s (%s)", s.Path, s.CreatedAt.Local().Format(time.RFC1123))
+}
@@ -0,0 +1,54 @@
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSnapshotCoversAllStoreFiles a point-in-time restore must bring back every persisted file of the store
+func TestSnapshotCoversAllStoreFiles(t *testing.T) {
+	dirPath := t.TempDir()
+	config := newTestConfig(t, `
+memoryFilePath: `+filepath.Join(dirPath, "memory.txt")+`
+summaryFilePath: `+filepath.Join(dirPath, "summaries.txt")+`
+userProfileFilePath: `+filepath.Join(dirPath, "profiles.txt")+`
+stateFilePath: `+filepath.Join(dirPath, "state.json")+`
+knowledgeFilePath: `+filepath.Join(dirPath, "knowledge.txt")+`
+embeddingCacheFilePath: `+filepath.Join(dirPath, "embeddings.cache")+`
+snapshotDirPath: `+filepath.Join(dirPath, "snapshots")+`
+`)
+	files := getStoreFiles(config)
+	if len(files) != 6 {
+		t.Fatalf("expected 6 store files, got %d", len(files))
+	}
+	for _, file := range files {
+		err := os.WriteFile(file.Path, []byte("original "+file.Name+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshotName, err := NewSnapshotter(config, testLogger{t: t}).CreateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		err = os.WriteFile(file.Path, []byte("changed\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = RestoreSnapshot(config, filepath.Join(dirPath, "snapshots", snapshotName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "original "+file.Name+"\n" {
+			t.Fatalf("%s wasn't restored: %q", file.Name, string(data))
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package filesystem
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"kgeyst.com/sveta/pkg/common"
+)
+
+// storeMutex guards writes to all the files of the store (memories, summaries, profiles etc.): writers share the lock,
+// while a snapshot takes it exclusively, so that it never captures a half-written line or an inconsistent set of files.
+var storeMutex sync.RWMutex
+
+// storeFile a persisted file of the store
+type storeFile struct {
+	// Name how the file is named in snapshot archives
+	Name string
+	Path string
+	// IsEncrypted whether the file is encrypted with the memory encryption key (see LoadMemoryEncryptionKey(..))
+	IsEncrypted bool
+}
+
+// getStoreFiles every persisted file of the store must be listed here, so that it's included in snapshots and
+// re-encrypted on key rotation. The defaults must match the defaults of the respective repositories.
+func getStoreFiles(config *common.Config) []storeFile {
+	files := []storeFile{
+		{Name: "memory.txt", Path: config.GetString("memoryFilePath"), IsEncrypted: true},
+		{Name: "summaries.txt", Path: config.GetStringOrDefault("summaryFilePath", "summaries.txt"), IsEncrypted: true},
+		{Name: "profiles.txt", Path: config.GetStringOrDefault("userProfileFilePath", "profiles.txt"), IsEncrypted: true},
+		{Name: "state.json", Path: config.GetStringOrDefault("stateFilePath", "state.json")},
+		{Name: "knowledge.txt", Path: config.GetStringOrDefault("knowledgeFilePath", "knowledge.txt"), IsEncrypted: true},
+		{Name: "embeddings.cache", Path: config.GetStringOrDefault("embeddingCacheFilePath", "embeddings.cache"), IsEncrypted: true},
+	}
+	result := make([]storeFile, 0, len(files))
+	for _, file := range files {
+		if file.Path != "" { // persistence is disabled
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+// writeLinesAtomically see writeFileAtomically(..)
+func writeLinesAtomically(filePath string, lines []string) error {
+	var buf strings.Builder
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	return writeFileAtomically(filePath, []byte(buf.String()))
+}
+
+// writeFileAtomically writes to a temporary file first, so that the original file is never left half-written.
+func writeFileAtomically(filePath string, data []byte) error {
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	tempFilePath := filePath + ".tmp"
+	tempFile, err := os.OpenFile(tempFilePath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(data)
+	if err != nil {
+		_ = tempFile.Close()
+		return err
+	}
+	err = tempFile.Sync()
+	if err != nil {
+		_ = tempFile.Close()
+		return err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFilePath, filePath)
+}
@@ -0,0 +1,125 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+type summaryRepository struct {
+	mutex     sync.Mutex
+	wrapped   domain.SummaryRepository
+	filePath  string
+	cipher    *memoryCipher
+	summaries map[string]string // where => summary
+}
+
+type jsonSummary struct {
+	Where   string `json:"where"`
+	Summary string `json:"summary"`
+}
+
+// NewSummaryRepository persists summaries to the summary file (see `summaryFilePath` in the config), one room per line.
+// The file is encrypted with the same key as the memory store (see LoadMemoryEncryptionKey(..)).
+func NewSummaryRepository(wrapped domain.SummaryRepository, config *common.Config) (domain.SummaryRepository, error) {
+	encryptionKey, err := LoadMemoryEncryptionKey(config)
+	if err != nil {
+		return nil, err
+	}
+	summaryCipher, err := newMemoryCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	r := &summaryRepository{
+		wrapped:   wrapped,
+		filePath:  config.GetStringOrDefault("summaryFilePath", "summaries.txt"),
+		cipher:    summaryCipher,
+		summaries: make(map[string]string),
+	}
+	err = r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *summaryRepository) FindByWhere(where string) (*string, error) {
+	return r.wrapped.FindByWhere(where)
+}
+
+func (r *summaryRepository) Store(where, summary string) error {
+	err := r.wrapped.Store(where, summary)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.summaries[where] = summary
+	return r.save()
+}
+
+func (r *summaryRepository) RemoveAll() error {
+	err := r.wrapped.RemoveAll()
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.summaries = make(map[string]string)
+	return r.save()
+}
+
+func (r *summaryRepository) load() error {
+	if _, err := os.Stat(r.filePath); os.IsNotExist(err) {
+		return nil
+	}
+	lines, err := common.ReadAllLines(r.filePath)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		plaintextLine, _, err := r.cipher.decrypt(line)
+		if err != nil {
+			return err
+		}
+		var summary jsonSummary
+		err = json.Unmarshal([]byte(plaintextLine), &summary)
+		if err != nil {
+			continue
+		}
+		r.summaries[summary.Where] = summary.Summary
+		err = r.wrapped.Store(summary.Where, summary.Summary)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *summaryRepository) save() error {
+	wheres := make([]string, 0, len(r.summaries))
+	for where := range r.summaries {
+		wheres = append(wheres, where)
+	}
+	sort.Strings(wheres)
+	lines := make([]string, 0, len(wheres))
+	for _, where := range wheres {
+		summaryBytes, err := json.Marshal(jsonSummary{Where: where, Summary: r.summaries[where]})
+		if err != nil {
+			return err
+		}
+		line, err := r.cipher.encrypt(string(summaryBytes))
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	return writeLinesAtomically(r.filePath, lines)
+}
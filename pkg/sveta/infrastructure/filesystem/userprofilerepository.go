@@ -0,0 +1,166 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+type userProfileRepository struct {
+	mutex    sync.Mutex
+	filePath string
+	cipher   *memoryCipher
+	entries  map[string][]*domain.UserProfileEntry // who => entries
+}
+
+type jsonUserProfileEntry struct {
+	ID         string `json:"id"`
+	Who        string `json:"who"`
+	What       string `json:"what"`
+	Where      string `json:"where"`
+	When       int64  `json:"when"`
+	Visibility string `json:"visibility"`
+}
+
+// NewUserProfileRepository stores user profiles in a separate file (see `userProfileFilePath` in the config), one entry
+// per line. Profiles are small, so the whole file is rewritten on every change. The file is encrypted with the same
+// key as the memory store (see LoadMemoryEncryptionKey(..)).
+func NewUserProfileRepository(config *common.Config) (domain.UserProfileRepository, error) {
+	encryptionKey, err := LoadMemoryEncryptionKey(config)
+	if err != nil {
+		return nil, err
+	}
+	profileCipher, err := newMemoryCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	r := &userProfileRepository{
+		filePath: config.GetStringOrDefault("userProfileFilePath", "profiles.txt"),
+		cipher:   profileCipher,
+		entries:  make(map[string][]*domain.UserProfileEntry),
+	}
+	err = r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *userProfileRepository) NextID() string {
+	return uuid.NewString()
+}
+
+func (r *userProfileRepository) Store(entry *domain.UserProfileEntry) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entries[entry.Who] = append(r.entries[entry.Who], entry)
+	return r.save()
+}
+
+func (r *userProfileRepository) FindByWho(who string) ([]*domain.UserProfileEntry, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entries := r.entries[who]
+	result := make([]*domain.UserProfileEntry, len(entries))
+	copy(result, entries)
+	return result, nil
+}
+
+func (r *userProfileRepository) Remove(who, id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entries := r.entries[who]
+	for index, entry := range entries {
+		if entry.ID == id {
+			r.entries[who] = append(entries[:index:index], entries[index+1:]...)
+			return r.save()
+		}
+	}
+	return nil
+}
+
+func (r *userProfileRepository) RemoveAll() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entries = make(map[string][]*domain.UserProfileEntry)
+	return r.save()
+}
+
+func (r *userProfileRepository) load() error {
+	if _, err := os.Stat(r.filePath); os.IsNotExist(err) {
+		return nil
+	}
+	lines, err := common.ReadAllLines(r.filePath)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		plaintextLine, _, err := r.cipher.decrypt(line)
+		if err != nil {
+			return err
+		}
+		var jsonEntry jsonUserProfileEntry
+		err = json.Unmarshal([]byte(plaintextLine), &jsonEntry)
+		if err != nil {
+			continue
+		}
+		visibility, ok := domain.ParseProfileVisibility(jsonEntry.Visibility)
+		if !ok {
+			visibility = domain.ProfileVisibilityRoom // the safest option
+		}
+		r.entries[jsonEntry.Who] = append(r.entries[jsonEntry.Who], &domain.UserProfileEntry{
+			ID:         jsonEntry.ID,
+			Who:        jsonEntry.Who,
+			What:       jsonEntry.What,
+			Where:      jsonEntry.Where,
+			When:       time.Unix(0, jsonEntry.When),
+			Visibility: visibility,
+		})
+	}
+	for _, entries := range r.entries {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].When.Before(entries[j].When)
+		})
+	}
+	return nil
+}
+
+func (r *userProfileRepository) save() error {
+	whos := make([]string, 0, len(r.entries))
+	for who := range r.entries {
+		whos = append(whos, who)
+	}
+	sort.Strings(whos)
+	var lines []string
+	for _, who := range whos {
+		for _, entry := range r.entries[who] {
+			jsonEntryBytes, err := json.Marshal(jsonUserProfileEntry{
+				ID:         entry.ID,
+				Who:        removeNewLines(entry.Who),
+				What:       removeNewLines(entry.What),
+				Where:      removeNewLines(entry.Where),
+				When:       entry.When.UnixNano(),
+				Visibility: entry.Visibility.String(),
+			})
+			if err != nil {
+				return err
+			}
+			line, err := r.cipher.encrypt(string(jsonEntryBytes))
+			if err != nil {
+				return err
+			}
+			lines = append(lines, line)
+		}
+	}
+	return writeLinesAtomically(r.filePath, lines)
+}
@@ -0,0 +1,112 @@
+package inmemory
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Standard BM25 parameters.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// lexicalIndex an inverted index over memories which allows to score them with BM25. Complements embedding-based search
+// which tends to blur exact names, numbers and rare terms (IRC nicks, product codes, URLs etc.)
+// NOTE: not thread-safe, synchronized by MemoryRepository
+type lexicalIndex struct {
+	postings      map[string]map[string]int // term => memory ID => term frequency
+	documentTerms map[string][]string       // memory ID => terms
+	totalLength   int
+}
+
+func newLexicalIndex() *lexicalIndex {
+	return &lexicalIndex{
+		postings:      make(map[string]map[string]int),
+		documentTerms: make(map[string][]string),
+	}
+}
+
+func (l *lexicalIndex) add(id, text string) {
+	l.remove(id)
+	terms := tokenize(text)
+	for _, term := range terms {
+		frequencies, ok := l.postings[term]
+		if !ok {
+			frequencies = make(map[string]int)
+			l.postings[term] = frequencies
+		}
+		frequencies[id]++
+	}
+	l.documentTerms[id] = terms
+	l.totalLength += len(terms)
+}
+
+func (l *lexicalIndex) remove(id string) {
+	terms, ok := l.documentTerms[id]
+	if !ok {
+		return
+	}
+	for _, term := range terms {
+		frequencies := l.postings[term]
+		delete(frequencies, id)
+		if len(frequencies) == 0 {
+			delete(l.postings, term)
+		}
+	}
+	delete(l.documentTerms, id)
+	l.totalLength -= len(terms)
+}
+
+func (l *lexicalIndex) clear() {
+	l.postings = make(map[string]map[string]int)
+	l.documentTerms = make(map[string][]string)
+	l.totalLength = 0
+}
+
+// score calculates the BM25 score of the memory with the given ID relative to the query terms (see tokenize(..))
+func (l *lexicalIndex) score(queryTerms []string, id string) float64 {
+	documentCount := len(l.documentTerms)
+	terms, ok := l.documentTerms[id]
+	if !ok || documentCount == 0 {
+		return 0.0
+	}
+	length := len(terms)
+	averageLength := float64(l.totalLength) / float64(documentCount)
+	var result float64
+	for _, term := range queryTerms {
+		frequencies := l.postings[term]
+		termFrequency := float64(frequencies[id])
+		if termFrequency == 0 {
+			continue
+		}
+		documentFrequency := float64(len(frequencies))
+		idf := math.Log(1.0 + (float64(documentCount)-documentFrequency+0.5)/(documentFrequency+0.5))
+		result += idf * termFrequency * (bm25K1 + 1) / (termFrequency + bm25K1*(1-bm25B+bm25B*float64(length)/averageLength))
+	}
+	return result
+}
+
+// tokenize splits the text into lowercase terms. Whole whitespace-delimited words are kept as terms (trimmed of
+// punctuation) so that URLs, product codes etc. can be matched exactly; their alphanumeric parts are added as
+// separate terms as well.
+func tokenize(text string) []string {
+	var terms []string
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		word = strings.TrimFunc(word, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		if word == "" {
+			continue
+		}
+		terms = append(terms, word)
+		parts := strings.FieldsFunc(word, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		if len(parts) > 1 {
+			terms = append(terms, parts...)
+		}
+	}
+	return terms
+}
@@ -19,7 +19,32 @@ func NewMemoryFactory(memoryRepository domain.MemoryRepository, embedder domain.
 }
 
 func (m *MemoryFactory) NewMemory(typ domain.MemoryType, who string, what string, where string) *domain.Memory {
-	return domain.NewMemory(m.memoryRepository.NextID(), typ, who, time.Now(), what, where, m.getEmbedding(what))
+	memory := domain.NewMemory(m.memoryRepository.NextID(), typ, who, time.Now(), what, where, m.getEmbedding(what))
+	if memory.Embedding != nil {
+		memory.EmbeddingModel = m.embedder.ModelName()
+	}
+	return memory
+}
+
+func (m *MemoryFactory) NewMemories(typ domain.MemoryType, who string, whats []string, where string) []*domain.Memory {
+	embeddings, err := m.embedder.EmbedBatch(whats)
+	if err != nil {
+		embeddings = nil
+	}
+	now := time.Now()
+	result := make([]*domain.Memory, len(whats))
+	for index, what := range whats {
+		var embedding *domain.Embedding
+		if embeddings != nil && embeddings[index].DimensionCount() > 0 {
+			embedding = &embeddings[index]
+		}
+		memory := domain.NewMemory(m.memoryRepository.NextID(), typ, who, now, what, where, embedding)
+		if memory.Embedding != nil {
+			memory.EmbeddingModel = m.embedder.ModelName()
+		}
+		result[index] = memory
+	}
+	return result
 }
 
 func (m *MemoryFactory) getEmbedding(sentence string) *domain.Embedding {
@@ -27,8 +52,8 @@ func (m *MemoryFactory) getEmbedding(sentence string) *domain.Embedding {
 		return nil
 	}
 	embedding, err := m.embedder.Embed(sentence)
-	if err != nil {
-		return nil
+	if err != nil || embedding.DimensionCount() == 0 {
+		return nil // will be re-embedded later, see domain.MemoryReembedder
 	}
 	return &embedding
 }
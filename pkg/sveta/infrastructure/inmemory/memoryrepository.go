@@ -3,6 +3,7 @@ package inmemory
 import (
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 
@@ -10,13 +11,26 @@ import (
 	"kgeyst.com/sveta/pkg/sveta/domain"
 )
 
+// reciprocalRankFusionK the constant from the original paper on reciprocal rank fusion (Cormack et al., 2009), it
+// dampens the impact of top-ranked results
+const reciprocalRankFusionK = 60
+
 type MemoryRepository struct {
-	mutex    sync.Mutex
-	memories []*domain.Memory
+	mutex        sync.Mutex
+	memories     []*domain.Memory
+	lexicalIndex *lexicalIndex
+}
+
+type scoredMemory struct {
+	Memory *domain.Memory
+	Index  int
+	Score  float64
 }
 
 func NewMemoryRepository() *MemoryRepository {
-	return &MemoryRepository{}
+	return &MemoryRepository{
+		lexicalIndex: newLexicalIndex(),
+	}
 }
 
 func (r *MemoryRepository) NextID() string {
@@ -27,6 +41,52 @@ func (r *MemoryRepository) Store(memory *domain.Memory) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	r.memories = append(r.memories, memory)
+	r.lexicalIndex.add(memory.ID, memory.What)
+	return nil
+}
+
+func (r *MemoryRepository) Update(memory *domain.Memory) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for index, existingMemory := range r.memories {
+		if existingMemory.ID == memory.ID {
+			r.memories[index] = memory
+			r.lexicalIndex.add(memory.ID, memory.What)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) Modify(id string, modify func(memory *domain.Memory)) (*domain.Memory, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for index, existingMemory := range r.memories {
+		if existingMemory.ID == id {
+			memory := existingMemory.Clone()
+			modify(memory)
+			r.memories[index] = memory
+			r.lexicalIndex.add(memory.ID, memory.What)
+			return memory, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MemoryRepository) RecordAccess(ids []string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	idSet := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		idSet[id] = true
+	}
+	for index, existingMemory := range r.memories {
+		if idSet[existingMemory.ID] {
+			memory := existingMemory.Clone()
+			memory.AccessCount++
+			r.memories[index] = memory
+		}
+	}
 	return nil
 }
 
@@ -36,11 +96,12 @@ func (r *MemoryRepository) Find(filter domain.MemoryFilter) ([]*domain.Memory, e
 	if filter.LatestCount < 0 || filter.LatestCount > len(r.memories) {
 		filter.LatestCount = len(r.memories)
 	}
+	now := time.Now()
 	var result []*domain.Memory
 	count := 0
 	for i := len(r.memories) - 1; i >= 0; i-- {
 		entry := r.memories[i]
-		if !memoryFilterApplies(filter, entry) {
+		if !memoryFilterApplies(filter, entry, now) {
 			continue
 		}
 		result = append(result, entry) // NOTE: underlying memory objects are shared
@@ -57,48 +118,70 @@ func (r *MemoryRepository) Find(filter domain.MemoryFilter) ([]*domain.Memory, e
 }
 
 func (r *MemoryRepository) FindByEmbeddings(filter domain.EmbeddingFilter) ([]*domain.Memory, error) {
+	queryDimensionCount, err := domain.GetCommonDimensionCount(filter.Embeddings)
+	if err != nil {
+		return nil, err
+	}
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	var similarities []struct {
-		Memory     *domain.Memory
-		Index      int
-		Similarity float64
+	now := time.Now()
+	var queryTerms []string
+	if filter.LexicalWeight > 0 {
+		queryTerms = tokenize(filter.Query)
 	}
+	var vectorRanking, lexicalRanking []scoredMemory
 	for index, memory := range r.memories {
-		if !embeddingFilterAppliesWithoutEmbedding(filter, memory) {
+		if !embeddingFilterAppliesWithoutEmbedding(filter, memory, now) {
 			continue
 		}
-		if memory.Embedding == nil {
+		if len(queryTerms) > 0 {
+			lexicalScore := r.lexicalIndex.score(queryTerms, memory.ID)
+			if lexicalScore > 0 {
+				lexicalRanking = append(lexicalRanking, scoredMemory{Memory: memory, Index: index, Score: lexicalScore})
+			}
+		}
+		if !isEmbeddingComparable(filter, memory, queryDimensionCount) {
 			continue
 		}
 		similarity := memory.Embedding.GetBestSimilarityTo(filter.Embeddings)
 		if similarity < filter.SimilarityThreshold { // ignore sentences which are too different
 			continue
 		}
-		similarities = append(similarities, struct {
-			Memory     *domain.Memory
-			Index      int
-			Similarity float64
-		}{Memory: memory, Index: index, Similarity: similarity})
-	}
-	sort.Slice(similarities, func(i, j int) bool {
-		return similarities[i].Similarity > similarities[j].Similarity
-	})
+		score := similarity
+		if filter.Scorer != nil {
+			score = filter.Scorer.Score(memory, similarity, now)
+		}
+		vectorRanking = append(vectorRanking, scoredMemory{Memory: memory, Index: index, Score: score})
+	}
+	sortScoredMemories(vectorRanking)
+	sortScoredMemories(lexicalRanking)
+	ranking := vectorRanking
+	if len(lexicalRanking) > 0 {
+		ranking = fuseRankings(vectorRanking, lexicalRanking, filter.LexicalWeight)
+	}
 	topCount := filter.TopCount
-	if topCount > len(similarities) {
-		topCount = len(similarities)
+	if topCount > len(ranking) {
+		topCount = len(ranking)
+	}
+	ranking = ranking[0:topCount]
+	if filter.MatchedIDs != nil {
+		for _, scored := range ranking {
+			filter.MatchedIDs[scored.Memory.ID] = true
+		}
 	}
-	similarities = similarities[0:topCount]
 	var result []*domain.Memory
-	for _, similarity := range similarities {
+	for _, scored := range ranking {
 		for index := 0; index < filter.SurroundingCount*2+1; index++ {
-			finalIndex := similarity.Index - (filter.SurroundingCount*2+1)/2 + index
+			finalIndex := scored.Index - (filter.SurroundingCount*2+1)/2 + index
 			if finalIndex < 0 {
 				finalIndex = 0
 			}
 			if finalIndex >= len(r.memories) {
 				finalIndex = len(r.memories) - 1
 			}
+			if r.memories[finalIndex].IsArchived || r.memories[finalIndex].IsExpired(now) {
+				continue
+			}
 			result = append(result, r.memories[finalIndex])
 		}
 	}
@@ -110,15 +193,79 @@ func (r *MemoryRepository) RemoveAll() error {
 	defer r.mutex.Unlock()
 	var newMems []*domain.Memory
 	for _, mem := range r.memories {
-		if mem.When.IsZero() {
+		if isImpersonalMemoryType(mem.Type) {
 			newMems = append(newMems, mem)
 		}
 	}
 	r.memories = newMems
+	r.lexicalIndex.clear()
+	for _, mem := range r.memories {
+		r.lexicalIndex.add(mem.ID, mem.What)
+	}
+	return nil
+}
+
+// isImpersonalMemoryType memories of these types aren't about the users, so they survive RemoveAll(); dialog memories,
+// summaries of the dialog and facts learned from it are removed
+func isImpersonalMemoryType(memoryType domain.MemoryType) bool {
+	switch memoryType {
+	case domain.MemoryTypeNews, domain.MemoryTypeBio, domain.MemoryTypeDocument, domain.MemoryTypeSearchResult:
+		return true
+	}
+	return false
+}
+
+func (r *MemoryRepository) RemoveExpired(now time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	newMems := make([]*domain.Memory, 0, len(r.memories))
+	for _, mem := range r.memories {
+		if mem.IsExpired(now) {
+			r.lexicalIndex.remove(mem.ID)
+			continue
+		}
+		newMems = append(newMems, mem)
+	}
+	r.memories = newMems
 	return nil
 }
 
-func memoryFilterApplies(filter domain.MemoryFilter, memory *domain.Memory) bool {
+func sortScoredMemories(memories []scoredMemory) {
+	sort.SliceStable(memories, func(i, j int) bool {
+		return memories[i].Score > memories[j].Score
+	})
+}
+
+// fuseRankings merges the vector-based and the lexical rankings using weighted reciprocal rank fusion.
+// `lexicalWeight` is from 0.0 (only the vector-based ranking matters) to 1.0 (only the lexical ranking matters).
+func fuseRankings(vectorRanking, lexicalRanking []scoredMemory, lexicalWeight float64) []scoredMemory {
+	scores := make(map[string]*scoredMemory)
+	var result []*scoredMemory
+	addRanking := func(ranking []scoredMemory, weight float64) {
+		for rank, scored := range ranking {
+			fused, ok := scores[scored.Memory.ID]
+			if !ok {
+				fused = &scoredMemory{Memory: scored.Memory, Index: scored.Index}
+				scores[scored.Memory.ID] = fused
+				result = append(result, fused)
+			}
+			fused.Score += weight / float64(reciprocalRankFusionK+rank+1)
+		}
+	}
+	addRanking(vectorRanking, 1.0-lexicalWeight)
+	addRanking(lexicalRanking, lexicalWeight)
+	fusedRanking := make([]scoredMemory, 0, len(result))
+	for _, fused := range result {
+		fusedRanking = append(fusedRanking, *fused)
+	}
+	sortScoredMemories(fusedRanking)
+	return fusedRanking
+}
+
+func memoryFilterApplies(filter domain.MemoryFilter, memory *domain.Memory, now time.Time) bool {
+	if (memory.IsArchived && !filter.IncludeArchived) || memory.IsExpired(now) {
+		return false
+	}
 	if len(filter.Types) > 0 && !domain.IsMemoryTypeInSlice(memory.Type, filter.Types) {
 		return false
 	}
@@ -134,16 +281,39 @@ func memoryFilterApplies(filter domain.MemoryFilter, memory *domain.Memory) bool
 	if filter.NotOlderThan != nil && memory.When.Before(*filter.NotOlderThan) {
 		return false
 	}
+	if filter.NotNewerThan != nil && memory.When.After(*filter.NotNewerThan) {
+		return false
+	}
+	if filter.WithoutEmbedding && memory.Embedding != nil && memory.Embedding.DimensionCount() > 0 {
+		return false
+	}
 	return true
 }
 
-func embeddingFilterAppliesWithoutEmbedding(filter domain.EmbeddingFilter, memory *domain.Memory) bool {
+// isEmbeddingComparable embeddings of different models must not be compared (the similarity would be meaningless)
+func isEmbeddingComparable(filter domain.EmbeddingFilter, memory *domain.Memory, queryDimensionCount int) bool {
+	if memory.Embedding == nil || memory.Embedding.DimensionCount() != queryDimensionCount {
+		return false
+	}
+	return filter.EmbeddingModel == "" || memory.EmbeddingModel == "" || memory.EmbeddingModel == filter.EmbeddingModel
+}
+
+func embeddingFilterAppliesWithoutEmbedding(filter domain.EmbeddingFilter, memory *domain.Memory, now time.Time) bool {
+	if memory.IsArchived || memory.IsExpired(now) {
+		return false
+	}
 	if len(filter.Types) > 0 && !domain.IsMemoryTypeInSlice(memory.Type, filter.Types) {
 		return false
 	}
 	if filter.Where != "" && memory.Where != filter.Where {
 		return false
 	}
+	if filter.NotOlderThan != nil && memory.When.Before(*filter.NotOlderThan) {
+		return false
+	}
+	if filter.NotNewerThan != nil && memory.When.After(*filter.NotNewerThan) {
+		return false
+	}
 	if common.IsStringInSlice(memory.ID, filter.ExcludedIDs) {
 		return false
 	}
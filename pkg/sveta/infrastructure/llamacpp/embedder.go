@@ -0,0 +1,242 @@
+package llamacpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+const (
+	// ConfigKeyEmbedderModelPath the path to the GGUF embedding model, relative to the working directory (only used if
+	// the embedding binary is run)
+	ConfigKeyEmbedderModelPath = "embedderModelPath"
+	// ConfigKeyEmbedderModelName the name of the embedding model (by default, it's derived from the model path)
+	ConfigKeyEmbedderModelName = "embedderModelName"
+	// ConfigKeyEmbedderDimensionCount the number of dimensions of the embedding model (detected automatically if not set)
+	ConfigKeyEmbedderDimensionCount = "embedderDimensionCount"
+	// ConfigKeyEmbedderServerURL the URL of a running llama.cpp server started with --embedding; if not set, the
+	// embedding binary is run for each batch instead
+	ConfigKeyEmbedderServerURL = "embedderServerURL"
+	// ConfigKeyEmbedderBinPath the path to llama.cpp's embedding binary, relative to the working directory
+	ConfigKeyEmbedderBinPath = "embedderBinPath"
+	// ConfigKeyEmbedderTimeout how long to wait for a single embedding
+	ConfigKeyEmbedderTimeout = "embedderTimeout"
+)
+
+var errWrongDimensionCount = errors.New("the embedding model returned an embedding of an unexpected dimension")
+
+// dimensionProbe what to embed to detect the dimension count of the model
+const dimensionProbe = "hello"
+
+type Embedder struct {
+	mutex          sync.Mutex
+	logger         common.Logger
+	modelPath      string
+	modelName      string
+	dimensionCount int // 0 if not detected yet
+	serverURL      string
+	binPath        string
+	timeout        time.Duration
+	httpClient     *http.Client
+}
+
+type embeddingRequest struct {
+	Input []string `json:"input"`
+}
+
+type embeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+}
+
+// NewEmbedder runs a local GGUF embedding model (nomic-embed-text, bge etc.) with llama.cpp, either via a running
+// llama.cpp server (see ConfigKeyEmbedderServerURL), or via llama.cpp's embedding binary.
+func NewEmbedder(config *common.Config, logger common.Logger) *Embedder {
+	modelPath := config.GetStringOrDefault(ConfigKeyEmbedderModelPath, "embedder.gguf")
+	modelName := config.GetString(ConfigKeyEmbedderModelName)
+	if modelName == "" {
+		modelName = strings.TrimSuffix(filepath.Base(modelPath), filepath.Ext(modelPath))
+	}
+	timeout := config.GetDurationOrDefault(ConfigKeyEmbedderTimeout, 30*time.Second)
+	return &Embedder{
+		logger:         logger,
+		modelPath:      modelPath,
+		modelName:      modelName,
+		dimensionCount: config.GetIntOrDefault(ConfigKeyEmbedderDimensionCount, 0),
+		serverURL:      strings.TrimSuffix(config.GetString(ConfigKeyEmbedderServerURL), "/"),
+		binPath:        config.GetStringOrDefault(ConfigKeyEmbedderBinPath, "llama-embedding"),
+		timeout:        timeout,
+		httpClient:     &http.Client{Timeout: timeout},
+	}
+}
+
+func (e *Embedder) Embed(sentence string) (domain.Embedding, error) {
+	embeddings, err := e.EmbedBatch([]string{sentence})
+	if err != nil {
+		return domain.Embedding{}, err
+	}
+	return embeddings[0], nil
+}
+
+// EmbedBatch empty sentences get empty embeddings
+func (e *Embedder) EmbedBatch(sentences []string) ([]domain.Embedding, error) {
+	result := make([]domain.Embedding, len(sentences))
+	var texts []string
+	var textIndices []int // index in `texts` => index in `sentences`
+	for index, sentence := range sentences {
+		sentence = strings.TrimSpace(strings.ReplaceAll(sentence, "\n", " ")) // newlines separate prompts for the binary
+		if sentence == "" {
+			continue
+		}
+		e.logger.Log(fmt.Sprintf("Embedding: \"%s\"...\n", sentence))
+		texts = append(texts, sentence)
+		textIndices = append(textIndices, index)
+	}
+	if len(texts) == 0 {
+		return result, nil
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	err := e.detectDimensionCountIfRequired()
+	if err != nil {
+		return nil, err
+	}
+	embeddings, err := e.embed(texts)
+	if err != nil {
+		return nil, err
+	}
+	for index, values := range embeddings {
+		if len(values) != e.dimensionCount {
+			return nil, errWrongDimensionCount
+		}
+		result[textIndices[index]] = domain.NewEmbedding(values)
+	}
+	return result, nil
+}
+
+func (e *Embedder) ModelName() string {
+	return e.modelName
+}
+
+// DimensionCount returns 0 if the model is unavailable and the dimension count isn't specified in the config
+func (e *Embedder) DimensionCount() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	err := e.detectDimensionCountIfRequired()
+	if err != nil {
+		e.logger.Log("failed to detect the dimension count of the embedding model: " + err.Error())
+	}
+	return e.dimensionCount
+}
+
+func (e *Embedder) detectDimensionCountIfRequired() error {
+	if e.dimensionCount > 0 {
+		return nil
+	}
+	embeddings, err := e.embed([]string{dimensionProbe})
+	if err != nil {
+		return err
+	}
+	if len(embeddings[0]) == 0 {
+		return errWrongDimensionCount
+	}
+	e.dimensionCount = len(embeddings[0])
+	return nil
+}
+
+// embed returns exactly one embedding per sentence, in the same order
+func (e *Embedder) embed(sentences []string) ([][]float64, error) {
+	var embeddings [][]float64
+	var err error
+	if e.serverURL != "" {
+		embeddings, err = e.embedWithServer(sentences)
+	} else {
+		embeddings, err = e.embedWithBinary(sentences)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) != len(sentences) {
+		return nil, errors.New("the embedding model returned a wrong number of embeddings")
+	}
+	return embeddings, nil
+}
+
+// embedWithServer uses the OpenAI-compatible endpoint, as its format is stable across llama.cpp versions
+func (e *Embedder) embedWithServer(sentences []string) ([][]float64, error) {
+	requestBody, err := json.Marshal(embeddingRequest{Input: sentences})
+	if err != nil {
+		return nil, err
+	}
+	response, err := e.httpClient.Post(e.serverURL+"/v1/embeddings", "application/json", bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the embedding server responded with %s", response.Status)
+	}
+	return parseEmbeddingResponse(response.Body)
+}
+
+// embedWithBinary the binary treats each line of the prompt as a separate prompt
+func (e *Embedder) embedWithBinary(sentences []string) ([][]float64, error) {
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), e.timeout)
+	defer cancelFunc()
+	cmd := exec.CommandContext(
+		ctx,
+		filepath.Join(workingDirectory, e.binPath),
+		"-m", filepath.Join(workingDirectory, e.modelPath),
+		"--embd-output-format", "json",
+		"--log-disable",
+		"-p", strings.Join(sentences, "\n"),
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run the embedding binary: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseEmbeddingResponse(&stdout)
+}
+
+func parseEmbeddingResponse(reader io.Reader) ([][]float64, error) {
+	var response embeddingResponse
+	err := json.NewDecoder(reader).Decode(&response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Data) == 0 {
+		return nil, errors.New("no embedding in the response")
+	}
+	result := make([][]float64, len(response.Data))
+	for _, data := range response.Data {
+		if data.Index < 0 || data.Index >= len(result) {
+			return nil, errors.New("wrong embedding index in the response")
+		}
+		result[data.Index] = data.Embedding
+	}
+	return result, nil
+}
@@ -0,0 +1,160 @@
+package llamacpp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// GGUFKeyChatTemplate the metadata key of the Jinja chat template the model was trained with
+const GGUFKeyChatTemplate = "tokenizer.chat_template"
+
+var ErrNotGGUF = errors.New("not a GGUF file")
+
+const ggufMagic = 0x46554747 // "GGUF" in little endian
+
+// maxGGUFStringSize protects against reading garbage as a huge string
+const maxGGUFStringSize = 64 * 1024 * 1024
+
+// GGUF metadata value types
+const (
+	ggufTypeUint8   = 0
+	ggufTypeInt8    = 1
+	ggufTypeUint16  = 2
+	ggufTypeInt16   = 3
+	ggufTypeUint32  = 4
+	ggufTypeInt32   = 5
+	ggufTypeFloat32 = 6
+	ggufTypeBool    = 7
+	ggufTypeString  = 8
+	ggufTypeArray   = 9
+	ggufTypeUint64  = 10
+	ggufTypeInt64   = 11
+	ggufTypeFloat64 = 12
+)
+
+// ReadGGUFMetadataString reads a string value from the metadata of a GGUF file (version 2 or later) without loading
+// the tensors. Returns false if the key isn't found.
+func ReadGGUFMetadataString(path, key string) (string, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+	reader := bufio.NewReaderSize(file, 1024*1024)
+	var header struct {
+		Magic       uint32
+		Version     uint32
+		TensorCount uint64
+		KVCount     uint64
+	}
+	err = binary.Read(reader, binary.LittleEndian, &header)
+	if err != nil {
+		return "", false, err
+	}
+	if header.Magic != ggufMagic {
+		return "", false, ErrNotGGUF
+	}
+	if header.Version < 2 {
+		return "", false, fmt.Errorf("GGUF version %d is not supported", header.Version)
+	}
+	for i := uint64(0); i < header.KVCount; i++ {
+		currentKey, err := readGGUFString(reader)
+		if err != nil {
+			return "", false, err
+		}
+		var valueType uint32
+		err = binary.Read(reader, binary.LittleEndian, &valueType)
+		if err != nil {
+			return "", false, err
+		}
+		if currentKey == key && valueType == ggufTypeString {
+			value, err := readGGUFString(reader)
+			if err != nil {
+				return "", false, err
+			}
+			return value, true, nil
+		}
+		err = skipGGUFValue(reader, valueType)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	return "", false, nil
+}
+
+func readGGUFString(reader *bufio.Reader) (string, error) {
+	var size uint64
+	err := binary.Read(reader, binary.LittleEndian, &size)
+	if err != nil {
+		return "", err
+	}
+	if size > maxGGUFStringSize {
+		return "", fmt.Errorf("GGUF string is too long (%d bytes)", size)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func skipGGUFValue(reader *bufio.Reader, valueType uint32) error {
+	switch valueType {
+	case ggufTypeString:
+		var size uint64
+		err := binary.Read(reader, binary.LittleEndian, &size)
+		if err != nil {
+			return err
+		}
+		_, err = reader.Discard(int(size))
+		return err
+	case ggufTypeArray:
+		var elementType uint32
+		err := binary.Read(reader, binary.LittleEndian, &elementType)
+		if err != nil {
+			return err
+		}
+		var count uint64
+		err = binary.Read(reader, binary.LittleEndian, &count)
+		if err != nil {
+			return err
+		}
+		if size := getGGUFValueSize(elementType); size > 0 { // fixed-size elements are skipped at once
+			_, err = reader.Discard(int(uint64(size) * count))
+			return err
+		}
+		for i := uint64(0); i < count; i++ {
+			err = skipGGUFValue(reader, elementType)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	size := getGGUFValueSize(valueType)
+	if size == 0 {
+		return fmt.Errorf("unknown GGUF value type %d", valueType)
+	}
+	_, err := reader.Discard(size)
+	return err
+}
+
+// getGGUFValueSize returns 0 for types of variable size (or unknown types)
+func getGGUFValueSize(valueType uint32) int {
+	switch valueType {
+	case ggufTypeUint8, ggufTypeInt8, ggufTypeBool:
+		return 1
+	case ggufTypeUint16, ggufTypeInt16:
+		return 2
+	case ggufTypeUint32, ggufTypeInt32, ggufTypeFloat32:
+		return 4
+	case ggufTypeUint64, ggufTypeInt64, ggufTypeFloat64:
+		return 8
+	}
+	return 0
+}
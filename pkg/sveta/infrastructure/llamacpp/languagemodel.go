@@ -2,10 +2,14 @@ package llamacpp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -27,6 +31,8 @@ const (
 	ConfigKeyLLMGRepeatPenalty = "llmRepeatPenalty"
 	// ConfigKeyLLResponseTimeout when to stop if the model takes too long to process input/generate output
 	ConfigKeyLLResponseTimeout = "llmResponseTimeout"
+	// ConfigKeyLLMBackend how llama.cpp is run: "process" (the binary is launched for each completion) or "server"
+	ConfigKeyLLMBackend = "llmBackend"
 )
 
 type LanguageModel struct {
@@ -38,6 +44,24 @@ type LanguageModel struct {
 	stopCondition      domain.StopCondition
 	responseCleaner    domain.ResponseCleaner
 	namedMutexAcquirer domain.NamedMutexAcquirer
+	inferenceParameters
+	promptCache *promptCache // nil if disabled
+	tokenizer   *tokenizer
+}
+
+// ModelParameters per-model overrides of the parameters in the config (zero values mean the config's values are used).
+// The temperature and the repeat penalty are pointers, as 0 is a valid value (for example, a temperature of 0 means
+// greedy sampling).
+type ModelParameters struct {
+	ContextSize    int
+	GPULayerCount  int
+	CPUThreadCount int
+	Temperature    *float64
+	RepeatPenalty  *float64
+}
+
+// inferenceParameters parameters specific to the current GPU, shared by both backends (see ConfigKeyLLMBackend)
+type inferenceParameters struct {
 	defaultTemperature float64
 	contextSize        int
 	gpuLayerCount      int
@@ -46,13 +70,43 @@ type LanguageModel struct {
 	responseTimeout    time.Duration
 }
 
+func newInferenceParameters(parameters ModelParameters, config *common.Config) inferenceParameters {
+	result := inferenceParameters{
+		defaultTemperature: config.GetFloatOrDefault(ConfigKeyLLMDefaultTemperature, 0.7),
+		contextSize:        config.GetIntOrDefault(ConfigKeyLLMContextSize, 4096),
+		gpuLayerCount:      config.GetIntOrDefault(ConfigKeyLLMGPULayerCount, 40),
+		cpuThreadCount:     config.GetIntOrDefault(ConfigKeyLLMCPUThreadCount, 6),
+		repeatPenalty:      config.GetFloatOrDefault(ConfigKeyLLMGRepeatPenalty, 1.1),
+		responseTimeout:    config.GetDurationOrDefault(ConfigKeyLLResponseTimeout, time.Minute),
+	}
+	if parameters.ContextSize > 0 {
+		result.contextSize = parameters.ContextSize
+	}
+	if parameters.GPULayerCount > 0 {
+		result.gpuLayerCount = parameters.GPULayerCount
+	}
+	if parameters.CPUThreadCount > 0 {
+		result.cpuThreadCount = parameters.CPUThreadCount
+	}
+	if parameters.Temperature != nil {
+		result.defaultTemperature = *parameters.Temperature
+	}
+	if parameters.RepeatPenalty != nil {
+		result.repeatPenalty = *parameters.RepeatPenalty
+	}
+	return result
+}
+
 func (l *LanguageModel) Name() string {
 	return l.name
 }
 
 // NewLanguageModel Creates a language model as implemented by llama.cpp
 // `binPath` specifies the path to the target model relative to the bin folder (llama.cpp supports many models: Llama 2, Solar, etc.)
-// `config` contains parameters specific to the current GPU (see the constant above)
+// `parameters` override the parameters in `config` for this model.
+// `config` contains parameters specific to the current GPU (see the constant above) and the backend: either the
+// llama.cpp binary is launched for each completion ("process", the default), or a long-running llama.cpp server is
+// managed for the model ("server", see NewServerLanguageModel(..))
 func NewLanguageModel(
 	modelName,
 	binPath string,
@@ -60,25 +114,42 @@ func NewLanguageModel(
 	promptFormatter domain.PromptFormatter,
 	stopCondition domain.StopCondition,
 	responseCleaner domain.ResponseCleaner,
+	parameters ModelParameters,
+	namedMutexAcquirer domain.NamedMutexAcquirer,
+	config *common.Config,
+	logger common.Logger,
+) domain.LanguageModel {
+	if config.GetStringOrDefault(ConfigKeyLLMBackend, "process") == "server" {
+		return NewServerLanguageModel(modelName, binPath, responseModes, promptFormatter, stopCondition, responseCleaner, parameters, namedMutexAcquirer, config, logger)
+	}
+	return NewProcessLanguageModel(modelName, binPath, responseModes, promptFormatter, stopCondition, responseCleaner, parameters, namedMutexAcquirer, config, logger)
+}
+
+// NewProcessLanguageModel launches the llama.cpp binary for each completion
+func NewProcessLanguageModel(
+	modelName,
+	binPath string,
+	responseModes []domain.ResponseMode,
+	promptFormatter domain.PromptFormatter,
+	stopCondition domain.StopCondition,
+	responseCleaner domain.ResponseCleaner,
+	parameters ModelParameters,
 	namedMutexAcquirer domain.NamedMutexAcquirer,
 	config *common.Config,
 	logger common.Logger,
 ) *LanguageModel {
 	return &LanguageModel{
-		name:               modelName,
-		binPath:            binPath,
-		responseModes:      responseModes,
-		promptFormatter:    promptFormatter,
-		stopCondition:      stopCondition,
-		responseCleaner:    responseCleaner,
-		namedMutexAcquirer: namedMutexAcquirer,
-		logger:             logger,
-		defaultTemperature: config.GetFloatOrDefault(ConfigKeyLLMDefaultTemperature, 0.7),
-		contextSize:        config.GetIntOrDefault(ConfigKeyLLMContextSize, 4096),
-		gpuLayerCount:      config.GetIntOrDefault(ConfigKeyLLMGPULayerCount, 40),
-		cpuThreadCount:     config.GetIntOrDefault(ConfigKeyLLMCPUThreadCount, 6),
-		repeatPenalty:      config.GetFloatOrDefault(ConfigKeyLLMGRepeatPenalty, 1.1),
-		responseTimeout:    config.GetDurationOrDefault(ConfigKeyLLResponseTimeout, time.Minute),
+		name:                modelName,
+		binPath:             binPath,
+		responseModes:       responseModes,
+		promptFormatter:     promptFormatter,
+		stopCondition:       stopCondition,
+		responseCleaner:     responseCleaner,
+		namedMutexAcquirer:  namedMutexAcquirer,
+		logger:              logger,
+		inferenceParameters: newInferenceParameters(parameters, config),
+		promptCache:         newPromptCache(modelName, binPath, config, logger),
+		tokenizer:           newTokenizer(modelName, binPath, nil, config, logger),
 	}
 }
 
@@ -94,18 +165,31 @@ func (l *LanguageModel) Complete(prompt string, options domain.CompleteOptions)
 		return "", err
 	}
 	defer namedMutex.Release()
-	command, err := l.buildInferCommand(options)
+	args, err := l.buildInferArgs(options)
 	if err != nil {
 		return "", err
 	}
+	promptCacheFileName := l.promptCache.prepareFile(options.PromptCacheKey)
+	if promptCacheFileName != "" {
+		args = append(args[:len(args)-1], "--prompt-cache", l.promptCache.filePath(promptCacheFileName), "-p")
+	}
 	var buf strings.Builder
-	err = runInferCommand(command, prompt, l.responseTimeout, func(s string) bool {
+	var stderr bytes.Buffer
+	err = runInferCommand(args, prompt, l.responseTimeout, &stderr, func(s string) bool {
 		if l.stopCondition.ShouldStop(prompt, buf.String()+s) {
 			return false
 		}
 		buf.WriteString(s)
 		return true
 	})
+	if promptCacheFileName != "" {
+		l.promptCache.touch(promptCacheFileName)
+		l.promptCache.logSavings(l.name, options.PromptCacheKey, parsePromptEvalStats(stderr.String()))
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		// What has been generated so far is left intact.
+		return buf.String(), fmt.Errorf("%w: llama.cpp (%s) didn't finish in %s", domain.ErrLanguageModelTimeout, l.name, l.responseTimeout)
+	}
 	if err != nil {
 		// A process can run successfully but be terminated with a SIGKILL for some reason (due to context cancellation?)
 		// So we ignore it but log it, leaving what has been generated so far intact.
@@ -125,27 +209,41 @@ func (l *LanguageModel) ResponseCleaner() domain.ResponseCleaner {
 	return l.responseCleaner
 }
 
-func (l *LanguageModel) buildInferCommand(options domain.CompleteOptions) (string, error) {
+func (l *LanguageModel) ContextSize() int {
+	return l.contextSize
+}
+
+func (l *LanguageModel) Tokenizer() domain.Tokenizer {
+	return l.tokenizer
+}
+
+// buildInferArgs returns the command line without the prompt (the grammar is passed as is, so it can contain spaces)
+func (l *LanguageModel) buildInferArgs(options domain.CompleteOptions) ([]string, error) {
 	workingDirectory, err := os.Getwd()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	result := fmt.Sprintf("%s/llama.cpp", workingDirectory)
+	args := []string{fmt.Sprintf("%s/llama.cpp", workingDirectory)}
 	if options.JSONMode {
-		result += fmt.Sprintf(" --grammar-file %s/json.gbnf", workingDirectory)
-	}
-	result += fmt.Sprintf(" -m %s/", workingDirectory)
-	result += fmt.Sprintf(
-		"%s -t %d -ngl %d --color -c %d --temp %f --repeat_penalty %f -n -1 -p ",
-		l.binPath,
-		l.cpuThreadCount,
-		l.gpuLayerCount,
-		l.contextSize,
-		options.TemperatureOrDefault(l.defaultTemperature),
-		l.repeatPenalty,
+		if options.JSONGrammar != "" {
+			args = append(args, "--grammar", options.JSONGrammar)
+		} else {
+			args = append(args, "--grammar-file", fmt.Sprintf("%s/json.gbnf", workingDirectory))
+		}
+	}
+	args = append(args,
+		"-m", fmt.Sprintf("%s/%s", workingDirectory, l.binPath),
+		"-t", strconv.Itoa(l.cpuThreadCount),
+		"-ngl", strconv.Itoa(l.gpuLayerCount),
+		"--color",
+		"-c", strconv.Itoa(l.contextSize),
+		"--temp", fmt.Sprintf("%f", options.TemperatureOrDefault(l.defaultTemperature)),
+		"--repeat_penalty", fmt.Sprintf("%f", l.repeatPenalty),
+		"-n", "-1",
+		"-p",
 	)
-	l.logger.Log(fmt.Sprintf("llama.cpp command: \"%s\"", result))
-	return result, nil
+	l.logger.Log(fmt.Sprintf("llama.cpp command: \"%s\"", strings.Join(args, " ")))
+	return args, nil
 }
 
 // We hook up to the llama.cpp binary by launching a subprocess and reading its standard output until
@@ -153,12 +251,13 @@ func (l *LanguageModel) buildInferCommand(options domain.CompleteOptions) (strin
 // Launching it as a new subprocess for each run has the following benefits:
 // - full isolation (for privacy)
 // - fault-tolerance: crashes in llama.cpp (out of memory, segfaults, etc.) do not crash the AI agent altogether
-func runInferCommand(cmdstr, prompt string, responseTimeout time.Duration, processLineFunc func(s string) bool) error {
-	args := strings.Fields(cmdstr) // TODO probably unsafe, pass the arguments like we do it in llava.cpp
-	args = append(args, prompt)
+// The diagnostics (timings etc.) are written to `stderr`.
+func runInferCommand(args []string, prompt string, responseTimeout time.Duration, stderr io.Writer, processLineFunc func(s string) bool) error {
+	args = append(args[:len(args):len(args)], prompt)
 	ctx, cancelFunc := context.WithDeadline(context.Background(), time.Now().Add(responseTimeout))
 	defer cancelFunc()
 	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = stderr
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -181,5 +280,9 @@ func runInferCommand(cmdstr, prompt string, responseTimeout time.Duration, proce
 		return err
 	}
 	wg.Wait()
-	return cmd.Wait()
+	err = cmd.Wait()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) { // not stopped by processLineFunc(..)
+		return ctx.Err()
+	}
+	return err
 }
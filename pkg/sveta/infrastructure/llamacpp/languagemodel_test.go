@@ -0,0 +1,42 @@
+package llamacpp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kgeyst.com/sveta/pkg/common"
+)
+
+func TestModelParametersOverrideConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configPath, []byte("llmDefaultTemperature: 0.7\nllmRepeatPenalty: 1.1\nllmContextSize: 4096\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := common.LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero := 0.0
+	one := 1.0
+	tests := []struct {
+		name                string
+		parameters          ModelParameters
+		expectedTemperature float64
+		expectedPenalty     float64
+		expectedContextSize int
+	}{
+		{name: "config", parameters: ModelParameters{}, expectedTemperature: 0.7, expectedPenalty: 1.1, expectedContextSize: 4096},
+		{name: "greedy", parameters: ModelParameters{Temperature: &zero, RepeatPenalty: &one}, expectedTemperature: 0.0, expectedPenalty: 1.0, expectedContextSize: 4096},
+		{name: "context size", parameters: ModelParameters{ContextSize: 8192}, expectedTemperature: 0.7, expectedPenalty: 1.1, expectedContextSize: 8192},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parameters := newInferenceParameters(test.parameters, config)
+			if parameters.defaultTemperature != test.expectedTemperature || parameters.repeatPenalty != test.expectedPenalty || parameters.contextSize != test.expectedContextSize {
+				t.Errorf("expected the temperature %f, the repeat penalty %f and the context size %d, got %+v", test.expectedTemperature, test.expectedPenalty, test.expectedContextSize, parameters)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package llamacpp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/filesystem"
+)
+
+const (
+	// ConfigKeyLLMPromptCacheDirPath where the evaluated prompts are saved per model and room, so that the prefix
+	// shared by consecutive prompts in a room isn't evaluated again; empty disables caching. The cache files contain
+	// the conversations and can't be encrypted, so caching is also disabled if the memory store is encrypted.
+	ConfigKeyLLMPromptCacheDirPath = "llmPromptCacheDirPath"
+	// ConfigKeyLLMPromptCacheMaxFileCount the maximum number of cache files per model (the least recently used are
+	// removed), as each can take hundreds of megabytes
+	ConfigKeyLLMPromptCacheMaxFileCount = "llmPromptCacheMaxFileCount"
+)
+
+const promptCacheFileExtension = ".cache"
+
+var (
+	// the llama.cpp binary prints these to stderr
+	promptEvalTimeRegexp     = regexp.MustCompile(`prompt eval time\s*=\s*([\d.]+) ms\s*/\s*(\d+) (tokens|runs)`)
+	sessionFileMatchesRegexp = regexp.MustCompile(`session file matches (\d+) / (\d+) tokens`)
+)
+
+// promptCache manages the cache files of a model: one file per room (see domain.PromptCacheKey), named
+// "<model+room hash>-<fingerprint><extension>", so that the stale file of a room can be found and removed when the
+// fingerprint changes. Both backends are serialized with the "llamaCPP" named mutex, so it's not synchronized.
+type promptCache struct {
+	dirPath string
+	// modelFingerprint changes if the model file is replaced
+	modelFingerprint string
+	maxFileCount     int
+	logger           common.Logger
+}
+
+// promptEvalStats what llama.cpp reports about the prompt evaluation (zero values if unknown)
+type promptEvalStats struct {
+	promptTokenCount int // including the cached ones
+	cachedTokenCount int
+	evaluatedCount   int
+	evalTime         time.Duration
+}
+
+// newPromptCache returns nil if caching is disabled (see ConfigKeyLLMPromptCacheDirPath)
+func newPromptCache(modelName, binPath string, config *common.Config, logger common.Logger) *promptCache {
+	dirPath := config.GetString(ConfigKeyLLMPromptCacheDirPath)
+	if dirPath == "" {
+		return nil
+	}
+	// An invalid key fails the memory repository anyway.
+	if encryptionKey, err := filesystem.LoadMemoryEncryptionKey(config); encryptionKey != nil || err != nil {
+		logger.Log("the prompt cache of " + modelName + " is disabled, as the memory store is encrypted\n")
+		return nil
+	}
+	modelFingerprint := modelName + "\x00" + binPath
+	info, err := os.Stat(binPath)
+	if err == nil {
+		modelFingerprint += fmt.Sprintf("\x00%d\x00%d", info.Size(), info.ModTime().UnixNano())
+	}
+	return &promptCache{
+		dirPath:          dirPath,
+		modelFingerprint: modelFingerprint,
+		maxFileCount:     config.GetIntOrDefault(ConfigKeyLLMPromptCacheMaxFileCount, 16),
+		logger:           logger,
+	}
+}
+
+// prepareFile returns the name of the cache file for the key (see prepare(..)), or an empty string if the prompt
+// shouldn't be cached (caching is disabled, the prompt isn't from a room, or the cache directory is unavailable)
+func (c *promptCache) prepareFile(key domain.PromptCacheKey) string {
+	if c == nil || key.IsZero() {
+		return ""
+	}
+	fileName, err := c.prepare(key)
+	if err != nil {
+		c.logger.Log(fmt.Sprintf("failed to prepare the prompt cache: %s\n", err))
+		return ""
+	}
+	return fileName
+}
+
+// prepare returns the name of the cache file for the key (relative to the cache directory), after removing the stale
+// files of the room and the least recently used files of the model over the limit
+func (c *promptCache) prepare(key domain.PromptCacheKey) (string, error) {
+	err := os.MkdirAll(c.dirPath, 0700)
+	if err != nil {
+		return "", err
+	}
+	roomPrefix := c.roomPrefix(key)
+	fileName := roomPrefix + "-" + key.Fingerprint + promptCacheFileExtension
+	stalePaths, err := filepath.Glob(filepath.Join(c.dirPath, roomPrefix+"-*"+promptCacheFileExtension))
+	if err != nil {
+		return "", err
+	}
+	for _, stalePath := range stalePaths {
+		if filepath.Base(stalePath) != fileName {
+			_ = os.Remove(stalePath)
+		}
+	}
+	c.evict(fileName)
+	return fileName, nil
+}
+
+func (c *promptCache) filePath(fileName string) string {
+	return filepath.Join(c.dirPath, fileName)
+}
+
+func (c *promptCache) exists(fileName string) bool {
+	_, err := os.Stat(c.filePath(fileName))
+	return err == nil
+}
+
+// touch marks the file as recently used
+func (c *promptCache) touch(fileName string) {
+	now := time.Now()
+	_ = os.Chtimes(c.filePath(fileName), now, now)
+}
+
+// evict removes the least recently used files of the model, keeping room for one more file (except for `keepFileName`)
+func (c *promptCache) evict(keepFileName string) {
+	if c.maxFileCount <= 0 {
+		return
+	}
+	paths, err := filepath.Glob(filepath.Join(c.dirPath, c.modelPrefix()+"*"+promptCacheFileExtension))
+	if err != nil {
+		return
+	}
+	type cacheFile struct {
+		path    string
+		modTime time.Time
+	}
+	var files []cacheFile
+	for _, path := range paths {
+		if filepath.Base(path) == keepFileName {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		files = append(files, cacheFile{path: path, modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for len(files) > c.maxFileCount-1 {
+		_ = os.Remove(files[0].path)
+		files = files[1:]
+	}
+}
+
+// logSavings estimates the time saved from the time it took to evaluate the rest of the prompt
+func (c *promptCache) logSavings(modelName string, key domain.PromptCacheKey, stats promptEvalStats) {
+	if stats.promptTokenCount == 0 {
+		return
+	}
+	message := fmt.Sprintf("Prompt cache (%s, %s): reused %d of %d tokens", modelName, key.Room, stats.cachedTokenCount, stats.promptTokenCount)
+	if stats.evaluatedCount > 0 && stats.evalTime > 0 {
+		savedTime := stats.evalTime * time.Duration(stats.cachedTokenCount) / time.Duration(stats.evaluatedCount)
+		message += fmt.Sprintf(", prompt eval took %s, saved ~%s", stats.evalTime.Round(time.Millisecond), savedTime.Round(time.Millisecond))
+	}
+	c.logger.Log(message + "\n")
+}
+
+// modelPrefix the files of different models (or different versions of the same model) never clash
+func (c *promptCache) modelPrefix() string {
+	hash := sha256.Sum256([]byte(c.modelFingerprint))
+	return hex.EncodeToString(hash[:])[:8]
+}
+
+func (c *promptCache) roomPrefix(key domain.PromptCacheKey) string {
+	hash := sha256.Sum256([]byte(c.modelFingerprint + "\x00" + key.Room))
+	return c.modelPrefix() + hex.EncodeToString(hash[:])[:16]
+}
+
+// parsePromptEvalStats parses the stderr of the llama.cpp binary
+func parsePromptEvalStats(stderr string) promptEvalStats {
+	var stats promptEvalStats
+	matches := sessionFileMatchesRegexp.FindStringSubmatch(stderr)
+	if matches != nil {
+		stats.cachedTokenCount, _ = strconv.Atoi(matches[1])
+		stats.promptTokenCount, _ = strconv.Atoi(matches[2])
+	}
+	matches = promptEvalTimeRegexp.FindStringSubmatch(stderr)
+	if matches != nil {
+		milliseconds, _ := strconv.ParseFloat(matches[1], 64)
+		stats.evalTime = time.Duration(milliseconds * float64(time.Millisecond))
+		stats.evaluatedCount, _ = strconv.Atoi(matches[2])
+		if stats.promptTokenCount == 0 {
+			stats.promptTokenCount = stats.evaluatedCount
+		}
+	}
+	return stats
+}
@@ -0,0 +1,590 @@
+package llamacpp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+const (
+	// ConfigKeyLLMServerBinPath the path to llama.cpp's server binary, relative to the working directory
+	ConfigKeyLLMServerBinPath = "llmServerBinPath"
+	// ConfigKeyLLMServerStartTimeout how long to wait for the server to start and load the model
+	ConfigKeyLLMServerStartTimeout = "llmServerStartTimeout"
+	// ConfigKeyLLMServerMaxRestartDelay the maximum delay between restarts of a failing server (the delay doubles
+	// after each consecutive failure, starting from 1 second)
+	ConfigKeyLLMServerMaxRestartDelay = "llmServerMaxRestartDelay"
+	// ConfigKeyLLMServerIdleTimeout the server is stopped (to free VRAM) if it wasn't used for this long, 10 minutes by
+	// default, so that the servers of rarely used models don't take VRAM forever; 0 means never
+	ConfigKeyLLMServerIdleTimeout = "llmServerIdleTimeout"
+)
+
+var ErrServerUnavailable = errors.New("the llama.cpp server is unavailable")
+
+// serverStderrTailSize how many last lines of stderr are included in errors
+const serverStderrTailSize = 10
+
+// serverHealthCheckInterval how often /health is polled while the server is loading the model
+const serverHealthCheckInterval = 250 * time.Millisecond
+
+const minServerRestartDelay = time.Second
+
+type ServerLanguageModel struct {
+	mutex              sync.Mutex
+	logger             common.Logger
+	name               string
+	binPath            string
+	serverBinPath      string
+	responseModes      []domain.ResponseMode
+	promptFormatter    domain.PromptFormatter
+	stopCondition      domain.StopCondition
+	responseCleaner    domain.ResponseCleaner
+	namedMutexAcquirer domain.NamedMutexAcquirer
+	inferenceParameters
+	startTimeout       time.Duration
+	maxRestartDelay    time.Duration
+	idleTimeout        time.Duration
+	httpClient         *http.Client
+	server             *server // nil if not started
+	failureCount       int     // consecutive failures, for the restart backoff
+	nextStartAllowedAt time.Time
+	idleTimer          *time.Timer
+	promptCache        *promptCache // nil if disabled
+	tokenizer          *tokenizer
+	// serverURL the URL of the running server or an empty string, for the tokenizer (`mutex` is held during
+	// completions)
+	serverURL atomic.Value
+}
+
+// server a running instance of llama.cpp's server
+type server struct {
+	cmd     *exec.Cmd
+	url     string
+	exited  chan struct{} // closed when the process exits
+	exitErr error         // valid after `exited` is closed
+	stderr  *serverLineRingBuffer
+	// slotFileName the prompt cache file which matches the contents of the slot (saved after the last completion), or
+	// empty (see promptCache)
+	slotFileName string
+}
+
+// completionRequest see llama.cpp's server documentation for /completion
+type completionRequest struct {
+	Prompt        string  `json:"prompt"`
+	PredictCount  int     `json:"n_predict"`
+	Temperature   float64 `json:"temperature"`
+	RepeatPenalty float64 `json:"repeat_penalty"`
+	Grammar       string  `json:"grammar,omitempty"`
+	CachePrompt   bool    `json:"cache_prompt"`
+	Stream        bool    `json:"stream"`
+	// SlotID the server is started with one slot if the prompt cache is enabled, so that it could be saved and restored
+	SlotID int `json:"id_slot"`
+}
+
+type completionChunk struct {
+	Content string `json:"content"`
+	Stop    bool   `json:"stop"`
+	// TokensEvaluated and Timings are only in the last chunk
+	TokensEvaluated int                `json:"tokens_evaluated"`
+	Timings         *completionTimings `json:"timings"`
+}
+
+type completionTimings struct {
+	PromptCount        int     `json:"prompt_n"`
+	PromptMilliseconds float64 `json:"prompt_ms"`
+	// CacheCount isn't reported by older versions of the server
+	CacheCount *int `json:"cache_n"`
+}
+
+// slotActionRequest see llama.cpp's server documentation for /slots
+type slotActionRequest struct {
+	FileName string `json:"filename"`
+}
+
+// NewServerLanguageModel manages a long-running llama.cpp server for the model, so that the weights are loaded once
+// and not on each completion. The server is started on the first completion, health-checked, and restarted with a
+// backoff if it crashes (ErrServerUnavailable is returned without waiting while it's down). The completion is
+// streamed so that the stop condition can interrupt it as soon as possible, same as with the llama.cpp binary.
+// Stop() must be called on shutdown to terminate the server.
+func NewServerLanguageModel(
+	modelName,
+	binPath string,
+	responseModes []domain.ResponseMode,
+	promptFormatter domain.PromptFormatter,
+	stopCondition domain.StopCondition,
+	responseCleaner domain.ResponseCleaner,
+	parameters ModelParameters,
+	namedMutexAcquirer domain.NamedMutexAcquirer,
+	config *common.Config,
+	logger common.Logger,
+) *ServerLanguageModel {
+	l := &ServerLanguageModel{
+		name:                modelName,
+		binPath:             binPath,
+		serverBinPath:       config.GetStringOrDefault(ConfigKeyLLMServerBinPath, "llama-server"),
+		responseModes:       responseModes,
+		promptFormatter:     promptFormatter,
+		stopCondition:       stopCondition,
+		responseCleaner:     responseCleaner,
+		namedMutexAcquirer:  namedMutexAcquirer,
+		logger:              logger,
+		inferenceParameters: newInferenceParameters(parameters, config),
+		startTimeout:        config.GetDurationOrDefault(ConfigKeyLLMServerStartTimeout, 2*time.Minute),
+		maxRestartDelay:     config.GetDurationOrDefault(ConfigKeyLLMServerMaxRestartDelay, time.Minute),
+		idleTimeout:         config.GetDurationOrDefault(ConfigKeyLLMServerIdleTimeout, 10*time.Minute),
+		httpClient:          &http.Client{},
+		promptCache:         newPromptCache(modelName, binPath, config, logger),
+	}
+	l.tokenizer = newTokenizer(modelName, binPath, l.getServerURL, config, logger)
+	return l
+}
+
+func (l *ServerLanguageModel) Name() string {
+	return l.name
+}
+
+func (l *ServerLanguageModel) ResponseModes() []domain.ResponseMode {
+	return l.responseModes
+}
+
+func (l *ServerLanguageModel) PromptFormatter() domain.PromptFormatter {
+	return l.promptFormatter
+}
+
+func (l *ServerLanguageModel) ResponseCleaner() domain.ResponseCleaner {
+	return l.responseCleaner
+}
+
+func (l *ServerLanguageModel) ContextSize() int {
+	return l.contextSize
+}
+
+func (l *ServerLanguageModel) Tokenizer() domain.Tokenizer {
+	return l.tokenizer
+}
+
+func (l *ServerLanguageModel) getServerURL() string {
+	serverURL, _ := l.serverURL.Load().(string)
+	return serverURL
+}
+
+// Complete returns the prompt followed by the completion, same as the llama.cpp binary which echoes the prompt (the
+// stop conditions and the response cleaners rely on it).
+func (l *ServerLanguageModel) Complete(prompt string, options domain.CompleteOptions) (string, error) {
+	// Only 1 request can be processed at a time currently (see LanguageModel.Complete(..)), even if the servers of
+	// several models are loaded.
+	namedMutex, err := l.namedMutexAcquirer.AcquireNamedMutex("llamaCPP", time.Minute)
+	if err != nil {
+		return "", err
+	}
+	defer namedMutex.Release()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	request, err := l.buildCompletionRequest(prompt, options)
+	if err != nil {
+		return "", err
+	}
+	err = l.startServerIfRequired()
+	if err != nil {
+		return "", err
+	}
+	defer l.resetIdleTimer()
+	s := l.server
+	promptCacheFileName := l.promptCache.prepareFile(options.PromptCacheKey)
+	if promptCacheFileName != "" && s.slotFileName != promptCacheFileName && l.promptCache.exists(promptCacheFileName) {
+		// If the slot already has the room's prompt (consecutive turns in the same room), the server reuses it itself.
+		err = l.runSlotAction(s, "restore", promptCacheFileName)
+		if err != nil {
+			l.logger.Log(fmt.Sprintf("llama.cpp server (%s) failed to restore the prompt cache: %s\n", l.name, err))
+		}
+	}
+	// The completion replaces the contents of the slot, so it matches the cache file only if it's saved afterwards
+	// (a failed completion, or one which isn't cached, such as a JSON query of a pass, leaves an unrelated prompt).
+	s.slotFileName = ""
+	var buf strings.Builder
+	buf.WriteString(prompt)
+	stats, err := l.streamCompletion(s, request, func(line string) bool {
+		if l.stopCondition.ShouldStop(prompt, buf.String()+line) {
+			return false
+		}
+		buf.WriteString(line)
+		return true
+	})
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			if buf.Len() == len(prompt) { // not a single line, probably hung
+				message := fmt.Sprintf("llama.cpp server (%s) didn't respond in %s: %s", l.name, l.responseTimeout, s.stderr.String())
+				l.failServer(message)
+				return "", fmt.Errorf("%w: %s", ErrServerUnavailable, message)
+			}
+			// Same as with the llama.cpp binary: what has been generated so far is left intact.
+			return buf.String(), fmt.Errorf("%w: llama.cpp server (%s) didn't finish in %s", domain.ErrLanguageModelTimeout, l.name, l.responseTimeout)
+		}
+		select {
+		case <-s.exited: // the connection can break a bit earlier than the process is reaped
+			message := fmt.Sprintf("llama.cpp server (%s) exited unexpectedly (%v): %s", l.name, s.exitErr, s.stderr.String())
+			l.failServer(message)
+			return "", fmt.Errorf("%w: %s", ErrServerUnavailable, message)
+		case <-time.After(time.Second):
+			return "", err
+		}
+	}
+	l.failureCount = 0
+	if promptCacheFileName != "" {
+		err = l.runSlotAction(s, "save", promptCacheFileName)
+		if err != nil {
+			l.logger.Log(fmt.Sprintf("llama.cpp server (%s) failed to save the prompt cache: %s\n", l.name, err))
+		} else {
+			s.slotFileName = promptCacheFileName
+			l.promptCache.touch(promptCacheFileName)
+		}
+		l.promptCache.logSavings(l.name, options.PromptCacheKey, stats)
+	}
+	return buf.String(), nil
+}
+
+// runSlotAction saves the state of the slot (the evaluated prompt) to the file in the prompt cache directory, or
+// restores it (see `--slot-save-path`)
+func (l *ServerLanguageModel) runSlotAction(s *server, action, fileName string) error {
+	requestBytes, err := json.Marshal(slotActionRequest{FileName: fileName})
+	if err != nil {
+		return err
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), l.responseTimeout)
+	defer cancelFunc()
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url+"/slots/0?action="+action, bytes.NewReader(requestBytes))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	response, err := l.httpClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("llama.cpp server returned status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// Stop terminates the server, if it's running
+func (l *ServerLanguageModel) Stop() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.idleTimer != nil {
+		l.idleTimer.Stop()
+	}
+	l.stopServer()
+}
+
+func (l *ServerLanguageModel) buildCompletionRequest(prompt string, options domain.CompleteOptions) (completionRequest, error) {
+	request := completionRequest{
+		Prompt:        prompt,
+		PredictCount:  -1,
+		Temperature:   options.TemperatureOrDefault(l.defaultTemperature),
+		RepeatPenalty: l.repeatPenalty,
+		CachePrompt:   true,
+		Stream:        true,
+	}
+	if options.JSONMode && options.JSONGrammar != "" {
+		request.Grammar = options.JSONGrammar
+	} else if options.JSONMode {
+		grammar, err := os.ReadFile("json.gbnf")
+		if err != nil {
+			return completionRequest{}, err
+		}
+		request.Grammar = string(grammar)
+	}
+	return request, nil
+}
+
+// streamCompletion passes the completion to processLineFunc(..) line by line (same as runInferCommand(..)) until it
+// signals it should stop with false as the returned value. The prompt evaluation stats are only known if the
+// completion wasn't stopped early.
+func (l *ServerLanguageModel) streamCompletion(s *server, request completionRequest, processLineFunc func(s string) bool) (promptEvalStats, error) {
+	var stats promptEvalStats
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return stats, err
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), l.responseTimeout)
+	defer cancelFunc()
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url+"/completion", bytes.NewReader(requestBytes))
+	if err != nil {
+		return stats, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	response, err := l.httpClient.Do(httpRequest)
+	if err != nil {
+		return stats, err
+	}
+	// Closing the connection early makes the server abort the generation.
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("llama.cpp server returned status %d", response.StatusCode)
+	}
+	var pendingLine strings.Builder
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		event, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue // empty lines between server-sent events
+		}
+		var chunk completionChunk
+		err = json.Unmarshal([]byte(event), &chunk)
+		if err != nil {
+			return stats, err
+		}
+		pendingLine.WriteString(chunk.Content)
+		lines := strings.SplitAfter(pendingLine.String(), "\n")
+		pendingLine.Reset()
+		pendingLine.WriteString(lines[len(lines)-1]) // the last one is incomplete
+		for _, line := range lines[:len(lines)-1] {
+			if !processLineFunc(line) {
+				return stats, nil
+			}
+		}
+		if chunk.Stop {
+			stats = newServerPromptEvalStats(chunk)
+			break
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return stats, err
+	}
+	if pendingLine.Len() > 0 {
+		processLineFunc(pendingLine.String())
+	}
+	return stats, nil
+}
+
+func newServerPromptEvalStats(lastChunk completionChunk) promptEvalStats {
+	timings := lastChunk.Timings
+	if timings == nil {
+		return promptEvalStats{}
+	}
+	stats := promptEvalStats{
+		promptTokenCount: lastChunk.TokensEvaluated,
+		evaluatedCount:   timings.PromptCount,
+		evalTime:         time.Duration(timings.PromptMilliseconds * float64(time.Millisecond)),
+	}
+	if timings.CacheCount != nil {
+		stats.cachedTokenCount = *timings.CacheCount
+	} else {
+		stats.cachedTokenCount = max(lastChunk.TokensEvaluated-timings.PromptCount, 0)
+	}
+	if stats.promptTokenCount == 0 {
+		stats.promptTokenCount = stats.cachedTokenCount + stats.evaluatedCount
+	}
+	return stats
+}
+
+func (l *ServerLanguageModel) startServerIfRequired() error {
+	if l.server != nil {
+		select {
+		case <-l.server.exited:
+			l.failServer(fmt.Sprintf("llama.cpp server (%s) exited unexpectedly (%v): %s", l.name, l.server.exitErr, l.server.stderr.String()))
+		default:
+			return nil
+		}
+	}
+	now := time.Now()
+	if now.Before(l.nextStartAllowedAt) {
+		return fmt.Errorf("%w: restarting in %s", ErrServerUnavailable, l.nextStartAllowedAt.Sub(now).Round(time.Second))
+	}
+	s, err := l.startServer()
+	if err != nil {
+		l.registerFailure(fmt.Sprintf("failed to start llama.cpp server (%s): %s", l.name, err))
+		return fmt.Errorf("%w: %s", ErrServerUnavailable, err)
+	}
+	l.server = s
+	err = l.waitUntilHealthy(s)
+	if err != nil {
+		message := fmt.Sprintf("llama.cpp server (%s) failed the health check: %s: %s", l.name, err, s.stderr.String())
+		l.failServer(message)
+		return fmt.Errorf("%w: %s", ErrServerUnavailable, message)
+	}
+	l.serverURL.Store(s.url)
+	l.logger.Log(fmt.Sprintf("Started llama.cpp server (%s) at %s\n", l.name, s.url))
+	return nil
+}
+
+func (l *ServerLanguageModel) startServer() (*server, error) {
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	port, err := findFreePort()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"-m", filepath.Join(workingDirectory, l.binPath),
+		"-t", strconv.Itoa(l.cpuThreadCount),
+		"-ngl", strconv.Itoa(l.gpuLayerCount),
+		"-c", strconv.Itoa(l.contextSize),
+		"--host", "127.0.0.1",
+		"--port", strconv.Itoa(port),
+	}
+	if l.promptCache != nil {
+		slotSavePath := l.promptCache.dirPath
+		if !filepath.IsAbs(slotSavePath) {
+			slotSavePath = filepath.Join(workingDirectory, slotSavePath)
+		}
+		args = append(args, "--parallel", "1", "--slot-save-path", slotSavePath+string(filepath.Separator))
+	}
+	cmd := exec.Command(filepath.Join(workingDirectory, l.serverBinPath), args...)
+	l.logger.Log(fmt.Sprintf("llama.cpp server command: \"%s\"\n", cmd.String()))
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	s := &server{
+		cmd:    cmd,
+		url:    fmt.Sprintf("http://127.0.0.1:%d", port),
+		exited: make(chan struct{}),
+		stderr: newServerLineRingBuffer(serverStderrTailSize),
+	}
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			s.stderr.Add(scanner.Text())
+		}
+		s.exitErr = cmd.Wait() // Wait() must not be called before all reads from the pipe are done
+		close(s.exited)
+	}()
+	return s, nil
+}
+
+// waitUntilHealthy polls /health which returns 503 while the model is being loaded
+func (l *ServerLanguageModel) waitUntilHealthy(s *server) error {
+	deadline := time.Now().Add(l.startTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-s.exited:
+			return fmt.Errorf("exited (%v)", s.exitErr)
+		default:
+		}
+		ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+"/health", nil)
+		if err != nil {
+			cancelFunc()
+			return err
+		}
+		response, err := l.httpClient.Do(request)
+		if err == nil {
+			_ = response.Body.Close()
+			if response.StatusCode == http.StatusOK {
+				cancelFunc()
+				return nil
+			}
+		}
+		cancelFunc()
+		time.Sleep(serverHealthCheckInterval)
+	}
+	return fmt.Errorf("not ready in %s", l.startTimeout)
+}
+
+// failServer kills the server (if it's still alive) so that it's restarted on one of the next calls
+func (l *ServerLanguageModel) failServer(reason string) {
+	l.stopServer()
+	l.registerFailure(reason)
+}
+
+func (l *ServerLanguageModel) stopServer() {
+	s := l.server
+	l.server = nil
+	l.serverURL.Store("")
+	if s != nil {
+		_ = s.cmd.Process.Kill()
+		<-s.exited
+	}
+}
+
+func (l *ServerLanguageModel) registerFailure(reason string) {
+	l.failureCount++
+	delay := minServerRestartDelay << min(l.failureCount-1, 16)
+	if delay > l.maxRestartDelay {
+		delay = l.maxRestartDelay
+	}
+	l.nextStartAllowedAt = time.Now().Add(delay)
+	l.logger.Log(fmt.Sprintf("%s (restarting in %s)\n", reason, delay))
+}
+
+// resetIdleTimer the server is stopped if it's not used during the idle timeout (see ConfigKeyLLMServerIdleTimeout)
+func (l *ServerLanguageModel) resetIdleTimer() {
+	if l.idleTimeout <= 0 {
+		return
+	}
+	if l.idleTimer != nil {
+		l.idleTimer.Stop()
+	}
+	l.idleTimer = time.AfterFunc(l.idleTimeout, func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if l.server != nil {
+			l.logger.Log(fmt.Sprintf("Stopping llama.cpp server (%s) after %s of inactivity\n", l.name, l.idleTimeout))
+			l.stopServer()
+		}
+	})
+}
+
+func findFreePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// serverLineRingBuffer keeps the last lines of output
+type serverLineRingBuffer struct {
+	mutex sync.Mutex
+	lines []string
+	size  int
+}
+
+func newServerLineRingBuffer(size int) *serverLineRingBuffer {
+	return &serverLineRingBuffer{size: size}
+}
+
+func (b *serverLineRingBuffer) Add(line string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.lines = append(b.lines, line)
+	if len(b.lines) > b.size {
+		b.lines = b.lines[len(b.lines)-b.size:]
+	}
+}
+
+func (b *serverLineRingBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.lines) == 0 {
+		return "no output in stderr"
+	}
+	return strings.Join(b.lines, "\n")
+}
@@ -0,0 +1,150 @@
+package llamacpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+// ConfigKeyLLMTokenizerBinPath the path to llama.cpp's tokenize binary, relative to the working directory (it only
+// loads the vocabulary of the model, so it's fast enough to be run for each prompt)
+const ConfigKeyLLMTokenizerBinPath = "llmTokenizerBinPath"
+
+const tokenizerTimeout = 10 * time.Second
+
+// tokenizeRequest see llama.cpp's server documentation for /tokenize
+type tokenizeRequest struct {
+	Content string `json:"content"`
+}
+
+type tokenizeResponse struct {
+	Tokens []json.RawMessage `json:"tokens"`
+}
+
+// tokenizer counts tokens with the model's own vocabulary: via the running llama.cpp server of the model if there's
+// one (see ServerLanguageModel), otherwise via llama.cpp's tokenize binary. If neither works, the token count is
+// estimated (see domain.NewApproximateTokenizer()).
+type tokenizer struct {
+	mutex           sync.Mutex
+	logger          common.Logger
+	modelName       string
+	binPath         string
+	tokenizeBinPath string
+	// serverURLFunc returns the URL of the running server, or an empty string; nil for the process backend
+	serverURLFunc func() string
+	httpClient    *http.Client
+	fallback      domain.Tokenizer
+	// isFallingBack the fallback is logged once, until the model's tokenizer works again
+	isFallingBack bool
+}
+
+func newTokenizer(modelName, binPath string, serverURLFunc func() string, config *common.Config, logger common.Logger) *tokenizer {
+	return &tokenizer{
+		logger:          logger,
+		modelName:       modelName,
+		binPath:         binPath,
+		tokenizeBinPath: config.GetStringOrDefault(ConfigKeyLLMTokenizerBinPath, "llama-tokenize"),
+		serverURLFunc:   serverURLFunc,
+		httpClient:      &http.Client{Timeout: tokenizerTimeout},
+		fallback:        domain.NewApproximateTokenizer(),
+	}
+}
+
+func (t *tokenizer) CountTokens(text string) int {
+	count, err := t.countTokens(text)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err != nil {
+		if !t.isFallingBack {
+			t.logger.Log(fmt.Sprintf("failed to count tokens with the tokenizer of %s, the token count is estimated: %s\n", t.modelName, err))
+			t.isFallingBack = true
+		}
+		return t.fallback.CountTokens(text)
+	}
+	t.isFallingBack = false
+	return count
+}
+
+func (t *tokenizer) countTokens(text string) (int, error) {
+	if t.serverURLFunc != nil {
+		serverURL := t.serverURLFunc()
+		if serverURL != "" {
+			count, err := t.countTokensWithServer(serverURL, text)
+			if err == nil {
+				return count, nil
+			}
+			// The server could have been stopped in the meantime.
+		}
+	}
+	return t.countTokensWithBinary(text)
+}
+
+func (t *tokenizer) countTokensWithServer(serverURL, text string) (int, error) {
+	requestBytes, err := json.Marshal(tokenizeRequest{Content: text})
+	if err != nil {
+		return 0, err
+	}
+	response, err := t.httpClient.Post(serverURL+"/tokenize", "application/json", bytes.NewReader(requestBytes))
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("llama.cpp server returned status %d", response.StatusCode)
+	}
+	var tokens tokenizeResponse
+	err = json.NewDecoder(response.Body).Decode(&tokens)
+	if err != nil {
+		return 0, err
+	}
+	return len(tokens.Tokens), nil
+}
+
+// countTokensWithBinary the text is passed via stdin, as prompts can exceed the maximum length of a command line
+// argument
+func (t *tokenizer) countTokensWithBinary(text string) (int, error) {
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), tokenizerTimeout)
+	defer cancelFunc()
+	cmd := exec.CommandContext(
+		ctx,
+		filepath.Join(workingDirectory, t.tokenizeBinPath),
+		"-m", filepath.Join(workingDirectory, t.binPath),
+		"--stdin",
+		"--ids",
+		"--log-disable",
+	)
+	cmd.Stdin = strings.NewReader(text)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return 0, fmt.Errorf("failed to run the tokenize binary: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseTokenIDs(stdout.String())
+}
+
+// parseTokenIDs parses the output of the tokenize binary with --ids: "[1, 15043, 3186]"
+func parseTokenIDs(output string) (int, error) {
+	var ids []int
+	err := json.Unmarshal([]byte(strings.TrimSpace(output)), &ids)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected output of the tokenize binary: %w", err)
+	}
+	return len(ids), nil
+}
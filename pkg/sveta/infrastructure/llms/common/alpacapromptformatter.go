@@ -35,9 +35,11 @@ func (p *AlpacaPromptFormatter) FormatPrompt(options domain.FormatOptions) strin
 		buf.WriteString(options.Summary)
 		buf.WriteString("\n\n")
 	}
+	buf.WriteString(domain.FormatKnowledgeMemories(options.Memories))
 	// the dialog history
-	for i := 0; i < len(options.Memories); i++ {
-		memory := options.Memories[i]
+	dialogMemories := options.DialogMemories()
+	for i := 0; i < len(dialogMemories); i++ {
+		memory := dialogMemories[i]
 		buf.WriteString("### ")
 		buf.WriteString(memory.Who)
 		if !memory.When.IsZero() {
@@ -61,6 +61,9 @@ func (a *AlpacaResponseCleaner) getNameWithDelimiter(name string) string {
 }
 
 func (a *AlpacaResponseCleaner) removePromptFromResponse(prompt, response string) string {
+	if strings.HasPrefix(response, prompt) { // the llama.cpp server echoes the prompt as is
+		return strings.TrimSpace(response[len(prompt):])
+	}
 	if len(response) < len(prompt)+1 {
 		return ""
 	}
@@ -0,0 +1,66 @@
+package common
+
+// ChatTemplate describes how a chat is formatted for a model trained on turns of a user and an assistant.
+// Consecutive turns of the same role are merged, as most of such models expect the roles to alternate.
+type ChatTemplate struct {
+	// BeginOfText is written at the beginning of the prompt
+	BeginOfText string
+	// SystemStart and SystemEnd surround the system prompt. If SystemStart is empty, the model has no system role, and
+	// the system prompt is prepended to the first user turn.
+	SystemStart string
+	SystemEnd   string
+	// UserStart and UserEnd surround a user turn
+	UserStart string
+	UserEnd   string
+	// AssistantStart and AssistantEnd surround an assistant turn; the prompt ends with AssistantStart
+	AssistantStart string
+	AssistantEnd   string
+	// StopMarker if the model starts a new turn (it appears in the response more often than in the prompt), the
+	// completion is stopped, and the response is cut there
+	StopMarker string
+	// SpecialTokens may or may not be echoed by llama.cpp along with the prompt, so they're ignored when the prompt is
+	// removed from the response
+	SpecialTokens []string
+}
+
+var ChatMLTemplate = ChatTemplate{
+	SystemStart:    "<|im_start|>system\n",
+	SystemEnd:      "<|im_end|>\n",
+	UserStart:      "<|im_start|>user\n",
+	UserEnd:        "<|im_end|>\n",
+	AssistantStart: "<|im_start|>assistant\n",
+	AssistantEnd:   "<|im_end|>\n",
+	StopMarker:     "<|im_start|>",
+	SpecialTokens:  []string{"<|im_start|>", "<|im_end|>"},
+}
+
+var MistralTemplate = ChatTemplate{
+	BeginOfText:    "<s>",
+	UserStart:      "[INST] ",
+	UserEnd:        " [/INST]",
+	AssistantStart: "",
+	AssistantEnd:   "</s>",
+	StopMarker:     "[INST]",
+	SpecialTokens:  []string{"<s>", "</s>"},
+}
+
+var GemmaTemplate = ChatTemplate{
+	BeginOfText:    "<bos>",
+	UserStart:      "<start_of_turn>user\n",
+	UserEnd:        "<end_of_turn>\n",
+	AssistantStart: "<start_of_turn>model\n",
+	AssistantEnd:   "<end_of_turn>\n",
+	StopMarker:     "<start_of_turn>",
+	SpecialTokens:  []string{"<bos>", "<start_of_turn>", "<end_of_turn>"},
+}
+
+var Phi3Template = ChatTemplate{
+	SystemStart:    "<|system|>\n",
+	SystemEnd:      "<|end|>\n",
+	UserStart:      "<|user|>\n",
+	UserEnd:        "<|end|>\n",
+	AssistantStart: "<|assistant|>\n",
+	AssistantEnd:   "<|end|>\n",
+	StopMarker:     "<|user|>",
+	SpecialTokens:  []string{"<|system|>", "<|user|>", "<|assistant|>", "<|end|>", "<|endoftext|>"},
+}
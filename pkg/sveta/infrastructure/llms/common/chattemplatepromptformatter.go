@@ -0,0 +1,120 @@
+package common
+
+import (
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+type ChatTemplatePromptFormatter struct {
+	template ChatTemplate
+}
+
+type chatTurn struct {
+	isAssistant bool
+	content     string
+}
+
+// NewChatTemplatePromptFormatter formats the prompt according to the template (see ChatTemplate). The AI agent's
+// lines are the assistant's turns, and other participants' lines are the user's turns prefixed with their names
+// (as there can be several users in a room).
+func NewChatTemplatePromptFormatter(template ChatTemplate) *ChatTemplatePromptFormatter {
+	return &ChatTemplatePromptFormatter{
+		template: template,
+	}
+}
+
+func (p *ChatTemplatePromptFormatter) FormatPrompt(options domain.FormatOptions) string {
+	systemPrompt := p.formatSystemPrompt(options)
+	turns := p.collectTurns(options)
+	var buf strings.Builder
+	buf.WriteString(p.template.BeginOfText)
+	if p.template.SystemStart != "" {
+		buf.WriteString(p.template.SystemStart)
+		buf.WriteString(systemPrompt)
+		buf.WriteString(p.template.SystemEnd)
+	} else if len(turns) == 0 || turns[0].isAssistant {
+		turns = append([]chatTurn{{content: systemPrompt}}, turns...)
+	} else {
+		turns[0].content = systemPrompt + "\n\n" + turns[0].content
+	}
+	for _, turn := range turns {
+		if turn.isAssistant {
+			buf.WriteString(p.template.AssistantStart)
+			buf.WriteString(turn.content)
+			buf.WriteString(p.template.AssistantEnd)
+		} else {
+			buf.WriteString(p.template.UserStart)
+			buf.WriteString(turn.content)
+			buf.WriteString(p.template.UserEnd)
+		}
+	}
+	// forces completion
+	buf.WriteString(p.template.AssistantStart)
+	return buf.String()
+}
+
+func (p *ChatTemplatePromptFormatter) formatSystemPrompt(options domain.FormatOptions) string {
+	var buf strings.Builder
+	buf.WriteString(options.AgentDescription)
+	if options.AgentDescriptionReminder != "" {
+		buf.WriteString(" ")
+		buf.WriteString(options.AgentDescriptionReminder)
+	}
+	// the announced time, if any
+	if options.AnnouncedTime != nil {
+		buf.WriteString(" Current time is ")
+		buf.WriteString(options.AnnouncedTime.Format("Mon, 02 Jan 2006 15:04:05"))
+		buf.WriteString(".\n\n")
+	}
+	if options.JSONOutputSchema != "" {
+		buf.WriteString(" Answer using JSON using the following JSON schema: ```\n")
+		buf.WriteString(options.JSONOutputSchema)
+		buf.WriteString("\n```.\n\n")
+	}
+	if options.Summary != "" {
+		buf.WriteString(options.Summary)
+		buf.WriteString("\n\n")
+	}
+	buf.WriteString(domain.FormatKnowledgeMemories(options.Memories))
+	return strings.TrimSpace(buf.String())
+}
+
+// collectTurns merges consecutive lines of the same role
+func (p *ChatTemplatePromptFormatter) collectTurns(options domain.FormatOptions) []chatTurn {
+	var turns []chatTurn
+	for _, memory := range options.DialogMemories() {
+		isAssistant := memory.Who == options.AgentName
+		var content string
+		if isAssistant {
+			content = memory.What
+		} else {
+			content = p.formatUserLine(memory)
+		}
+		if len(turns) > 0 && turns[len(turns)-1].isAssistant == isAssistant {
+			turns[len(turns)-1].content += "\n" + content
+			continue
+		}
+		turns = append(turns, chatTurn{isAssistant: isAssistant, content: content})
+	}
+	return turns
+}
+
+func (p *ChatTemplatePromptFormatter) formatUserLine(memory *domain.Memory) string {
+	var buf strings.Builder
+	buf.WriteString(memory.Who)
+	if !memory.When.IsZero() {
+		diff := time.Now().Sub(memory.When)
+		if diff > time.Minute {
+			buf.WriteString(" (said ")
+			buf.WriteString(humanize.Time(memory.When))
+			buf.WriteString(")")
+		}
+	}
+	buf.WriteString(": ")
+	buf.WriteString(memory.What)
+	return buf.String()
+}
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+// Run `go test ./pkg/sveta/infrastructure/llms/common -update` to regenerate the golden files after an intended change
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func newTestFormatOptions() domain.FormatOptions {
+	announcedTime := time.Date(2024, time.May, 3, 18, 0, 0, 0, time.UTC)
+	newMemory := func(memoryType domain.MemoryType, who, what string) *domain.Memory {
+		// the zero time, so that "(said ... ago)" doesn't depend on when the test is run
+		return domain.NewMemory(who+what, memoryType, who, time.Time{}, what, "room", nil)
+	}
+	return domain.FormatOptions{
+		AgentName:                "Sveta",
+		AgentDescription:         "You're Sveta, a friendly AI.",
+		AgentDescriptionReminder: "Keep it short.",
+		Summary:                  "John asked about the weather.",
+		AnnouncedTime:            &announcedTime,
+		Memories: []*domain.Memory{
+			newMemory(domain.MemoryTypeFact, "", "John likes cats."),
+			newMemory(domain.MemoryTypeDialog, "John", "Hi!"),
+			newMemory(domain.MemoryTypeDialog, "Mary", "Hello, Sveta."),
+			newMemory(domain.MemoryTypeDialog, "Sveta", "Hi, John and Mary!"),
+			newMemory(domain.MemoryTypeDialog, "John", "Do you like cats?"),
+		},
+	}
+}
+
+func TestChatTemplatePromptFormatter(t *testing.T) {
+	for _, test := range testChatTemplates {
+		t.Run(test.name, func(t *testing.T) {
+			prompt := NewChatTemplatePromptFormatter(test.template).FormatPrompt(newTestFormatOptions())
+			goldenPath := filepath.Join("testdata", test.name+".golden")
+			if *update {
+				err := os.WriteFile(goldenPath, []byte(prompt), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			expectedPrompt, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prompt != string(expectedPrompt) {
+				t.Errorf("the prompt doesn't match %s:\n%s", goldenPath, prompt)
+			}
+		})
+	}
+}
+
+var testChatTemplates = []struct {
+	name     string
+	template ChatTemplate
+}{
+	{name: "chatml", template: ChatMLTemplate},
+	{name: "mistral", template: MistralTemplate},
+	{name: "gemma", template: GemmaTemplate},
+	{name: "phi3", template: Phi3Template},
+}
+
+func TestChatTemplateStopCondition(t *testing.T) {
+	for _, test := range testChatTemplates {
+		t.Run(test.name, func(t *testing.T) {
+			prompt := NewChatTemplatePromptFormatter(test.template).FormatPrompt(newTestFormatOptions())
+			strippedPrompt := NewChatTemplateResponseCleaner(test.template).removeSpecialTokens(prompt)
+			tests := []struct {
+				name         string
+				response     string
+				expectedStop bool
+			}{
+				{name: "the turn goes on", response: prompt + "I do!", expectedStop: false},
+				{name: "a new turn", response: prompt + "I do!" + test.template.AssistantEnd + test.template.StopMarker, expectedStop: true},
+				{name: "special tokens stripped from the prompt", response: strippedPrompt + "I do!", expectedStop: false},
+			}
+			for _, subtest := range tests {
+				t.Run(subtest.name, func(t *testing.T) {
+					shouldStop := NewChatTemplateStopCondition(test.template).ShouldStop(prompt, subtest.response)
+					if shouldStop != subtest.expectedStop {
+						t.Errorf("expected ShouldStop to return %t, got %t", subtest.expectedStop, shouldStop)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestChatTemplateResponseCleaner(t *testing.T) {
+	for _, test := range testChatTemplates {
+		t.Run(test.name, func(t *testing.T) {
+			prompt := NewChatTemplatePromptFormatter(test.template).FormatPrompt(newTestFormatOptions())
+			cleaner := NewChatTemplateResponseCleaner(test.template)
+			strippedPrompt := cleaner.removeSpecialTokens(prompt)
+			nextTurn := test.template.AssistantEnd + test.template.UserStart + "John: And dogs?"
+			tests := []struct {
+				name             string
+				response         string
+				expectedResponse string
+			}{
+				{name: "echoed prompt", response: prompt + "I do!", expectedResponse: "I do!"},
+				{name: "a new turn", response: prompt + "I do!" + nextTurn, expectedResponse: "I do!"},
+				{name: "the agent's name", response: prompt + "Sveta: I do!" + test.template.AssistantEnd, expectedResponse: "I do!"},
+				{name: "special tokens stripped", response: strippedPrompt + "I do!\n", expectedResponse: "I do!"},
+				{name: "special tokens stripped, the agent's name", response: strippedPrompt + "Sveta: I do!", expectedResponse: "I do!"},
+				{name: "shorter than the prompt", response: strippedPrompt[:len(strippedPrompt)/2], expectedResponse: ""},
+			}
+			for _, subtest := range tests {
+				t.Run(subtest.name, func(t *testing.T) {
+					response := cleaner.CleanResponse(domain.CleanOptions{
+						Prompt:    prompt,
+						Response:  subtest.response,
+						AgentName: "Sveta",
+					})
+					if response != subtest.expectedResponse {
+						t.Errorf("expected %q, got %q", subtest.expectedResponse, response)
+					}
+				})
+			}
+		})
+	}
+}
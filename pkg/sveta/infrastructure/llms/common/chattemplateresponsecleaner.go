@@ -0,0 +1,57 @@
+package common
+
+import (
+	"strings"
+
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+type ChatTemplateResponseCleaner struct {
+	template ChatTemplate
+}
+
+// NewChatTemplateResponseCleaner removes the prompt echoed by llama.cpp, everything after the end of the turn, and
+// the agent's name if the model imitates the "Name: " prefixes of the user turns.
+func NewChatTemplateResponseCleaner(template ChatTemplate) *ChatTemplateResponseCleaner {
+	return &ChatTemplateResponseCleaner{
+		template: template,
+	}
+}
+
+func (c *ChatTemplateResponseCleaner) CleanResponse(options domain.CleanOptions) string {
+	response := options.Response
+	if strings.HasPrefix(response, options.Prompt) { // the llama.cpp server echoes the prompt as is
+		response = response[len(options.Prompt):]
+	} else {
+		// The llama.cpp binary may omit the special tokens when echoing the prompt.
+		prompt := c.removeSpecialTokens(options.Prompt)
+		response = c.removeSpecialTokens(response)
+		if len(response) < len(prompt) {
+			return ""
+		}
+		response = response[len(prompt):]
+	}
+	for _, endOfTurn := range []string{c.template.AssistantEnd, c.template.StopMarker} {
+		endOfTurn = strings.TrimSpace(endOfTurn)
+		if endOfTurn == "" {
+			continue
+		}
+		index := strings.Index(response, endOfTurn)
+		if index != -1 {
+			response = response[:index]
+		}
+	}
+	response = strings.TrimSpace(response)
+	agentNamePrefix := options.AgentName + ":"
+	if strings.HasPrefix(response, agentNamePrefix) {
+		response = response[len(agentNamePrefix):]
+	}
+	return strings.TrimSpace(response)
+}
+
+func (c *ChatTemplateResponseCleaner) removeSpecialTokens(s string) string {
+	for _, token := range c.template.SpecialTokens {
+		s = strings.ReplaceAll(s, token, "")
+	}
+	return s
+}
@@ -0,0 +1,19 @@
+package common
+
+import "strings"
+
+type ChatTemplateStopCondition struct {
+	template ChatTemplate
+}
+
+// NewChatTemplateStopCondition stops completion when the model starts a new turn (see ChatTemplate.StopMarker), which
+// is only possible if llama.cpp prints special tokens; otherwise, the model stops itself with the end-of-turn token.
+func NewChatTemplateStopCondition(template ChatTemplate) *ChatTemplateStopCondition {
+	return &ChatTemplateStopCondition{
+		template: template,
+	}
+}
+
+func (c *ChatTemplateStopCondition) ShouldStop(prompt, response string) bool {
+	return strings.Count(response, c.template.StopMarker) > strings.Count(prompt, c.template.StopMarker)
+}
@@ -0,0 +1,12 @@
+package common
+
+// NoStopCondition never stops the completion, for models which are good at stopping it themselves
+type NoStopCondition struct{}
+
+func NewNoStopCondition() *NoStopCondition {
+	return &NoStopCondition{}
+}
+
+func (n *NoStopCondition) ShouldStop(_, _ string) bool {
+	return false
+}
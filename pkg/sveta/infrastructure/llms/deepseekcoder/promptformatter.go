@@ -8,16 +8,16 @@ import (
 
 type promptFormatter struct{}
 
-func newPromptFormatter() *promptFormatter {
+func NewPromptFormatter() domain.PromptFormatter {
 	return &promptFormatter{}
 }
 
 func (p *promptFormatter) FormatPrompt(options domain.FormatOptions) string {
 	var builder strings.Builder
 	builder.WriteString(options.AgentDescription)
-	// note that we don't output agent reminder or the summary because it does not support it
+	// note that we don't output agent reminder, the summary or knowledge because it does not support it
 	builder.WriteRune('\n')
-	for _, memory := range options.Memories {
+	for _, memory := range options.DialogMemories() {
 		if memory.Who == options.AgentName {
 			builder.WriteString("### Response:\n")
 		} else {
@@ -8,7 +8,7 @@ import (
 
 type responseCleaner struct{}
 
-func newResponseCleaner() *responseCleaner {
+func NewResponseCleaner() domain.ResponseCleaner {
 	return &responseCleaner{}
 }
 
@@ -12,7 +12,7 @@ import (
 
 type promptFormatter struct{}
 
-func newPromptFormatter() *promptFormatter {
+func NewPromptFormatter() domain.PromptFormatter {
 	return &promptFormatter{}
 }
 
@@ -36,10 +36,12 @@ func (p *promptFormatter) FormatPrompt(options domain.FormatOptions) string {
 		buf.WriteString(options.Summary)
 		buf.WriteString("\n\n")
 	}
+	buf.WriteString(domain.FormatKnowledgeMemories(options.Memories))
 	buf.WriteString("<|eot_id|>")
 	// the dialog history
-	for i := 0; i < len(options.Memories); i++ {
-		memory := options.Memories[i]
+	dialogMemories := options.DialogMemories()
+	for i := 0; i < len(dialogMemories); i++ {
+		memory := dialogMemories[i]
 		buf.WriteString("<|start_header_id|>")
 		buf.WriteString(memory.Who)
 		if !memory.When.IsZero() {
@@ -50,7 +52,7 @@ func (p *promptFormatter) FormatPrompt(options domain.FormatOptions) string {
 				buf.WriteString(")")
 			}
 		}
-		buf.WriteString("<|end_header_id|\n")
+		buf.WriteString("<|end_header_id|>\n")
 		buf.WriteString(memory.What)
 		buf.WriteString("<|eot_id|>")
 	}
@@ -8,13 +8,16 @@ import (
 
 type responseCleaner struct{}
 
-func newResponseCleaner() *responseCleaner {
+func NewResponseCleaner() domain.ResponseCleaner {
 	return &responseCleaner{}
 }
 
 func (r *responseCleaner) CleanResponse(options domain.CleanOptions) string {
 	prompt := options.Prompt
 	response := options.Response
+	if strings.HasPrefix(response, prompt) { // the llama.cpp server echoes the prompt as is, with the special tokens
+		return strings.TrimSpace(response[len(prompt):])
+	}
 	prompt = strings.ReplaceAll(prompt, "<|begin_of_text|>", "")
 	prompt = strings.ReplaceAll(prompt, "<|start_header_id|>", "")
 	prompt = strings.ReplaceAll(prompt, "<|end_header_id|>", "")
@@ -1,8 +1,10 @@
 package llama3
 
+import "kgeyst.com/sveta/pkg/sveta/domain"
+
 type stopCondition struct{}
 
-func newStopCondition() *stopCondition {
+func NewStopCondition() domain.StopCondition {
 	return &stopCondition{}
 }
 
@@ -1,6 +1,7 @@
 package logging
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -32,11 +33,11 @@ func (l *languageModelDecorator) Complete(prompt string, options domain.Complete
 	l.logger.Log(fmt.Sprintf("\n================\n raw prompt (using '%s'):\n%s\n================\n\n", l.Name(), prompt))
 	t := time.Now()
 	response, err := l.wrappedLanguageModel.Complete(prompt, options)
-	if err != nil {
+	if err != nil && !errors.Is(err, domain.ErrLanguageModelTimeout) {
 		return "", err
 	}
 	l.logger.Log(fmt.Sprintf("\n================\n raw prompt response:\n%s\n (took %d ms)\n================\n", response, time.Now().Sub(t).Milliseconds()))
-	return response, nil
+	return response, err
 }
 
 func (l *languageModelDecorator) PromptFormatter() domain.PromptFormatter {
@@ -46,3 +47,11 @@ func (l *languageModelDecorator) PromptFormatter() domain.PromptFormatter {
 func (l *languageModelDecorator) ResponseCleaner() domain.ResponseCleaner {
 	return l.wrappedLanguageModel.ResponseCleaner()
 }
+
+func (l *languageModelDecorator) ContextSize() int {
+	return l.wrappedLanguageModel.ContextSize()
+}
+
+func (l *languageModelDecorator) Tokenizer() domain.Tokenizer {
+	return l.wrappedLanguageModel.Tokenizer()
+}
@@ -0,0 +1,500 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/llamacpp"
+	llmscommon "kgeyst.com/sveta/pkg/sveta/infrastructure/llms/common"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/llms/deepseekcoder"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/llms/llama3"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/llms/logging"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/openai"
+)
+
+const (
+	// ConfigKeyLanguageModels the list of language models (see ModelDefinition)
+	ConfigKeyLanguageModels = "languageModels"
+	// ConfigKeyLanguageModelSelectors which models are used for which role, in the order of rotation (see the roles below)
+	ConfigKeyLanguageModelSelectors = "languageModelSelectors"
+	// ConfigKeyLanguageModelSelectorStrategies how models are chosen for each role: "roundRobin" (by default), "weighted"
+	// (see ModelDefinition.Weight) or "priority" (the first healthy model in the list)
+	ConfigKeyLanguageModelSelectorStrategies = "languageModelSelectorStrategies"
+)
+
+const (
+	// RoleDefault the dialog, JSON etc.
+	RoleDefault = "default"
+	// RoleRoleplay the dialog in roleplay rooms
+	RoleRoleplay = "roleplay"
+	// RoleRerank reranking recalled memories
+	RoleRerank = "rerank"
+	// RoleCode writing code
+	RoleCode = "code"
+	// RoleRewrite rewriting the user query
+	RoleRewrite = "rewrite"
+)
+
+// Prompt formats, stop conditions and response cleaners
+const (
+	FormatAlpaca        = "alpaca"
+	FormatLlama3        = "llama3"
+	FormatDeepSeekCoder = "deepseekcoder"
+	FormatChatML        = "chatml"
+	FormatMistral       = "mistral"
+	FormatGemma         = "gemma"
+	FormatPhi3          = "phi3"
+	// FormatAuto the format is detected from the chat template in the model file (GGUF only)
+	FormatAuto = "auto"
+	// StopConditionNone the model is good at stopping completion itself
+	StopConditionNone = "none"
+)
+
+// Backends
+const (
+	// BackendLlamaCpp the model is run locally with llama.cpp (see llamacpp.ConfigKeyLLMBackend)
+	BackendLlamaCpp = "llamacpp"
+	// BackendOpenAI the model is served by an OpenAI-compatible API (see openai.ConfigKeyOpenAIBaseURL)
+	BackendOpenAI = "openai"
+)
+
+var ErrUnknownLanguageModel = errors.New("unknown language model")
+
+// ModelDefinition describes a language model in the config. Zero (or, for the temperature and the repeat penalty,
+// missing) values of the parameters mean the global values are used (see llamacpp.ConfigKeyLLMContextSize etc.)
+type ModelDefinition struct {
+	Name string `yaml:"name"`
+	// Backend "llamacpp" (by default) or "openai"
+	Backend string `yaml:"backend"`
+	// File the path to the model, relative to the working directory (llama.cpp only)
+	File string `yaml:"file"`
+	// BaseURL, APIKey, Model and Mode override the global openAI* parameters (OpenAI-compatible APIs only)
+	BaseURL string `yaml:"baseURL"`
+	APIKey  string `yaml:"apiKey"`
+	Model   string `yaml:"model"`
+	Mode    string `yaml:"mode"`
+	// PromptFormat "alpaca", "llama3", "deepseekcoder", "chatml", "mistral", "gemma", "phi3" or "auto" (by default);
+	// llama.cpp only, as OpenAI-compatible APIs format prompts themselves (see openai.ConfigKeyOpenAIMode)
+	PromptFormat string `yaml:"promptFormat"`
+	// StopCondition one of the prompt formats or "none" (by default, the same as the prompt format)
+	StopCondition string `yaml:"stopCondition"`
+	// ResponseCleaner one of the prompt formats (by default, the same as the prompt format)
+	ResponseCleaner string `yaml:"responseCleaner"`
+	// ResponseModes "normal", "json", "rerank", "code"
+	ResponseModes  []string `yaml:"responseModes"`
+	ContextSize    int      `yaml:"contextSize"`
+	GPULayerCount  int      `yaml:"gpuLayerCount"`
+	CPUThreadCount int      `yaml:"cpuThreadCount"`
+	Temperature    *float64 `yaml:"temperature"`
+	RepeatPenalty  *float64 `yaml:"repeatPenalty"`
+	// Weight how often the model is chosen relative to others, for the "weighted" strategy (1 by default)
+	Weight int `yaml:"weight"`
+}
+
+// defaultModelDefinitions used if the config doesn't declare any models
+var defaultModelDefinitions = []ModelDefinition{
+	{
+		Name:          "llama3",
+		File:          "llama3.bin",
+		PromptFormat:  FormatLlama3,
+		ResponseModes: []string{"normal", "json"},
+	},
+	{
+		Name:          "solar-generic",
+		File:          "solar-generic.bin",
+		PromptFormat:  FormatAlpaca,
+		ResponseModes: []string{"normal", "rerank", "json"},
+	},
+	{
+		Name:          "llama2-roleplay",
+		File:          "llama2-roleplay.bin",
+		PromptFormat:  FormatAlpaca,
+		ResponseModes: []string{"normal"},
+	},
+	{
+		Name:          "deepseekcoder",
+		File:          "deepseekcoder.bin",
+		PromptFormat:  FormatDeepSeekCoder,
+		ResponseModes: []string{"code"},
+	},
+}
+
+// defaultSelectors used for the roles which aren't declared in the config, unless the config declares its own models
+var defaultSelectors = map[string][]string{
+	RoleDefault:  {"llama3", "solar-generic", "llama2-roleplay"},
+	RoleRoleplay: {"llama2-roleplay", "solar-generic"},
+	RoleRerank:   {"solar-generic"},
+	RoleCode:     {"deepseekcoder"},
+	RoleRewrite:  {"solar-generic"},
+}
+
+// defaultOpenAIModelDefinitions used instead of defaultModelDefinitions if the config doesn't declare any models but
+// sets openai.ConfigKeyOpenAIBaseURL: the API replaces the local models, except for code
+var defaultOpenAIModelDefinitions = []ModelDefinition{
+	{
+		Name:          "openai",
+		Backend:       BackendOpenAI,
+		ResponseModes: []string{"normal", "json", "rerank"},
+	},
+	{
+		Name:          "deepseekcoder",
+		File:          "deepseekcoder.bin",
+		PromptFormat:  FormatDeepSeekCoder,
+		ResponseModes: []string{"code"},
+	},
+}
+
+// defaultOpenAISelectors see defaultOpenAIModelDefinitions
+var defaultOpenAISelectors = map[string][]string{
+	RoleDefault:  {"openai"},
+	RoleRoleplay: {"openai"},
+	RoleRerank:   {"openai"},
+	RoleCode:     {"deepseekcoder"},
+	RoleRewrite:  {"openai"},
+}
+
+// roleResponseModes which response modes the services of each role use (at least one model of the role must support
+// each of them)
+var roleResponseModes = map[string][]domain.ResponseMode{
+	RoleDefault:  {domain.ResponseModeNormal, domain.ResponseModeJSON},
+	RoleRoleplay: {domain.ResponseModeNormal},
+	RoleRerank:   {domain.ResponseModeRerank},
+	RoleCode:     {domain.ResponseModeCode},
+	RoleRewrite:  {domain.ResponseModeJSON},
+}
+
+// Registry creates language models declared in the config (see ConfigKeyLanguageModels) and the selectors per role
+// (see ConfigKeyLanguageModelSelectors).
+type Registry struct {
+	languageModels map[string]domain.LanguageModel
+	weights        map[string]int
+	selectors      map[string][]string
+	strategies     map[string]domain.LanguageModelSelectionStrategy
+	// healthTracker is shared by all the selectors
+	healthTracker *domain.LanguageModelHealthTracker
+	stoppers      common.Stoppers
+}
+
+// NewRegistry fails if the config is malformed: unknown formats, response modes, models etc.
+func NewRegistry(
+	aiContext *domain.AIContext,
+	namedMutexAcquirer domain.NamedMutexAcquirer,
+	config *common.Config,
+	logger common.Logger,
+) (*Registry, error) {
+	definitions, selectors := defaultModelDefinitions, defaultSelectors
+	if config.GetString(openai.ConfigKeyOpenAIBaseURL) != "" {
+		definitions, selectors = defaultOpenAIModelDefinitions, defaultOpenAISelectors
+	}
+	isDeclared, err := config.Unmarshal(ConfigKeyLanguageModels, &definitions)
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s: %w", ConfigKeyLanguageModels, err)
+	}
+	// The default selectors refer to the default models, so they can't be applied to the models declared in the config.
+	if isDeclared {
+		selectors = nil
+	}
+	selectors = copySelectors(selectors)
+	_, err = config.Unmarshal(ConfigKeyLanguageModelSelectors, &selectors)
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s: %w", ConfigKeyLanguageModelSelectors, err)
+	}
+	if _, ok := selectors[RoleDefault]; !ok {
+		return nil, fmt.Errorf("no language models for the role \"%s\" in %s", RoleDefault, ConfigKeyLanguageModelSelectors)
+	}
+	var strategyNames map[string]string
+	_, err = config.Unmarshal(ConfigKeyLanguageModelSelectorStrategies, &strategyNames)
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s: %w", ConfigKeyLanguageModelSelectorStrategies, err)
+	}
+	r := &Registry{
+		languageModels: make(map[string]domain.LanguageModel),
+		weights:        make(map[string]int),
+		selectors:      selectors,
+		strategies:     make(map[string]domain.LanguageModelSelectionStrategy),
+		healthTracker:  domain.NewLanguageModelHealthTracker(config, logger),
+	}
+	for role, strategyName := range strategyNames {
+		strategy, ok := domain.ParseLanguageModelSelectionStrategy(strategyName)
+		if !ok {
+			return nil, fmt.Errorf("unknown selection strategy \"%s\" for the role \"%s\"", strategyName, role)
+		}
+		r.strategies[role] = strategy
+	}
+	for _, definition := range definitions {
+		if definition.Name == "" {
+			return nil, fmt.Errorf("a language model must have a name: %+v", definition)
+		}
+		if _, ok := r.languageModels[definition.Name]; ok {
+			return nil, fmt.Errorf("language model \"%s\" is declared twice", definition.Name)
+		}
+		languageModel, err := newLanguageModel(definition, aiContext, namedMutexAcquirer, config, logger)
+		if err != nil {
+			return nil, fmt.Errorf("language model \"%s\": %w", definition.Name, err)
+		}
+		if stopper, ok := languageModel.(common.Stopper); ok { // llama.cpp servers (see `llmBackend` in the config)
+			r.stoppers = append(r.stoppers, stopper)
+		}
+		r.languageModels[definition.Name] = logging.NewLanguageModelDecorator(languageModel, logger)
+		r.weights[definition.Name] = definition.Weight
+	}
+	for role, names := range r.selectors {
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no language models for the role \"%s\"", role)
+		}
+		supportedResponseModes := make(map[domain.ResponseMode]struct{})
+		for _, name := range names {
+			languageModel, ok := r.languageModels[name]
+			if !ok {
+				return nil, fmt.Errorf("%w \"%s\" for the role \"%s\"", ErrUnknownLanguageModel, name, role)
+			}
+			for _, responseMode := range languageModel.ResponseModes() {
+				supportedResponseModes[responseMode] = struct{}{}
+			}
+		}
+		for _, responseMode := range roleResponseModes[role] {
+			if _, ok := supportedResponseModes[responseMode]; !ok {
+				return nil, fmt.Errorf("none of the language models for the role \"%s\" supports the response mode \"%s\"", role, responseMode)
+			}
+		}
+	}
+	return r, nil
+}
+
+// Selector creates a new selector for the role. Unknown roles get the models (and the strategy) of RoleDefault.
+// All the selectors share the health of the models.
+func (r *Registry) Selector(role string) *domain.LanguageModelSelector {
+	names, ok := r.selectors[role]
+	if !ok {
+		role = RoleDefault
+		names = r.selectors[role]
+	}
+	languageModels := make([]domain.LanguageModel, 0, len(names))
+	weights := make([]int, 0, len(names))
+	for _, name := range names {
+		languageModels = append(languageModels, r.languageModels[name])
+		weights = append(weights, r.weights[name])
+	}
+	return domain.NewLanguageModelSelector(
+		languageModels,
+		domain.DefaultLanguageModelSelectorOptions.
+			WithStrategy(r.strategies[role]).
+			WithWeights(weights).
+			WithHealthTracker(r.healthTracker),
+	)
+}
+
+// DecorateLanguageModels wraps all the models (for example, see cassette.NewLanguageModelDecorator(..)). Must be
+// called before the selectors are created.
+func (r *Registry) DecorateLanguageModels(decorate func(languageModel domain.LanguageModel) domain.LanguageModel) {
+	for name, languageModel := range r.languageModels {
+		r.languageModels[name] = decorate(languageModel)
+	}
+}
+
+// HealthTracker returns the health of the models shared by the selectors (see Selector(..))
+func (r *Registry) HealthTracker() *domain.LanguageModelHealthTracker {
+	return r.healthTracker
+}
+
+// Stop terminates the llama.cpp servers started for the models, if any
+func (r *Registry) Stop() {
+	r.stoppers.Stop()
+}
+
+// copySelectors so that the default selectors aren't changed when the config is merged into them
+func copySelectors(selectors map[string][]string) map[string][]string {
+	result := make(map[string][]string, len(selectors))
+	for role, names := range selectors {
+		result[role] = names
+	}
+	return result
+}
+
+func newLanguageModel(
+	definition ModelDefinition,
+	aiContext *domain.AIContext,
+	namedMutexAcquirer domain.NamedMutexAcquirer,
+	config *common.Config,
+	logger common.Logger,
+) (domain.LanguageModel, error) {
+	if len(definition.ResponseModes) == 0 {
+		return nil, errors.New("no response modes")
+	}
+	responseModes := make([]domain.ResponseMode, 0, len(definition.ResponseModes))
+	for _, name := range definition.ResponseModes {
+		responseMode, ok := domain.ParseResponseMode(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown response mode \"%s\"", name)
+		}
+		responseModes = append(responseModes, responseMode)
+	}
+	switch definition.Backend {
+	case "", BackendLlamaCpp:
+		return newLlamaCppLanguageModel(definition, responseModes, aiContext, namedMutexAcquirer, config, logger)
+	case BackendOpenAI:
+		return openai.NewLanguageModel(
+			definition.Name,
+			responseModes,
+			openai.ModelParameters{
+				BaseURL:     definition.BaseURL,
+				APIKey:      definition.APIKey,
+				Model:       definition.Model,
+				Mode:        definition.Mode,
+				ContextSize: definition.ContextSize,
+				Temperature: definition.Temperature,
+			},
+			aiContext,
+			config,
+			logger,
+		), nil
+	}
+	return nil, fmt.Errorf("unknown backend \"%s\"", definition.Backend)
+}
+
+func newLlamaCppLanguageModel(
+	definition ModelDefinition,
+	responseModes []domain.ResponseMode,
+	aiContext *domain.AIContext,
+	namedMutexAcquirer domain.NamedMutexAcquirer,
+	config *common.Config,
+	logger common.Logger,
+) (domain.LanguageModel, error) {
+	if definition.File == "" {
+		return nil, errors.New("no file")
+	}
+	if definition.PromptFormat == "" || definition.PromptFormat == FormatAuto {
+		definition.PromptFormat = detectPromptFormat(definition, logger)
+	}
+	promptFormatter, err := newPromptFormatter(definition.PromptFormat)
+	if err != nil {
+		return nil, err
+	}
+	stopConditionName := definition.StopCondition
+	if stopConditionName == "" {
+		stopConditionName = definition.PromptFormat
+	}
+	stopCondition, err := newStopCondition(stopConditionName, aiContext)
+	if err != nil {
+		return nil, err
+	}
+	responseCleanerName := definition.ResponseCleaner
+	if responseCleanerName == "" {
+		responseCleanerName = definition.PromptFormat
+	}
+	responseCleaner, err := newResponseCleaner(responseCleanerName)
+	if err != nil {
+		return nil, err
+	}
+	return llamacpp.NewLanguageModel(
+		definition.Name,
+		definition.File,
+		responseModes,
+		promptFormatter,
+		stopCondition,
+		responseCleaner,
+		llamacpp.ModelParameters{
+			ContextSize:    definition.ContextSize,
+			GPULayerCount:  definition.GPULayerCount,
+			CPUThreadCount: definition.CPUThreadCount,
+			Temperature:    definition.Temperature,
+			RepeatPenalty:  definition.RepeatPenalty,
+		},
+		namedMutexAcquirer,
+		config,
+		logger,
+	), nil
+}
+
+// chatTemplateMarkers maps substrings of chat templates to prompt formats, in the order of checking
+var chatTemplateMarkers = []struct {
+	marker string
+	format string
+}{
+	{marker: "<|im_start|>", format: FormatChatML},
+	{marker: "<|start_header_id|>", format: FormatLlama3},
+	{marker: "<start_of_turn>", format: FormatGemma},
+	{marker: "<|user|>", format: FormatPhi3},
+	{marker: "[INST]", format: FormatMistral},
+	{marker: "### Instruction", format: FormatDeepSeekCoder},
+}
+
+// detectPromptFormat reads the chat template from the model file; falls back to Alpaca if there's no chat template
+// or it's not recognized.
+func detectPromptFormat(definition ModelDefinition, logger common.Logger) string {
+	chatTemplate, ok, err := llamacpp.ReadGGUFMetadataString(definition.File, llamacpp.GGUFKeyChatTemplate)
+	if err != nil {
+		logger.Log(fmt.Sprintf("language model \"%s\": failed to read the chat template from \"%s\" (%s), falling back to \"%s\"\n", definition.Name, definition.File, err, FormatAlpaca))
+		return FormatAlpaca
+	}
+	if !ok {
+		logger.Log(fmt.Sprintf("language model \"%s\": no chat template in \"%s\", falling back to \"%s\"\n", definition.Name, definition.File, FormatAlpaca))
+		return FormatAlpaca
+	}
+	for _, m := range chatTemplateMarkers {
+		if strings.Contains(chatTemplate, m.marker) {
+			logger.Log(fmt.Sprintf("language model \"%s\": detected prompt format \"%s\"\n", definition.Name, m.format))
+			return m.format
+		}
+	}
+	logger.Log(fmt.Sprintf("language model \"%s\": unknown chat template, falling back to \"%s\"\n", definition.Name, FormatAlpaca))
+	return FormatAlpaca
+}
+
+// chatTemplates the prompt formats implemented with llmscommon.ChatTemplate
+var chatTemplates = map[string]llmscommon.ChatTemplate{
+	FormatChatML:  llmscommon.ChatMLTemplate,
+	FormatMistral: llmscommon.MistralTemplate,
+	FormatGemma:   llmscommon.GemmaTemplate,
+	FormatPhi3:    llmscommon.Phi3Template,
+}
+
+func newPromptFormatter(name string) (domain.PromptFormatter, error) {
+	if template, ok := chatTemplates[name]; ok {
+		return llmscommon.NewChatTemplatePromptFormatter(template), nil
+	}
+	switch name {
+	case FormatAlpaca:
+		return llmscommon.NewAlpacaPromptFormatter(), nil
+	case FormatLlama3:
+		return llama3.NewPromptFormatter(), nil
+	case FormatDeepSeekCoder:
+		return deepseekcoder.NewPromptFormatter(), nil
+	}
+	return nil, fmt.Errorf("unknown prompt format \"%s\"", name)
+}
+
+func newStopCondition(name string, aiContext *domain.AIContext) (domain.StopCondition, error) {
+	if template, ok := chatTemplates[name]; ok {
+		return llmscommon.NewChatTemplateStopCondition(template), nil
+	}
+	switch name {
+	case FormatAlpaca:
+		return llmscommon.NewAlpacaStopCondition(aiContext), nil
+	case FormatLlama3:
+		return llama3.NewStopCondition(), nil
+	case FormatDeepSeekCoder:
+		return deepseekcoder.NewStopCondition(), nil
+	case StopConditionNone:
+		return llmscommon.NewNoStopCondition(), nil
+	}
+	return nil, fmt.Errorf("unknown stop condition \"%s\"", name)
+}
+
+func newResponseCleaner(name string) (domain.ResponseCleaner, error) {
+	if template, ok := chatTemplates[name]; ok {
+		return llmscommon.NewChatTemplateResponseCleaner(template), nil
+	}
+	switch name {
+	case FormatAlpaca:
+		return llmscommon.NewAlpacaResponseCleaner(), nil
+	case FormatLlama3:
+		return llama3.NewResponseCleaner(), nil
+	case FormatDeepSeekCoder:
+		return deepseekcoder.NewResponseCleaner(), nil
+	}
+	return nil, fmt.Errorf("unknown response cleaner \"%s\"", name)
+}
@@ -0,0 +1,250 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+	"kgeyst.com/sveta/pkg/sveta/infrastructure/llamacpp"
+)
+
+// recordingLogger keeps the messages, so that tests can check what was logged
+type recordingLogger struct {
+	t        *testing.T
+	messages []string
+}
+
+func (l *recordingLogger) Log(message string) {
+	l.t.Log(message)
+	l.messages = append(l.messages, message)
+}
+
+// writeTestGGUF writes a GGUF file with no tensors; the chat template (if any) goes after metadata of other types, to
+// check that they're skipped
+func writeTestGGUF(t *testing.T, chatTemplate string) string {
+	var buffer bytes.Buffer
+	write := func(values ...any) {
+		for _, value := range values {
+			err := binary.Write(&buffer, binary.LittleEndian, value)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writeString := func(value string) {
+		write(uint64(len(value)))
+		buffer.WriteString(value)
+	}
+	kvCount := uint64(2)
+	if chatTemplate != "" {
+		kvCount++
+	}
+	write(uint32(0x46554747), uint32(3), uint64(0), kvCount)
+	writeString("general.quantization_version")
+	write(uint32(4), uint32(2)) // uint32
+	writeString("tokenizer.ggml.tokens")
+	write(uint32(9), uint32(8), uint64(2)) // an array of 2 strings
+	writeString("<s>")
+	writeString("</s>")
+	if chatTemplate != "" {
+		writeString(llamacpp.GGUFKeyChatTemplate)
+		write(uint32(8)) // string
+		writeString(chatTemplate)
+	}
+	path := filepath.Join(t.TempDir(), "model.gguf")
+	err := os.WriteFile(path, buffer.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDetectPromptFormat(t *testing.T) {
+	tests := []struct {
+		name           string
+		chatTemplate   string
+		isNotGGUF      bool
+		expectedFormat string
+	}{
+		{
+			name:           "chatml",
+			chatTemplate:   "{% for message in messages %}{{'<|im_start|>' + message['role'] + '\n' + message['content'] + '<|im_end|>' + '\n'}}{% endfor %}",
+			expectedFormat: FormatChatML,
+		},
+		{
+			name:           "mistral",
+			chatTemplate:   "{{ bos_token }}{% for message in messages %}{% if message['role'] == 'user' %}{{ '[INST] ' + message['content'] + ' [/INST]' }}{% endif %}{% endfor %}",
+			expectedFormat: FormatMistral,
+		},
+		{
+			name:           "gemma",
+			chatTemplate:   "{{ bos_token }}{% for message in messages %}{{ '<start_of_turn>' + role + '\n' + message['content'] | trim + '<end_of_turn>\n' }}{% endfor %}",
+			expectedFormat: FormatGemma,
+		},
+		{
+			name:           "phi3",
+			chatTemplate:   "{% for message in messages %}{% if message['role'] == 'user' %}{{'<|user|>' + '\n' + message['content'] + '<|end|>' + '\n'}}{% endif %}{% endfor %}",
+			expectedFormat: FormatPhi3,
+		},
+		{
+			name:           "llama3",
+			chatTemplate:   "{% for message in messages %}{{ '<|start_header_id|>' + message['role'] + '<|end_header_id|>\n\n' + message['content'] | trim + '<|eot_id|>' }}{% endfor %}",
+			expectedFormat: FormatLlama3,
+		},
+		{
+			name:           "unknown chat template",
+			chatTemplate:   "{% for message in messages %}{{ message['role'] + ': ' + message['content'] }}{% endfor %}",
+			expectedFormat: FormatAlpaca,
+		},
+		{
+			name:           "no chat template",
+			expectedFormat: FormatAlpaca,
+		},
+		{
+			name:           "not GGUF",
+			isNotGGUF:      true,
+			expectedFormat: FormatAlpaca,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeTestGGUF(t, test.chatTemplate)
+			if test.isNotGGUF {
+				err := os.WriteFile(path, []byte("ggml model file from before GGUF"), 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			logger := &recordingLogger{t: t}
+			format := detectPromptFormat(ModelDefinition{Name: "test", File: path}, logger)
+			if format != test.expectedFormat {
+				t.Errorf("expected the prompt format \"%s\", got \"%s\"", test.expectedFormat, format)
+			}
+			isFallbackLogged := len(logger.messages) == 1 && strings.Contains(logger.messages[0], "falling back to \""+FormatAlpaca+"\"")
+			if isFallbackLogged != (test.expectedFormat == FormatAlpaca) {
+				t.Errorf("the fallback to \"%s\" must be logged (and only it), got %q", FormatAlpaca, logger.messages)
+			}
+		})
+	}
+}
+
+func newTestConfig(t *testing.T, yaml string) *common.Config {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configPath, []byte(yaml), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := common.LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestDeclaredModelsDontGetDefaultSelectors(t *testing.T) {
+	tests := []struct {
+		name        string
+		yaml        string
+		expectedErr string
+	}{
+		{
+			name: "only the default role",
+			yaml: "languageModels:\n" +
+				"  - {name: mistral, file: mistral.gguf, promptFormat: mistral, responseModes: [normal, json, rerank]}\n" +
+				"languageModelSelectors:\n" +
+				"  default: [mistral]\n",
+		},
+		{
+			name:        "no default role",
+			yaml:        "languageModels:\n  - {name: mistral, file: mistral.gguf, promptFormat: mistral, responseModes: [normal]}\n",
+			expectedErr: "no language models for the role \"default\"",
+		},
+		{
+			name: "an unknown model",
+			yaml: "languageModels:\n" +
+				"  - {name: mistral, file: mistral.gguf, promptFormat: mistral, responseModes: [normal, json]}\n" +
+				"languageModelSelectors:\n" +
+				"  default: [mistral]\n" +
+				"  code: [deepseekcoder]\n",
+			expectedErr: ErrUnknownLanguageModel.Error(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logger := &recordingLogger{t: t}
+			r, err := NewRegistry(domain.NewAIContext("Sveta", "You're Sveta.", ""), nil, newTestConfig(t, test.yaml), logger)
+			if test.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+					t.Fatalf("expected an error with %q, got %v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+			if names := r.selectors[RoleCode]; names != nil {
+				t.Errorf("expected no default selector for the role \"%s\", got %v", RoleCode, names)
+			}
+			languageModels, err := r.Selector(RoleRerank).SelectWithFallbacks(domain.ResponseModeRerank)
+			if err != nil || len(languageModels) != 1 || languageModels[0].Name() != "mistral" {
+				t.Errorf("expected the role \"%s\" to fall back to the models of \"%s\", got %v (%v)", RoleRerank, RoleDefault, languageModels, err)
+			}
+		})
+	}
+}
+
+func TestOpenAIBackend(t *testing.T) {
+	tests := []struct {
+		name           string
+		yaml           string
+		expectedModels map[string]string // role => the first model
+	}{
+		{
+			name: "the API replaces the default models, except for code",
+			yaml: "openAIBaseURL: http://localhost:11434/v1\n",
+			expectedModels: map[string]string{
+				RoleDefault:  "openai",
+				RoleRoleplay: "openai",
+				RoleRerank:   "openai",
+				RoleRewrite:  "openai",
+				RoleCode:     "deepseekcoder",
+			},
+		},
+		{
+			name: "the API is declared along with a local model",
+			yaml: "openAIBaseURL: http://localhost:11434/v1\n" +
+				"languageModels:\n" +
+				"  - {name: qwen, backend: openai, model: qwen2.5, temperature: 0, responseModes: [normal, json, rerank]}\n" +
+				"  - {name: mistral, file: mistral.gguf, promptFormat: mistral, responseModes: [normal]}\n" +
+				"languageModelSelectors:\n" +
+				"  default: [qwen]\n" +
+				"  roleplay: [mistral]\n",
+			expectedModels: map[string]string{
+				RoleDefault:  "qwen",
+				RoleRoleplay: "mistral",
+				RoleRerank:   "qwen",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := NewRegistry(domain.NewAIContext("Sveta", "You're Sveta.", ""), nil, newTestConfig(t, test.yaml), &recordingLogger{t: t})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+			for role, expectedModel := range test.expectedModels {
+				languageModels, err := r.Selector(role).SelectWithFallbacks(roleResponseModes[role][0])
+				if err != nil || len(languageModels) == 0 || languageModels[0].Name() != expectedModel {
+					t.Errorf("expected \"%s\" for the role \"%s\", got %v (%v)", expectedModel, role, languageModels, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package openai
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+const (
+	roleSystem    = "system"
+	roleUser      = "user"
+	roleAssistant = "assistant"
+)
+
+type ChatPromptFormatter struct{}
+
+// NewChatPromptFormatter formats the prompt as a JSON-encoded list of chat messages (the role and the content), to be
+// sent to a chat API as is. The system prompt goes first. The agent's lines are the assistant's messages, and other
+// participants' lines are the user's messages prefixed with their names (as there can be several users in a room).
+func NewChatPromptFormatter() *ChatPromptFormatter {
+	return &ChatPromptFormatter{}
+}
+
+func (p *ChatPromptFormatter) FormatPrompt(options domain.FormatOptions) string {
+	var buf strings.Builder
+	// the system prompt
+	buf.WriteString(options.AgentDescription)
+	if options.AgentDescriptionReminder != "" {
+		buf.WriteString(" ")
+		buf.WriteString(options.AgentDescriptionReminder)
+	}
+	// the announced time, if any
+	if options.AnnouncedTime != nil {
+		buf.WriteString(" Current time is ")
+		buf.WriteString(options.AnnouncedTime.Format("Mon, 02 Jan 2006 15:04:05"))
+		buf.WriteString(".\n\n")
+	}
+	if options.JSONOutputSchema != "" {
+		buf.WriteString(" Answer using JSON using the following JSON schema: ```\n")
+		buf.WriteString(options.JSONOutputSchema)
+		buf.WriteString("\n```.\n\n")
+	}
+	if options.Summary != "" {
+		buf.WriteString(options.Summary)
+		buf.WriteString("\n\n")
+	}
+	buf.WriteString(domain.FormatKnowledgeMemories(options.Memories))
+	messages := []chatMessage{{Role: roleSystem, Content: strings.TrimSpace(buf.String())}}
+	// the dialog history
+	for _, memory := range options.DialogMemories() {
+		if memory.Who == options.AgentName {
+			messages = append(messages, chatMessage{Role: roleAssistant, Content: memory.What})
+			continue
+		}
+		var content strings.Builder
+		content.WriteString(memory.Who)
+		if !memory.When.IsZero() {
+			diff := time.Now().Sub(memory.When)
+			if diff > time.Minute {
+				content.WriteString(" (said ")
+				content.WriteString(humanize.Time(memory.When))
+				content.WriteString(")")
+			}
+		}
+		content.WriteString(": ")
+		content.WriteString(memory.What)
+		messages = append(messages, chatMessage{Role: roleUser, Content: content.String()})
+	}
+	messagesBytes, err := json.Marshal(messages)
+	if err != nil {
+		return "" // can't happen with strings only
+	}
+	return string(messagesBytes)
+}
+
+// decodeChatMessages if the prompt wasn't formatted with ChatPromptFormatter, it's sent as a single user message
+func decodeChatMessages(prompt string) []chatMessage {
+	var messages []chatMessage
+	err := json.Unmarshal([]byte(prompt), &messages)
+	if err != nil || len(messages) == 0 {
+		return []chatMessage{{Role: roleUser, Content: prompt}}
+	}
+	return messages
+}
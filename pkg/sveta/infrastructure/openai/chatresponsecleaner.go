@@ -0,0 +1,24 @@
+package openai
+
+import (
+	"strings"
+
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+type ChatResponseCleaner struct{}
+
+// NewChatResponseCleaner a chat API returns only the assistant's message, without the prompt, but the model can still
+// imitate the "Name: " prefixes of the user messages (see ChatPromptFormatter).
+func NewChatResponseCleaner() *ChatResponseCleaner {
+	return &ChatResponseCleaner{}
+}
+
+func (c *ChatResponseCleaner) CleanResponse(options domain.CleanOptions) string {
+	response := strings.TrimSpace(options.Response)
+	agentNamePrefix := options.AgentName + ":"
+	if strings.HasPrefix(response, agentNamePrefix) {
+		response = response[len(agentNamePrefix):]
+	}
+	return strings.TrimSpace(response)
+}
@@ -0,0 +1,290 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+	llmscommon "kgeyst.com/sveta/pkg/sveta/infrastructure/llms/common"
+)
+
+const (
+	// ConfigKeyOpenAIBaseURL the base URL of an OpenAI-compatible API (Ollama, vLLM, LM Studio, a llama.cpp server
+	// etc.), for example: http://localhost:11434/v1
+	ConfigKeyOpenAIBaseURL = "openAIBaseURL"
+	// ConfigKeyOpenAIAPIKey sent as a bearer token, if set
+	ConfigKeyOpenAIAPIKey = "openAIAPIKey"
+	// ConfigKeyOpenAIModel the name of the model as known to the API
+	ConfigKeyOpenAIModel = "openAIModel"
+	// ConfigKeyOpenAIMode which endpoint to use: "chat" (/chat/completions) or "completions" (/completions)
+	ConfigKeyOpenAIMode = "openAIMode"
+	// ConfigKeyOpenAITimeout when to stop if the API takes too long to respond
+	ConfigKeyOpenAITimeout = "openAITimeout"
+	// ConfigKeyOpenAIContextSize the context size of the model (the API doesn't tell it)
+	ConfigKeyOpenAIContextSize = "openAIContextSize"
+)
+
+const (
+	modeChat        = "chat"
+	modeCompletions = "completions"
+)
+
+// LanguageModel talks to an OpenAI-compatible API.
+// In the chat mode, the prompt is a JSON-encoded list of chat messages (see NewChatPromptFormatter()), and the API
+// applies the model's chat template itself. In the completions mode, the prompt is formatted as usual (Alpaca-style)
+// and the completion is returned after the prompt, as with llama.cpp, so that the existing stop conditions and
+// response cleaners can be reused.
+type LanguageModel struct {
+	logger        common.Logger
+	name          string
+	responseModes []domain.ResponseMode
+	baseURL       string
+	apiKey        string
+	model         string
+	mode          string
+	// temperature nil if the API's default is used
+	temperature     *float64
+	promptFormatter domain.PromptFormatter
+	stopCondition   domain.StopCondition // nil in the chat mode
+	responseCleaner domain.ResponseCleaner
+	timeout         time.Duration
+	contextSize     int
+	tokenizer       domain.Tokenizer
+	httpClient      *http.Client
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type responseFormat struct {
+	Type string `json:"type"`
+}
+
+type completionRequest struct {
+	Model          string          `json:"model"`
+	Prompt         string          `json:"prompt,omitempty"`
+	Messages       []chatMessage   `json:"messages,omitempty"`
+	Temperature    *float64        `json:"temperature,omitempty"`
+	ResponseFormat *responseFormat `json:"response_format,omitempty"`
+	Stream         bool            `json:"stream"`
+}
+
+// completionChunk a streamed chunk of both /completions and /chat/completions
+type completionChunk struct {
+	Choices []struct {
+		Text  string `json:"text"`
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// ModelParameters per-model overrides of the config (see the config keys above), so that several models could be
+// declared (see registry.ModelDefinition); empty values mean the config's values are used
+type ModelParameters struct {
+	BaseURL     string
+	APIKey      string
+	Model       string
+	Mode        string
+	ContextSize int
+	// Temperature used if it's not specified in the options; if nil, the API's default is used
+	Temperature *float64
+}
+
+// NewLanguageModel see ModelParameters
+func NewLanguageModel(
+	name string,
+	responseModes []domain.ResponseMode,
+	parameters ModelParameters,
+	aiContext *domain.AIContext,
+	config *common.Config,
+	logger common.Logger,
+) *LanguageModel {
+	l := &LanguageModel{
+		logger:        logger,
+		name:          name,
+		responseModes: responseModes,
+		baseURL:       strings.TrimSuffix(config.GetString(ConfigKeyOpenAIBaseURL), "/"),
+		apiKey:        config.GetString(ConfigKeyOpenAIAPIKey),
+		model:         config.GetString(ConfigKeyOpenAIModel),
+		mode:          config.GetStringOrDefault(ConfigKeyOpenAIMode, modeChat),
+		temperature:   parameters.Temperature,
+		timeout:       config.GetDurationOrDefault(ConfigKeyOpenAITimeout, time.Minute),
+		contextSize:   config.GetIntOrDefault(ConfigKeyOpenAIContextSize, 8192),
+		tokenizer:     domain.NewApproximateTokenizer(),
+		httpClient:    &http.Client{},
+	}
+	if parameters.BaseURL != "" {
+		l.baseURL = strings.TrimSuffix(parameters.BaseURL, "/")
+	}
+	if parameters.APIKey != "" {
+		l.apiKey = parameters.APIKey
+	}
+	if parameters.Model != "" {
+		l.model = parameters.Model
+	}
+	if parameters.Mode != "" {
+		l.mode = parameters.Mode
+	}
+	if parameters.ContextSize > 0 {
+		l.contextSize = parameters.ContextSize
+	}
+	if l.mode == modeCompletions {
+		l.promptFormatter = llmscommon.NewAlpacaPromptFormatter()
+		l.stopCondition = llmscommon.NewAlpacaStopCondition(aiContext)
+		l.responseCleaner = llmscommon.NewAlpacaResponseCleaner()
+	} else {
+		l.mode = modeChat
+		l.promptFormatter = NewChatPromptFormatter()
+		l.responseCleaner = NewChatResponseCleaner()
+	}
+	return l
+}
+
+func (l *LanguageModel) Name() string {
+	return l.name
+}
+
+func (l *LanguageModel) ResponseModes() []domain.ResponseMode {
+	return l.responseModes
+}
+
+func (l *LanguageModel) PromptFormatter() domain.PromptFormatter {
+	return l.promptFormatter
+}
+
+func (l *LanguageModel) ResponseCleaner() domain.ResponseCleaner {
+	return l.responseCleaner
+}
+
+func (l *LanguageModel) ContextSize() int {
+	return l.contextSize
+}
+
+// Tokenizer the API doesn't expose the model's tokenizer, so the token count is estimated
+func (l *LanguageModel) Tokenizer() domain.Tokenizer {
+	return l.tokenizer
+}
+
+func (l *LanguageModel) Complete(prompt string, options domain.CompleteOptions) (string, error) {
+	request := completionRequest{
+		Model:  l.model,
+		Stream: true,
+	}
+	endpoint := "/chat/completions"
+	var buf strings.Builder
+	if l.mode == modeCompletions {
+		endpoint = "/completions"
+		request.Prompt = prompt
+		buf.WriteString(prompt)
+	} else {
+		request.Messages = decodeChatMessages(prompt)
+	}
+	if options.HasTemperature {
+		temperature := options.Temperature
+		request.Temperature = &temperature
+	} else {
+		request.Temperature = l.temperature
+	}
+	if options.JSONMode {
+		request.ResponseFormat = &responseFormat{Type: "json_object"}
+	}
+	err := l.streamCompletion(endpoint, request, func(line string) bool {
+		if l.stopCondition != nil && l.stopCondition.ShouldStop(prompt, buf.String()+line) {
+			return false
+		}
+		buf.WriteString(line)
+		return true
+	})
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && buf.Len() > len(request.Prompt) {
+			// Same as with llama.cpp: what has been generated so far is left intact.
+			return buf.String(), fmt.Errorf("%w: %s didn't finish in %s", domain.ErrLanguageModelTimeout, l.name, l.timeout)
+		}
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// streamCompletion passes the completion to processLineFunc(..) line by line until it signals it should stop with
+// false as the returned value.
+func (l *LanguageModel) streamCompletion(endpoint string, request completionRequest, processLineFunc func(s string) bool) error {
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), l.timeout)
+	defer cancelFunc()
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, l.baseURL+endpoint, bytes.NewReader(requestBytes))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if l.apiKey != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+l.apiKey)
+	}
+	response, err := l.httpClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	// Closing the connection early makes the server abort the generation.
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("%s responded with %s: %s", l.baseURL, response.Status, strings.TrimSpace(string(body)))
+	}
+	var pendingLine strings.Builder
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		event, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue // empty lines between server-sent events, comments etc.
+		}
+		event = strings.TrimSpace(event)
+		if event == "[DONE]" {
+			break
+		}
+		var chunk completionChunk
+		err = json.Unmarshal([]byte(event), &chunk)
+		if err != nil {
+			return err
+		}
+		if chunk.Error != nil {
+			return fmt.Errorf("%s failed: %s", l.baseURL, chunk.Error.Message)
+		}
+		for _, choice := range chunk.Choices {
+			pendingLine.WriteString(choice.Text)
+			pendingLine.WriteString(choice.Delta.Content)
+		}
+		lines := strings.SplitAfter(pendingLine.String(), "\n")
+		pendingLine.Reset()
+		pendingLine.WriteString(lines[len(lines)-1]) // the last one is incomplete
+		for _, line := range lines[:len(lines)-1] {
+			if !processLineFunc(line) {
+				return nil
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if pendingLine.Len() > 0 {
+		processLineFunc(pendingLine.String())
+	}
+	return nil
+}
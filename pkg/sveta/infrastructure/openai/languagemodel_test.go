@@ -0,0 +1,228 @@
+package openai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kgeyst.com/sveta/pkg/common"
+	"kgeyst.com/sveta/pkg/sveta/domain"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Log(message string) {
+	l.t.Log(message)
+}
+
+// recordedRequest what the test server received
+type recordedRequest struct {
+	path          string
+	authorization string
+	body          map[string]any
+}
+
+// newTestServer streams the chunks as server-sent events, followed by [DONE]
+func newTestServer(t *testing.T, chunks []string, requests chan<- recordedRequest) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := recordedRequest{
+			path:          r.URL.Path,
+			authorization: r.Header.Get("Authorization"),
+		}
+		err := json.NewDecoder(r.Body).Decode(&request.body)
+		if err != nil {
+			t.Error(err)
+		}
+		requests <- request
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			_, _ = fmt.Fprintf(w, "data: %s\n\n", chunk)
+			w.(http.Flusher).Flush()
+		}
+		_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestLanguageModel(t *testing.T, yaml string) *LanguageModel {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configPath, []byte(yaml), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := common.LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewLanguageModel(
+		"openai",
+		[]domain.ResponseMode{domain.ResponseModeNormal, domain.ResponseModeJSON},
+		ModelParameters{},
+		domain.NewAIContext("Sveta", "You're Sveta.", ""),
+		config,
+		testLogger{t: t},
+	)
+}
+
+func chatChunk(content string) string {
+	return fmt.Sprintf(`{"choices":[{"delta":{"content":%q}}]}`, content)
+}
+
+func TestChatCompletionIsStreamed(t *testing.T) {
+	requests := make(chan recordedRequest, 1)
+	server := newTestServer(t, []string{chatChunk("Hel"), chatChunk("lo\nwor"), chatChunk("ld")}, requests)
+	languageModel := newTestLanguageModel(t, "openAIBaseURL: "+server.URL+"/v1\nopenAIModel: test\nopenAIAPIKey: secret\n")
+	prompt := `[{"role":"system","content":"You're Sveta."},{"role":"user","content":"John: hi"}]`
+	response, err := languageModel.Complete(prompt, domain.DefaultCompleteOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != "Hello\nworld" {
+		t.Errorf("expected the streamed response, got %q", response)
+	}
+	request := <-requests
+	if request.path != "/v1/chat/completions" {
+		t.Errorf("expected the chat endpoint, got %s", request.path)
+	}
+	if request.authorization != "Bearer secret" {
+		t.Errorf("expected the API key as a bearer token, got %q", request.authorization)
+	}
+	if request.body["model"] != "test" || request.body["stream"] != true {
+		t.Errorf("unexpected request: %v", request.body)
+	}
+	if messages, ok := request.body["messages"].([]any); !ok || len(messages) != 2 {
+		t.Errorf("expected the chat messages, got %v", request.body["messages"])
+	}
+	if _, ok := request.body["temperature"]; ok {
+		t.Errorf("the temperature must not be sent if it's not set, got %v", request.body["temperature"])
+	}
+}
+
+func TestCompletionIsStoppedByStopCondition(t *testing.T) {
+	requests := make(chan recordedRequest, 1)
+	server := newTestServer(t, []string{
+		`{"choices":[{"text":"Hi, John!\n"}]}`,
+		`{"choices":[{"text":"### Instruction:\nJohn: how are you?\n"}]}`,
+	}, requests)
+	languageModel := newTestLanguageModel(t, "openAIBaseURL: "+server.URL+"\nopenAIMode: completions\n")
+	prompt := "### Instruction:\nJohn: hi\n### Response:\nSveta: "
+	response, err := languageModel.Complete(prompt, domain.DefaultCompleteOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != prompt+"Hi, John!\n" {
+		t.Errorf("expected the prompt followed by the completion up to the stop condition, got %q", response)
+	}
+	request := <-requests
+	if request.path != "/completions" || request.body["prompt"] != prompt {
+		t.Errorf("unexpected request to %s: %v", request.path, request.body)
+	}
+	if request.authorization != "" {
+		t.Errorf("no API key is configured, got %q", request.authorization)
+	}
+}
+
+func TestExplicitZeroTemperatureIsSent(t *testing.T) {
+	requests := make(chan recordedRequest, 1)
+	server := newTestServer(t, []string{chatChunk("{}")}, requests)
+	languageModel := newTestLanguageModel(t, "openAIBaseURL: "+server.URL+"\n")
+	_, err := languageModel.Complete("hi", domain.DefaultCompleteOptions.WithTemperature(0.0).WithJSONMode(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := <-requests
+	if temperature, ok := request.body["temperature"]; !ok || temperature != 0.0 {
+		t.Errorf("expected the temperature 0, got %v", request.body["temperature"])
+	}
+	if responseFormat, ok := request.body["response_format"].(map[string]any); !ok || responseFormat["type"] != "json_object" {
+		t.Errorf("expected the JSON response format, got %v", request.body["response_format"])
+	}
+}
+
+func TestErrorsAreReturned(t *testing.T) {
+	unauthorizedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"message":"invalid API key"}}`, http.StatusUnauthorized)
+	}))
+	defer unauthorizedServer.Close()
+	failingServer := newTestServer(t, []string{chatChunk("Hel"), `{"error":{"message":"the model crashed"}}`}, make(chan recordedRequest, 1))
+	tests := []struct {
+		serverURL       string
+		expectedMessage string
+	}{
+		{serverURL: unauthorizedServer.URL, expectedMessage: "invalid API key"},
+		{serverURL: failingServer.URL, expectedMessage: "the model crashed"},
+	}
+	for _, test := range tests {
+		languageModel := newTestLanguageModel(t, "openAIBaseURL: "+test.serverURL+"\nopenAIAPIKey: wrong\n")
+		response, err := languageModel.Complete("hi", domain.DefaultCompleteOptions)
+		if err == nil || !strings.Contains(err.Error(), test.expectedMessage) {
+			t.Errorf("expected an error with %q, got %v", test.expectedMessage, err)
+		}
+		if response != "" {
+			t.Errorf("expected no response, got %q", response)
+		}
+	}
+}
+
+func TestTimeoutReturnsPartialResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "data: %s\n\n", chatChunk("Hello\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // hangs until the client gives up
+	}))
+	defer server.Close()
+	languageModel := newTestLanguageModel(t, "openAIBaseURL: "+server.URL+"\nopenAITimeout: 200\n")
+	response, err := languageModel.Complete("hi", domain.DefaultCompleteOptions)
+	if !errors.Is(err, domain.ErrLanguageModelTimeout) {
+		t.Errorf("expected ErrLanguageModelTimeout, got %v", err)
+	}
+	if response != "Hello\n" {
+		t.Errorf("expected the partial response, got %q", response)
+	}
+}
+
+func TestModelParametersOverrideConfig(t *testing.T) {
+	requests := make(chan recordedRequest, 1)
+	server := newTestServer(t, []string{chatChunk("Hi")}, requests)
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configPath, []byte("openAIBaseURL: http://localhost:1\nopenAIModel: global\nopenAIContextSize: 4096\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := common.LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	temperature := 0.0
+	languageModel := NewLanguageModel(
+		"qwen",
+		[]domain.ResponseMode{domain.ResponseModeNormal},
+		ModelParameters{BaseURL: server.URL + "/", APIKey: "secret", Model: "qwen2.5", ContextSize: 32768, Temperature: &temperature},
+		domain.NewAIContext("Sveta", "You're Sveta.", ""),
+		config,
+		testLogger{t: t},
+	)
+	_, err = languageModel.Complete("hi", domain.DefaultCompleteOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := <-requests
+	if request.body["model"] != "qwen2.5" || request.authorization != "Bearer secret" {
+		t.Errorf("expected the model's own parameters, got %v (%q)", request.body, request.authorization)
+	}
+	if value, ok := request.body["temperature"]; !ok || value != 0.0 {
+		t.Errorf("expected the model's temperature 0, got %v", request.body["temperature"])
+	}
+	if languageModel.Name() != "qwen" || languageModel.ContextSize() != 32768 {
+		t.Errorf("expected the model's name and context size, got %s (%d)", languageModel.Name(), languageModel.ContextSize())
+	}
+}